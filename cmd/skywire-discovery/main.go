@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/skycoin/skycoin/src/util/file"
+	"github.com/skycoin/skywire/pkg/net/skycoin-messenger/factory"
+)
+
+var (
+	address   string
+	seedPath  string
+	storePath string
+
+	// timeouts of the conns
+	options = factory.DefaultOptions()
+
+	version bool
+)
+
+func parseFlags() {
+	dir := filepath.Join(file.UserHome(), ".skywire", "discovery")
+	flag.StringVar(&address, "address", ":5999", "address to listen on")
+	flag.StringVar(&seedPath, "seed-path", filepath.Join(dir, "keys.json"), "path to save seed info")
+	flag.StringVar(&storePath, "store-path", filepath.Join(dir, "services.json"), "path to save the services of the nodes, empty to keep them in memory only")
+	flag.BoolVar(&version, "v", false, "print current version")
+	options.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+}
+
+func main() {
+	parseFlags()
+	if version {
+		fmt.Println(factory.VERSION)
+		return
+	}
+
+	osSignal := make(chan os.Signal, 1)
+	signal.Notify(osSignal, os.Interrupt, os.Kill)
+
+	store, err := factory.NewDiscoveryStore(storePath)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	f := factory.NewMessengerFactory()
+	f.SetOptions(options)
+	defer f.Close()
+	err = f.SetDefaultSeedConfigPath(seedPath)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	f.SetLoggerLevel(factory.DebugLevel)
+	f.SetAppVersion(factory.VERSION)
+	f.UseDiscoveryStore(store)
+	err = f.Listen(address)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	log.Infof("listen on %s, nodes connect to %s-%s", address, address, f.GetDefaultSeedConfig().PublicKey)
+	select {
+	case signal := <-osSignal:
+		if signal == os.Interrupt {
+			log.Debugln("exit by signal Interrupt")
+		} else if signal == os.Kill {
+			log.Debugln("exit by signal Kill")
+		}
+	}
+}
@@ -20,6 +20,9 @@ var (
 	webPort  string
 	seedPath string
 
+	// timeouts of the conns
+	options = factory.DefaultOptions()
+
 	version bool
 )
 
@@ -30,6 +33,7 @@ func parseFlags() {
 	flag.StringVar(&address, "address", ":5998", "address to listen on")
 	flag.StringVar(&seedPath, "seed-path", filepath.Join(file.UserHome(), ".skywire", "discovery", "keys.json"), "path to save seed info")
 	flag.BoolVar(&version, "v", false, "print current version")
+	options.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 }
 
@@ -44,6 +48,7 @@ func main() {
 	signal.Notify(osSignal, os.Interrupt, os.Kill)
 
 	f := factory.NewMessengerFactory()
+	f.SetOptions(options)
 	defer f.Close()
 	f.SetDefaultSeedConfigPath(seedPath)
 	f.SetLoggerLevel(factory.DebugLevel)
@@ -4,14 +4,15 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/skycoin/skycoin/src/util/file"
+	"github.com/skycoin/skywire/pkg/net/skycoin-messenger/factory"
 	"github.com/skycoin/skywire/pkg/node"
 	"github.com/skycoin/skywire/pkg/node/api"
 )
@@ -19,13 +20,17 @@ import (
 var (
 	config   node.Config
 	confPath string
+	// timeouts of the conns
+	options = factory.DefaultOptions()
+	// bytes/sec of all the transports, 0 is no limit
+	rateLimit uint64
 
 	version bool
 )
 
 func parseFlags() {
 	flag.StringVar(&config.Address, "address", ":5000", "address to listen on")
-	flag.Var(&config.DiscoveryAddresses, "discovery-address", "addresses of discovery")
+	flag.Var(&config.DiscoveryAddresses, "discovery-address", "addresses of discovery, host:port-pubkey or wss://host/path-pubkey")
 	flag.BoolVar(&config.ConnectManager, "connect-manager", true, "connect to manager if true")
 	flag.StringVar(&config.ManagerAddr, "manager-address", ":5998", "address of node manager")
 	flag.StringVar(&config.ManagerWeb, "manager-web", ":8000", "address of node manager")
@@ -35,6 +40,8 @@ func parseFlags() {
 	flag.StringVar(&config.AutoStartPath, "auto-start-path", filepath.Join(file.UserHome(), ".skywire", "node", "autoStart.json"), "path to save launch info")
 	flag.StringVar(&confPath, "conf", filepath.Join(file.UserHome(), ".skywire", "node", "conf.json"), "node default config")
 	flag.BoolVar(&version, "v", false, "print current version")
+	flag.Uint64Var(&rateLimit, "rate-limit", 0, "bytes/sec all the transports may send, 0 is no limit, the node api sets limits per node and app")
+	options.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 }
 
@@ -56,6 +63,8 @@ func main() {
 		}
 		n = node.New(config.SeedPath, config.AutoStartPath, config.WebPort)
 	}
+	n.SetOptions(options)
+	n.SetRateLimits(factory.RateLimitsConfig{Global: rateLimit})
 	var err error
 	if len(config.DiscoveryAddresses) == 0 {
 		cfs := &node.NodeConfigs{}
@@ -90,8 +99,8 @@ func main() {
 	log.Debugf("listen on %s", config.Address)
 	var na *api.NodeApi
 	var tokenUrl string
-	if len(strings.Split(config.ManagerWeb, ":")) == 1 {
-		tokenUrl = fmt.Sprintf("http://127.0.0.1%s/getToken", config.ManagerWeb)
+	if host, port, err := net.SplitHostPort(config.ManagerWeb); err == nil && len(host) == 0 {
+		tokenUrl = fmt.Sprintf("http://%s/getToken", net.JoinHostPort("127.0.0.1", port))
 	} else {
 		tokenUrl = fmt.Sprintf("http://%s/getToken", config.ManagerWeb)
 	}
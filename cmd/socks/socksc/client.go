@@ -34,6 +34,9 @@ var (
 
 	discoveryKey string
 
+	// timeouts of the conns
+	options = factory.DefaultOptions()
+
 	version bool
 )
 
@@ -46,6 +49,7 @@ func parseFlags() {
 	flag.StringVar(&appKey, "app-key", "", "connect to app key")
 	flag.StringVar(&discoveryKey, "discovery-key", "", "connect to discovery key")
 	flag.BoolVar(&version, "v", false, "print current version")
+	options.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 }
 
@@ -71,6 +75,7 @@ func main() {
 	signal.Notify(osSignal, os.Interrupt, os.Kill)
 
 	a := app.NewClient(app.Client, "socksc", Version)
+	a.SetOptions(options)
 	a.AppConnectionInitCallback = func(resp *factory.AppConnResp) *factory.AppFeedback {
 		if resp.Failed {
 			return &factory.AppFeedback{
@@ -12,6 +12,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/skycoin/skycoin/src/util/file"
 	"github.com/skycoin/skywire/pkg/app"
+	"github.com/skycoin/skywire/pkg/net/skycoin-messenger/factory"
 )
 
 const (
@@ -28,6 +29,9 @@ var (
 	// allow node public keys to connect
 	nodeKeys app.NodeKeys
 
+	// timeouts of the conns
+	options = factory.DefaultOptions()
+
 	version bool
 )
 
@@ -38,6 +42,7 @@ func parseFlags() {
 	flag.StringVar(&seedPath, "seed-path", filepath.Join(file.UserHome(), ".skywire", "ss", "keys.json"), "path to save seed info")
 	flag.Var(&nodeKeys, "node-key", "allow node public keys to connect")
 	flag.BoolVar(&version, "v", false, "print current version")
+	options.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 }
 
@@ -57,6 +62,7 @@ func main() {
 	ss.SetDebug(true)
 	appmain()
 	a := app.NewServer(app.Public, "sockss", ":"+strconv.Itoa(serverPort), Version)
+	a.SetOptions(options)
 	a.SetAllowNodes(nodeKeys)
 
 	if !seed {
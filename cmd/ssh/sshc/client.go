@@ -32,6 +32,9 @@ var (
 
 	discoveryKey string
 
+	// timeouts of the conns
+	options = factory.DefaultOptions()
+
 	version bool
 )
 
@@ -43,6 +46,7 @@ func parseFlags() {
 	flag.StringVar(&appKey, "app-key", "", "connect to app key")
 	flag.StringVar(&discoveryKey, "discovery-key", "", "connect to discovery key")
 	flag.BoolVar(&version, "v", false, "print current version")
+	options.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 }
 
@@ -61,6 +65,7 @@ func main() {
 	signal.Notify(osSignal, os.Interrupt, os.Kill)
 
 	a := app.NewClient(app.Client, "sshc", Version)
+	a.SetOptions(options)
 	a.AppConnectionInitCallback = func(resp *factory.AppConnResp) *factory.AppFeedback {
 		log.Infof("please ssh to %s", net.JoinHostPort(resp.Host, strconv.Itoa(resp.Port)))
 		return &factory.AppFeedback{
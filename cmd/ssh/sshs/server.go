@@ -10,6 +10,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/skycoin/skycoin/src/util/file"
 	"github.com/skycoin/skywire/pkg/app"
+	"github.com/skycoin/skywire/pkg/net/skycoin-messenger/factory"
 )
 
 const (
@@ -25,6 +26,9 @@ var (
 	// allow node public keys to connect
 	nodeKeys app.NodeKeys
 
+	// timeouts of the conns
+	options = factory.DefaultOptions()
+
 	version bool
 )
 
@@ -34,6 +38,7 @@ func parseFlags() {
 	flag.StringVar(&seedPath, "seed-path", filepath.Join(file.UserHome(), ".skywire", "sshs", "keys.json"), "path to save seed info")
 	flag.Var(&nodeKeys, "node-key", "allow node public keys to connect")
 	flag.BoolVar(&version, "v", false, "print current version")
+	options.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 }
 
@@ -48,6 +53,7 @@ func main() {
 	signal.Notify(osSignal, os.Interrupt, os.Kill)
 
 	a := app.NewServer(app.Private, "sshs", ":22", Version)
+	a.SetOptions(options)
 	a.SetAllowNodes(nodeKeys)
 	if !seed {
 		seedPath = ""
@@ -3,6 +3,7 @@ package app
 import (
 	"fmt"
 	"os"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/skycoin/skycoin/src/cipher"
@@ -15,9 +16,16 @@ type App struct {
 	serviceAddr string
 	appType     Type
 	allowNodes  NodeKeys
+	transports  factory.TransportMode
 	Version     string
 
 	AppConnectionInitCallback func(resp *factory.AppConnResp) *factory.AppFeedback
+
+	// Dial calls waiting for the transport to an app, and the address of
+	// the streams of the transports built
+	dials       map[cipher.PubKey][]chan *factory.AppConnResp
+	streamAddrs map[cipher.PubKey]string
+	dialsMutex  sync.Mutex
 }
 
 type NodeKeys []string
@@ -62,25 +70,24 @@ func NewClient(appType Type, service, version string) *App {
 	}
 }
 
+// SetOptions sets the timeouts of the conn to the node and the transports,
+// call it before Start
+func (app *App) SetOptions(o factory.Options) {
+	app.net.SetOptions(o)
+}
+
 func (app *App) Start(addr, scPath string) error {
 	err := app.net.ConnectWithConfig(addr, &factory.ConnConfig{
 		SeedConfigPath: scPath,
 		OnConnected: func(connection *factory.Connection) {
-			switch app.appType {
-			case Public:
-				connection.OfferServiceWithAddress(app.serviceAddr, app.Version, app.service)
-			case Client:
-				fallthrough
-			case Private:
-				connection.OfferPrivateServiceWithAddress(app.serviceAddr, app.Version, app.allowNodes, app.service)
-			}
+			app.offer(connection)
 		},
 		OnDisconnected: func(connection *factory.Connection) {
 			log.Debug("exit on disconnected")
 			os.Exit(1)
 		},
 		FindServiceNodesByAttributesCallback: app.FindServiceByAttributesCallback,
-		AppConnectionInitCallback:            app.AppConnectionInitCallback,
+		AppConnectionInitCallback:            app.appConnectionInit,
 	})
 	return err
 }
@@ -93,25 +100,64 @@ func (app *App) SetAllowNodes(nodes NodeKeys) {
 	app.allowNodes = nodes
 }
 
+// SetTransports sets whether the service takes streams, datagrams or both
+// through transports, streams by default. Call it before Start.
+func (app *App) SetTransports(modes factory.TransportMode) {
+	app.transports = modes
+}
+
+// offer the service of the app to the node, only the allowed nodes reach
+// the ones that are not public
+func (app *App) offer(connection *factory.Connection) error {
+	s := &factory.Service{
+		Key:        connection.GetKey(),
+		Attributes: []string{app.service},
+		Address:    app.serviceAddr,
+		Version:    app.Version,
+		Transports: app.transports,
+	}
+	if app.appType != Public {
+		s.HideFromDiscovery = true
+		s.AllowNodes = app.allowNodes
+	}
+	return connection.UpdateServices(&factory.NodeServices{Services: []*factory.Service{s}})
+}
+
 func (app *App) ConnectTo(nodeKeyHex, appKeyHex, discoveryKeyHex string) (err error) {
-	nodeKey, err := cipher.PubKeyFromHex(nodeKeyHex)
+	nodeKey, appKey, discoveryKey, err := parseConnectKeys(nodeKeyHex, appKeyHex, discoveryKeyHex)
 	if err != nil {
 		return
 	}
-	appKey, err := cipher.PubKeyFromHex(appKeyHex)
+	app.net.ForEachConn(func(connection *factory.Connection) {
+		connection.BuildAppConnection(nodeKey, appKey, discoveryKey)
+	})
+	return
+}
+
+// ConnectRouteTo connects to the app through hops nodes forwarding routes,
+// the node picks them out of the ones the discovery knows
+func (app *App) ConnectRouteTo(nodeKeyHex, appKeyHex, discoveryKeyHex string, hops int) (err error) {
+	nodeKey, appKey, discoveryKey, err := parseConnectKeys(nodeKeyHex, appKeyHex, discoveryKeyHex)
 	if err != nil {
 		return
 	}
+	app.net.ForEachConn(func(connection *factory.Connection) {
+		connection.BuildRouteConnection(nodeKey, appKey, discoveryKey, hops)
+	})
+	return
+}
 
-	discoveryKey := cipher.PubKey{}
+func parseConnectKeys(nodeKeyHex, appKeyHex, discoveryKeyHex string) (nodeKey, appKey, discoveryKey cipher.PubKey, err error) {
+	nodeKey, err = cipher.PubKeyFromHex(nodeKeyHex)
+	if err != nil {
+		return
+	}
+	appKey, err = cipher.PubKeyFromHex(appKeyHex)
+	if err != nil {
+		return
+	}
 	if len(discoveryKeyHex) != 0 {
 		discoveryKey, err = cipher.PubKeyFromHex(discoveryKeyHex)
-		if err != nil {
-			return
-		}
 	}
-	app.net.ForEachConn(func(connection *factory.Connection) {
-		connection.BuildAppConnection(nodeKey, appKey, discoveryKey)
-	})
 	return
 }
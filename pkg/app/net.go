@@ -0,0 +1,148 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+	"github.com/skycoin/skywire/pkg/net/skycoin-messenger/factory"
+)
+
+// Listen serves the streams of the transports other apps build to the app,
+// call it before Start. The address listened on is the one of the service
+// the app offers, an available port of the loopback if none was given.
+func (app *App) Listen() (ln net.Listener, err error) {
+	addr := app.serviceAddr
+	if len(addr) == 0 {
+		addr = "127.0.0.1:0"
+	}
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	app.serviceAddr = ln.Addr().String()
+	return
+}
+
+// Dial opens a stream to the app of appKeyHex on the node of nodeKeyHex. The
+// transport is built by the first call, the next ones open streams over it
+// while it is up.
+func (app *App) Dial(nodeKeyHex, appKeyHex, discoveryKeyHex string) (conn net.Conn, err error) {
+	appKey, err := cipher.PubKeyFromHex(appKeyHex)
+	if err != nil {
+		return
+	}
+	if addr, ok := app.getStreamAddr(appKey); ok {
+		conn, err = net.Dial("tcp", addr)
+		if err == nil {
+			return
+		}
+		app.deleteStreamAddr(appKey, addr)
+	}
+
+	c := make(chan *factory.AppConnResp, 4)
+	app.addDial(appKey, c)
+	defer app.deleteDial(appKey, c)
+	err = app.ConnectTo(nodeKeyHex, appKeyHex, discoveryKeyHex)
+	if err != nil {
+		return
+	}
+	timeout := time.NewTimer(app.net.GetOptions().TransportSetupTimeout)
+	defer timeout.Stop()
+	var failed string
+	for {
+		select {
+		case resp := <-c:
+			// another discovery may still make it
+			if resp.Failed {
+				failed = resp.Msg.Msg
+				continue
+			}
+			addr := net.JoinHostPort(resp.Host, strconv.Itoa(resp.Port))
+			app.setStreamAddr(appKey, addr)
+			conn, err = net.Dial("tcp", addr)
+			return
+		case <-timeout.C:
+			if len(failed) > 0 {
+				err = fmt.Errorf("dial app %s: %s", appKeyHex, failed)
+			} else {
+				err = fmt.Errorf("dial app %s: timeout", appKeyHex)
+			}
+			return
+		}
+	}
+}
+
+// the transports built for Dial are not reported to AppConnectionInitCallback
+func (app *App) appConnectionInit(resp *factory.AppConnResp) *factory.AppFeedback {
+	app.dialsMutex.Lock()
+	dials := app.dials[resp.App]
+	for _, c := range dials {
+		select {
+		case c <- resp:
+		default:
+		}
+	}
+	app.dialsMutex.Unlock()
+	if len(dials) < 1 && app.AppConnectionInitCallback != nil {
+		return app.AppConnectionInitCallback(resp)
+	}
+	return &factory.AppFeedback{
+		Port:   resp.Port,
+		Failed: resp.Failed,
+		Msg:    resp.Msg,
+	}
+}
+
+func (app *App) addDial(key cipher.PubKey, c chan *factory.AppConnResp) {
+	app.dialsMutex.Lock()
+	if app.dials == nil {
+		app.dials = make(map[cipher.PubKey][]chan *factory.AppConnResp)
+	}
+	app.dials[key] = append(app.dials[key], c)
+	app.dialsMutex.Unlock()
+}
+
+func (app *App) deleteDial(key cipher.PubKey, c chan *factory.AppConnResp) {
+	app.dialsMutex.Lock()
+	dials := app.dials[key]
+	for i, d := range dials {
+		if d == c {
+			dials = append(dials[:i], dials[i+1:]...)
+			break
+		}
+	}
+	if len(dials) < 1 {
+		delete(app.dials, key)
+	} else {
+		app.dials[key] = dials
+	}
+	app.dialsMutex.Unlock()
+}
+
+func (app *App) getStreamAddr(key cipher.PubKey) (addr string, ok bool) {
+	app.dialsMutex.Lock()
+	addr, ok = app.streamAddrs[key]
+	app.dialsMutex.Unlock()
+	return
+}
+
+func (app *App) setStreamAddr(key cipher.PubKey, addr string) {
+	app.dialsMutex.Lock()
+	if app.streamAddrs == nil {
+		app.streamAddrs = make(map[cipher.PubKey]string)
+	}
+	app.streamAddrs[key] = addr
+	app.dialsMutex.Unlock()
+}
+
+// the transport of addr closed, a transport built since is kept
+func (app *App) deleteStreamAddr(key cipher.PubKey, addr string) {
+	app.dialsMutex.Lock()
+	if app.streamAddrs[key] == addr {
+		delete(app.streamAddrs, key)
+	}
+	app.dialsMutex.Unlock()
+}
@@ -18,6 +18,7 @@ func NewClientUDPConn(c *net.UDPConn, addr *net.UDPAddr) *ClientUDPConn {
 	uc := conn.NewUDPConn(c, addr)
 	uc.SendPing = true
 	uc.UnsharedUdpConn = true
+	uc.SetConnID(conn.NewConnID())
 	return &ClientUDPConn{UDPConn: uc}
 }
 
@@ -34,9 +35,9 @@ func (c *ClientUDPConn) ReadLoop() (err error) {
 		}
 		c.Close()
 	}()
-	maxBuf := make([]byte, conn.MTU)
+	maxBuf := make([]byte, conn.MAX_PLPMTU)
 	for {
-		n, err := c.UdpConn.Read(maxBuf)
+		n, _, err := c.UdpConn.ReadFrom(maxBuf)
 		if err != nil {
 			return err
 		}
@@ -57,13 +58,28 @@ func (c *ClientUDPConn) ReadLoop() (err error) {
 			if err != nil {
 				return err
 			}
-		case msg.TYPE_NORMAL, msg.TYPE_FEC, msg.TYPE_SYN:
+		case msg.TYPE_SACK:
+			err = c.RecvSAck(m)
+			if err != nil {
+				return err
+			}
+		case msg.TYPE_PROBE:
+			err = c.RecvProbe(m)
+			if err != nil {
+				return err
+			}
+		case msg.TYPE_PROBE_ACK:
+			err = c.RecvProbeAck(m)
+			if err != nil {
+				return err
+			}
+		case msg.TYPE_NORMAL, msg.TYPE_FEC, msg.TYPE_SYN, msg.TYPE_AEAD:
 			err = c.Process(t, m)
 			if err != nil {
 				return err
 			}
 		case msg.TYPE_FIN:
-			err = conn.ErrFin
+			err = c.RecvFin(m)
 			break
 		default:
 			c.GetContextLogger().Debugf("not implemented msg type %d", t)
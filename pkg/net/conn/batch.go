@@ -0,0 +1,64 @@
+package conn
+
+import (
+	"net"
+)
+
+// Datagram is one packet of a batch, N is the length of the packet read into
+// Buf or Buf is written whole
+type Datagram struct {
+	Buf  []byte
+	N    int
+	Addr net.Addr
+}
+
+// BatchConn reads and writes several datagrams per syscall where the
+// platform supports it. A BatchConn is used by one reader and one writer at
+// a time.
+type BatchConn interface {
+	// ReadBatch blocks until at least one datagram arrived, it returns the
+	// number of datagrams filled
+	ReadBatch(ds []Datagram) (n int, err error)
+	// WriteBatch returns the number of datagrams written, less than
+	// len(ds) only with an error
+	WriteBatch(ds []Datagram) (n int, err error)
+}
+
+// NewBatchConn batches the i/o of c with recvmmsg and sendmmsg on linux, other
+// platforms and sockets that are not a *net.UDPConn fall back to a syscall
+// per datagram
+func NewBatchConn(c net.PacketConn) BatchConn {
+	if b := newMmsgConn(c); b != nil {
+		return b
+	}
+	return &packetBatchConn{c}
+}
+
+// packetBatchConn reads and writes the datagrams of a batch one by one
+type packetBatchConn struct {
+	net.PacketConn
+}
+
+// ReadBatch only waits for the first datagram and returns that one, later
+// ones would block until they arrive
+func (c *packetBatchConn) ReadBatch(ds []Datagram) (n int, err error) {
+	if len(ds) == 0 {
+		return
+	}
+	ds[0].N, ds[0].Addr, err = c.ReadFrom(ds[0].Buf)
+	if err != nil {
+		return
+	}
+	return 1, nil
+}
+
+func (c *packetBatchConn) WriteBatch(ds []Datagram) (n int, err error) {
+	for n < len(ds) {
+		_, err = c.WriteTo(ds[n].Buf, ds[n].Addr)
+		if err != nil {
+			return
+		}
+		n++
+	}
+	return
+}
@@ -0,0 +1,216 @@
+package conn
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// struct mmsghdr
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// mmsgBuffers are the headers of the datagrams of a batch
+type mmsgBuffers struct {
+	msgs  []mmsghdr
+	iovs  []unix.Iovec
+	names []unix.RawSockaddrAny
+}
+
+func (b *mmsgBuffers) grow(n int) {
+	if len(b.msgs) >= n {
+		return
+	}
+	b.msgs = make([]mmsghdr, n)
+	b.iovs = make([]unix.Iovec, n)
+	b.names = make([]unix.RawSockaddrAny, n)
+}
+
+// mmsgConn reads and writes a batch with one recvmmsg or sendmmsg.
+// ipv4.PacketConn of golang.org/x/net has ReadBatch and WriteBatch too, but
+// it sends to ipv4 addresses as sockaddr_in and the dual stack sockets of
+// Listen(":port") refuse those, here they are mapped to ipv6
+type mmsgConn struct {
+	raw syscall.RawConn
+	// the socket is ipv6 and takes ipv4 addresses mapped
+	inet6 bool
+
+	rbufs mmsgBuffers
+	wbufs mmsgBuffers
+}
+
+func newMmsgConn(c net.PacketConn) BatchConn {
+	uc, ok := c.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	mc := &mmsgConn{raw: raw}
+	err = raw.Control(func(fd uintptr) {
+		sa, e := unix.Getsockname(int(fd))
+		if e != nil {
+			err = e
+			return
+		}
+		_, mc.inet6 = sa.(*unix.SockaddrInet6)
+	})
+	if err != nil {
+		return nil
+	}
+	return mc
+}
+
+func (c *mmsgConn) ReadBatch(ds []Datagram) (n int, err error) {
+	if len(ds) == 0 {
+		return
+	}
+	b := &c.rbufs
+	b.grow(len(ds))
+	for i := range ds {
+		setIovec(&b.iovs[i], ds[i].Buf)
+		h := &b.msgs[i].hdr
+		*h = unix.Msghdr{}
+		h.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		h.Namelen = unix.SizeofSockaddrAny
+		h.Iov = &b.iovs[i]
+		h.Iovlen = 1
+	}
+	var errno syscall.Errno
+	err = c.raw.Read(func(fd uintptr) bool {
+		r, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&b.msgs[0])), uintptr(len(ds)), 0, 0, 0)
+		if e == unix.EAGAIN {
+			return false
+		}
+		n, errno = int(r), e
+		return true
+	})
+	if err == nil && errno != 0 {
+		err = &net.OpError{Op: "read", Net: "udp", Err: errno}
+	}
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		ds[i].N = int(b.msgs[i].len)
+		ds[i].Addr = sockaddrToUDPAddr(&b.names[i])
+	}
+	return
+}
+
+func (c *mmsgConn) WriteBatch(ds []Datagram) (n int, err error) {
+	if len(ds) == 0 {
+		return
+	}
+	b := &c.wbufs
+	b.grow(len(ds))
+	for i := range ds {
+		addr, ok := ds[i].Addr.(*net.UDPAddr)
+		if !ok {
+			return 0, errors.New("not a udp address")
+		}
+		namelen, err := c.udpAddrToSockaddr(addr, &b.names[i])
+		if err != nil {
+			return 0, err
+		}
+		setIovec(&b.iovs[i], ds[i].Buf)
+		h := &b.msgs[i].hdr
+		*h = unix.Msghdr{}
+		h.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		h.Namelen = namelen
+		h.Iov = &b.iovs[i]
+		h.Iovlen = 1
+	}
+	// sendmmsg stops early when the socket buffer is full
+	for n < len(ds) {
+		var sent int
+		var errno syscall.Errno
+		err = c.raw.Write(func(fd uintptr) bool {
+			r, _, e := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&b.msgs[n])), uintptr(len(ds)-n), 0, 0, 0)
+			if e == unix.EAGAIN {
+				return false
+			}
+			sent, errno = int(r), e
+			return true
+		})
+		if err == nil && errno != 0 {
+			err = &net.OpError{Op: "write", Net: "udp", Addr: ds[n].Addr, Err: errno}
+		}
+		if err != nil {
+			return
+		}
+		n += sent
+	}
+	return
+}
+
+// empty buffers read a datagram as truncated to 0 bytes or write an empty one
+func setIovec(iov *unix.Iovec, buf []byte) {
+	iov.Base = nil
+	if len(buf) > 0 {
+		iov.Base = &buf[0]
+	}
+	iov.SetLen(len(buf))
+}
+
+func sockaddrToUDPAddr(rsa *unix.RawSockaddrAny) *net.UDPAddr {
+	switch rsa.Addr.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, sa.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: int(p[0])<<8 | int(p[1])}
+	case unix.AF_INET6:
+		sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		addr := &net.UDPAddr{IP: ip, Port: int(p[0])<<8 | int(p[1])}
+		if ip4 := ip.To4(); ip4 != nil {
+			// like ReadFrom, mapped addresses are reported as ipv4
+			addr.IP = ip4
+		} else if sa.Scope_id != 0 {
+			addr.Zone = strconv.Itoa(int(sa.Scope_id))
+		}
+		return addr
+	}
+	return nil
+}
+
+func (c *mmsgConn) udpAddrToSockaddr(addr *net.UDPAddr, rsa *unix.RawSockaddrAny) (namelen uint32, err error) {
+	if ip4 := addr.IP.To4(); ip4 != nil && !c.inet6 {
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		*sa = unix.RawSockaddrInet4{Family: unix.AF_INET}
+		p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		p[0], p[1] = byte(addr.Port>>8), byte(addr.Port)
+		copy(sa.Addr[:], ip4)
+		return unix.SizeofSockaddrInet4, nil
+	}
+	ip := addr.IP.To16()
+	if ip == nil || !c.inet6 {
+		err = &net.AddrError{Err: "address family not supported by the socket", Addr: addr.String()}
+		return
+	}
+	sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(rsa))
+	*sa = unix.RawSockaddrInet6{Family: unix.AF_INET6}
+	p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	p[0], p[1] = byte(addr.Port>>8), byte(addr.Port)
+	copy(sa.Addr[:], ip)
+	if addr.Zone != "" {
+		if ifi, e := net.InterfaceByName(addr.Zone); e == nil {
+			sa.Scope_id = uint32(ifi.Index)
+		} else if id, e := strconv.Atoi(addr.Zone); e == nil {
+			sa.Scope_id = uint32(id)
+		}
+	}
+	return unix.SizeofSockaddrInet6, nil
+}
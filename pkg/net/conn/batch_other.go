@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package conn
+
+import "net"
+
+// recvmmsg and sendmmsg are linux only
+func newMmsgConn(c net.PacketConn) BatchConn {
+	return nil
+}
@@ -0,0 +1,205 @@
+package conn
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenUDP(t testing.TB, address string) *net.UDPConn {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func newDatagrams(n, size int) []Datagram {
+	ds := make([]Datagram, n)
+	for i := range ds {
+		ds[i].Buf = make([]byte, size)
+	}
+	return ds
+}
+
+func testBatchConn(t *testing.T, newConn func(c net.PacketConn) BatchConn, address string) {
+	a := listenUDP(t, address)
+	defer a.Close()
+	b := listenUDP(t, "127.0.0.1:0")
+	defer b.Close()
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: b.LocalAddr().(*net.UDPAddr).Port}
+
+	out := make([]Datagram, 10)
+	for i := range out {
+		out[i] = Datagram{Buf: bytes.Repeat([]byte{byte(i)}, 100+i), Addr: to}
+	}
+	n, err := newConn(a).WriteBatch(out)
+	if err != nil || n != len(out) {
+		t.Fatalf("wrote %d of %d datagrams, err %v", n, len(out), err)
+	}
+
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	bc := newConn(b)
+	in := newDatagrams(UDP_BATCH_SIZE, MTU)
+	port := a.LocalAddr().(*net.UDPAddr).Port
+	for received := 0; received < len(out); {
+		n, err = bc.ReadBatch(in)
+		if err != nil {
+			t.Fatalf("received %d of %d datagrams, err %v", received, len(out), err)
+		}
+		for _, d := range in[:n] {
+			if !bytes.Equal(d.Buf[:d.N], out[received].Buf) {
+				t.Fatalf("datagram %d differs", received)
+			}
+			addr, ok := d.Addr.(*net.UDPAddr)
+			if !ok || !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || addr.Port != port {
+				t.Fatalf("datagram %d from %v", received, d.Addr)
+			}
+			received++
+		}
+	}
+}
+
+func TestBatchConn_Empty(t *testing.T) {
+	a := listenUDP(t, "127.0.0.1:0")
+	defer a.Close()
+	b := listenUDP(t, "127.0.0.1:0")
+	defer b.Close()
+	out := []Datagram{{Addr: b.LocalAddr()}, {Buf: []byte{1}, Addr: b.LocalAddr()}}
+	if n, err := NewBatchConn(a).WriteBatch(out); err != nil || n != len(out) {
+		t.Fatalf("wrote %d of %d datagrams, err %v", n, len(out), err)
+	}
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	bc := NewBatchConn(b)
+	// an empty buffer reads the datagram truncated
+	in := []Datagram{{}, {}}
+	for received := 0; received < len(out); {
+		n, err := bc.ReadBatch(in[received:])
+		if err != nil {
+			t.Fatalf("received %d of %d datagrams, err %v", received, len(out), err)
+		}
+		received += n
+	}
+	for i, d := range in {
+		if d.N != 0 || d.Addr == nil {
+			t.Fatalf("datagram %d read %d bytes from %v", i, d.N, d.Addr)
+		}
+	}
+}
+
+func TestBatchConn(t *testing.T) {
+	t.Run("ipv4", func(t *testing.T) {
+		testBatchConn(t, NewBatchConn, "127.0.0.1:0")
+	})
+	t.Run("dual stack", func(t *testing.T) {
+		testBatchConn(t, NewBatchConn, ":0")
+	})
+	t.Run("fallback", func(t *testing.T) {
+		testBatchConn(t, func(c net.PacketConn) BatchConn {
+			return &packetBatchConn{c}
+		}, "127.0.0.1:0")
+	})
+}
+
+// the write benchmarks report packets/sec of one writer, compare them with
+// -cpu 1
+func benchmarkWrite(b *testing.B, batch int) {
+	sink := listenUDP(b, "127.0.0.1:0")
+	defer sink.Close()
+	c := listenUDP(b, "127.0.0.1:0")
+	defer c.Close()
+	bc := NewBatchConn(c)
+	ds := newDatagrams(batch, BASE_PLPMTU)
+	for i := range ds {
+		ds[i].Addr = sink.LocalAddr()
+	}
+	b.SetBytes(int64(BASE_PLPMTU))
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batch {
+		n := batch
+		if b.N-i < n {
+			n = b.N - i
+		}
+		if batch == 1 {
+			_, err := c.WriteTo(ds[0].Buf, ds[0].Addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		if _, err := bc.WriteBatch(ds[:n]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+}
+
+func BenchmarkUDPWriteTo(b *testing.B) {
+	benchmarkWrite(b, 1)
+}
+
+func BenchmarkUDPWriteBatch(b *testing.B) {
+	benchmarkWrite(b, UDP_BATCH_SIZE)
+}
+
+// the read benchmarks flood a socket from another goroutine and report the
+// packets/sec the reader gets through
+func benchmarkRead(b *testing.B, batch bool) {
+	c := listenUDP(b, "127.0.0.1:0")
+	defer c.Close()
+	c.SetReadBuffer(4 * 1024 * 1024)
+	sender := listenUDP(b, "127.0.0.1:0")
+	defer sender.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		bc := NewBatchConn(sender)
+		ds := newDatagrams(UDP_BATCH_SIZE, BASE_PLPMTU)
+		for i := range ds {
+			ds[i].Addr = c.LocalAddr()
+		}
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := bc.WriteBatch(ds); err != nil {
+				return
+			}
+		}
+	}()
+
+	bc := NewBatchConn(c)
+	ds := newDatagrams(UDP_BATCH_SIZE, MTU)
+	b.SetBytes(int64(BASE_PLPMTU))
+	b.ResetTimer()
+	for i := 0; i < b.N; {
+		if !batch {
+			if _, _, err := c.ReadFrom(ds[0].Buf); err != nil {
+				b.Fatal(err)
+			}
+			i++
+			continue
+		}
+		n, err := bc.ReadBatch(ds)
+		if err != nil {
+			b.Fatal(err)
+		}
+		i += n
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+}
+
+func BenchmarkUDPReadFrom(b *testing.B) {
+	benchmarkRead(b, false)
+}
+
+func BenchmarkUDPReadBatch(b *testing.B) {
+	benchmarkRead(b, true)
+}
@@ -0,0 +1,234 @@
+package conn
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/skycoin/skywire/pkg/net/msg"
+)
+
+const rttUnit = time.Microsecond
+
+type bbr struct {
+	delivered     uint64
+	deliveredTime time.Time
+	sentTime      time.Time
+	bwFilter      *maxBandwidthFilter
+	minRTT        time.Duration
+	cwnd          uint32
+	mode
+	pacingGain     int
+	pacingRate     uint64
+	lastCycleStart time.Time
+	cycleOffset    int
+	cwndGain       int
+	fullBwCnt      uint
+	fullBw         rate
+
+	appLimited   bool
+	endOfLimited uint32
+
+	lastSentSeq    uint32
+	roundTripCount roundTripCount
+	currentTripEnd uint32
+}
+
+// NewBBR returns the default congestion controller, it paces msgs at the
+// estimated bottleneck bandwidth and ignores single losses
+func NewBBR() CongestionController {
+	return &bbr{
+		bwFilter:   newMaxBandwidthFilter(bandwidthWindowSize, 0, 0),
+		cwnd:       INITIAL_CWND,
+		pacingGain: highGain,
+		pacingRate: INITIAL_PACING_RATE,
+		cwndGain:   highGain,
+	}
+}
+
+func (b *bbr) OnSend(m *msg.UDPMessage, appLimited bool) {
+	seq := m.GetSeq()
+	b.lastSentSeq = seq
+	if appLimited {
+		b.appLimited = true
+		b.endOfLimited = seq
+	}
+	m.UpdateState(b.delivered, b.deliveredTime, b.sentTime)
+}
+
+func (b *bbr) OnAck(m *msg.UDPMessage, minRTT time.Duration, inFlight uint32) {
+	isRoundStart := b.updateRoundTripCounter(m.GetSeq())
+
+	b.delivered++
+	b.deliveredTime = time.Now()
+	b.sentTime = m.GetTransmittedTime()
+	b.minRTT = minRTT
+
+	if m.GetSentTime().IsZero() || m.GetDeliveredTime().IsZero() {
+		return
+	}
+
+	b.tryToCancelAppLimited(m.GetSeq())
+	if b.appLimited {
+		logrus.Debugf("app limited used:%d max:%d", inFlight, b.cwnd)
+		return
+	}
+
+	sd := b.sentTime.Sub(m.GetSentTime()) / rttUnit
+	ad := b.deliveredTime.Sub(m.GetDeliveredTime()) / rttUnit
+	interval := ad
+	if sd > ad {
+		interval = sd
+	}
+	d := b.delivered - m.GetDelivered()
+	drate := rate(d * BW_UNIT / uint64(interval))
+	logrus.Debugf("drate(%d) d %d interval %d sd %d ad %d", drate, d, interval, sd, ad)
+	if drate <= 0 {
+		return
+	}
+	if minRTT <= 0 {
+		return
+	}
+	rtt := uint64(minRTT / rttUnit)
+	if uint64(interval) < rtt {
+		return
+	}
+
+	hm := b.bwFilter.GetBest()
+	if drate >= hm {
+		b.bwFilter.Update(drate, b.roundTripCount)
+		hm = b.bwFilter.GetBest()
+	}
+	if hm <= 0 {
+		return
+	}
+	max := uint64(hm)
+	if b.mode == probeBW {
+		b.updateGainCyclePhase(max, rtt, inFlight)
+	}
+	if isRoundStart {
+		b.checkFullBwReached()
+	}
+	b.checkDrain(max, rtt, inFlight)
+	b.setPacingRate(max, b.pacingGain)
+	b.setCwnd(d, max, rtt, b.cwndGain)
+	logrus.Debugf("mode %d, max bw %d rtt %d", b.mode, max, rtt)
+}
+
+// the bandwidth samples already tell BBR about the losses
+func (b *bbr) OnLoss(m *msg.UDPMessage) {
+}
+
+func (b *bbr) PacingRate() uint64 {
+	return b.pacingRate
+}
+
+func (b *bbr) Cwnd() uint32 {
+	return b.cwnd
+}
+
+func (b *bbr) setPacingRate(bw uint64, gain int) {
+	bw *= MAX_UDP_PACKAGE_SIZE
+	bw *= uint64(gain)
+	bw >>= BBR_SCALE
+	bw *= 1000000
+	rate := bw >> BW_SCALE
+	logrus.Debugf("setPacingRate: rate %d", rate)
+	b.pacingRate = rate
+}
+
+func (b *bbr) setCwnd(acked, bw, rtt uint64, gain int) {
+	target := b.targetCwnd(bw, rtt, gain)
+
+	cwnd := b.cwnd
+	if b.fullBwReached() {
+		n := cwnd + uint32(acked)
+		if n < target {
+			cwnd = n
+		} else {
+			cwnd = target
+		}
+	} else if cwnd < target {
+		cwnd = cwnd + uint32(acked)
+	}
+	if INITIAL_CWND > cwnd {
+		cwnd = INITIAL_CWND
+	} else if cwnd > MAX_CWND {
+		cwnd = MAX_CWND
+	}
+
+	logrus.Debugf("setCwnd %d", cwnd)
+	b.cwnd = cwnd
+}
+
+func (b *bbr) tryToCancelAppLimited(seq uint32) {
+	if b.appLimited && seq > b.endOfLimited {
+		b.appLimited = false
+	}
+}
+
+func (b *bbr) fullBwReached() bool {
+	return b.fullBwCnt >= fullBwCnt
+}
+
+func (b *bbr) checkFullBwReached() {
+	if b.fullBwReached() || b.appLimited {
+		return
+	}
+
+	bwt := b.fullBw * fullBwThresh >> BBR_SCALE
+	max := b.bwFilter.GetBest()
+	if max >= bwt {
+		b.fullBw = max
+		b.fullBwCnt = 0
+		return
+	}
+	b.fullBwCnt++
+}
+
+func (b *bbr) checkDrain(bw, rtt uint64, inFlight uint32) {
+	if b.mode == startup && b.fullBwReached() {
+		b.mode = drain
+		b.pacingGain = drainGain
+		b.cwndGain = highGain
+	}
+	if b.mode == drain {
+		pcwnd := b.targetCwnd(bw, rtt, BBR_UNIT)
+		if inFlight <= pcwnd {
+			b.mode = probeBW
+			b.cwndGain = cwndGain
+			b.pacingGain = BBR_UNIT
+		}
+	}
+}
+
+func (b *bbr) updateRoundTripCounter(seq uint32) bool {
+	if seq > b.currentTripEnd {
+		b.roundTripCount++
+		b.currentTripEnd = b.lastSentSeq
+		return true
+	}
+	return false
+}
+
+func (b *bbr) targetCwnd(bw, rtt uint64, gain int) uint32 {
+	cwnd := uint32((((bw * rtt * uint64(b.cwndGain)) >> BBR_SCALE) + BW_UNIT - 1) / BW_UNIT)
+	cwnd = (cwnd + 1) & ^uint32(1)
+	return cwnd
+}
+
+func (b *bbr) updateGainCyclePhase(bw, rtt uint64, inFlight uint32) {
+	c := time.Now().Sub(b.lastCycleStart) > b.minRTT
+	if b.pacingGain > BBR_UNIT && inFlight < b.targetCwnd(bw, rtt, b.pacingGain) {
+		c = false
+	}
+
+	if b.pacingGain < BBR_UNIT && inFlight <= b.targetCwnd(bw, rtt, BBR_UNIT) {
+		c = true
+	}
+
+	if c {
+		b.cycleOffset = (b.cycleOffset + 1) % gainCycleLength
+		b.lastCycleStart = time.Now()
+		b.pacingGain = pacingGain[b.cycleOffset]
+	}
+}
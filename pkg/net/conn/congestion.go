@@ -0,0 +1,52 @@
+package conn
+
+import (
+	"time"
+
+	"github.com/skycoin/skywire/pkg/net/msg"
+)
+
+// CongestionController decides how many msgs a UDPConn keeps in flight and
+// how fast it sends them. Calls are serialized by the conn.
+type CongestionController interface {
+	// OnSend is called when a msg is transmitted for the first time,
+	// appLimited is true if no other msg was waiting for the window
+	OnSend(m *msg.UDPMessage, appLimited bool)
+	// OnAck is called when a msg is acked, minRTT is the min of the recent
+	// rtt samples and inFlight the msgs in flight before this ack
+	OnAck(m *msg.UDPMessage, minRTT time.Duration, inFlight uint32)
+	// OnLoss is called when a msg is resent after a timeout or a loss report
+	OnLoss(m *msg.UDPMessage)
+	// PacingRate returns the send rate in bytes per second
+	PacingRate() uint64
+	// Cwnd returns the max msgs in flight
+	Cwnd() uint32
+}
+
+type fixed struct {
+	cwnd uint32
+	rate uint64
+}
+
+// NewFixed returns a controller with a constant window and pacing rate in
+// bytes per second, for links whose capacity is known
+func NewFixed(cwnd uint32, rate uint64) CongestionController {
+	return &fixed{cwnd: cwnd, rate: rate}
+}
+
+func (f *fixed) OnSend(m *msg.UDPMessage, appLimited bool) {
+}
+
+func (f *fixed) OnAck(m *msg.UDPMessage, minRTT time.Duration, inFlight uint32) {
+}
+
+func (f *fixed) OnLoss(m *msg.UDPMessage) {
+}
+
+func (f *fixed) PacingRate() uint64 {
+	return f.rate
+}
+
+func (f *fixed) Cwnd() uint32 {
+	return f.cwnd
+}
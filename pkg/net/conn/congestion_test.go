@@ -0,0 +1,60 @@
+package conn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skycoin/skywire/pkg/net/msg"
+)
+
+func TestCubic(t *testing.T) {
+	c := NewCubic()
+	var seq uint32
+	send := func() *msg.UDPMessage {
+		seq++
+		m := msg.NewUDP(msg.TYPE_NORMAL, seq, nil)
+		c.OnSend(m, false)
+		return m
+	}
+	for i := 0; i < 20; i++ {
+		c.OnAck(send(), 50*time.Millisecond, 0)
+	}
+	if c.Cwnd() != INITIAL_CWND+20 {
+		t.Fatalf("slow start cwnd %d", c.Cwnd())
+	}
+
+	lost := send()
+	inFlight := []*msg.UDPMessage{send(), send()}
+	c.OnLoss(lost)
+	cwnd := c.Cwnd()
+	if cwnd != uint32((INITIAL_CWND+20)*cubicBeta) {
+		t.Fatalf("cwnd %d after loss", cwnd)
+	}
+	// one reduction per window
+	c.OnLoss(inFlight[0])
+	c.OnAck(inFlight[1], 50*time.Millisecond, 0)
+	if c.Cwnd() != cwnd {
+		t.Fatalf("cwnd %d changed in recovery", c.Cwnd())
+	}
+
+	for i := 0; i < 100; i++ {
+		c.OnAck(send(), 50*time.Millisecond, 0)
+	}
+	if c.Cwnd() <= cwnd || c.Cwnd() > MAX_CWND {
+		t.Fatalf("congestion avoidance cwnd %d", c.Cwnd())
+	}
+	if c.PacingRate() == 0 {
+		t.Fatal("zero pacing rate")
+	}
+}
+
+func TestUDPConn_SetCongestionController(t *testing.T) {
+	c := NewUDPConn(nil, nil)
+	c.SetCongestionController(NewFixed(2, 1000))
+	if c.getCwnd() != MIN_CWND {
+		t.Fatalf("cwnd %d", c.getCwnd())
+	}
+	if c.getPacingRate() != 1000 {
+		t.Fatalf("pacing rate %d", c.getPacingRate())
+	}
+}
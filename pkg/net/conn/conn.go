@@ -36,11 +36,25 @@ type Connection interface {
 	GetSentBytes() uint64
 	// Get received bytes count
 	GetReceivedBytes() uint64
+	// Snapshot of the connection counters
+	Stats() Stats
+	// Count a msg of uncompressed bytes that went over the conn as
+	// compressed bytes
+	AddCompressedBytes(uncompressed, compressed int)
 
 	NewPendingChannel() (channel int)
 	DeletePendingChannel(channel int)
 	WriteToChannel(channel int, bytes []byte) (err error)
-
+	// PRIORITY_INTERACTIVE or PRIORITY_BULK, new channels are interactive
+	SetChannelPriority(channel, priority int) error
+	// max bytes of a msg sent in one packet, longer writes are split
+	GetPayloadSize() int
+	// the msgs written wait for all the limiters to allow them
+	SetRateLimiters(limiters ...*RateLimiter)
+
+	// Drain waits until written msgs have been delivered, call it before
+	// Close to not lose the last ones
+	Drain(timeout time.Duration) error
 	WaitForDisconnected()
 	GetDisconnectedChan() <-chan struct{}
 
@@ -53,7 +67,7 @@ type Connection interface {
 }
 
 type ConnCommonFields struct {
-	seq uint32 // id of last message, increment every new message
+	seq uint64 // id of last message, increment every new message, the wire carries the low 32 bits
 
 	HighestACKedSequenceNumber uint32 // highest packet that has been ACKed
 	LastAck                    int64  // last time an ACK of receipt was received (better to store id of highest packet id with an ACK?)
@@ -62,6 +76,9 @@ type ConnCommonFields struct {
 
 	sentBytes     uint64
 	receivedBytes uint64
+	// bytes of the msgs offered to compression before and after it
+	uncompressedBytes uint64
+	compressedBytes   uint64
 
 	Status int // STATUS_CONNECTING, STATUS_CONNECTED, STATUS_ERROR
 	err    error
@@ -81,6 +98,8 @@ type ConnCommonFields struct {
 
 	directlyHistory      *list.List
 	directlyHistoryMutex sync.Mutex
+
+	options Options
 }
 
 func NewConnCommonFileds() *ConnCommonFields {
@@ -91,6 +110,7 @@ func NewConnCommonFileds() *ConnCommonFields {
 		Out:             make(chan []byte, 1),
 		disconnected:    make(chan struct{}),
 		directlyHistory: list.New(),
+		options:         DefaultOptions(),
 	}
 	fields.cryptoCond = sync.NewCond(&fields.cryptoMutex)
 	fields.ctxLogger.Store(entry)
@@ -167,6 +187,12 @@ func (c *ConnCommonFields) Close() {
 	close(c.disconnected)
 }
 
+// Drain returns at once, tcp writes go straight to the socket which
+// delivers them on close
+func (c *ConnCommonFields) Drain(timeout time.Duration) error {
+	return nil
+}
+
 func (c *ConnCommonFields) IsClosed() bool {
 	c.FieldsMutex.RLock()
 	defer c.FieldsMutex.RUnlock()
@@ -193,10 +219,19 @@ func (c *ConnCommonFields) GetSentBytes() uint64 {
 	return atomic.LoadUint64(&c.sentBytes)
 }
 
+func (c *ConnCommonFields) GetPayloadSize() int {
+	return MAX_UDP_PACKAGE_SIZE
+}
+
 func (c *ConnCommonFields) AddSentBytes(n int) {
 	atomic.AddUint64(&c.sentBytes, uint64(n))
 }
 
+func (c *ConnCommonFields) AddCompressedBytes(uncompressed, compressed int) {
+	atomic.AddUint64(&c.uncompressedBytes, uint64(uncompressed))
+	atomic.AddUint64(&c.compressedBytes, uint64(compressed))
+}
+
 func (c *ConnCommonFields) GetReceivedBytes() uint64 {
 	return atomic.LoadUint64(&c.receivedBytes)
 }
@@ -205,18 +240,27 @@ func (c *ConnCommonFields) AddReceivedBytes(n int) {
 	atomic.AddUint64(&c.receivedBytes, uint64(n))
 }
 
+// tcp conns have one stream, every channel is channel 0
 func (c *ConnCommonFields) NewPendingChannel() (channel int) {
-	panic("not implemented")
+	return
 }
 
 func (c *ConnCommonFields) DeletePendingChannel(channel int) {
-	panic("not implemented")
 }
 
 func (c *ConnCommonFields) WriteToChannel(channel int, bytes []byte) (err error) {
 	panic("not implemented")
 }
 
+// msgs of tcp conns go out in the order written
+func (c *ConnCommonFields) SetChannelPriority(channel, priority int) error {
+	return nil
+}
+
+// tcp conns are not shaped
+func (c *ConnCommonFields) SetRateLimiters(limiters ...*RateLimiter) {
+}
+
 func (c *ConnCommonFields) SetCrypto(crypto *Crypto) {
 	c.crypto.Store(crypto)
 	c.cryptoCond.Broadcast()
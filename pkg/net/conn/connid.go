@@ -0,0 +1,93 @@
+package conn
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+
+	"github.com/skycoin/skywire/pkg/net/msg"
+)
+
+// NewConnID returns a random non zero connection id
+func NewConnID() (id uint32) {
+	b := make([]byte, msg.CONN_ID_SIZE)
+	for id == 0 {
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		id = binary.BigEndian.Uint32(b)
+	}
+	return
+}
+
+// HeaderConnID returns the connection id in the header of a data msg, 0 if
+// the sender didn't set one
+func HeaderConnID(m []byte) uint32 {
+	if len(m) < msg.UDP_HEADER_SIZE || m[msg.UDP_FLAGS_BEGIN]&msg.UDP_FLAG_CONN_ID == 0 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(m[msg.UDP_CONN_ID_BEGIN:msg.UDP_CONN_ID_END])
+}
+
+func (c *UDPConn) GetConnID() uint32 {
+	return atomic.LoadUint32(&c.connID)
+}
+
+// SetConnID sets the id sent in the header of data msgs, call it before the first write
+func (c *UDPConn) SetConnID(id uint32) {
+	atomic.StoreUint32(&c.connID, id)
+}
+
+// Authenticates reports whether the AEAD msg m was sealed by the peer of the
+// conn, the msgs of another peer that picked the same id are not
+func (c *UDPConn) Authenticates(m []byte) bool {
+	crypto := c.GetCrypto()
+	if crypto == nil || len(m) < msg.UDP_HEADER_END || m[msg.UDP_TYPE_BEGIN] != msg.TYPE_AEAD {
+		return false
+	}
+	seq := binary.BigEndian.Uint32(m[msg.UDP_SEQ_BEGIN:msg.UDP_SEQ_END])
+	l := binary.BigEndian.Uint32(m[msg.UDP_LEN_BEGIN:msg.UDP_LEN_END])
+	if uint32(len(m)) < msg.UDP_HEADER_END+l {
+		return false
+	}
+	return crypto.Verify(seq, aeadAD(m), m[msg.UDP_HEADER_END:msg.UDP_HEADER_END+l])
+}
+
+func (c *UDPConn) setConnIDHeader(m []byte) {
+	id := c.GetConnID()
+	if id == 0 {
+		return
+	}
+	m[msg.UDP_FLAGS_BEGIN] |= msg.UDP_FLAG_CONN_ID
+	binary.BigEndian.PutUint32(m[msg.UDP_CONN_ID_BEGIN:], id)
+}
+
+// migrate moves the conn to addr once an authenticated msg with its id
+// came from there, the peer's nat rebound or it switched networks
+func (c *UDPConn) migrate(id uint32, addr *net.UDPAddr) {
+	if addr == nil || id == 0 || id != c.GetConnID() {
+		return
+	}
+	c.addrMutex.Lock()
+	from := c.addr
+	if from != nil && from.IP.Equal(addr.IP) && from.Port == addr.Port && from.Zone == addr.Zone {
+		c.addrMutex.Unlock()
+		return
+	}
+	c.addr = addr
+	c.addrMutex.Unlock()
+	// the new path may carry less
+	c.pmtud.reset()
+	c.GetContextLogger().Infof("conn %x migrated from %s to %s", id, from, addr)
+	if c.OnMigrate != nil {
+		c.OnMigrate(from, addr)
+	}
+}
+
+func (c *UDPConn) getAddr() (addr *net.UDPAddr) {
+	c.addrMutex.RLock()
+	addr = c.addr
+	c.addrMutex.RUnlock()
+	return
+}
@@ -3,6 +3,9 @@ package conn
 import (
 	"errors"
 	"time"
+
+	"github.com/skycoin/skywire/pkg/net/msg"
+	"github.com/skycoin/skywire/pkg/net/wheel"
 )
 
 const VERSION = "0.1.0"
@@ -29,13 +32,86 @@ const (
 	QUICK_LOST_THRESH       = 3
 	QUICK_LOST_RESEND_COUNT = 1
 
+	// link mtu assumed when the interfaces don't tell
 	MTU = 1500
+	// ipv4 and udp headers
+	IP_UDP_OVERHEAD = 28
 
 	MIN_RTO = 50 * time.Millisecond
 
-	MAX_CWND = 300
+	MIN_CWND     = 4
+	INITIAL_CWND = 10
+	MAX_CWND     = 300
+
+	// bytes per second before the first rtt sample
+	INITIAL_PACING_RATE = highGain * 10 * BW_UNIT / 1000
 
 	MAX_UDP_PACKAGE_SIZE = 1200
+
+	// datagrams read or written with one syscall where batching is supported
+	UDP_BATCH_SIZE = 32
+)
+
+const (
+	// gcm tag
+	MAX_AEAD_OVERHEAD = 16
+	// a fec msg carries a whole data msg after its own header
+	UDP_OVERHEAD = msg.PKG_HEADER_SIZE + 2*msg.UDP_HEADER_SIZE + MAX_AEAD_OVERHEAD
+
+	// datagram size assumed on every path, it carries MAX_UDP_PACKAGE_SIZE
+	BASE_PLPMTU = MAX_UDP_PACKAGE_SIZE + UDP_OVERHEAD
+	// jumbo frames, the search stops at the mtu of the local links below it
+	MAX_PLPMTU = 9000
+
+	// probes of a size before it is considered too big
+	PMTUD_MAX_PROBES = 3
+	// the search stops once the bounds are closer than this
+	PMTUD_SEARCH_STEP   = 16
+	PMTUD_PROBE_TIMEOUT = time.Second
+	// search again for a bigger size after this
+	PMTUD_RAISE_PERIOD = 10 * time.Minute
+	// consecutive rto resends dropping back to BASE_PLPMTU
+	PMTUD_BLACK_HOLE_RTOS = 3
+
+	// acks received within this are sent together
+	ACK_DELAY = 2 * time.Millisecond
+	// pacing falling behind the clock may catch up by this much at once,
+	// the timer wheel fires up to a tick late
+	MAX_PACING_CREDIT = 2 * wheel.TICK
+
+	// bytes a rate limiter lets through at once after being idle, as a
+	// duration of its rate
+	RATE_LIMIT_BURST = 100 * time.Millisecond
+
+	// how often Drain checks for unacked msgs
+	DRAIN_CHECK_PERIOD = 10 * time.Millisecond
+	// a closed NetConn delivers what was written within this
+	NET_CONN_DRAIN_TIMEOUT = 5 * time.Second
+
+	// limits of the reassembly of fragmented msgs, per msg, for all the msgs
+	// of a conn and the number of msgs at once
+	MAX_REASSEMBLY_SIZE  = 4 * 1024 * 1024
+	MAX_REASSEMBLY_BYTES = 16 * 1024 * 1024
+	MAX_REASSEMBLY_MSGS  = 64
+)
+
+// priority classes of pending channels
+const (
+	PRIORITY_INTERACTIVE = iota
+	PRIORITY_BULK
+)
+
+// msgs a channel of each class sends in its round robin turn
+var priorityWeights = [...]int{
+	PRIORITY_INTERACTIVE: 4,
+	PRIORITY_BULK:        1,
+}
+
+const (
+	// forward secret sessions move to a new key every REKEY_MSG_COUNT messages
+	// or REKEY_PERIOD, whichever comes first
+	REKEY_MSG_COUNT = 1 << 16
+	REKEY_PERIOD    = 10 * time.Minute
 )
 
 const (
@@ -77,3 +153,9 @@ const (
 )
 
 var ErrFin = errors.New("fin")
+
+var ErrDrainTimeout = errors.New("drain timeout")
+
+var ErrMsgTooBig = errors.New("msg too big")
+
+var ErrSeqExhausted = errors.New("seq exhausted")
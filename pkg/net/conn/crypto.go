@@ -1,8 +1,11 @@
 package conn
 
 import (
+	"bytes"
 	"crypto/aes"
 	cipher2 "crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/skycoin/skycoin/src/cipher"
@@ -11,15 +14,41 @@ import (
 	"sync/atomic"
 )
 
+var ErrAuth = errors.New("message authentication failed")
+
+var ErrNonceReuse = errors.New("seq has been sealed before")
+
 type Crypto struct {
 	key     cipher.PubKey
 	secKey  cipher.SecKey
 	target  cipher.PubKey
+	secret  []byte
 	block   atomic.Value
 	es      cipher2.Stream
 	esMutex sync.Mutex
 	ds      cipher2.Stream
 	dsMutex sync.Mutex
+
+	// authenticated encryption, sealer for outgoing and opener for incoming
+	sealer *ratchet
+	opener *ratchet
+	// 1 if outgoing messages are sealed
+	aead int32
+	// 1 if the AEAD keys move forward every REKEY_MSG_COUNT messages or
+	// REKEY_PERIOD
+	rekey int32
+	// highest seq sealed, a nonce is never used twice under a key
+	sealedSeq   uint64
+	sealedMutex sync.Mutex
+	// seq of the first authenticated incoming message, legacy messages
+	// after it are rejected
+	firstAuthSeq uint64
+	authed       bool
+	authMutex    sync.RWMutex
+	window       replayWindow
+	// acks and fins are sealed with their own seqs
+	controlSeq    uint64
+	controlWindow replayWindow
 }
 
 func NewCrypto(key cipher.PubKey, secKey cipher.SecKey) *Crypto {
@@ -38,6 +67,10 @@ func (c *Crypto) SetTargetKey(target cipher.PubKey) (err error) {
 	c.target = target
 	ecdh := cipher.ECDH(target, c.secKey)
 	b, err := aes.NewCipher(ecdh)
+	if err != nil {
+		return
+	}
+	c.secret = ecdh
 	c.block.Store(b)
 	return
 }
@@ -55,6 +88,224 @@ func (c *Crypto) Init(iv []byte) (err error) {
 	c.dsMutex.Lock()
 	c.ds = cipher2.NewCFBDecrypter(block.(cipher2.Block), iv)
 	c.dsMutex.Unlock()
+
+	c.sealer, err = newRatchet(c.aeadKey(iv, c.key, c.target))
+	if err != nil {
+		return
+	}
+	c.opener, err = newRatchet(c.aeadKey(iv, c.target, c.key))
+	return
+}
+
+// each direction gets its own key so the same seq never reuses a nonce
+func (c *Crypto) aeadKey(iv []byte, from, to cipher.PubKey) []byte {
+	h := sha256.New()
+	h.Write(c.secret)
+	h.Write(iv)
+	h.Write(from[:])
+	h.Write(to[:])
+	return h.Sum(nil)
+}
+
+// SetEphemeralKeys mixes the Diffie-Hellman results of both ephemeral keys
+// into the session secret, call it after SetTargetKey and before Init.
+// Recorded traffic can't be decrypted later with the static keys alone.
+func (c *Crypto) SetEphemeralKeys(ephemeral cipher.SecKey, remoteEphemeral cipher.PubKey) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("SetEphemeralKeys recovered err %v", e)
+		}
+	}()
+	if c.secret == nil {
+		err = errors.New("call SetTargetKey first")
+		return
+	}
+	ee := cipher.ECDH(remoteEphemeral, ephemeral)
+	// remote ephemeral with local static, local ephemeral with remote static
+	es := cipher.ECDH(remoteEphemeral, c.secKey)
+	se := cipher.ECDH(c.target, ephemeral)
+	// both sides have to mix in the same order
+	if bytes.Compare(c.key[:], c.target[:]) > 0 {
+		es, se = se, es
+	}
+	h := sha256.New()
+	h.Write(c.secret)
+	h.Write(ee)
+	h.Write(es)
+	h.Write(se)
+	secret := h.Sum(nil)
+	b, err := aes.NewCipher(secret)
+	if err != nil {
+		return
+	}
+	c.secret = secret
+	c.block.Store(b)
+	return
+}
+
+// Move to a new key every REKEY_MSG_COUNT messages or REKEY_PERIOD
+func (c *Crypto) EnableRekey() {
+	atomic.StoreInt32(&c.rekey, 1)
+}
+
+func (c *Crypto) isRekey() bool {
+	return atomic.LoadInt32(&c.rekey) == 1
+}
+
+// Seal outgoing messages with AEAD from now on
+func (c *Crypto) EnableAEAD() {
+	atomic.StoreInt32(&c.aead, 1)
+}
+
+func (c *Crypto) IsAEAD() bool {
+	return atomic.LoadInt32(&c.aead) == 1
+}
+
+func (c *Crypto) Overhead() int {
+	if c.sealer == nil {
+		return 0
+	}
+	return c.sealer.overhead()
+}
+
+// the full 64 bits seq, the wire carries only the low 32 bits of it
+func nonce(size int, seq uint64) []byte {
+	n := make([]byte, size)
+	binary.BigEndian.PutUint64(n[size-8:], seq)
+	return n
+}
+
+// Seal encrypts and authenticates data in place, the result has Overhead() extra bytes.
+// seq has to be higher than the ones sealed before, ErrNonceReuse otherwise
+func (c *Crypto) Seal(seq uint64, ad, data []byte) (result []byte, err error) {
+	if c.sealer == nil {
+		err = errors.New("call Init first")
+		return
+	}
+	c.sealedMutex.Lock()
+	defer c.sealedMutex.Unlock()
+	if seq <= c.sealedSeq {
+		err = ErrNonceReuse
+		return
+	}
+	aead, err := c.sealer.seal(c.isRekey())
+	if err != nil {
+		return
+	}
+	result = aead.Seal(data[:0], nonce(aead.NonceSize(), seq), data, ad)
+	c.sealedSeq = seq
+	return
+}
+
+// Open authenticates and decrypts data in place, rejects replayed seq.
+// The full seq is the one nearest to the highest seq opened so far
+func (c *Crypto) Open(wireSeq uint32, ad, data []byte) (result []byte, err error) {
+	if c.opener == nil {
+		err = errors.New("call Init first")
+		return
+	}
+	seq := c.window.expand(wireSeq)
+	err = c.window.check(seq)
+	if err != nil {
+		return
+	}
+	err = c.opener.open(c.isRekey(), true, data, func(aead cipher2.AEAD) (err error) {
+		result, err = aead.Open(data[:0], nonce(aead.NonceSize(), seq), data, ad)
+		return
+	})
+	if err != nil {
+		err = ErrAuth
+		return
+	}
+	err = c.window.update(seq)
+	if err != nil {
+		return
+	}
+	c.authMutex.Lock()
+	if !c.authed {
+		c.authed = true
+		c.firstAuthSeq = seq
+	}
+	c.authMutex.Unlock()
+	// the peer speaks AEAD, so do we
+	c.EnableAEAD()
+	return
+}
+
+// Verify reports whether data authenticates as seq, it leaves data, the
+// replay window and the keys as they are
+func (c *Crypto) Verify(wireSeq uint32, ad, data []byte) bool {
+	if c.opener == nil {
+		return false
+	}
+	seq := c.window.expand(wireSeq)
+	err := c.opener.open(c.isRekey(), false, data, func(aead cipher2.AEAD) (err error) {
+		_, err = aead.Open(nil, nonce(aead.NonceSize(), seq), data, ad)
+		return
+	})
+	return err == nil
+}
+
+// nonces of control msgs have the first byte set, they never meet the ones
+// of data msgs
+func controlNonce(size int, seq uint64) []byte {
+	n := nonce(size, seq)
+	n[0] = 1
+	return n
+}
+
+// SealControl authenticates the control msg m, the peer needs seq and tag
+// to open it
+func (c *Crypto) SealControl(m []byte) (seq uint32, tag []byte, err error) {
+	if c.sealer == nil {
+		err = errors.New("call Init first")
+		return
+	}
+	c.sealedMutex.Lock()
+	defer c.sealedMutex.Unlock()
+	aead, err := c.sealer.seal(c.isRekey())
+	if err != nil {
+		return
+	}
+	c.controlSeq++
+	seq = uint32(c.controlSeq)
+	tag = aead.Seal(nil, controlNonce(aead.NonceSize(), c.controlSeq), nil, m)
+	return
+}
+
+// OpenControl authenticates the control msg m with the seq and tag it came
+// with, rejects replayed seq
+func (c *Crypto) OpenControl(wireSeq uint32, m, tag []byte) (err error) {
+	if c.opener == nil {
+		err = errors.New("call Init first")
+		return
+	}
+	seq := c.controlWindow.expand(wireSeq)
+	err = c.controlWindow.check(seq)
+	if err != nil {
+		return
+	}
+	err = c.opener.open(c.isRekey(), true, tag, func(aead cipher2.AEAD) (err error) {
+		_, err = aead.Open(nil, controlNonce(aead.NonceSize(), seq), tag, m)
+		return
+	})
+	if err != nil {
+		err = ErrAuth
+		return
+	}
+	err = c.controlWindow.update(seq)
+	if err != nil {
+		return
+	}
+	c.EnableAEAD()
+	return
+}
+
+// AcceptLegacy returns false for unauthenticated messages sent after the peer switched to AEAD
+func (c *Crypto) AcceptLegacy(seq uint32) (ok bool) {
+	c.authMutex.RLock()
+	ok = !c.authed || uint64(seq) < c.firstAuthSeq
+	c.authMutex.RUnlock()
 	return
 }
 
@@ -106,7 +357,8 @@ func (cr *CryptoReader) Read(p []byte) (n int, err error) {
 		return
 	}
 	crypto := cr.cg.GetCrypto()
-	if crypto == nil {
+	// AEAD messages are opened one by one
+	if crypto == nil || crypto.IsAEAD() {
 		return
 	}
 	err = crypto.Decrypt(p[:n])
@@ -0,0 +1,240 @@
+package conn
+
+import (
+	"bytes"
+	"crypto/aes"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func newCryptoPair(t *testing.T) (a, b *Crypto) {
+	apk, ask := cipher.GenerateKeyPair()
+	bpk, bsk := cipher.GenerateKeyPair()
+	iv := cipher.RandByte(aes.BlockSize)
+	a = NewCrypto(apk, ask)
+	b = NewCrypto(bpk, bsk)
+	if err := a.SetTargetKey(bpk); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetTargetKey(apk); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Init(iv); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Init(iv); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestCrypto_SealOpen(t *testing.T) {
+	a, b := newCryptoPair(t)
+	a.EnableAEAD()
+	ad := []byte{0x04, 0, 0, 0, 1}
+	data := []byte("hello skywire")
+
+	sealed, err := a.Seal(1, ad, append(make([]byte, 0, len(data)+a.Overhead()), data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed) != len(data)+a.Overhead() {
+		t.Fatalf("sealed len %d", len(sealed))
+	}
+
+	tampered := append([]byte{}, sealed...)
+	tampered[0] ^= 0xff
+	if _, err = b.Open(1, ad, tampered); err != ErrAuth {
+		t.Fatalf("tampered data err %v", err)
+	}
+	if _, err = b.Open(1, []byte{0x01, 0, 0, 0, 1}, append([]byte{}, sealed...)); err != ErrAuth {
+		t.Fatalf("tampered header err %v", err)
+	}
+	if b.IsAEAD() {
+		t.Fatal("AEAD enabled by unauthenticated message")
+	}
+
+	opened, err := b.Open(1, ad, append([]byte{}, sealed...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, data) {
+		t.Fatalf("opened %x", opened)
+	}
+	if !b.IsAEAD() {
+		t.Fatal("AEAD not enabled by authenticated message")
+	}
+
+	if _, err = b.Open(1, ad, append([]byte{}, sealed...)); err != ErrReplay {
+		t.Fatalf("replayed msg err %v", err)
+	}
+	if b.AcceptLegacy(2) {
+		t.Fatal("legacy msg accepted after AEAD")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, seq := range []uint64{3, 1, 2, 5, 100} {
+		if err := w.update(seq); err != nil {
+			t.Fatalf("seq %d err %v", seq, err)
+		}
+	}
+	for _, seq := range []uint64{1, 3, 100} {
+		if err := w.check(seq); err != ErrReplay {
+			t.Fatalf("seq %d replayed err %v", seq, err)
+		}
+	}
+	if err := w.check(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.update(100 + replayWindowSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.check(4); err != ErrReplay {
+		t.Fatalf("too old seq err %v", err)
+	}
+	if err := w.check(101); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCrypto_EphemeralRekey(t *testing.T) {
+	apk, ask := cipher.GenerateKeyPair()
+	bpk, bsk := cipher.GenerateKeyPair()
+	aepk, aesk := cipher.GenerateKeyPair()
+	bepk, besk := cipher.GenerateKeyPair()
+	iv := cipher.RandByte(aes.BlockSize)
+	a := NewCrypto(apk, ask)
+	b := NewCrypto(bpk, bsk)
+	for _, c := range []struct {
+		crypto    *Crypto
+		target    cipher.PubKey
+		ephemeral cipher.SecKey
+		remote    cipher.PubKey
+	}{{a, bpk, aesk, bepk}, {b, apk, besk, aepk}} {
+		if err := c.crypto.SetTargetKey(c.target); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.crypto.SetEphemeralKeys(c.ephemeral, c.remote); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.crypto.Init(iv); err != nil {
+			t.Fatal(err)
+		}
+		c.crypto.EnableAEAD()
+		c.crypto.EnableRekey()
+	}
+	if bytes.Equal(a.secret, cipher.ECDH(bpk, ask)) {
+		t.Fatal("ephemeral keys not mixed in")
+	}
+
+	sealed := make(map[uint64][]byte)
+	seal := func(seq uint64) {
+		s, err := a.Seal(seq, nil, []byte{byte(seq)})
+		if err != nil {
+			t.Fatalf("seal seq %d err %v", seq, err)
+		}
+		sealed[seq] = s
+	}
+	open := func(seq uint64) {
+		opened, err := b.Open(uint32(seq), nil, sealed[seq])
+		if err != nil {
+			t.Fatalf("open seq %d err %v", seq, err)
+		}
+		if !bytes.Equal(opened, []byte{byte(seq)}) {
+			t.Fatalf("seq %d opened %x", seq, opened)
+		}
+	}
+	seal(1)
+	seal(2)
+	open(1)
+	a.sealer.sealed = REKEY_MSG_COUNT
+	seal(3)
+	seal(4)
+	if e := a.sealer.getEpoch(); e != 1 {
+		t.Fatalf("sealer epoch %d after %d msgs", e, REKEY_MSG_COUNT)
+	}
+	// the first msg of the new epoch arrives late, the last one of the old
+	// epoch later still
+	open(4)
+	open(2)
+	open(3)
+	if e := b.opener.getEpoch(); e != 1 {
+		t.Fatalf("opener epoch %d", e)
+	}
+	if _, err := a.Seal(1, nil, []byte{1}); err != ErrNonceReuse {
+		t.Fatalf("old seq err %v", err)
+	}
+}
+
+func TestCrypto_RekeyEpoch(t *testing.T) {
+	a, b := newCryptoPair(t)
+	a.EnableRekey()
+	b.EnableRekey()
+	roundTrip := func(seq uint64) {
+		sealed, err := a.Seal(seq, nil, []byte{byte(seq)})
+		if err != nil {
+			t.Fatalf("seal seq %d err %v", seq, err)
+		}
+		if _, err = b.Open(uint32(seq), nil, sealed); err != nil {
+			t.Fatalf("open seq %d err %v", seq, err)
+		}
+	}
+
+	// a quiet conn moves on after REKEY_PERIOD
+	roundTrip(1)
+	a.sealer.begin = time.Now().Add(-REKEY_PERIOD)
+	roundTrip(2)
+	if a.sealer.getEpoch() != 1 || b.opener.getEpoch() != 1 {
+		t.Fatalf("epochs %d %d after REKEY_PERIOD", a.sealer.getEpoch(), b.opener.getEpoch())
+	}
+	roundTrip(3)
+	if a.sealer.getEpoch() != 1 {
+		t.Fatalf("epoch %d moved again", a.sealer.getEpoch())
+	}
+
+	// the epoch keeps counting when the wire seq wraps
+	for _, seq := range []uint64{1<<32 - 1, 1 << 32, 1<<32 + 1} {
+		a.sealer.sealed = REKEY_MSG_COUNT
+		roundTrip(seq)
+	}
+	if a.sealer.getEpoch() != 4 || b.opener.getEpoch() != 4 {
+		t.Fatalf("epochs %d %d after the wrap", a.sealer.getEpoch(), b.opener.getEpoch())
+	}
+}
+
+func TestCrypto_SeqWrap(t *testing.T) {
+	a, b := newCryptoPair(t)
+	nonces := make(map[string]uint64)
+	for _, seq := range []uint64{1<<32 - 2, 1<<32 - 1, 1 << 32, 1<<32 + 1} {
+		n := string(nonce(12, seq))
+		if _, ok := nonces[n]; ok {
+			t.Fatalf("seq %d reuses the nonce of %d", seq, nonces[n])
+		}
+		nonces[n] = seq
+		data := []byte{byte(seq), byte(seq >> 32)}
+		sealed, err := a.Seal(seq, nil, append([]byte{}, data...))
+		if err != nil {
+			t.Fatalf("seal seq %d err %v", seq, err)
+		}
+		opened, err := b.Open(uint32(seq), nil, append([]byte{}, sealed...))
+		if err != nil {
+			t.Fatalf("open seq %d err %v", seq, err)
+		}
+		if !bytes.Equal(opened, data) {
+			t.Fatalf("seq %d opened %x", seq, opened)
+		}
+		if _, err = b.Open(uint32(seq), nil, sealed); err != ErrReplay {
+			t.Fatalf("replayed seq %d err %v", seq, err)
+		}
+	}
+	if _, err := a.Seal(1<<32, nil, []byte{1}); err != ErrNonceReuse {
+		t.Fatalf("resealed seq err %v", err)
+	}
+	if s := expandSeq(1<<32+5, 0xfffffff0); s != 0xfffffff0 {
+		t.Fatalf("late seq before the wrap expanded to %x", s)
+	}
+}
@@ -0,0 +1,125 @@
+package conn
+
+import (
+	"math"
+	"time"
+
+	"github.com/skycoin/skywire/pkg/net/msg"
+)
+
+const (
+	// scaling constant of the cubic function, in msgs per second^3
+	cubicC = 0.4
+	// window reduction factor on loss
+	cubicBeta = 0.7
+	// pacing gains relative to cwnd per rtt
+	cubicSlowStartGain  = 2
+	cubicAvoidanceGain  = 1.25
+	cubicInitialSsthres = MAX_CWND
+)
+
+// cubic grows the window as a cubic function of the time since the last
+// loss (RFC 8312), it backs off on loss unlike BBR
+type cubic struct {
+	cwnd     float64
+	ssthresh float64
+	// window before the last reduction
+	wMax float64
+	// reno-friendly window estimate
+	wEst       float64
+	k          float64
+	epochStart time.Time
+	minRTT     time.Duration
+
+	lastSentSeq uint32
+	// acks and losses of msgs sent before the last reduction are ignored
+	recoveryEnd uint32
+}
+
+func NewCubic() CongestionController {
+	return &cubic{
+		cwnd:     INITIAL_CWND,
+		ssthresh: cubicInitialSsthres,
+	}
+}
+
+func (c *cubic) OnSend(m *msg.UDPMessage, appLimited bool) {
+	c.lastSentSeq = m.GetSeq()
+}
+
+func (c *cubic) OnAck(m *msg.UDPMessage, minRTT time.Duration, inFlight uint32) {
+	c.minRTT = minRTT
+	if m.GetSeq() <= c.recoveryEnd {
+		return
+	}
+	if c.cwnd < c.ssthresh {
+		c.cwnd++
+		c.clamp()
+		return
+	}
+
+	now := time.Now()
+	if c.epochStart.IsZero() {
+		c.epochStart = now
+		c.wEst = c.cwnd
+		if c.cwnd < c.wMax {
+			c.k = math.Cbrt((c.wMax - c.cwnd) / cubicC)
+		} else {
+			c.k = 0
+			c.wMax = c.cwnd
+		}
+	}
+	t := (now.Sub(c.epochStart) + minRTT).Seconds() - c.k
+	target := cubicC*t*t*t + c.wMax
+	if target > c.cwnd {
+		c.cwnd += (target - c.cwnd) / c.cwnd
+	} else {
+		c.cwnd += 0.01 / c.cwnd
+	}
+
+	c.wEst += 3 * (1 - cubicBeta) / (1 + cubicBeta) / c.cwnd
+	if c.wEst > c.cwnd {
+		c.cwnd = c.wEst
+	}
+	c.clamp()
+}
+
+func (c *cubic) OnLoss(m *msg.UDPMessage) {
+	if m.GetSeq() <= c.recoveryEnd {
+		return
+	}
+	c.recoveryEnd = c.lastSentSeq
+	c.epochStart = time.Time{}
+	// fast convergence, leave bandwidth to new flows
+	if c.cwnd < c.wMax {
+		c.wMax = c.cwnd * (1 + cubicBeta) / 2
+	} else {
+		c.wMax = c.cwnd
+	}
+	c.cwnd *= cubicBeta
+	c.clamp()
+	c.ssthresh = c.cwnd
+}
+
+func (c *cubic) PacingRate() uint64 {
+	if c.minRTT <= 0 {
+		return INITIAL_PACING_RATE
+	}
+	gain := cubicAvoidanceGain
+	if c.cwnd < c.ssthresh {
+		gain = cubicSlowStartGain
+	}
+	return uint64(gain * c.cwnd * MAX_UDP_PACKAGE_SIZE / c.minRTT.Seconds())
+}
+
+func (c *cubic) Cwnd() uint32 {
+	return uint32(c.cwnd)
+}
+
+func (c *cubic) clamp() {
+	if c.cwnd < MIN_CWND {
+		c.cwnd = MIN_CWND
+	} else if c.cwnd > MAX_CWND {
+		c.cwnd = MAX_CWND
+	}
+}
@@ -1,152 +1,246 @@
 package conn
 
 import (
+	"encoding/binary"
 	"errors"
 
 	"github.com/klauspost/reedsolomon"
+	"github.com/skycoin/skywire/pkg/net/msg"
 	"github.com/skycoin/skywire/pkg/net/util"
 )
 
-type fecDecoder struct {
+type fecRatio struct {
 	dataShards   int
 	parityShards int
-	shardSize    uint32
+}
+
+func (r fecRatio) off() bool {
+	return r.dataShards < 1 || r.parityShards < 1
+}
+
+func (r fecRatio) shardSize() int {
+	return r.dataShards + r.parityShards
+}
+
+const (
+	// max data or parity shards of a group
+	fecMaxShards = 16
+	// data msgs sent between two ratio updates
+	fecUpdatePeriod = 64
+	// raise the ratio if more resends than this per thousand msgs
+	fecRaiseThresh = 20
+	// lower the ratio if less resends than this per thousand msgs
+	fecLowerThresh = 5
+	// periods in a row under fecLowerThresh before lowering the ratio
+	fecLowerPeriods = 4
+	// groups older than this many seqs are dropped by the decoder
+	fecDecodeWindow = 256
+)
+
+var (
+	// from less to more redundancy, the first one turns fec off
+	fecRatios = [...]fecRatio{
+		{0, 0},
+		{8, 1},
+		{4, 1},
+		{4, 2},
+		{4, 4},
+	}
+	fecDefaultRatio = 2
+)
+
+// fecAdapter picks the ratio of the next group from the resends since the last update.
+// resends happen only for msgs fec could not recover, so the ratio is raised
+// quickly and lowered slowly
+type fecAdapter struct {
+	index      int
+	sent       uint32
+	lastSent   uint32
+	lastResent uint32
+	lowPeriods int
+}
+
+func (a *fecAdapter) update(resent uint32) fecRatio {
+	a.sent++
+	if a.sent-a.lastSent >= fecUpdatePeriod {
+		rate := (resent - a.lastResent) * 1000 / (a.sent - a.lastSent)
+		a.lastSent = a.sent
+		a.lastResent = resent
+		switch {
+		case rate > fecRaiseThresh:
+			a.lowPeriods = 0
+			if a.index < len(fecRatios)-1 {
+				a.index++
+			}
+		case rate < fecLowerThresh:
+			a.lowPeriods++
+			if a.lowPeriods >= fecLowerPeriods && a.index > 0 {
+				a.lowPeriods = 0
+				a.index--
+			}
+		default:
+			a.lowPeriods = 0
+		}
+	}
+	return fecRatios[a.index]
+}
+
+type fecCodecs map[fecRatio]reedsolomon.Encoder
+
+func (cs fecCodecs) get(r fecRatio) (codec reedsolomon.Encoder, err error) {
+	codec, ok := cs[r]
+	if ok {
+		return
+	}
+	codec, err = reedsolomon.New(r.dataShards, r.parityShards, reedsolomon.WithMaxGoroutines(1))
+	if err != nil {
+		return
+	}
+	cs[r] = codec
+	return
+}
 
-	lowestGroup uint32
-	groups      map[uint32]*group
+func setFECHeader(m []byte, r fecRatio, index int) {
+	m[msg.UDP_FEC_DATA_SHARDS_BEGIN] = byte(r.dataShards)
+	m[msg.UDP_FEC_PARITY_SHARDS_BEGIN] = byte(r.parityShards)
+	m[msg.UDP_FEC_INDEX_BEGIN] = byte(index)
+}
 
-	codec reedsolomon.Encoder
+func getFECHeader(m []byte) (r fecRatio, index int) {
+	r.dataShards = int(m[msg.UDP_FEC_DATA_SHARDS_BEGIN])
+	r.parityShards = int(m[msg.UDP_FEC_PARITY_SHARDS_BEGIN])
+	index = int(m[msg.UDP_FEC_INDEX_BEGIN])
+	return
+}
+
+type fecDecoder struct {
+	highestSeq uint32
+	groups     map[uint32]*group
+
+	codecs fecCodecs
 }
 
 type group struct {
+	fecRatio
 	datas     [][]byte
 	dataRecv  []bool
 	dataCount int
 	count     int
 	startSeq  uint32
 	recovered bool
+	done      bool
 	maxSize   int
 }
 
-func newFECDecoder(dataShards, parityShards int) *fecDecoder {
-	fec := &fecDecoder{
-		dataShards:   dataShards,
-		parityShards: parityShards,
-		shardSize:    uint32(dataShards + parityShards),
-
+func newFECDecoder() *fecDecoder {
+	return &fecDecoder{
 		groups: make(map[uint32]*group),
+		codecs: make(fecCodecs),
 	}
-
-	var err error
-	fec.codec, err = reedsolomon.New(dataShards, parityShards, reedsolomon.WithMaxGoroutines(1))
-	if err != nil {
-		return nil
-	}
-	return fec
 }
 
-func (fec *fecDecoder) decode(seq uint32, data []byte) (g *group, err error) {
+// decode adds a data or fec msg of the group startSeq, the group is returned
+// once it recovered the lost data msgs
+func (fec *fecDecoder) decode(startSeq uint32, r fecRatio, index int, data []byte) (g *group, err error) {
 	sz := len(data)
 	if sz <= 0 {
 		err = errors.New("empty fec data")
 		return
 	}
-	seq = seq - 1
-	gindex := seq / fec.shardSize
-	if gindex < fec.lowestGroup {
+	if r.off() || r.dataShards > fecMaxShards || r.parityShards > fecMaxShards || index >= r.shardSize() {
 		return
 	}
+	fec.gc(startSeq)
 
-	g, ok := fec.groups[gindex]
+	g, ok := fec.groups[startSeq]
 	if !ok {
+		if fec.highestSeq-startSeq > fecDecodeWindow && fec.highestSeq > startSeq {
+			return
+		}
 		g = &group{
-			startSeq: gindex * fec.shardSize,
-			datas:    make([][]byte, fec.shardSize),
-			dataRecv: make([]bool, fec.dataShards),
+			fecRatio: r,
+			startSeq: startSeq,
+			datas:    make([][]byte, r.shardSize()),
+			dataRecv: make([]bool, r.dataShards),
 		}
-		fec.groups[gindex] = g
+		fec.groups[startSeq] = g
 	}
-	if g == nil {
-		return
+	if g.done || g.fecRatio != r || g.datas[index] != nil {
+		return nil, nil
+	}
+	if sz > g.maxSize {
+		g.maxSize = sz
 	}
+	g.count++
+	if index < r.dataShards {
+		g.dataCount++
+		g.dataRecv[index] = true
+	}
+	g.datas[index] = util.FixedMtuPool.GetSize(sz, 0)
+	copy(g.datas[index], data)
 
-	index := seq % fec.shardSize
-	if g.datas[index] == nil {
-		if sz > g.maxSize {
-			g.maxSize = sz
-		}
-		g.count++
-		if index < uint32(fec.dataShards) {
-			g.dataCount++
-			g.dataRecv[index] = true
-		}
-		g.datas[index] = util.FixedMtuPool.Get()
-		g.datas[index] = g.datas[index][:sz]
-		copy(g.datas[index], data)
-	} else {
+	if g.dataCount == r.dataShards {
+		g.done = true
+		g.release()
 		return nil, nil
 	}
 
-	if g.dataCount == fec.dataShards {
-		goto OK
+	if g.count < r.dataShards {
+		return nil, nil
 	}
-
-	if g.count >= fec.dataShards {
-		cache := g.datas
-		for k, v := range cache {
-			if v == nil {
-				continue
-			}
-			s := len(v)
-			util.XorBytes(v[s:g.maxSize], v[s:g.maxSize], v[s:g.maxSize])
-			cache[k] = v[:g.maxSize]
-		}
-		if err = fec.codec.ReconstructData(cache); err == nil {
-			g.recovered = true
-			goto OK
+	codec, err := fec.codecs.get(r)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range g.datas {
+		if v == nil {
+			continue
 		}
+		s := len(v)
+		util.XorBytes(v[s:g.maxSize], v[s:g.maxSize], v[s:g.maxSize])
+		g.datas[k] = v[:g.maxSize]
 	}
+	if err = codec.ReconstructData(g.datas); err != nil {
+		return nil, err
+	}
+	g.recovered = true
+	g.done = true
+	return
+}
 
-	return nil, err
-OK:
-	if fec.lowestGroup == gindex {
-		for {
-			fec.lowestGroup++
-			group := fec.groups[gindex]
-			if group != nil {
-				for _, v := range group.datas {
-					if len(v) > 0 {
-						util.FixedMtuPool.Put(v)
-					}
-				}
-			}
-
-			delete(fec.groups, gindex)
-			if len(fec.groups) < 1 {
-				break
-			}
-			gindex++
-			g, ok := fec.groups[gindex]
-			if !ok || g != nil {
-				break
-			}
-		}
-	} else {
-		for _, v := range fec.groups[gindex].datas {
-			if len(v) > 0 {
-				util.FixedMtuPool.Put(v)
-			}
+// drop the groups out of the window, the returned group is only released by
+// a later call so the caller can read it
+func (fec *fecDecoder) gc(seq uint32) {
+	if seq <= fec.highestSeq {
+		return
+	}
+	moved := seq/fecUpdatePeriod != fec.highestSeq/fecUpdatePeriod
+	fec.highestSeq = seq
+	if !moved {
+		return
+	}
+	for k, g := range fec.groups {
+		if seq-k <= fecDecodeWindow {
+			continue
 		}
-		fec.groups[gindex] = nil
+		g.release()
+		delete(fec.groups, k)
 	}
+}
 
-	return
+func (g *group) release() {
+	for i, v := range g.datas {
+		if len(v) > 0 {
+			util.FixedMtuPool.Put(v)
+		}
+		g.datas[i] = nil
+	}
 }
 
 type fecEncoder struct {
-	dataShards   int
-	parityShards int
-	shardSize    uint32
+	fecAdapter
+	ratio    fecRatio
+	startSeq uint32
 
 	count   int
 	maxSize int
@@ -154,60 +248,96 @@ type fecEncoder struct {
 	cache    [][]byte
 	tmpCache [][]byte
 
-	codec reedsolomon.Encoder
+	codecs fecCodecs
 }
 
-func newFECEncoder(dataShards, parityShards int) *fecEncoder {
+func newFECEncoder() *fecEncoder {
 	fec := &fecEncoder{
-		dataShards:   dataShards,
-		parityShards: parityShards,
-		shardSize:    uint32(dataShards + parityShards),
+		fecAdapter: fecAdapter{index: fecDefaultRatio},
+		codecs:     make(fecCodecs),
 	}
 
-	var err error
-	fec.codec, err = reedsolomon.New(dataShards, parityShards, reedsolomon.WithMaxGoroutines(1))
-	if err != nil {
-		return nil
-	}
-
-	fec.cache = make([][]byte, fec.shardSize)
-	fec.tmpCache = make([][]byte, fec.shardSize)
+	fec.cache = make([][]byte, 2*fecMaxShards)
+	fec.tmpCache = make([][]byte, 2*fecMaxShards)
 	for k := range fec.cache {
-		fec.cache[k] = make([]byte, 1500)
+		fec.cache[k] = make([]byte, MTU)
 	}
 	return fec
 }
 
-func (fec *fecEncoder) encode(data []byte) (datas [][]byte, err error) {
-	sz := len(data)
+// encode sets the fec header of the data msg m and returns the fec msgs
+// once the group is complete, resent is the sum of the resend counters and
+// plpmtu the max datagram size of the path
+func (fec *fecEncoder) encode(m []byte, resent uint32, plpmtu int) (fecs [][]byte, err error) {
+	ratio := fec.update(resent)
+	if fec.count == 0 {
+		fec.ratio = ratio
+		fec.startSeq = binary.BigEndian.Uint32(m[msg.UDP_SEQ_BEGIN:msg.UDP_SEQ_END])
+	}
+	if fec.ratio.off() {
+		setFECHeader(m, fec.ratio, 0)
+		return
+	}
+	if msg.PKG_HEADER_SIZE+msg.UDP_HEADER_SIZE+len(m) > plpmtu {
+		// queued before the path mtu dropped, its fec msg would not get
+		// through so the group is given up
+		fec.maxSize = 0
+		fec.count = 0
+		setFECHeader(m, fecRatios[0], 0)
+		return
+	}
+	setFECHeader(m, fec.ratio, fec.count)
+
+	sz := len(m)
+	if cap(fec.cache[fec.count]) < sz {
+		fec.cache[fec.count] = make([]byte, sz)
+	}
 	fec.cache[fec.count] = fec.cache[fec.count][:sz]
-	copy(fec.cache[fec.count], data)
+	copy(fec.cache[fec.count], m)
 	if sz > fec.maxSize {
 		fec.maxSize = sz
 	}
 	fec.count++
 
-	if fec.count == fec.dataShards {
-		for i := 0; i < fec.dataShards; i++ {
-			shard := fec.cache[i]
-			s := len(shard)
-			util.XorBytes(shard[s:fec.maxSize], shard[s:fec.maxSize], shard[s:fec.maxSize])
-		}
-
-		c := fec.tmpCache
-		for k, v := range fec.cache {
-			c[k] = v[:fec.maxSize]
-		}
-
-		if err = fec.codec.Encode(c); err == nil {
-			datas = fec.cache[fec.dataShards:]
-			for i, v := range datas {
-				datas[i] = v[:fec.maxSize]
-			}
-		}
+	if fec.count < fec.ratio.dataShards {
+		return
+	}
+	defer func() {
 		fec.maxSize = 0
 		fec.count = 0
+	}()
+	codec, err := fec.codecs.get(fec.ratio)
+	if err != nil {
+		return
+	}
+	for i := 0; i < fec.ratio.dataShards; i++ {
+		shard := fec.cache[i]
+		s := len(shard)
+		util.XorBytes(shard[s:fec.maxSize], shard[s:fec.maxSize], shard[s:fec.maxSize])
+	}
+
+	c := fec.tmpCache[:fec.ratio.shardSize()]
+	for k := range c {
+		c[k] = fec.cache[k][:fec.maxSize]
 	}
 
+	if err = codec.Encode(c); err != nil {
+		return
+	}
+	for i, v := range c[fec.ratio.dataShards:] {
+		fecs = append(fecs, fecMsg(v, fec.startSeq, fec.ratio, fec.ratio.dataShards+i))
+	}
+	return
+}
+
+func fecMsg(b []byte, seq uint32, r fecRatio, index int) (result []byte) {
+	hz := msg.PKG_HEADER_SIZE + msg.UDP_HEADER_SIZE
+	result = make([]byte, hz+len(b))
+	l := copy(result[hz:], b)
+	m := result[msg.PKG_HEADER_SIZE:]
+	m[0] = msg.TYPE_FEC
+	binary.BigEndian.PutUint32(m[msg.UDP_SEQ_BEGIN:msg.UDP_SEQ_END], seq)
+	binary.BigEndian.PutUint32(m[msg.UDP_LEN_BEGIN:msg.UDP_LEN_END], uint32(l))
+	setFECHeader(m, r, index)
 	return
 }
@@ -0,0 +1,126 @@
+package conn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/skycoin/skywire/pkg/net/msg"
+)
+
+// reassembly is a msg of which the first next fragments arrived
+type reassembly struct {
+	count int
+	next  int
+	buf   []byte
+}
+
+// reassembler joins the fragments of msgs bigger than a packet. The stream
+// delivers the fragments of a msg in order, fragments of msgs of other
+// channels may come in between.
+type reassembler struct {
+	msgs  map[uint32]*reassembly
+	bytes int
+	mtx   sync.Mutex
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{msgs: make(map[uint32]*reassembly)}
+}
+
+// push returns the msg once its last fragment arrived
+func (r *reassembler) push(b []byte) (m []byte, err error) {
+	if len(b) < msg.FRAG_HEADER_SIZE {
+		err = fmt.Errorf("invalid fragment %x", b)
+		return
+	}
+	id := binary.BigEndian.Uint32(b[msg.FRAG_ID_BEGIN:msg.FRAG_ID_END])
+	index := int(binary.BigEndian.Uint16(b[msg.FRAG_INDEX_BEGIN:msg.FRAG_INDEX_END]))
+	count := int(binary.BigEndian.Uint16(b[msg.FRAG_COUNT_BEGIN:msg.FRAG_COUNT_END]))
+	b = b[msg.FRAG_HEADER_END:]
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	ra, ok := r.msgs[id]
+	if !ok {
+		if index != 0 || count < 1 {
+			err = fmt.Errorf("fragment %d/%d of unknown msg %d", index, count, id)
+			return
+		}
+		if len(r.msgs) >= MAX_REASSEMBLY_MSGS {
+			err = fmt.Errorf("more than %d msgs being reassembled", MAX_REASSEMBLY_MSGS)
+			return
+		}
+		ra = &reassembly{count: count}
+		r.msgs[id] = ra
+	}
+	if index != ra.next || count != ra.count {
+		err = fmt.Errorf("fragment %d/%d of msg %d, expected %d/%d", index, count, id, ra.next, ra.count)
+		r._drop(id, ra)
+		return
+	}
+	if len(ra.buf)+len(b) > MAX_REASSEMBLY_SIZE || r.bytes+len(b) > MAX_REASSEMBLY_BYTES {
+		err = fmt.Errorf("msg %d too big to reassemble", id)
+		r._drop(id, ra)
+		return
+	}
+	ra.buf = append(ra.buf, b...)
+	ra.next++
+	r.bytes += len(b)
+	if ra.next < ra.count {
+		return
+	}
+	r._drop(id, ra)
+	return ra.buf, nil
+}
+
+// the msg is done or broken, the rest of a broken one fails as fragments of
+// an unknown msg
+func (r *reassembler) _drop(id uint32, ra *reassembly) {
+	delete(r.msgs, id)
+	r.bytes -= len(ra.buf)
+}
+
+// writeFragments splits bytes into fragments of at most size bytes
+func (c *UDPConn) writeFragments(channel int, bytes []byte, msgt byte, size int) (err error) {
+	if len(bytes) > MAX_REASSEMBLY_SIZE {
+		return ErrMsgTooBig
+	}
+	chunk := size - msg.FRAG_HEADER_SIZE
+	count := (len(bytes) + chunk - 1) / chunk
+	if count > msg.MAX_FRAG_COUNT {
+		return ErrMsgTooBig
+	}
+	id := c.nextFragID()
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunk
+		if end > len(bytes) {
+			end = len(bytes)
+		}
+		b := make([]byte, msg.FRAG_HEADER_SIZE+end-i*chunk)
+		binary.BigEndian.PutUint32(b[msg.FRAG_ID_BEGIN:], id)
+		binary.BigEndian.PutUint16(b[msg.FRAG_INDEX_BEGIN:], uint16(i))
+		binary.BigEndian.PutUint16(b[msg.FRAG_COUNT_BEGIN:], uint16(count))
+		copy(b[msg.FRAG_HEADER_END:], bytes[i*chunk:end])
+		m := msg.NewUDPWithoutSeq(msgt, b)
+		m.SetFragment()
+		c.addMsgToChannel(channel, m)
+	}
+	return
+}
+
+// SetPeerReassembly is called once the peer told it reassembles fragments,
+// at the handshake of the conn or by UDP_FLAG_REASSEMBLY in the header of
+// its msgs
+func (c *UDPConn) SetPeerReassembly() {
+	atomic.StoreInt32(&c.peerReassembly, 1)
+}
+
+func (c *UDPConn) isPeerReassembly() bool {
+	return atomic.LoadInt32(&c.peerReassembly) == 1
+}
+
+func (c *UDPConn) nextFragID() uint32 {
+	return atomic.AddUint32(&c.fragID, 1)
+}
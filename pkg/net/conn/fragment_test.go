@@ -0,0 +1,94 @@
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/skycoin/skywire/pkg/net/msg"
+)
+
+func fragment(id uint32, index, count int, b []byte) []byte {
+	f := make([]byte, msg.FRAG_HEADER_SIZE+len(b))
+	binary.BigEndian.PutUint32(f[msg.FRAG_ID_BEGIN:], id)
+	binary.BigEndian.PutUint16(f[msg.FRAG_INDEX_BEGIN:], uint16(index))
+	binary.BigEndian.PutUint16(f[msg.FRAG_COUNT_BEGIN:], uint16(count))
+	copy(f[msg.FRAG_HEADER_END:], b)
+	return f
+}
+
+func TestReassembler(t *testing.T) {
+	r := newReassembler()
+	// fragments of two channels interleaved
+	fs := [][]byte{
+		fragment(1, 0, 2, []byte("hel")),
+		fragment(2, 0, 2, []byte("sky")),
+		fragment(1, 1, 2, []byte("lo")),
+		fragment(2, 1, 2, []byte("wire")),
+	}
+	var msgs [][]byte
+	for _, f := range fs {
+		m, err := r.push(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != nil {
+			msgs = append(msgs, m)
+		}
+	}
+	if len(msgs) != 2 || !bytes.Equal(msgs[0], []byte("hello")) || !bytes.Equal(msgs[1], []byte("skywire")) {
+		t.Fatalf("msgs %q", msgs)
+	}
+	if len(r.msgs) != 0 || r.bytes != 0 {
+		t.Fatalf("%d msgs %d bytes left", len(r.msgs), r.bytes)
+	}
+
+	if _, err := r.push(fragment(3, 1, 2, nil)); err == nil {
+		t.Fatal("fragment without the first one")
+	}
+	r.push(fragment(4, 0, 3, nil))
+	if _, err := r.push(fragment(4, 2, 3, nil)); err == nil {
+		t.Fatal("fragment out of order")
+	}
+	if len(r.msgs) != 0 {
+		t.Fatal("broken msg kept")
+	}
+	big := make([]byte, MAX_REASSEMBLY_SIZE)
+	if _, err := r.push(fragment(5, 0, 2, big)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.push(fragment(5, 1, 2, []byte{1})); err == nil {
+		t.Fatal("msg over MAX_REASSEMBLY_SIZE")
+	}
+	if len(r.msgs) != 0 || r.bytes != 0 {
+		t.Fatalf("%d msgs %d bytes left", len(r.msgs), r.bytes)
+	}
+}
+
+func TestUDPConn_ReassemblyDrop(t *testing.T) {
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c := NewUDPConn(ln, ln.LocalAddr().(*net.UDPAddr))
+	defer c.Close()
+	fs := [][]byte{
+		fragment(1, 0, 2, []byte("sky")),
+		// lost its first fragment
+		fragment(2, 1, 2, []byte("x")),
+		fragment(1, 1, 2, []byte("wire")),
+	}
+	for i, f := range fs {
+		if err := c.process(msg.TYPE_SYN, uint32(i+1), true, f); err != nil {
+			t.Fatalf("fragment %d closes the conn: %v", i, err)
+		}
+	}
+	if m := <-c.In; !bytes.Equal(m, []byte("skywire")) {
+		t.Fatalf("msg %q", m)
+	}
+	if n := c.Stats().ReassemblyDropCount; n != 1 {
+		t.Fatalf("%d drops", n)
+	}
+}
@@ -0,0 +1,222 @@
+package conn
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// MsgConn is the part of a Connection NetConn needs, the msgs of it must not
+// be read by anything else
+type MsgConn interface {
+	Write(bytes []byte) error
+	GetChanIn() <-chan []byte
+	GetRemoteAddr() net.Addr
+	GetDisconnectedChan() <-chan struct{}
+	Drain(timeout time.Duration) error
+	Close()
+}
+
+// NetConn is a net.Conn over the msgs of a conn. The bytes of a Write are
+// sent as one msg, Read returns them as a stream, keeping the part of a msg
+// that did not fit. Writes can't be interrupted once queued to the conn, the
+// write deadline is checked before.
+type NetConn struct {
+	conn MsgConn
+
+	buf []byte
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	readMutex sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewNetConn(conn MsgConn) *NetConn {
+	return &NetConn{
+		conn:          conn,
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		closed:        make(chan struct{}),
+	}
+}
+
+func (c *NetConn) Read(b []byte) (n int, err error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	if c.isClosed() {
+		err = net.ErrClosed
+		return
+	}
+	if len(c.buf) < 1 {
+		if c.readDeadline.expired() {
+			err = os.ErrDeadlineExceeded
+			return
+		}
+		select {
+		case m, ok := <-c.conn.GetChanIn():
+			if !ok {
+				err = io.EOF
+				return
+			}
+			c.buf = m
+		case <-c.closed:
+			err = net.ErrClosed
+			return
+		case <-c.readDeadline.wait():
+			err = os.ErrDeadlineExceeded
+			return
+		}
+	}
+	n = copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return
+}
+
+func (c *NetConn) Write(b []byte) (n int, err error) {
+	if c.isClosed() {
+		err = net.ErrClosed
+		return
+	}
+	if c.writeDeadline.expired() {
+		err = os.ErrDeadlineExceeded
+		return
+	}
+	select {
+	case <-c.conn.GetDisconnectedChan():
+		err = io.ErrClosedPipe
+		return
+	default:
+	}
+	if len(b) < 1 {
+		return
+	}
+	// the conn keeps the bytes until they are acked
+	m := make([]byte, len(b))
+	copy(m, b)
+	err = c.conn.Write(m)
+	if err != nil {
+		return
+	}
+	n = len(b)
+	return
+}
+
+// Close closes the conn once the bytes written are delivered, Read and Write
+// fail at once
+func (c *NetConn) Close() error {
+	closed := false
+	c.closeOnce.Do(func() {
+		closed = true
+		close(c.closed)
+		go func() {
+			c.conn.Drain(NET_CONN_DRAIN_TIMEOUT)
+			c.conn.Close()
+		}()
+	})
+	if !closed {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+func (c *NetConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// LocalAddr returns the address of the socket if the conn knows it
+func (c *NetConn) LocalAddr() net.Addr {
+	if la, ok := c.conn.(interface {
+		LocalAddr() net.Addr
+	}); ok {
+		return la.LocalAddr()
+	}
+	switch c.conn.GetRemoteAddr().(type) {
+	case *net.TCPAddr:
+		return &net.TCPAddr{}
+	default:
+		return &net.UDPAddr{}
+	}
+}
+
+func (c *NetConn) RemoteAddr() net.Addr {
+	return c.conn.GetRemoteAddr()
+}
+
+func (c *NetConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *NetConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *NetConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// deadline is closed when the time set passes, a new time re-arms it
+type deadline struct {
+	timer   *time.Timer
+	expires chan struct{}
+	mtx     sync.Mutex
+}
+
+func newDeadline() *deadline {
+	return &deadline{expires: make(chan struct{})}
+}
+
+// set the deadline, the zero time is none
+func (d *deadline) set(t time.Time) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// the timer fired, wait() of the old time must not see the new one
+		<-d.expires
+	}
+	d.timer = nil
+	select {
+	case <-d.expires:
+		d.expires = make(chan struct{})
+	default:
+	}
+	if t.IsZero() {
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		expires := d.expires
+		d.timer = time.AfterFunc(dur, func() {
+			close(expires)
+		})
+		return
+	}
+	close(d.expires)
+}
+
+func (d *deadline) wait() <-chan struct{} {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.expires
+}
+
+func (d *deadline) expired() bool {
+	select {
+	case <-d.wait():
+		return true
+	default:
+		return false
+	}
+}
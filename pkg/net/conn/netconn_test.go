@@ -0,0 +1,130 @@
+package conn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeConn delivers the msgs written to the other end of the pipe
+type pipeConn struct {
+	in, out      chan []byte
+	disconnected chan struct{}
+	closeOnce    *sync.Once
+}
+
+func newPipeConns() (a, b *pipeConn) {
+	ab, ba := make(chan []byte, 16), make(chan []byte, 16)
+	disconnected := make(chan struct{})
+	once := &sync.Once{}
+	a = &pipeConn{in: ba, out: ab, disconnected: disconnected, closeOnce: once}
+	b = &pipeConn{in: ab, out: ba, disconnected: disconnected, closeOnce: once}
+	return
+}
+
+func (c *pipeConn) Write(bytes []byte) error {
+	select {
+	case <-c.disconnected:
+		return io.ErrClosedPipe
+	default:
+	}
+	c.out <- bytes
+	return nil
+}
+
+func (c *pipeConn) GetChanIn() <-chan []byte { return c.in }
+
+func (c *pipeConn) GetRemoteAddr() net.Addr { return &net.UDPAddr{} }
+
+func (c *pipeConn) GetDisconnectedChan() <-chan struct{} { return c.disconnected }
+
+func (c *pipeConn) Drain(timeout time.Duration) error { return nil }
+
+func (c *pipeConn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.disconnected)
+		close(c.in)
+		close(c.out)
+	})
+}
+
+func TestNetConn_ReadWrite(t *testing.T) {
+	a, b := newPipeConns()
+	ca, cb := NewNetConn(a), NewNetConn(b)
+	buf := []byte("hello")
+	if _, err := ca.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	// the msg sent is a copy
+	buf[0] = 'j'
+	if _, err := ca.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 11)
+	if _, err := io.ReadFull(cb, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello world" {
+		t.Fatalf("read %q", got)
+	}
+
+	ca.Close()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := cb.Read(got); err != io.EOF {
+		t.Fatalf("read of closed conn err %v", err)
+	}
+	if _, err := ca.Write(got); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("write of closed conn err %v", err)
+	}
+}
+
+func TestNetConn_Deadline(t *testing.T) {
+	a, b := newPipeConns()
+	ca, cb := NewNetConn(a), NewNetConn(b)
+	buf := make([]byte, 8)
+
+	cb.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	_, err := cb.Read(buf)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read err %v", err)
+	}
+	if e := time.Since(start); e < 20*time.Millisecond {
+		t.Fatalf("read timed out after %s", e)
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("read err %v is not a timeout", err)
+	}
+
+	// a new deadline re-arms it
+	cb.SetReadDeadline(time.Time{})
+	ca.Write([]byte("x"))
+	if n, err := cb.Read(buf); err != nil || n != 1 {
+		t.Fatalf("read %d err %v", n, err)
+	}
+
+	ca.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := ca.Write(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write err %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cb.Read(buf)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cb.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("read err %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close did not unblock read")
+	}
+}
@@ -0,0 +1,59 @@
+package conn
+
+import "time"
+
+// Options are the timeouts of a conn, zero fields keep the defaults of
+// TCP_READ_TIMEOUT, TCP_PING_TICK_PERIOD, UDP_PING_TICK_PERIOD and
+// UDP_GC_PERIOD
+type Options struct {
+	// a tcp conn without msgs for this long is closed
+	TCPReadTimeout time.Duration
+	// tcp clients ping the server this often
+	TCPPingTickPeriod time.Duration
+	// udp conns that send pings do it once idle for this long
+	UDPPingTickPeriod time.Duration
+	// a udp conn without msgs for this long is closed
+	UDPGCPeriod time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		TCPReadTimeout:    TCP_READ_TIMEOUT * time.Second,
+		TCPPingTickPeriod: TCP_PING_TICK_PERIOD * time.Second,
+		UDPPingTickPeriod: UDP_PING_TICK_PERIOD * time.Second,
+		UDPGCPeriod:       UDP_GC_PERIOD * time.Second,
+	}
+}
+
+// WithDefaults returns o with the zero fields set to the defaults
+func (o Options) WithDefaults() Options {
+	d := DefaultOptions()
+	if o.TCPReadTimeout <= 0 {
+		o.TCPReadTimeout = d.TCPReadTimeout
+	}
+	if o.TCPPingTickPeriod <= 0 {
+		o.TCPPingTickPeriod = d.TCPPingTickPeriod
+	}
+	if o.UDPPingTickPeriod <= 0 {
+		o.UDPPingTickPeriod = d.UDPPingTickPeriod
+	}
+	if o.UDPGCPeriod <= 0 {
+		o.UDPGCPeriod = d.UDPGCPeriod
+	}
+	return o
+}
+
+// SetOptions replaces the timeouts, call it before the read and write loops
+// start
+func (c *ConnCommonFields) SetOptions(o Options) {
+	c.FieldsMutex.Lock()
+	c.options = o.WithDefaults()
+	c.FieldsMutex.Unlock()
+}
+
+func (c *ConnCommonFields) GetOptions() (o Options) {
+	c.FieldsMutex.RLock()
+	o = c.options
+	c.FieldsMutex.RUnlock()
+	return
+}
@@ -0,0 +1,100 @@
+package conn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skywire/pkg/net/msg"
+)
+
+func TestOptions_WithDefaults(t *testing.T) {
+	d := DefaultOptions()
+	custom := Options{
+		TCPReadTimeout:    time.Second,
+		TCPPingTickPeriod: 2 * time.Second,
+		UDPPingTickPeriod: 3 * time.Second,
+		UDPGCPeriod:       4 * time.Second,
+	}
+	partial := d
+	partial.UDPPingTickPeriod = time.Second
+	for _, tc := range []struct {
+		name     string
+		in, want Options
+	}{
+		{"zero", Options{}, d},
+		{"defaults", d, d},
+		{"custom", custom, custom},
+		{"negative", Options{TCPReadTimeout: -1, TCPPingTickPeriod: -1, UDPPingTickPeriod: -1, UDPGCPeriod: -1}, d},
+		{"partial", Options{UDPPingTickPeriod: time.Second}, partial},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.in.WithDefaults(); got != tc.want {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+// an idle udp conn that sends pings does it every UDPPingTickPeriod and is
+// closed after UDPGCPeriod
+func TestUDPConn_Options(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options Options
+		pings   bool
+		closed  bool
+	}{
+		{"defaults", Options{}, false, false},
+		{"ping", Options{UDPPingTickPeriod: 10 * time.Millisecond}, true, false},
+		{"gc", Options{UDPPingTickPeriod: 20 * time.Millisecond, UDPGCPeriod: 20 * time.Millisecond}, false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			peer := listenUDP(t, "127.0.0.1:0")
+			defer peer.Close()
+			ca, _ := newCryptoPair(t)
+			c := NewUDPConn(listenUDP(t, "127.0.0.1:0"), peer.LocalAddr().(*net.UDPAddr))
+			c.UnsharedUdpConn = true
+			c.SendPing = true
+			c.SetCrypto(ca)
+			c.SetOptions(tc.options)
+			defer c.Close()
+			done := make(chan error, 1)
+			go func() {
+				done <- c.WriteLoop()
+			}()
+
+			// the idle time is counted in seconds
+			wait := 200 * time.Millisecond
+			if tc.closed {
+				wait = 3 * time.Second
+			}
+			select {
+			case err := <-done:
+				if !tc.closed {
+					t.Fatalf("conn closed, err %v", err)
+				}
+			case <-time.After(wait):
+				if tc.closed {
+					t.Fatal("idle conn not closed")
+				}
+			}
+
+			var pings int
+			buf := make([]byte, MTU)
+			for {
+				peer.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+				n, _, err := peer.ReadFrom(buf)
+				if err != nil {
+					break
+				}
+				if n > msg.PKG_HEADER_SIZE && buf[msg.PKG_HEADER_SIZE+msg.PING_MSG_TYPE_BEGIN] == msg.TYPE_PING {
+					pings++
+				}
+			}
+			if (pings > 0) != tc.pings {
+				t.Fatalf("%d pings", pings)
+			}
+		})
+	}
+}
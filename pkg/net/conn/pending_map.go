@@ -34,6 +34,14 @@ func (m *UDPPendingMap) AddMsg(k uint32, v *msg.UDPMessage) {
 	m.Unlock()
 }
 
+// Len returns the number of unacked msgs
+func (m *UDPPendingMap) Len() (n int) {
+	m.RLock()
+	n = len(m.pendings)
+	m.RUnlock()
+	return
+}
+
 func (m *UDPPendingMap) Dismiss() {
 	m.RLock()
 	for _, m := range m.pendings {
@@ -64,19 +72,44 @@ func (m *UDPPendingMap) exists(k uint32) (ok bool) {
 	return
 }
 
-func (m *UDPPendingMap) DelMsgAndGetLossMsgs(k uint32) (ok bool, um *msg.UDPMessage, loss []*msg.UDPMessage) {
+// DelMsgAndGetLossMsgs removes k and the msgs in the sack ranges, um is the
+// msg of k and acked the other removed msgs. The msgs still pending below the
+// highest acked seq miss an ack, they are returned in loss after
+// QUICK_LOST_THRESH misses
+func (m *UDPPendingMap) DelMsgAndGetLossMsgs(k uint32, ranges ...sackRange) (ok bool, um *msg.UDPMessage, acked, loss []*msg.UDPMessage) {
 	m.Lock()
+	defer m.Unlock()
 	um, ok = m.pendings[k]
-	if !ok {
-		m.Unlock()
+	highest := k
+	if ok {
+		m.del(um, k)
+	}
+	var seqs []uint32
+	for _, r := range ranges {
+		seqs = seqs[:0]
+		m.seqs.AscendGreaterOrEqual(seq(r.begin), func(i btree.Item) bool {
+			s := uint32(i.(seq))
+			if s > r.end {
+				return false
+			}
+			seqs = append(seqs, s)
+			return true
+		})
+		for _, s := range seqs {
+			v := m.pendings[s]
+			m.del(v, s)
+			acked = append(acked, v)
+			if s > highest {
+				highest = s
+			}
+		}
+	}
+	if !ok && len(acked) < 1 {
 		return
 	}
-	um.Acked()
-	delete(m.pendings, k)
 
-	m.seqs.Delete(seq(k))
 	if QUICK_LOST_ENABLE {
-		m.seqs.AscendLessThan(seq(k), func(i btree.Item) bool {
+		m.seqs.AscendLessThan(seq(highest), func(i btree.Item) bool {
 			v, ok := m.pendings[uint32(i.(seq))]
 			if ok {
 				miss := v.AddMiss()
@@ -89,6 +122,11 @@ func (m *UDPPendingMap) DelMsgAndGetLossMsgs(k uint32) (ok bool, um *msg.UDPMess
 			return true
 		})
 	}
-	m.Unlock()
 	return
 }
+
+func (m *UDPPendingMap) del(um *msg.UDPMessage, k uint32) {
+	um.Acked()
+	delete(m.pendings, k)
+	m.seqs.Delete(seq(k))
+}
@@ -18,16 +18,52 @@ func TestNewUDPPendingMap(t *testing.T) {
 	m.AddMsg(4, newUdp(4))
 	m.AddMsg(5, newUdp(5))
 
-	t.Log(m.DelMsgAndGetLossMsgs(1, 3))
+	t.Log(m.DelMsgAndGetLossMsgs(1))
 	//t.Log(m.DelMsgAndGetLossMsgs(3))
-	t.Log(m.DelMsgAndGetLossMsgs(4, 3))
-	t.Log(m.DelMsgAndGetLossMsgs(5, 3))
+	t.Log(m.DelMsgAndGetLossMsgs(4))
+	t.Log(m.DelMsgAndGetLossMsgs(5))
 	m.AddMsg(6, newUdp(6))
-	t.Log(m.DelMsgAndGetLossMsgs(3, 3))
+	t.Log(m.DelMsgAndGetLossMsgs(3))
 	m.AddMsg(7, newUdp(7))
-	t.Log(m.DelMsgAndGetLossMsgs(6, 3))
+	t.Log(m.DelMsgAndGetLossMsgs(6))
 	m.AddMsg(8, newUdp(8))
 	m.AddMsg(9, newUdp(9))
-	t.Log(m.DelMsgAndGetLossMsgs(8, 3))
-	t.Log(m.DelMsgAndGetLossMsgs(9, 3))
+	t.Log(m.DelMsgAndGetLossMsgs(8))
+	t.Log(m.DelMsgAndGetLossMsgs(9))
+}
+
+func TestUDPPendingMap_SAck(t *testing.T) {
+	q := newOrderedStreamQueue()
+	m := NewUDPPendingMap()
+	for i := uint32(1); i <= 200; i++ {
+		m.AddMsg(i, newUdp(i))
+		// lose every 50th msg
+		if i%50 != 0 {
+			q.Push(i, newUdp(i))
+		}
+	}
+	ns := q.GetNextAckSeq()
+	ranges := q.GetAckedRanges(ns+1, msg.MAX_SACK_RANGES)
+	if ns != 50 || len(ranges) != 3 || ranges[2] != (sackRange{begin: 151, end: 199}) {
+		t.Fatalf("next %d ranges %v", ns, ranges)
+	}
+
+	p := sackMsg(199, ns, ranges)
+	seq, ns2, ranges2, err := parseSackMsg(p[msg.PKG_HEADER_SIZE:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 199 || ns2 != ns || len(ranges2) != len(ranges) {
+		t.Fatalf("parsed %d %d %v", seq, ns2, ranges2)
+	}
+
+	ok, _, acked, _ := m.DelMsgAndGetLossMsgs(seq, append([]sackRange{{0, ns2 - 1}}, ranges2...)...)
+	if !ok || len(acked) != 195 {
+		t.Fatalf("ok %t acked %d", ok, len(acked))
+	}
+	for _, s := range []uint32{50, 100, 150, 200} {
+		if !m.exists(s) {
+			t.Fatalf("lost msg %d acked", s)
+		}
+	}
 }
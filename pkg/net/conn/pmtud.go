@@ -0,0 +1,200 @@
+package conn
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/skycoin/skywire/pkg/net/msg"
+)
+
+// pmtud searches the largest datagram the path carries (DPLPMTUD, RFC 8899).
+// Probes are padded msgs outside of the stream, a probe ack confirms the
+// size. The search starts once the peer tells it answers probes.
+type pmtud struct {
+	// largest confirmed datagram size
+	plpmtu int
+	// bounds of the search, high is known to be too big
+	low  int
+	high int
+	// size of the probe in flight, 0 if none
+	probeSize int
+	probes    int
+	searching bool
+	// consecutive rto resends
+	rtos int
+
+	enabled bool
+	timer   *time.Timer
+	mtx     sync.Mutex
+}
+
+func newPMTUD() *pmtud {
+	p := &pmtud{
+		plpmtu: BASE_PLPMTU,
+		low:    BASE_PLPMTU,
+		high:   maxPLPMTU() + 1,
+		timer:  time.NewTimer(0),
+	}
+	if !p.timer.Stop() {
+		<-p.timer.C
+	}
+	return p
+}
+
+func (p *pmtud) enable() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.enabled {
+		return
+	}
+	p.enabled = true
+	p.searching = true
+	p.timer.Reset(0)
+}
+
+// next returns the size of the probe to send when the timer fires, 0 if the
+// search is over
+func (p *pmtud) next() (size int) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if !p.searching {
+		p.searching = true
+		p.low = p.plpmtu
+		p.high = maxPLPMTU() + 1
+	}
+	if p.probeSize > 0 {
+		// the probe timed out
+		p.probes++
+		if p.probes >= PMTUD_MAX_PROBES {
+			p.high = p.probeSize
+			p.probeSize = 0
+		}
+	}
+	if p.probeSize == 0 {
+		if p.high-p.low <= PMTUD_SEARCH_STEP {
+			p.searching = false
+			p.timer.Reset(PMTUD_RAISE_PERIOD)
+			return
+		}
+		p.probeSize = (p.low + p.high) / 2
+		p.probes = 0
+	}
+	p.timer.Reset(PMTUD_PROBE_TIMEOUT)
+	return p.probeSize
+}
+
+// the probe could not be sent, the size is too big for the interface
+func (p *pmtud) failed(size int) {
+	p.mtx.Lock()
+	if size == p.probeSize {
+		p.high = size
+		p.probeSize = 0
+		p.timer.Reset(0)
+	}
+	p.mtx.Unlock()
+}
+
+func (p *pmtud) confirmed(size int) (ok bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if size != p.probeSize {
+		return
+	}
+	p.plpmtu = size
+	p.low = size
+	p.probeSize = 0
+	p.timer.Reset(0)
+	return true
+}
+
+// rto returns true if the timeouts look like a black hole for the current
+// size, the size drops back to BASE_PLPMTU and the search starts again
+func (p *pmtud) rto() (reset bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.plpmtu <= BASE_PLPMTU {
+		return
+	}
+	p.rtos++
+	if p.rtos < PMTUD_BLACK_HOLE_RTOS {
+		return
+	}
+	p.rtos = 0
+	p.high = p.plpmtu
+	p.plpmtu = BASE_PLPMTU
+	p.low = BASE_PLPMTU
+	p.probeSize = 0
+	p.searching = true
+	p.timer.Reset(0)
+	return true
+}
+
+// reset starts over from BASE_PLPMTU, the path changed
+func (p *pmtud) reset() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.plpmtu = BASE_PLPMTU
+	p.low = BASE_PLPMTU
+	p.high = maxPLPMTU() + 1
+	p.probeSize = 0
+	p.rtos = 0
+	if p.enabled {
+		p.searching = true
+		p.timer.Reset(0)
+	}
+}
+
+func (p *pmtud) acked() {
+	p.mtx.Lock()
+	p.rtos = 0
+	p.mtx.Unlock()
+}
+
+func (p *pmtud) size() (s int) {
+	p.mtx.Lock()
+	s = p.plpmtu
+	p.mtx.Unlock()
+	return
+}
+
+var (
+	linkPLPMTU     int
+	linkPLPMTUOnce sync.Once
+)
+
+// maxPLPMTU returns the largest datagram the local links carry, up to
+// MAX_PLPMTU
+func maxPLPMTU() int {
+	linkPLPMTUOnce.Do(func() {
+		linkPLPMTU = MTU - IP_UDP_OVERHEAD
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return
+		}
+		for _, i := range ifaces {
+			if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			if s := i.MTU - IP_UDP_OVERHEAD; s > linkPLPMTU {
+				linkPLPMTU = s
+			}
+		}
+		if linkPLPMTU > MAX_PLPMTU {
+			linkPLPMTU = MAX_PLPMTU
+		}
+	})
+	return linkPLPMTU
+}
+
+func probeMsg(t byte, size, padding int) (p []byte) {
+	p = make([]byte, msg.PKG_HEADER_SIZE+msg.PROBE_HEADER_SIZE+padding)
+	m := p[msg.PKG_HEADER_SIZE:]
+	m[msg.PROBE_TYPE_BEGIN] = t
+	binary.BigEndian.PutUint32(m[msg.PROBE_SIZE_BEGIN:], uint32(size))
+	checksum := crc32.ChecksumIEEE(m)
+	binary.BigEndian.PutUint32(p[msg.PKG_CRC32_BEGIN:], checksum)
+	return
+}
@@ -0,0 +1,61 @@
+package conn
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+// AllowFragmentation lets the kernel fragment the datagrams of c, paths with
+// a smaller mtu than the one found still carry them. Probes set the DF bit
+// for themselves, see writeProbe
+func AllowFragmentation(c *net.UDPConn) (err error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+	return setMTUDiscover(raw, syscall.IP_PMTUDISC_DONT, syscall.IPV6_PMTUDISC_DONT)
+}
+
+// the sockets are shared by conns, one probe at a time
+var probeMutex sync.Mutex
+
+// writeProbe sends b with the DF bit so that a too big probe gets lost
+// instead of fragmented and confirmed. The msgs other conns write meanwhile
+// get the bit too, a too big one is resent without it
+func writeProbe(c net.PacketConn, b []byte, addr net.Addr) (n int, err error) {
+	udp, ok := c.(*net.UDPConn)
+	if !ok {
+		return c.WriteTo(b, addr)
+	}
+	raw, err := udp.SyscallConn()
+	if err != nil {
+		return
+	}
+	probeMutex.Lock()
+	defer probeMutex.Unlock()
+	err = setMTUDiscover(raw, syscall.IP_PMTUDISC_PROBE, syscall.IPV6_PMTUDISC_PROBE)
+	if err != nil {
+		return
+	}
+	n, err = udp.WriteTo(b, addr)
+	if e := setMTUDiscover(raw, syscall.IP_PMTUDISC_DONT, syscall.IPV6_PMTUDISC_DONT); err == nil {
+		err = e
+	}
+	return
+}
+
+func setMTUDiscover(raw syscall.RawConn, v4, v6 int) (err error) {
+	cerr := raw.Control(func(fd uintptr) {
+		// the socket may be ipv4 only, ipv6 only or dual stack
+		err4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, v4)
+		err6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, v6)
+		if err4 != nil && err6 != nil {
+			err = err4
+		}
+	})
+	if err == nil {
+		err = cerr
+	}
+	return
+}
@@ -0,0 +1,36 @@
+package conn
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestWriteProbe(t *testing.T) {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = AllowFragmentation(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writeProbe(c, make([]byte, BASE_PLPMTU), c.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mode int
+	raw.Control(func(fd uintptr) {
+		mode, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the probe had the DF bit
+	if mode != syscall.IP_PMTUDISC_DONT {
+		t.Fatalf("mtu discover mode %d after the probe", mode)
+	}
+}
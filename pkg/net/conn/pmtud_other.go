@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package conn
+
+import "net"
+
+// AllowFragmentation is the default on this platform
+func AllowFragmentation(c *net.UDPConn) error {
+	return nil
+}
+
+// the DF bit can't be set on this platform, probes bigger than the path may
+// be fragmented and confirmed
+func writeProbe(c net.PacketConn, b []byte, addr net.Addr) (n int, err error) {
+	return c.WriteTo(b, addr)
+}
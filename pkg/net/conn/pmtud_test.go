@@ -0,0 +1,50 @@
+package conn
+
+import (
+	"testing"
+
+	"github.com/skycoin/skywire/pkg/net/msg"
+)
+
+func TestPMTUD(t *testing.T) {
+	const pathMTU = 1400
+	p := newPMTUD()
+	p.enable()
+	for i := 0; i < 100; i++ {
+		size := p.next()
+		if size == 0 {
+			break
+		}
+		if size <= pathMTU {
+			p.confirmed(size)
+		}
+	}
+	if s := p.size(); s > pathMTU || pathMTU-s > PMTUD_SEARCH_STEP {
+		t.Fatalf("plpmtu %d, path mtu %d", s, pathMTU)
+	}
+
+	for i := 0; i < PMTUD_BLACK_HOLE_RTOS-1; i++ {
+		if p.rto() {
+			t.Fatal("reset before black hole detection")
+		}
+	}
+	p.acked()
+	for i := 0; i < PMTUD_BLACK_HOLE_RTOS-1; i++ {
+		p.rto()
+	}
+	if !p.rto() || p.size() != BASE_PLPMTU {
+		t.Fatalf("plpmtu %d after black hole", p.size())
+	}
+}
+
+func TestPMTUD_Jumbo(t *testing.T) {
+	if s := maxPLPMTU(); s < MTU-IP_UDP_OVERHEAD || s > MAX_PLPMTU {
+		t.Fatalf("search bound %d", s)
+	}
+	// bodies bigger than the pooled buffers of a 1500 bytes link
+	m := msg.NewUDP(msg.TYPE_NORMAL, 1, make([]byte, MAX_PLPMTU-UDP_OVERHEAD))
+	p := m.PkgBytes()
+	if len(p) != msg.PKG_HEADER_SIZE+msg.UDP_HEADER_SIZE+MAX_PLPMTU-UDP_OVERHEAD || cap(p)-len(p) < MAX_AEAD_OVERHEAD {
+		t.Fatalf("pkg len %d cap %d", len(p), cap(p))
+	}
+}
@@ -0,0 +1,139 @@
+package conn
+
+import (
+	"crypto/aes"
+	cipher2 "crypto/cipher"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// ratchet derives a new AEAD key for every epoch by hashing the previous
+// key, old keys are dropped so recorded messages of past epochs can't be
+// decrypted with the current state. The sealing side moves to the next
+// epoch on its own, the opening side follows once a message opens with the
+// next key
+type ratchet struct {
+	epoch uint64
+	key   []byte
+	aead  cipher2.AEAD
+	prev  cipher2.AEAD
+	// derived once a message didn't open with the current key
+	nextKey []byte
+	next    cipher2.AEAD
+	// messages sealed in the epoch and when it began
+	sealed uint64
+	begin  time.Time
+	// ciphertext kept while trying the keys, a failed open overwrites it
+	scratch []byte
+	mtx     sync.Mutex
+}
+
+func newRatchet(key []byte) (r *ratchet, err error) {
+	r = &ratchet{key: key, begin: time.Now()}
+	r.aead, err = newGCM(key)
+	return
+}
+
+func newGCM(key []byte) (aead cipher2.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	return cipher2.NewGCM(block)
+}
+
+func nextRatchetKey(key []byte) []byte {
+	h := sha256.New()
+	h.Write(key)
+	h.Write([]byte("skywire rekey"))
+	return h.Sum(nil)
+}
+
+// seal returns the AEAD of the next outgoing message, with rekey the
+// epoch moves forward after REKEY_MSG_COUNT messages or REKEY_PERIOD
+func (r *ratchet) seal(rekey bool) (aead cipher2.AEAD, err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if rekey && (r.sealed >= REKEY_MSG_COUNT || time.Since(r.begin) >= REKEY_PERIOD) {
+		err = r._deriveNext()
+		if err != nil {
+			return
+		}
+		r._advance()
+	}
+	r.sealed++
+	aead = r.aead
+	return
+}
+
+// open calls fn with the AEAD of the current epoch and with rekey the ones
+// of the next and the previous epoch until one opens data, the peer may have
+// moved on and messages of the last epoch may still arrive. With advance a
+// message of the next epoch moves the ratchet forward
+func (r *ratchet) open(rekey, advance bool, data []byte, fn func(aead cipher2.AEAD) error) (err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if !rekey {
+		return fn(r.aead)
+	}
+	r.scratch = append(r.scratch[:0], data...)
+	err = fn(r.aead)
+	if err == nil {
+		return
+	}
+	if r.next == nil {
+		if e := r._deriveNext(); e != nil {
+			return e
+		}
+	}
+	copy(data, r.scratch)
+	err = fn(r.next)
+	if err == nil {
+		if advance {
+			r._advance()
+		}
+		return
+	}
+	if r.prev != nil {
+		copy(data, r.scratch)
+		err = fn(r.prev)
+	}
+	return
+}
+
+func (r *ratchet) _deriveNext() (err error) {
+	key := nextRatchetKey(r.key)
+	aead, err := newGCM(key)
+	if err != nil {
+		return
+	}
+	r.nextKey = key
+	r.next = aead
+	return
+}
+
+// call it after _deriveNext
+func (r *ratchet) _advance() {
+	r.epoch++
+	r.key = r.nextKey
+	r.prev = r.aead
+	r.aead = r.next
+	r.nextKey = nil
+	r.next = nil
+	r.sealed = 0
+	r.begin = time.Now()
+}
+
+func (r *ratchet) getEpoch() (epoch uint64) {
+	r.mtx.Lock()
+	epoch = r.epoch
+	r.mtx.Unlock()
+	return
+}
+
+func (r *ratchet) overhead() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.aead.Overhead()
+}
@@ -0,0 +1,120 @@
+package conn
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket of bytes/sec, one limiter may be shared by
+// several conns. Sending is allowed while the bucket is not empty and takes
+// the bytes sent, so the bucket runs into debt by at most a packet. A rate of
+// 0 is no limit.
+type RateLimiter struct {
+	rate   uint64
+	tokens float64
+	last   time.Time
+	mtx    sync.Mutex
+}
+
+func NewRateLimiter(rate uint64) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the rate at once, the bucket starts full when a limit is
+// set on an unlimited limiter
+func (l *RateLimiter) SetRate(rate uint64) {
+	l.mtx.Lock()
+	if l.rate == 0 {
+		l.tokens = l.burst(rate)
+	}
+	l.fill(time.Now())
+	l.rate = rate
+	if b := l.burst(rate); l.tokens > b {
+		l.tokens = b
+	}
+	l.mtx.Unlock()
+}
+
+func (l *RateLimiter) GetRate() (rate uint64) {
+	l.mtx.Lock()
+	rate = l.rate
+	l.mtx.Unlock()
+	return
+}
+
+// Delay returns how long to wait until sending is allowed, 0 if it is now
+func (l *RateLimiter) Delay() (d time.Duration) {
+	l.mtx.Lock()
+	d = l.delay(time.Now())
+	l.mtx.Unlock()
+	return
+}
+
+// Take counts n bytes sent
+func (l *RateLimiter) Take(n int) {
+	l.mtx.Lock()
+	if l.rate > 0 {
+		l.fill(time.Now())
+		l.tokens -= float64(n)
+	}
+	l.mtx.Unlock()
+}
+
+// Wait blocks until sending is allowed and takes n bytes, it returns false
+// if done is closed before
+func (l *RateLimiter) Wait(n int, done <-chan struct{}) bool {
+	for {
+		l.mtx.Lock()
+		now := time.Now()
+		d := l.delay(now)
+		if d == 0 {
+			if l.rate > 0 {
+				l.tokens -= float64(n)
+			}
+			l.mtx.Unlock()
+			return true
+		}
+		l.mtx.Unlock()
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-done:
+			t.Stop()
+			return false
+		}
+	}
+}
+
+// call it with mtx held
+func (l *RateLimiter) delay(now time.Time) time.Duration {
+	if l.rate == 0 {
+		return 0
+	}
+	l.fill(now)
+	if l.tokens > 0 {
+		return 0
+	}
+	return time.Duration((1 - l.tokens) * float64(time.Second) / float64(l.rate))
+}
+
+// call it with mtx held
+func (l *RateLimiter) fill(now time.Time) {
+	if l.rate > 0 && now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if b := l.burst(l.rate); l.tokens > b {
+			l.tokens = b
+		}
+	}
+	l.last = now
+}
+
+// the bucket holds the bytes of RATE_LIMIT_BURST, at least a packet
+func (l *RateLimiter) burst(rate uint64) float64 {
+	b := float64(rate) * RATE_LIMIT_BURST.Seconds()
+	if b < MAX_PLPMTU {
+		b = MAX_PLPMTU
+	}
+	return b
+}
@@ -0,0 +1,55 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	const rate = 1024 * 1024
+	l := NewRateLimiter(rate)
+	if d := l.Delay(); d != 0 {
+		t.Fatalf("full bucket delays %s", d)
+	}
+	// a ms in debt
+	l.Take(int(rate*RATE_LIMIT_BURST.Seconds()) + rate/1000)
+	d := l.Delay()
+	if d <= 0 || d > time.Millisecond {
+		t.Fatalf("bucket 1ms in debt delays %s", d)
+	}
+	l.Take(rate / 10)
+	if d = l.Delay(); d < 90*time.Millisecond || d > 110*time.Millisecond {
+		t.Fatalf("bucket 100ms in debt delays %s", d)
+	}
+	l.SetRate(0)
+	if d = l.Delay(); d != 0 {
+		t.Fatalf("unlimited delays %s", d)
+	}
+	l.Take(rate)
+	if d = l.Delay(); d != 0 {
+		t.Fatalf("unlimited delays %s after a take", d)
+	}
+}
+
+func TestRateLimiter_Wait(t *testing.T) {
+	const rate = 1024 * 1024
+	l := NewRateLimiter(rate)
+	start := time.Now()
+	for sent := 0; sent < rate/2; sent += BASE_PLPMTU {
+		if !l.Wait(BASE_PLPMTU, nil) {
+			t.Fatal("wait failed")
+		}
+	}
+	// the burst goes at once, the rest at rate
+	min := time.Second/2 - RATE_LIMIT_BURST - 10*time.Millisecond
+	if e := time.Since(start); e < min || e > 2*min {
+		t.Fatalf("%d bytes in %s at %d B/s", rate/2, e, rate)
+	}
+
+	done := make(chan struct{})
+	close(done)
+	l.Take(rate)
+	if l.Wait(BASE_PLPMTU, done) {
+		t.Fatal("wait of a limiter in debt did not stop")
+	}
+}
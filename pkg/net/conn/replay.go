@@ -0,0 +1,91 @@
+package conn
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	replayWindowWordBits = 64
+	replayWindowWords    = 256
+	replayWindowSize     = replayWindowWordBits * (replayWindowWords - 1)
+)
+
+var ErrReplay = errors.New("replayed or too old sequence")
+
+// sliding window of authenticated sequence numbers, rejects duplicates and
+// sequences older than replayWindowSize
+type replayWindow struct {
+	highest uint64
+	bitmap  [replayWindowWords]uint64
+	used    bool
+	mtx     sync.Mutex
+}
+
+// check returns ErrReplay if seq has been seen or fell out of the window
+func (w *replayWindow) check(seq uint64) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w._check(seq)
+}
+
+func (w *replayWindow) _check(seq uint64) error {
+	if !w.used || seq > w.highest {
+		return nil
+	}
+	if w.highest-seq >= replayWindowSize {
+		return ErrReplay
+	}
+	index := (seq / replayWindowWordBits) % replayWindowWords
+	if w.bitmap[index]&(1<<(seq%replayWindowWordBits)) > 0 {
+		return ErrReplay
+	}
+	return nil
+}
+
+// update marks seq as seen, call it after the packet has been authenticated
+func (w *replayWindow) update(seq uint64) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	err := w._check(seq)
+	if err != nil {
+		return err
+	}
+	index := seq / replayWindowWordBits
+	if !w.used || seq > w.highest {
+		current := w.highest / replayWindowWordBits
+		diff := index - current
+		if !w.used || diff > replayWindowWords {
+			diff = replayWindowWords
+		}
+		for i := uint64(1); i <= diff; i++ {
+			w.bitmap[(current+i)%replayWindowWords] = 0
+		}
+		w.highest = seq
+		w.used = true
+	}
+	w.bitmap[index%replayWindowWords] |= 1 << (seq % replayWindowWordBits)
+	return nil
+}
+
+// expand returns the full seq whose low 32 bits are seq, taking the one
+// nearest to the highest seq seen
+func (w *replayWindow) expand(seq uint32) uint64 {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if !w.used {
+		return uint64(seq)
+	}
+	return expandSeq(w.highest, seq)
+}
+
+func expandSeq(highest uint64, seq uint32) (full uint64) {
+	const span = 1 << 32
+	full = highest&^(span-1) | uint64(seq)
+	if full+span/2 <= highest {
+		full += span
+	} else if full > highest+span/2 && full >= span {
+		full -= span
+	}
+	return
+}
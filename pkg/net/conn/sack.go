@@ -0,0 +1,78 @@
+package conn
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/skycoin/skywire/pkg/net/msg"
+)
+
+// sackRange is an inclusive range of received seqs
+type sackRange struct {
+	begin uint32
+	end   uint32
+}
+
+func (r sackRange) contains(seq uint32) bool {
+	return seq >= r.begin && seq <= r.end
+}
+
+// convert the 32 bits mask of the ack header, bit 0 is start
+func maskToRanges(start, mask uint32) (ranges []sackRange) {
+	for i := uint32(0); mask > 0; i++ {
+		if mask&1 > 0 {
+			n := start + i
+			l := len(ranges)
+			if l > 0 && ranges[l-1].end+1 == n {
+				ranges[l-1].end = n
+			} else {
+				ranges = append(ranges, sackRange{begin: n, end: n})
+			}
+		}
+		mask >>= 1
+	}
+	return
+}
+
+func sackMsg(seq, ns uint32, ranges []sackRange) (p []byte) {
+	if len(ranges) > msg.MAX_SACK_RANGES {
+		ranges = ranges[:msg.MAX_SACK_RANGES]
+	}
+	p = make([]byte, msg.PKG_HEADER_SIZE+msg.SACK_HEADER_SIZE+len(ranges)*msg.SACK_RANGE_SIZE)
+	m := p[msg.PKG_HEADER_SIZE:]
+	m[msg.SACK_TYPE_BEGIN] = msg.TYPE_SACK
+	binary.BigEndian.PutUint32(m[msg.SACK_SEQ_BEGIN:], seq)
+	binary.BigEndian.PutUint32(m[msg.SACK_NEXT_SEQ_BEGIN:], ns)
+	m[msg.SACK_RANGE_COUNT_BEGIN] = byte(len(ranges))
+	b := m[msg.SACK_HEADER_END:]
+	for i, r := range ranges {
+		binary.BigEndian.PutUint32(b[i*msg.SACK_RANGE_SIZE:], r.begin)
+		binary.BigEndian.PutUint32(b[i*msg.SACK_RANGE_SIZE+msg.MSG_SEQ_SIZE:], r.end)
+	}
+	return
+}
+
+func parseSackMsg(m []byte) (seq, ns uint32, ranges []sackRange, err error) {
+	if len(m) < msg.SACK_HEADER_SIZE {
+		err = fmt.Errorf("invalid sack msg %x", m)
+		return
+	}
+	seq = binary.BigEndian.Uint32(m[msg.SACK_SEQ_BEGIN:msg.SACK_SEQ_END])
+	ns = binary.BigEndian.Uint32(m[msg.SACK_NEXT_SEQ_BEGIN:msg.SACK_NEXT_SEQ_END])
+	count := int(m[msg.SACK_RANGE_COUNT_BEGIN])
+	b := m[msg.SACK_HEADER_END:]
+	if count > msg.MAX_SACK_RANGES || len(b) < count*msg.SACK_RANGE_SIZE {
+		err = fmt.Errorf("invalid sack msg %x", m)
+		return
+	}
+	ranges = make([]sackRange, count)
+	for i := range ranges {
+		ranges[i].begin = binary.BigEndian.Uint32(b[i*msg.SACK_RANGE_SIZE:])
+		ranges[i].end = binary.BigEndian.Uint32(b[i*msg.SACK_RANGE_SIZE+msg.MSG_SEQ_SIZE:])
+		if ranges[i].begin > ranges[i].end {
+			err = fmt.Errorf("invalid sack range %d-%d", ranges[i].begin, ranges[i].end)
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,86 @@
+package conn
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the counters of a connection, the udp fields are
+// zero for tcp connections
+type Stats struct {
+	Type          string `json:"type"`
+	RemoteAddr    string `json:"remote_addr"`
+	SentBytes     uint64 `json:"sent_bytes"`
+	ReceivedBytes uint64 `json:"received_bytes"`
+	// unix time of the last read
+	LastTime      int64  `json:"last_time"`
+	AuthFailCount uint32 `json:"auth_fail_count"`
+	// msgs offered to compression, uncompressed bytes / compressed bytes
+	UncompressedBytes uint64  `json:"uncompressed_bytes"`
+	CompressedBytes   uint64  `json:"compressed_bytes"`
+	CompressionRatio  float64 `json:"compression_ratio"`
+
+	RTT time.Duration `json:"rtt"`
+	RTO time.Duration `json:"rto"`
+	// in msgs
+	Cwnd     uint32 `json:"cwnd"`
+	UsedCwnd uint32 `json:"used_cwnd"`
+	// bytes/sec
+	PacingRate      uint64 `json:"pacing_rate"`
+	BytesInFlight   int    `json:"bytes_in_flight"`
+	RTOResendCount  uint32 `json:"rto_resend_count"`
+	LossResendCount uint32 `json:"loss_resend_count"`
+	AckCount        uint32 `json:"ack_count"`
+	OverAckCount    uint32 `json:"over_ack_count"`
+	ReplayCount     uint32 `json:"replay_count"`
+	PLPMTU          int    `json:"plpmtu"`
+	PayloadSize     int    `json:"payload_size"`
+	ConnID          uint32 `json:"conn_id"`
+	// fragmented msgs dropped by the reassembler
+	ReassemblyDropCount uint32 `json:"reassembly_drop_count"`
+}
+
+func (c *ConnCommonFields) Stats() (s Stats) {
+	s.SentBytes = c.GetSentBytes()
+	s.ReceivedBytes = c.GetReceivedBytes()
+	s.LastTime = c.GetLastTime()
+	s.UncompressedBytes = atomic.LoadUint64(&c.uncompressedBytes)
+	s.CompressedBytes = atomic.LoadUint64(&c.compressedBytes)
+	if s.CompressedBytes > 0 {
+		s.CompressionRatio = float64(s.UncompressedBytes) / float64(s.CompressedBytes)
+	}
+	return
+}
+
+func (c *TCPConn) Stats() (s Stats) {
+	s = c.ConnCommonFields.Stats()
+	s.Type = "tcp"
+	s.RemoteAddr = c.GetRemoteAddr().String()
+	s.AuthFailCount = atomic.LoadUint32(&c.authFailCount)
+	return
+}
+
+func (c *UDPConn) Stats() (s Stats) {
+	s = c.ConnCommonFields.Stats()
+	s.Type = "udp"
+	if addr := c.getAddr(); addr != nil {
+		s.RemoteAddr = addr.String()
+	}
+	s.AuthFailCount = atomic.LoadUint32(&c.authFailCount)
+	s.RTT = c.getRTT()
+	s.RTO = c.getRTO()
+	s.Cwnd = c.getCwnd()
+	s.UsedCwnd = c.getUsedCwnd()
+	s.PacingRate = c.getPacingRate()
+	s.BytesInFlight = c.getBytesInFlight()
+	s.RTOResendCount = atomic.LoadUint32(&c.rtoResendCount)
+	s.LossResendCount = atomic.LoadUint32(&c.lossResendCount)
+	s.AckCount = atomic.LoadUint32(&c.ackCount)
+	s.OverAckCount = atomic.LoadUint32(&c.overAckCount)
+	s.ReplayCount = atomic.LoadUint32(&c.replayCount)
+	s.ReassemblyDropCount = atomic.LoadUint32(&c.reassemblyDropCount)
+	s.PLPMTU = c.pmtud.size()
+	s.PayloadSize = c.GetPayloadSize()
+	s.ConnID = c.GetConnID()
+	return
+}
@@ -13,6 +13,7 @@ type streamQueue interface {
 	Len() (s int)
 	GetNextAckSeq() (s uint32)
 	GetAckedSeqs(start, end uint32) (mask uint32)
+	GetAckedRanges(start uint32, max int) (ranges []sackRange)
 }
 
 type packet struct {
@@ -24,47 +25,26 @@ func (a packet) Less(b btree.Item) bool {
 	return a.seq < b.(packet).seq
 }
 
-type fecStreamQueue struct {
-	dataShards   uint32
-	parityShards uint32
-	shardSize    uint32
-
+// deliver msgs in seq order
+type orderedStreamQueue struct {
 	ackedSeq uint32
 	msgs     *btree.BTree
 	mutex    sync.RWMutex
 }
 
-func newFECStreamQueue(dataShards, parityShards uint32) *fecStreamQueue {
-	return &fecStreamQueue{
-		dataShards:   dataShards,
-		parityShards: parityShards,
-		shardSize:    dataShards + parityShards,
-		msgs:         btree.New(2),
-	}
-}
-
-func (q *fecStreamQueue) _getDataShardSeq(seq uint32) (s uint32) {
-	ss := seq - 1
-	i := ss / q.shardSize
-	j := ss % q.shardSize
-	if j >= q.dataShards {
-		s = (i+1)*q.shardSize + 1
-	} else {
-		s = seq
+func newOrderedStreamQueue() *orderedStreamQueue {
+	return &orderedStreamQueue{
+		msgs: btree.New(2),
 	}
-	return
 }
 
-func (q *fecStreamQueue) _getNextAckSeq() (s uint32) {
-	return q._getDataShardSeq(q.ackedSeq + 1)
+func (q *orderedStreamQueue) _getNextAckSeq() (s uint32) {
+	return q.ackedSeq + 1
 }
 
-func (q *fecStreamQueue) Push(k uint32, m *msg.UDPMessage) (ok bool, msgs []*msg.UDPMessage) {
-	if (k-1)%q.shardSize >= q.dataShards {
-		return
-	}
+func (q *orderedStreamQueue) Push(k uint32, m *msg.UDPMessage) (ok bool, msgs []*msg.UDPMessage) {
 	defer func() {
-		logrus.Debugf("fecStreamQueue return %t, len %d, push k %d, next %d ", ok, len(msgs), k, q._getNextAckSeq())
+		logrus.Debugf("orderedStreamQueue return %t, len %d, push k %d, next %d ", ok, len(msgs), k, q._getNextAckSeq())
 	}()
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
@@ -86,7 +66,7 @@ func (q *fecStreamQueue) Push(k uint32, m *msg.UDPMessage) (ok bool, msgs []*msg
 	return
 }
 
-func (q *fecStreamQueue) pop() (msgs []*msg.UDPMessage) {
+func (q *orderedStreamQueue) pop() (msgs []*msg.UDPMessage) {
 	for i := q._getNextAckSeq(); ; i = q._getNextAckSeq() {
 		min, ok := q.msgs.Min().(packet)
 		if !ok {
@@ -106,28 +86,28 @@ func (q *fecStreamQueue) pop() (msgs []*msg.UDPMessage) {
 	return
 }
 
-func (q *fecStreamQueue) push(k uint32, m *msg.UDPMessage) {
+func (q *orderedStreamQueue) push(k uint32, m *msg.UDPMessage) {
 	q.msgs.ReplaceOrInsert(packet{
 		seq:  k,
 		data: m,
 	})
 }
 
-func (q *fecStreamQueue) Len() (s int) {
+func (q *orderedStreamQueue) Len() (s int) {
 	q.mutex.RLock()
 	s = q.msgs.Len()
 	q.mutex.RUnlock()
 	return
 }
 
-func (q *fecStreamQueue) GetNextAckSeq() (s uint32) {
+func (q *orderedStreamQueue) GetNextAckSeq() (s uint32) {
 	q.mutex.RLock()
 	s = q._getNextAckSeq()
 	q.mutex.RUnlock()
 	return
 }
 
-func (q *fecStreamQueue) GetAckedSeqs(start, end uint32) (mask uint32) {
+func (q *orderedStreamQueue) GetAckedSeqs(start, end uint32) (mask uint32) {
 	if end-start > 32 {
 		end = start + 32
 	}
@@ -143,3 +123,26 @@ func (q *fecStreamQueue) GetAckedSeqs(start, end uint32) (mask uint32) {
 	})
 	return
 }
+
+// GetAckedRanges returns at most max ranges of the received seqs from start
+func (q *orderedStreamQueue) GetAckedRanges(start uint32, max int) (ranges []sackRange) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	q.msgs.AscendGreaterOrEqual(packet{seq: start}, func(i btree.Item) bool {
+		p, ok := i.(packet)
+		if !ok {
+			return true
+		}
+		l := len(ranges)
+		if l > 0 && ranges[l-1].end+1 == p.seq {
+			ranges[l-1].end = p.seq
+			return true
+		}
+		if l >= max {
+			return false
+		}
+		ranges = append(ranges, sackRange{begin: p.seq, end: p.seq})
+		return true
+	})
+	return
+}
@@ -18,6 +18,8 @@ const (
 type TCPConn struct {
 	*ConnCommonFields
 	TcpConn net.Conn
+
+	authFailCount uint32
 }
 
 func (c *TCPConn) ReadLoop() (err error) {
@@ -45,18 +47,14 @@ func (c *TCPConn) ReadLoop() (err error) {
 			n := msg.PING_MSG_HEADER_END
 			reader.Discard(n)
 			c.AddReceivedBytes(n)
-		case msg.TYPE_SYN, msg.TYPE_NORMAL:
-			err = c.ReadBytes(reader, header, msg.MSG_HEADER_SIZE)
+		case msg.TYPE_SYN, msg.TYPE_NORMAL, msg.TYPE_AEAD:
+			body, err := c.ReadMsg(reader, header)
 			if err != nil {
 				return err
 			}
-
-			m := msg.NewByHeader(header)
-			err = c.ReadBytes(reader, m.Body, int(m.Len))
-			if err != nil {
-				return err
+			if body != nil {
+				c.In <- body
 			}
-			c.In <- m.Body
 		default:
 			c.GetContextLogger().Debugf("not implemented msg type %d", t)
 			return fmt.Errorf("not implemented msg type %d", msg_t)
@@ -88,8 +86,8 @@ func (c *TCPConn) WriteLoop() (err error) {
 	}
 }
 
-func getTCPReadDeadline() time.Time {
-	return time.Now().Add(time.Second * TCP_READ_TIMEOUT)
+func (c *TCPConn) getReadDeadline() time.Time {
+	return time.Now().Add(c.GetOptions().TCPReadTimeout)
 }
 
 func (c *TCPConn) ReadBytes(r io.Reader, buf []byte, min int) (err error) {
@@ -101,21 +99,82 @@ func (c *TCPConn) ReadBytes(r io.Reader, buf []byte, min int) (err error) {
 	return
 }
 
+// ReadMsg reads one message, the body is nil if the message failed authentication
+func (c *TCPConn) ReadMsg(reader io.Reader, header []byte) (body []byte, err error) {
+	err = c.ReadBytes(reader, header, msg.MSG_HEADER_SIZE)
+	if err != nil {
+		return
+	}
+
+	m := msg.NewByHeader(header)
+	err = c.ReadBytes(reader, m.Body, int(m.Len))
+	if err != nil {
+		return
+	}
+	crypto := c.GetCrypto()
+	switch m.Type {
+	case msg.TYPE_AEAD:
+		if crypto == nil {
+			c.AddAuthFailCount()
+			return
+		}
+		body, err = crypto.Open(m.GetSeq(), header, m.Body)
+		if err != nil {
+			c.GetContextLogger().Debugf("open msg seq %d err %v", m.GetSeq(), err)
+			c.AddAuthFailCount()
+			body, err = nil, nil
+		}
+		return
+	case msg.TYPE_NORMAL:
+		if crypto != nil && crypto.IsAEAD() {
+			c.GetContextLogger().Debugf("unauthenticated msg seq %d", m.GetSeq())
+			c.AddAuthFailCount()
+			return
+		}
+	}
+	body = m.Body
+	return
+}
+
 func (c *TCPConn) Write(bytes []byte) error {
-	s := atomic.AddUint32(&c.seq, 1)
-	m := msg.New(msg.TYPE_NORMAL, s, bytes)
+	crypto := c.GetCrypto()
+	if crypto != nil && crypto.IsAEAD() {
+		// seqs are sealed in the order they go out
+		c.WriteMutex.Lock()
+		defer c.WriteMutex.Unlock()
+		s := atomic.AddUint64(&c.seq, 1)
+		m := msg.New(msg.TYPE_AEAD, uint32(s), make([]byte, len(bytes), len(bytes)+crypto.Overhead()))
+		copy(m.Body, bytes)
+		m.Len += uint32(crypto.Overhead())
+		sealed, err := crypto.Seal(s, m.HeaderBytes(), m.Body)
+		if err != nil {
+			return err
+		}
+		m.Body = sealed
+		return c._writeDirectly(m.Bytes())
+	}
+	s := atomic.AddUint64(&c.seq, 1)
+	m := msg.New(msg.TYPE_NORMAL, uint32(s), bytes)
 	return c.WriteBytes(m.Bytes())
 }
 
+func (c *TCPConn) WriteToChannel(channel int, bytes []byte) error {
+	return c.Write(bytes)
+}
+
 func (c *TCPConn) WriteSyn(bytes []byte) error {
-	s := atomic.AddUint32(&c.seq, 1)
-	m := msg.New(msg.TYPE_SYN, s, bytes)
+	s := atomic.AddUint64(&c.seq, 1)
+	m := msg.New(msg.TYPE_SYN, uint32(s), bytes)
 	return c.writeDirectly(m.Bytes())
 }
 
 func (c *TCPConn) writeDirectly(bytes []byte) (err error) {
 	c.WriteMutex.Lock()
 	defer c.WriteMutex.Unlock()
+	return c._writeDirectly(bytes)
+}
+
+func (c *TCPConn) _writeDirectly(bytes []byte) (err error) {
 	for index := 0; index != len(bytes); {
 		n, err := c.TcpConn.Write(bytes[index:])
 		if err != nil {
@@ -129,7 +188,7 @@ func (c *TCPConn) writeDirectly(bytes []byte) (err error) {
 
 func (c *TCPConn) WriteBytes(bytes []byte) (err error) {
 	crypto := c.GetCrypto()
-	if crypto != nil {
+	if crypto != nil && !crypto.IsAEAD() {
 		err = crypto.Encrypt(bytes)
 		if err != nil {
 			return
@@ -139,12 +198,16 @@ func (c *TCPConn) WriteBytes(bytes []byte) (err error) {
 	return
 }
 
+func (c *TCPConn) AddAuthFailCount() {
+	atomic.AddUint32(&c.authFailCount, 1)
+}
+
 func (c *TCPConn) Ping() error {
 	return c.WriteBytes(msg.GenPingMsg())
 }
 
 func (c *TCPConn) UpdateLastTime() {
-	c.TcpConn.SetReadDeadline(getTCPReadDeadline())
+	c.TcpConn.SetReadDeadline(c.getReadDeadline())
 	c.ConnCommonFields.UpdateLastTime()
 }
 
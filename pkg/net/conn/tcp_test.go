@@ -0,0 +1,35 @@
+package conn
+
+import (
+	"net"
+	"testing"
+)
+
+// the channel calls of the transports work on tcp conns, they have one
+// stream
+func TestTCPConn_Channels(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := &TCPConn{TcpConn: a, ConnCommonFields: NewConnCommonFileds()}
+	channel := c.NewPendingChannel()
+	if err := c.SetChannelPriority(channel, 1); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.WriteToChannel(channel, []byte("hello"))
+	}()
+	buf := make([]byte, 64)
+	n, err := b.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n < 5 || string(buf[n-5:n]) != "hello" {
+		t.Fatalf("wrote %x", buf[:n])
+	}
+	c.DeletePendingChannel(channel)
+}
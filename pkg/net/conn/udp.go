@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"math"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -13,15 +14,19 @@ import (
 	"github.com/google/btree"
 	"github.com/sirupsen/logrus"
 	"github.com/skycoin/skywire/pkg/net/msg"
+	"github.com/skycoin/skywire/pkg/net/wheel"
 )
 
 type UDPConn struct {
 	*ConnCommonFields
 	*UDPPendingMap
 	streamQueue
-	UdpConn         *net.UDPConn
+	UdpConn         net.PacketConn
 	UnsharedUdpConn bool
 	addr            *net.UDPAddr
+	addrMutex       sync.RWMutex
+	// 0 if the peer doesn't send one
+	connID uint32
 
 	// write loop with ping
 	SendPing bool
@@ -32,58 +37,126 @@ type UDPConn struct {
 	lossResendCount uint32
 	ackCount        uint32
 	overAckCount    uint32
-
-	lastAck     uint32
-	lastCnt     uint32
-	lastCnted   uint32
-	lastAckCond *sync.Cond
-	lastAckMtx  sync.Mutex
+	authFailCount   uint32
+	replayCount     uint32
+	// fragmented msgs dropped by the reassembler
+	reassemblyDropCount uint32
+
+	lastAck    uint32
+	lastCnt    uint32
+	lastCnted  uint32
+	lastAckMtx sync.Mutex
+	// 1 while ackTimer is armed
+	ackScheduled int32
+	// 1 if acks are sent as TYPE_SACK
+	peerSAck int32
+	// 1 if msgs bigger than a packet are sent as fragments
+	peerReassembly int32
+	fragID         uint32
+	reassembler    *reassembler
+
+	// 1 if the msgs written wait in their channels until SetCrypto
+	holdSends int32
 
 	// congestion algorithm
 	*ca
-	pacingTimer      *time.Timer
-	pacingTimerMutex sync.Mutex
-	pacingChan       chan struct{}
+	pacingChan chan struct{}
+	// the ack timer asks WriteLoop to send the acks through it
+	ackChan chan struct{}
+
+	// drives the delayed acks, rto resends and pacing, its callbacks only
+	// queue work and wake WriteLoop, the socket is written by WriteLoop
+	wheel       *wheel.Wheel
+	ackTimer    *wheel.Timer
+	pacingTimer *wheel.Timer
 
 	// fec
 	*fecEncoder
 	*fecDecoder
 
+	pmtud *pmtud
+
+	// shape the msgs sent
+	rateLimiters []*RateLimiter
+
+	// packets of writePendingMsgs waiting for flushBytes, copied to the
+	// buffers of the batch
+	batch     []Datagram
+	batchBufs [][]byte
+	batchConn BatchConn
+
 	closed bool
 
 	// callbacks
 	BeforeSend func(m *msg.UDPMessage)
 	BeforeRead func(m *msg.UDPMessage)
+	// the conn moved to a new remote address
+	OnMigrate func(from, to *net.UDPAddr)
 }
 
-const (
-	dataShards   = 4
-	parityShards = 1
-)
-
 // used for server spawn udp conn
-func NewUDPConn(c *net.UDPConn, addr *net.UDPAddr) *UDPConn {
+func NewUDPConn(c net.PacketConn, addr *net.UDPAddr) *UDPConn {
 	conn := &UDPConn{
 		UdpConn:          c,
 		addr:             addr,
 		ConnCommonFields: NewConnCommonFileds(),
 		UDPPendingMap:    NewUDPPendingMap(),
-		streamQueue:      newFECStreamQueue(dataShards, parityShards),
+		streamQueue:      newOrderedStreamQueue(),
 		rto:              300 * time.Millisecond,
-		fecEncoder:       newFECEncoder(dataShards, parityShards),
-		fecDecoder:       newFECDecoder(dataShards, parityShards),
+		fecEncoder:       newFECEncoder(),
+		fecDecoder:       newFECDecoder(),
+		pmtud:            newPMTUD(),
+		reassembler:      newReassembler(),
 	}
 	conn.ca = newCA()
-	conn.pacingTimer = time.NewTimer(0)
-	if !conn.pacingTimer.Stop() {
-		<-conn.pacingTimer.C
-	}
 	conn.pacingChan = make(chan struct{}, 1)
-	conn.lastAckCond = sync.NewCond(&conn.lastAckMtx)
-	go conn.ackLoop()
+	conn.ackChan = make(chan struct{}, 1)
+	conn.SetTimerWheel(wheel.Default)
 	return conn
 }
 
+// SetTimerWheel moves the timers of the conn to w, call it before the first
+// write
+func (c *UDPConn) SetTimerWheel(w *wheel.Wheel) {
+	if c.ackTimer != nil {
+		c.ackTimer.Stop()
+		c.pacingTimer.Stop()
+	}
+	c.wheel = w
+	c.ackTimer = w.NewTimer(c.ackCallback)
+	c.pacingTimer = w.NewTimer(c.wakeWriter)
+}
+
+// wakeWriter makes WriteLoop write the pending msgs, it does not block
+func (c *UDPConn) wakeWriter() {
+	select {
+	case c.pacingChan <- struct{}{}:
+	default:
+	}
+}
+
+// HoldUntilCrypto keeps the msgs written in their channels until SetCrypto,
+// none goes out unsealed or sealed under keys that are replaced
+func (c *UDPConn) HoldUntilCrypto() {
+	atomic.StoreInt32(&c.holdSends, 1)
+}
+
+func (c *UDPConn) isHeld() bool {
+	return atomic.LoadInt32(&c.holdSends) == 1 && c.GetCrypto() == nil
+}
+
+// SetCrypto wakes WriteLoop for the msgs held until now
+func (c *UDPConn) SetCrypto(crypto *Crypto) {
+	c.ConnCommonFields.SetCrypto(crypto)
+	c.wakeWriter()
+}
+
+// SetCongestionController replaces the default BBR controller, call it
+// before the first write
+func (c *UDPConn) SetCongestionController(cc CongestionController) {
+	c.ca.setCongestionController(cc)
+}
+
 func (c *UDPConn) ReadLoop() error {
 	return nil
 }
@@ -91,8 +164,9 @@ func (c *UDPConn) ReadLoop() error {
 func (c *UDPConn) WriteLoop() (err error) {
 	var pingTicker *time.Ticker
 	var pingTickerChan <-chan time.Time
+	options := c.GetOptions()
 	if c.SendPing {
-		pingTicker = time.NewTicker(time.Second * UDP_PING_TICK_PERIOD)
+		pingTicker = time.NewTicker(options.UDPPingTickPeriod)
 		pingTickerChan = pingTicker.C
 	}
 	defer func() {
@@ -111,12 +185,11 @@ func (c *UDPConn) WriteLoop() (err error) {
 			if c.GetCrypto() == nil {
 				continue
 			}
-			nowUnix := time.Now().Unix()
-			lastTime := c.GetLastTime()
-			if nowUnix-lastTime >= UDP_GC_PERIOD {
+			idle := time.Since(time.Unix(c.GetLastTime(), 0))
+			if idle >= options.UDPGCPeriod {
 				c.Close()
 				return errors.New("timeout")
-			} else if nowUnix-lastTime < UDP_PING_TICK_PERIOD {
+			} else if idle < options.UDPPingTickPeriod {
 				continue
 			}
 			err := c.Ping()
@@ -138,12 +211,10 @@ func (c *UDPConn) WriteLoop() (err error) {
 				c.SetStatusToError(err)
 				c.Close()
 			}
-		case <-c.pacingTimer.C:
-			err := c.writePendingMsgs()
-			if err != nil {
-				c.SetStatusToError(err)
-				c.Close()
-			}
+		case <-c.ackChan:
+			c.sendAck()
+		case <-c.pmtud.timer.C:
+			c.probe()
 		}
 	}
 }
@@ -159,37 +230,27 @@ func (c *UDPConn) ackReady() (seq uint32, ok bool) {
 	return
 }
 
-func (c *UDPConn) ackLoop() (err error) {
-	t := time.NewTicker(2 * time.Millisecond)
-	defer func() {
-		t.Stop()
-		if err != nil {
-			c.SetStatusToError(err)
-		}
-	}()
+// ackCallback runs on the wheel, WriteLoop sends the acks gathered since
+// the timer was armed
+func (c *UDPConn) ackCallback() {
+	atomic.StoreInt32(&c.ackScheduled, 0)
+	select {
+	case c.ackChan <- struct{}{}:
+	default:
+	}
+}
 
-	for {
-		select {
-		case <-t.C:
-			la, ok := c.ackReady()
-			if ok {
-				err = c.ack(la)
-				if err != nil {
-					return
-				}
-			} else {
-				t.Stop()
-				c.lastAckMtx.Lock()
-				c.lastAckCond.Wait()
-				c.lastAckMtx.Unlock()
-				if c.IsClosed() {
-					return
-				}
-				t = time.NewTicker(2 * time.Millisecond)
-			}
-		case <-c.disconnected:
-			return
-		}
+func (c *UDPConn) sendAck() {
+	if c.IsClosed() {
+		return
+	}
+	la, ok := c.ackReady()
+	if !ok {
+		return
+	}
+	err := c.ack(la)
+	if err != nil {
+		c.SetStatusToError(err)
 	}
 }
 
@@ -203,15 +264,21 @@ func (c *UDPConn) WriteToChannel(channel int, bytes []byte) (err error) {
 	return
 }
 
+// msgs bigger than the payload size are split, peers that reassemble get
+// fragments delivered as one msg
 func (c *UDPConn) writeToChannel(channel int, bytes []byte, msgt byte) (err error) {
-	if len(bytes) > MAX_UDP_PACKAGE_SIZE {
-		for i := 0; i < len(bytes)/MAX_UDP_PACKAGE_SIZE; i++ {
-			err = c.addToChannel(channel, bytes[i*MAX_UDP_PACKAGE_SIZE:(i+1)*MAX_UDP_PACKAGE_SIZE], msgt)
+	size := c.GetPayloadSize()
+	if len(bytes) > size && c.isPeerReassembly() {
+		return c.writeFragments(channel, bytes, msgt, size)
+	}
+	if len(bytes) > size {
+		for i := 0; i < len(bytes)/size; i++ {
+			err = c.addToChannel(channel, bytes[i*size:(i+1)*size], msgt)
 			if err != nil {
 				return
 			}
 		}
-		i := len(bytes) % MAX_UDP_PACKAGE_SIZE
+		i := len(bytes) % size
 		if i > 0 {
 			err = c.addToChannel(channel, bytes[len(bytes)-i:], msgt)
 			if err != nil {
@@ -225,30 +292,30 @@ func (c *UDPConn) writeToChannel(channel int, bytes []byte, msgt byte) (err erro
 }
 
 func (c *UDPConn) addToChannel(channel int, bytes []byte, msgt byte) (err error) {
-	m := msg.NewUDPWithoutSeq(msgt, bytes)
-	c.addToPendingChannel(channel, m)
-	c.pacingChan <- struct{}{}
+	c.addMsgToChannel(channel, msg.NewUDPWithoutSeq(msgt, bytes))
 	return
 }
 
+func (c *UDPConn) addMsgToChannel(channel int, m *msg.UDPMessage) {
+	c.addToPendingChannel(channel, m)
+	// a closed conn has no writer to wake
+	c.wakeWriter()
+}
+
+// resendCallback runs on the wheel, the msg is queued for WriteLoop
 func (c *UDPConn) resendCallback(m *msg.UDPMessage) (err error) {
 	c.AddRTOResendCount()
-	err = c.resendMsg(m)
-	if err != nil {
-		c.SetStatusToError(err)
-		c.Close()
+	if c.pmtud.rto() {
+		c.GetContextLogger().Debugf("pmtud black hole, size %d", BASE_PLPMTU)
 	}
-	return
+	return c.resendMsg(m)
 }
 
 func (c *UDPConn) transmitted(m *msg.UDPMessage) {
-	seq := m.GetSeq()
-	c.ca.updateLastSentSeq(seq)
-	c.ca.checkAppLimited(seq)
-	c.addMsg(seq, m)
+	c.ca.onSend(m)
+	c.addMsg(m.GetSeq(), m)
 	m.Transmitted()
-	m.SetRTO(c.getRTO(), c.resendCallback)
-	m.UpdateState(c.getDelivered(), c.getDeliveredTime(), c.getSentTime())
+	m.SetRTO(c.wheel, c.getRTO(), c.resendCallback)
 }
 
 func (c *UDPConn) resendMsg(m *msg.UDPMessage) (err error) {
@@ -256,17 +323,30 @@ func (c *UDPConn) resendMsg(m *msg.UDPMessage) (err error) {
 		return
 	}
 	m.Loss()
+	c.ca.onLoss(m)
 	c.GetContextLogger().Debugf("resendMsg %s", m)
 	c.addToResendChannel(m)
-	c.pacingChan <- struct{}{}
+	// called by the rto timer too
+	c.wakeWriter()
 	return
 }
 
 func (c *UDPConn) writePendingMsgs() (err error) {
 	c.ca.nextPacingMutex.Lock()
 	defer c.ca.nextPacingMutex.Unlock()
+	// the packets due now leave in batches
+	defer func() {
+		if e := c.flushBytes(); err == nil {
+			err = e
+		}
+	}()
 	for {
-		if !c.ca.isPacingTime() {
+		if !c.ca.isPacingTime() || c.isHeld() {
+			return nil
+		}
+		if d := c.rateLimitDelay(); d > 0 {
+			// the pacing timer wakes the writer once the limits allow
+			c.pacingTimer.Reset(d)
 			return nil
 		}
 		m := c.ca.popMessage()
@@ -275,8 +355,13 @@ func (c *UDPConn) writePendingMsgs() (err error) {
 			return nil
 		}
 		tx := !m.IsTransmitted()
+		var seq uint64
 		if tx {
-			m.SetSeq(c.GetNextSeq())
+			seq, err = c.GetNextSeq()
+			if err != nil {
+				return
+			}
+			m.SetSeq(uint32(seq))
 			if c.BeforeSend != nil {
 				c.BeforeSend(m)
 			}
@@ -285,6 +370,16 @@ func (c *UDPConn) writePendingMsgs() (err error) {
 			c.GetContextLogger().Debugf("resend msg seq %d", m.GetSeq())
 		}
 		pkgBytes := m.PkgBytes()
+		if tx {
+			// before sealing, the flags of the msg and the id are
+			// authenticated with it
+			var flags byte
+			if m.IsFragment() {
+				flags = msg.UDP_FLAG_FRAGMENT
+			}
+			pkgBytes[msg.PKG_HEADER_SIZE+msg.UDP_FLAGS_BEGIN] = flags
+			c.setConnIDHeader(pkgBytes[msg.PKG_HEADER_SIZE:])
+		}
 		if DEBUG_DATA_HEX {
 			c.GetContextLogger().Debugf("before encrypt out %x", pkgBytes)
 		}
@@ -293,50 +388,137 @@ func (c *UDPConn) writePendingMsgs() (err error) {
 			if tx {
 				crypto := c.GetCrypto()
 				if crypto != nil {
-					err = crypto.Encrypt(pkgBytes[msg.PKG_HEADER_SIZE+msg.UDP_HEADER_END:])
+					if crypto.IsAEAD() {
+						// the ack info is sealed with the msg, resends
+						// carry it as it was
+						c.fillAckInfo(pkgBytes[msg.PKG_HEADER_SIZE:])
+					}
+					pkgBytes, err = c.encrypt(crypto, pkgBytes, seq)
 					if err != nil {
 						return
 					}
 				}
 				m.SetCache(pkgBytes)
 			}
-			err = c.WriteBytes(pkgBytes)
-		case msg.TYPE_SYN:
-			err = c.WriteBytes(pkgBytes)
 		}
+		var fecs [][]byte
+		if tx {
+			fecs, err = c.fecEncoder.encode(pkgBytes[msg.PKG_HEADER_SIZE:], c.getResendCount(), c.pmtud.size())
+			if err != nil {
+				return err
+			}
+		} else {
+			// the group has been decoded or dropped by the peer
+			setFECHeader(pkgBytes[msg.PKG_HEADER_SIZE:], fecRatios[0], 0)
+		}
+		err = c.queueBytes(pkgBytes)
 		if err != nil {
 			return err
 		}
+		c.takeRateLimits(len(pkgBytes))
 		d := c.ca.calcPacingTime(m.PkgBytesLen())
-		c.pacingTimerMutex.Lock()
 		c.pacingTimer.Reset(d)
-		c.pacingTimerMutex.Unlock()
 		if tx {
 			c.transmitted(m)
-			ps, err := c.fecEncoder.encode(pkgBytes[msg.PKG_HEADER_SIZE:])
-			if err != nil {
-				return err
-			}
-			if len(ps) > 0 {
-				for _, v := range ps {
-					err = c.WriteBytes(fec(v, c.GetNextSeq()))
+			if len(fecs) > 0 {
+				for _, v := range fecs {
+					err = c.queueBytes(v)
 					if err != nil {
 						return err
 					}
+					c.takeRateLimits(len(v))
 				}
 			}
 		} else {
-			m.SetRTO(c.getRTO(), c.resendCallback)
+			m.SetRTO(c.wheel, c.getRTO(), c.resendCallback)
 		}
 	}
 }
 
+func (c *UDPConn) encrypt(crypto *Crypto, pkgBytes []byte, fullSeq uint64) (result []byte, err error) {
+	m := pkgBytes[msg.PKG_HEADER_SIZE:]
+	body := m[msg.UDP_HEADER_END:]
+	if !crypto.IsAEAD() {
+		err = crypto.Encrypt(body)
+		result = pkgBytes
+		return
+	}
+	l := uint32(len(body) + crypto.Overhead())
+	m[msg.UDP_TYPE_BEGIN] = msg.TYPE_AEAD
+	binary.BigEndian.PutUint32(m[msg.UDP_LEN_BEGIN:msg.UDP_LEN_END], l)
+	sealed, err := crypto.Seal(fullSeq, aeadAD(m), body)
+	if err != nil {
+		return
+	}
+	result = pkgBytes[:msg.PKG_HEADER_SIZE+msg.UDP_HEADER_END+len(sealed)]
+	return
+}
+
+// additional data of AEAD messages, the header up to the ack info, the
+// flags and a non zero conn id are authenticated with the body
+func aeadAD(m []byte) (ad []byte) {
+	ad = make([]byte, 0, msg.UDP_ACK_ACKED_SEQ_END+msg.FLAGS_SIZE+msg.CONN_ID_SIZE)
+	ad = append(ad, m[msg.UDP_TYPE_BEGIN:msg.UDP_ACK_ACKED_SEQ_END]...)
+	ad = append(ad, m[msg.UDP_FLAGS_BEGIN])
+	if HeaderConnID(m) != 0 {
+		ad = append(ad, m[msg.UDP_CONN_ID_BEGIN:msg.UDP_CONN_ID_END]...)
+	}
+	return
+}
+
+func isFragment(m []byte) bool {
+	return m[msg.UDP_FLAGS_BEGIN]&msg.UDP_FLAG_FRAGMENT > 0
+}
+
+// authenticate AEAD messages with their header m, the ones that failed are
+// counted and dropped
+func (c *UDPConn) open(t byte, seq uint32, m, body []byte) (result []byte, ok bool) {
+	switch t {
+	case msg.TYPE_AEAD:
+		crypto := c.GetCrypto()
+		if crypto == nil {
+			c.AddAuthFailCount()
+			return
+		}
+		var err error
+		result, err = crypto.Open(seq, aeadAD(m), body)
+		if err == ErrReplay {
+			c.GetContextLogger().Debugf("replayed msg seq %d", seq)
+			c.AddReplayCount()
+			// might be a resend for a lost ack
+			c.Ack(seq)
+			return
+		}
+		if err != nil {
+			c.GetContextLogger().Debugf("open msg seq %d err %v", seq, err)
+			c.AddAuthFailCount()
+			return
+		}
+		ok = true
+		return
+	case msg.TYPE_NORMAL:
+		crypto := c.GetCrypto()
+		if crypto != nil && !crypto.AcceptLegacy(seq) {
+			c.GetContextLogger().Debugf("unauthenticated msg seq %d", seq)
+			c.AddAuthFailCount()
+			return
+		}
+	}
+	return body, true
+}
+
 func (c *UDPConn) fillAckInfo(m []byte) {
+	nSeq := c.GetNextAckSeq()
 	c.lastAckMtx.Lock()
 	seq := c.lastAck
-	c.lastCnted = c.lastCnt
+	// the header holds 32 seqs past nSeq, leave the rest to a sack msg
+	if seq <= nSeq+32 || !c.isPeerSAck() {
+		c.lastCnted = c.lastCnt
+	}
 	c.lastAckMtx.Unlock()
-	nSeq := c.GetNextAckSeq()
+	m[msg.UDP_FLAGS_BEGIN] = m[msg.UDP_FLAGS_BEGIN]&msg.UDP_FLAG_FRAGMENT |
+		msg.UDP_FLAG_SACK | msg.UDP_FLAG_PMTUD | msg.UDP_FLAG_REASSEMBLY
+	c.setConnIDHeader(m)
 	binary.BigEndian.PutUint32(m[msg.UDP_ACK_SEQ_BEGIN:], seq)
 	binary.BigEndian.PutUint32(m[msg.UDP_ACK_NEXT_SEQ_BEGIN:], nSeq)
 	if seq > nSeq+1 {
@@ -349,21 +531,18 @@ func (c *UDPConn) fillAckInfo(m []byte) {
 	}
 }
 
-func fec(b []byte, seq uint32) (result []byte) {
-	hz := msg.PKG_HEADER_SIZE + msg.UDP_HEADER_SIZE
-	result = make([]byte, hz+len(b))
-	l := copy(result[hz:], b)
-	m := result[msg.PKG_HEADER_SIZE:]
-	m[0] = msg.TYPE_FEC
-	binary.BigEndian.PutUint32(m[msg.UDP_SEQ_BEGIN:msg.UDP_SEQ_END], seq)
-	binary.BigEndian.PutUint32(m[msg.UDP_LEN_BEGIN:msg.UDP_LEN_END], uint32(l))
-	return
+func (c *UDPConn) Process(t byte, m []byte) (err error) {
+	return c.ProcessFrom(t, m, nil)
 }
 
-func (c *UDPConn) Process(t byte, m []byte) (err error) {
-	err = c.processAckInfo(m)
-	if err != nil {
-		return
+// ProcessFrom processes a data msg that came from addr, the conn migrates
+// there if the msg is authenticated and carries its id
+func (c *UDPConn) ProcessFrom(t byte, m []byte, addr *net.UDPAddr) (err error) {
+	if t == msg.TYPE_FEC && !c.sealsControl() {
+		err = c.processAckInfo(m)
+		if err != nil {
+			return
+		}
 	}
 	seq := binary.BigEndian.Uint32(m[msg.UDP_SEQ_BEGIN:msg.UDP_SEQ_END])
 	l := binary.BigEndian.Uint32(m[msg.UDP_LEN_BEGIN:msg.UDP_LEN_END])
@@ -372,10 +551,13 @@ func (c *UDPConn) Process(t byte, m []byte) (err error) {
 		c.GetContextLogger().Debugf("%x", m)
 	}
 
+	r, index := getFECHeader(m)
+	var g *group
 	if t == msg.TYPE_FEC {
-		m = m[msg.UDP_HEADER_END:]
+		g, err = c.decode(seq, r, index, m[msg.UDP_HEADER_END:])
+	} else if index < r.dataShards {
+		g, err = c.decode(seq-uint32(index), r, index, m)
 	}
-	g, err := c.decode(seq, m)
 	if err != nil {
 		return
 	}
@@ -395,7 +577,20 @@ func (c *UDPConn) Process(t byte, m []byte) (err error) {
 					c.GetContextLogger().Debugf("fec recovered \n%x", m)
 				}
 				if uint32(len(m)) >= msg.UDP_HEADER_END+l {
-					err = c.process(t, seq, m[msg.UDP_HEADER_END:msg.UDP_HEADER_END+l])
+					id := HeaderConnID(m)
+					fragment := isFragment(m)
+					body, ok := c.open(t, seq, m, m[msg.UDP_HEADER_END:msg.UDP_HEADER_END+l])
+					if !ok {
+						continue
+					}
+					err = c.processAuthAckInfo(t, m)
+					if err != nil {
+						return
+					}
+					if t == msg.TYPE_AEAD {
+						c.migrate(id, addr)
+					}
+					err = c.process(t, seq, fragment, body)
 					if err != nil {
 						return
 					}
@@ -405,7 +600,20 @@ func (c *UDPConn) Process(t byte, m []byte) (err error) {
 	}
 	if t != msg.TYPE_FEC &&
 		uint32(len(m)) >= msg.UDP_HEADER_END+l {
-		err = c.process(t, seq, m[msg.UDP_HEADER_END:msg.UDP_HEADER_END+l])
+		id := HeaderConnID(m)
+		fragment := isFragment(m)
+		body, ok := c.open(t, seq, m, m[msg.UDP_HEADER_END:msg.UDP_HEADER_END+l])
+		if !ok {
+			return
+		}
+		err = c.processAuthAckInfo(t, m)
+		if err != nil {
+			return
+		}
+		if t == msg.TYPE_AEAD {
+			c.migrate(id, addr)
+		}
+		err = c.process(t, seq, fragment, body)
 		if err != nil {
 			return
 		}
@@ -414,26 +622,58 @@ func (c *UDPConn) Process(t byte, m []byte) (err error) {
 	return
 }
 
+// processAuthAckInfo takes the ack info of a msg that has been opened, the
+// peer of an AEAD conn seals it with the msg
+func (c *UDPConn) processAuthAckInfo(t byte, m []byte) (err error) {
+	if t != msg.TYPE_AEAD && c.sealsControl() {
+		return
+	}
+	return c.processAckInfo(m)
+}
+
 func (c *UDPConn) processAckInfo(m []byte) (err error) {
+	flags := m[msg.UDP_FLAGS_BEGIN]
+	if flags&msg.UDP_FLAG_SACK > 0 {
+		c.setPeerSAck()
+	}
+	if flags&msg.UDP_FLAG_PMTUD > 0 {
+		c.pmtud.enable()
+	}
+	if flags&msg.UDP_FLAG_REASSEMBLY > 0 {
+		c.SetPeerReassembly()
+	}
 	seq := binary.BigEndian.Uint32(m[msg.UDP_ACK_SEQ_BEGIN:])
 	ns := binary.BigEndian.Uint32(m[msg.UDP_ACK_NEXT_SEQ_BEGIN:])
 	acked := binary.BigEndian.Uint32(m[msg.UDP_ACK_ACKED_SEQ_BEGIN:])
 	c.GetContextLogger().Debugf("udp ack %d, next %d, acked %b", seq, ns, acked)
-	return c.recvAck(seq, ns, acked)
+	return c.recvAck(seq, ns, maskToRanges(ns+1, acked))
 }
 
-func (c *UDPConn) process(t byte, seq uint32, m []byte) (err error) {
+// the peer sets UDP_FLAG_SACK in the header of its msgs if it reads TYPE_SACK
+func (c *UDPConn) setPeerSAck() {
+	atomic.StoreInt32(&c.peerSAck, 1)
+}
+
+func (c *UDPConn) isPeerSAck() bool {
+	return atomic.LoadInt32(&c.peerSAck) == 1
+}
+
+func (c *UDPConn) process(t byte, seq uint32, fragment bool, m []byte) (err error) {
 	switch t {
-	case msg.TYPE_SYN, msg.TYPE_NORMAL:
+	case msg.TYPE_SYN, msg.TYPE_NORMAL, msg.TYPE_AEAD:
 		err = c.Ack(seq)
 		if err != nil {
 			return
 		}
 	}
-	ok, ms := c.Push(seq, msg.NewUDP(t, seq, m))
+	um := msg.NewUDP(t, seq, m)
+	if fragment {
+		um.SetFragment()
+	}
+	ok, ms := c.Push(seq, um)
 	if ok {
 		for _, m := range ms {
-			if m.Type != msg.TYPE_SYN {
+			if m.Type == msg.TYPE_NORMAL {
 				if DEBUG_DATA_HEX {
 					c.GetContextLogger().Debugf("MustGetCrypto t %d seq %d \n%x", m.Type, m.GetSeq(), m.Body)
 				}
@@ -449,7 +689,20 @@ func (c *UDPConn) process(t byte, seq uint32, m []byte) (err error) {
 			if c.BeforeRead != nil {
 				c.BeforeRead(m)
 			}
-			c.In <- m.Body
+			if !m.IsFragment() {
+				c.In <- m.Body
+				continue
+			}
+			// a bad fragment costs its msg only, the conn goes on
+			body, e := c.reassembler.push(m.Body)
+			if e != nil {
+				c.GetContextLogger().Debugf("reassembly drop %v", e)
+				c.AddReassemblyDropCount()
+				continue
+			}
+			if body != nil {
+				c.In <- body
+			}
 		}
 	}
 	return
@@ -461,12 +714,14 @@ func (c *UDPConn) WriteSyn(bytes []byte) (err error) {
 }
 
 func (c *UDPConn) WriteBytes(bytes []byte) (err error) {
-	c.fillAckInfo(bytes[msg.PKG_CRC32_END:])
+	if bytes[msg.PKG_HEADER_SIZE+msg.UDP_TYPE_BEGIN] != msg.TYPE_AEAD {
+		c.fillAckInfo(bytes[msg.PKG_CRC32_END:])
+	}
 	checksum := crc32.ChecksumIEEE(bytes[msg.PKG_CRC32_END:])
 	binary.BigEndian.PutUint32(bytes[msg.PKG_CRC32_BEGIN:], checksum)
 	l := len(bytes)
 	c.AddSentBytes(l)
-	n, err := c.UdpConn.WriteToUDP(bytes, c.addr)
+	n, err := c.UdpConn.WriteTo(bytes, c.getAddr())
 	if DEBUG_DATA_HEX {
 		c.GetContextLogger().Debugf("write out %x", bytes)
 	}
@@ -476,10 +731,56 @@ func (c *UDPConn) WriteBytes(bytes []byte) (err error) {
 	return
 }
 
+// queueBytes is WriteBytes for writePendingMsgs, the packet is sent with the
+// next flushBytes. Call it with nextPacingMutex held.
+// queueBytes copies the packet, an ack may return the buffer of the msg to
+// the pool before the batch is flushed
+func (c *UDPConn) queueBytes(bytes []byte) (err error) {
+	i := len(c.batch)
+	if i == len(c.batchBufs) {
+		c.batchBufs = append(c.batchBufs, nil)
+	}
+	bytes = append(c.batchBufs[i][:0], bytes...)
+	c.batchBufs[i] = bytes
+	if bytes[msg.PKG_HEADER_SIZE+msg.UDP_TYPE_BEGIN] != msg.TYPE_AEAD {
+		c.fillAckInfo(bytes[msg.PKG_CRC32_END:])
+	}
+	checksum := crc32.ChecksumIEEE(bytes[msg.PKG_CRC32_END:])
+	binary.BigEndian.PutUint32(bytes[msg.PKG_CRC32_BEGIN:], checksum)
+	c.batch = append(c.batch, Datagram{Buf: bytes, Addr: c.getAddr()})
+	if len(c.batch) >= UDP_BATCH_SIZE {
+		err = c.flushBytes()
+	}
+	return
+}
+
+// flushBytes writes the queued packets with as few syscalls as the platform
+// allows. Call it with nextPacingMutex held.
+func (c *UDPConn) flushBytes() (err error) {
+	if len(c.batch) == 0 {
+		return
+	}
+	if c.batchConn == nil {
+		c.batchConn = NewBatchConn(c.UdpConn)
+	}
+	n, err := c.batchConn.WriteBatch(c.batch)
+	for _, d := range c.batch[:n] {
+		c.AddSentBytes(len(d.Buf))
+		if DEBUG_DATA_HEX {
+			c.GetContextLogger().Debugf("write out %x", d.Buf)
+		}
+	}
+	for i := range c.batch {
+		c.batch[i] = Datagram{}
+	}
+	c.batch = c.batch[:0]
+	return
+}
+
 func (c *UDPConn) WriteExt(bytes []byte) (err error) {
 	l := len(bytes)
 	c.AddSentBytes(l)
-	n, err := c.UdpConn.WriteToUDP(bytes, c.addr)
+	n, err := c.UdpConn.WriteTo(bytes, c.getAddr())
 	if DEBUG_DATA_HEX {
 		c.GetContextLogger().Debugf("write out %x", bytes)
 	}
@@ -489,17 +790,42 @@ func (c *UDPConn) WriteExt(bytes []byte) (err error) {
 	return
 }
 
+// writeProbe is WriteExt with the DF bit set
+func (c *UDPConn) writeProbe(bytes []byte) (err error) {
+	l := len(bytes)
+	c.AddSentBytes(l)
+	n, err := writeProbe(c.UdpConn, bytes, c.getAddr())
+	if err == nil && n != l {
+		return errors.New("nothing was written")
+	}
+	return
+}
+
 func (c *UDPConn) Ack(seq uint32) error {
 	c.lastAckMtx.Lock()
 	c.lastAck = seq
 	c.lastCnt++
 	c.lastAckMtx.Unlock()
-	c.lastAckCond.Broadcast()
+	// acks are delayed to be sent together
+	if atomic.CompareAndSwapInt32(&c.ackScheduled, 0, 1) {
+		c.ackTimer.Reset(ACK_DELAY)
+	}
 	return nil
 }
 
 func (c *UDPConn) ack(seq uint32) error {
 	nSeq := c.GetNextAckSeq()
+	if c.isPeerSAck() {
+		ranges := c.GetAckedRanges(nSeq+1, msg.MAX_SACK_RANGES)
+		c.GetContextLogger().Debugf("sack %d, next %d, ranges %v", seq, nSeq, ranges)
+		p, err := c.sealControl(sackMsg(seq, nSeq, ranges))
+		if err != nil {
+			return err
+		}
+		checksum := crc32.ChecksumIEEE(p[msg.PKG_HEADER_SIZE:])
+		binary.BigEndian.PutUint32(p[msg.PKG_CRC32_BEGIN:], checksum)
+		return c.WriteExt(p)
+	}
 	c.GetContextLogger().Debugf("ack %d, next %d", seq, nSeq)
 	p := make([]byte, msg.ACK_HEADER_SIZE+msg.PKG_HEADER_SIZE)
 	m := p[msg.PKG_HEADER_SIZE:]
@@ -511,7 +837,11 @@ func (c *UDPConn) ack(seq uint32) error {
 		binary.BigEndian.PutUint32(m[msg.ACK_ACKED_SEQ_BEGIN:msg.ACK_ACKED_SEQ_END], acked)
 		c.GetContextLogger().Debugf("ack %d, next %d, acked %d", seq, nSeq, acked)
 	}
-	checksum := crc32.ChecksumIEEE(m)
+	p, err := c.sealControl(p)
+	if err != nil {
+		return err
+	}
+	checksum := crc32.ChecksumIEEE(p[msg.PKG_HEADER_SIZE:])
 	binary.BigEndian.PutUint32(p[msg.PKG_CRC32_BEGIN:], checksum)
 	return c.WriteExt(p)
 }
@@ -520,41 +850,81 @@ func (c *UDPConn) fin() error {
 	p := make([]byte, msg.PKG_HEADER_SIZE+msg.UDP_TYPE_SIZE)
 	m := p[msg.PKG_HEADER_SIZE:]
 	m[msg.UDP_TYPE_BEGIN] = msg.TYPE_FIN
-	checksum := crc32.ChecksumIEEE(m)
+	p, err := c.sealControl(p)
+	if err != nil {
+		return err
+	}
+	checksum := crc32.ChecksumIEEE(p[msg.PKG_HEADER_SIZE:])
 	binary.BigEndian.PutUint32(p[msg.PKG_CRC32_BEGIN:], checksum)
 	c.GetContextLogger().Debug("fin")
 	return c.WriteExt(p)
 }
 
-func (c *UDPConn) recvAck(seq, ns, acked uint32) (err error) {
-	err = c.delMsg(seq, false)
+// recvAck acks seq, the seqs below ns and the seqs in ranges
+func (c *UDPConn) recvAck(seq, ns uint32, ranges []sackRange) (err error) {
+	if ns > 0 {
+		ranges = append([]sackRange{{begin: 0, end: ns - 1}}, ranges...)
+	}
+	return c.delMsg(seq, ranges)
+}
+
+// acks and fins of AEAD conns carry a seq and a tag, forged ones would drop
+// unacked msgs or close the conn
+func (c *UDPConn) sealsControl() bool {
+	crypto := c.GetCrypto()
+	return crypto != nil && crypto.IsAEAD()
+}
+
+// sealControl appends the seq and the tag of the control msg in p
+func (c *UDPConn) sealControl(p []byte) (result []byte, err error) {
+	if !c.sealsControl() {
+		return p, nil
+	}
+	seq, tag, err := c.GetCrypto().SealControl(p[msg.PKG_HEADER_SIZE:])
 	if err != nil {
 		return
 	}
-	for n, ok := c.getMinUnAckSeq(); ok && ns > n; n, ok = c.getMinUnAckSeq() {
-		c.GetContextLogger().Debugf("ignore ack %d", n)
-		err = c.delMsg(n, true)
-		if err != nil {
-			return
-		}
-	}
+	result = make([]byte, len(p)+msg.MSG_SEQ_SIZE, len(p)+msg.MSG_SEQ_SIZE+len(tag))
+	copy(result, p)
+	binary.BigEndian.PutUint32(result[len(p):], seq)
+	result = append(result, tag...)
+	return
+}
 
-	for i := uint32(0); acked > 0; i++ {
-		if acked&1 > 0 {
-			n := i + ns + 1
-			c.GetContextLogger().Debugf("ignore ack %d", n)
-			err = c.delMsg(n, true)
-			if err != nil {
-				return
-			}
+// openControl returns the control msg in m without its seq and tag, ok is
+// false if the conn is AEAD and m didn't authenticate
+func (c *UDPConn) openControl(m []byte) (result []byte, ok bool) {
+	if !c.sealsControl() {
+		return m, true
+	}
+	crypto := c.GetCrypto()
+	size := msg.MSG_SEQ_SIZE + crypto.Overhead()
+	if len(m) < msg.MSG_TYPE_SIZE+size {
+		c.GetContextLogger().Debugf("unauthenticated control msg %x", m)
+		c.AddAuthFailCount()
+		return
+	}
+	result = m[:len(m)-size]
+	seq := binary.BigEndian.Uint32(m[len(result):])
+	err := crypto.OpenControl(seq, result, m[len(result)+msg.MSG_SEQ_SIZE:])
+	if err != nil {
+		c.GetContextLogger().Debugf("open control msg seq %d err %v", seq, err)
+		if err == ErrReplay {
+			c.AddReplayCount()
+		} else {
+			c.AddAuthFailCount()
 		}
-		acked >>= 1
+		return nil, false
 	}
-
+	ok = true
 	return
 }
 
 func (c *UDPConn) RecvAck(m []byte) (err error) {
+	m, ok := c.openControl(m)
+	if !ok {
+		return
+	}
 	if len(m) < msg.ACK_HEADER_SIZE {
 		return fmt.Errorf("invalid ack msg %x", m)
 	}
@@ -563,7 +933,70 @@ func (c *UDPConn) RecvAck(m []byte) (err error) {
 	acked := binary.BigEndian.Uint32(m[msg.ACK_ACKED_SEQ_BEGIN:msg.ACK_ACKED_SEQ_END])
 
 	c.GetContextLogger().Debugf("recv ack %d, next %d, acked %b", seq, ns, acked)
-	return c.recvAck(seq, ns, acked)
+	return c.recvAck(seq, ns, maskToRanges(ns+1, acked))
+}
+
+func (c *UDPConn) RecvSAck(m []byte) (err error) {
+	m, ok := c.openControl(m)
+	if !ok {
+		return
+	}
+	seq, ns, ranges, err := parseSackMsg(m)
+	if err != nil {
+		return
+	}
+	c.GetContextLogger().Debugf("recv sack %d, next %d, ranges %v", seq, ns, ranges)
+	return c.recvAck(seq, ns, ranges)
+}
+
+// RecvFin returns ErrFin if the peer closed the conn
+func (c *UDPConn) RecvFin(m []byte) (err error) {
+	if _, ok := c.openControl(m); !ok {
+		return
+	}
+	return ErrFin
+}
+
+func (c *UDPConn) probe() {
+	size := c.pmtud.next()
+	if size < 1 {
+		c.GetContextLogger().Debugf("pmtud search done, size %d", c.pmtud.size())
+		return
+	}
+	c.GetContextLogger().Debugf("pmtud probe %d", size)
+	err := c.writeProbe(probeMsg(msg.TYPE_PROBE, size, size-msg.PKG_HEADER_SIZE-msg.PROBE_HEADER_SIZE))
+	if err != nil {
+		c.GetContextLogger().Debugf("pmtud probe %d err %v", size, err)
+		c.pmtud.failed(size)
+	}
+}
+
+// RecvProbe acks a probe with the size it arrived with
+func (c *UDPConn) RecvProbe(m []byte) (err error) {
+	if len(m) < msg.PROBE_HEADER_SIZE {
+		return fmt.Errorf("invalid probe msg %x", m)
+	}
+	size := binary.BigEndian.Uint32(m[msg.PROBE_SIZE_BEGIN:msg.PROBE_SIZE_END])
+	if int(size) != len(m)+msg.PKG_HEADER_SIZE {
+		return
+	}
+	return c.WriteExt(probeMsg(msg.TYPE_PROBE_ACK, int(size), 0))
+}
+
+func (c *UDPConn) RecvProbeAck(m []byte) (err error) {
+	if len(m) < msg.PROBE_HEADER_SIZE {
+		return fmt.Errorf("invalid probe ack msg %x", m)
+	}
+	size := int(binary.BigEndian.Uint32(m[msg.PROBE_SIZE_BEGIN:msg.PROBE_SIZE_END]))
+	if c.pmtud.confirmed(size) {
+		c.GetContextLogger().Debugf("pmtud confirmed %d", size)
+	}
+	return
+}
+
+// GetPayloadSize returns the max bytes of a msg sent in one datagram
+func (c *UDPConn) GetPayloadSize() int {
+	return c.pmtud.size() - UDP_OVERHEAD
 }
 
 func (c *UDPConn) Ping() error {
@@ -577,8 +1010,30 @@ func (c *UDPConn) Ping() error {
 	return c.WriteExt(p)
 }
 
-func (c *UDPConn) GetNextSeq() uint32 {
-	return atomic.AddUint32(&c.seq, 1)
+// Drain waits until the pending msgs have been sent and acked, it fails
+// with ErrDrainTimeout after timeout
+func (c *UDPConn) Drain(timeout time.Duration) (err error) {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&c.ca.pendingCnt) > 0 || c.UDPPendingMap.Len() > 0 {
+		if c.IsClosed() {
+			return c.GetStatusError()
+		}
+		if time.Now().After(deadline) {
+			return ErrDrainTimeout
+		}
+		time.Sleep(DRAIN_CHECK_PERIOD)
+	}
+	return
+}
+
+// GetNextSeq returns ErrSeqExhausted instead of wrapping the 32 bits seq,
+// acks couldn't tell the msgs after the wrap from the old ones
+func (c *UDPConn) GetNextSeq() (seq uint64, err error) {
+	seq = atomic.AddUint64(&c.seq, 1)
+	if seq > math.MaxUint32 {
+		err = ErrSeqExhausted
+	}
+	return
 }
 
 func (c *UDPConn) IsClosed() (r bool) {
@@ -596,18 +1051,22 @@ func (c *UDPConn) Close() {
 	}
 	c.closed = true
 	c.FieldsMutex.Unlock()
+	if c.ca != nil {
+		c.ca.close()
+	}
 	if c.UDPPendingMap != nil {
 		c.UDPPendingMap.Dismiss()
 	}
-	if c.addr != nil && c.GetStatusError() != ErrFin {
+	if c.getAddr() != nil && c.GetStatusError() != ErrFin {
 		c.fin()
 	}
 	c.ConnCommonFields.Close()
 	if c.UnsharedUdpConn {
 		c.UdpConn.Close()
 	}
-	if c.lastAckCond != nil {
-		c.lastAckCond.Broadcast()
+	if c.ackTimer != nil {
+		c.ackTimer.Stop()
+		c.pacingTimer.Stop()
 	}
 }
 
@@ -617,17 +1076,27 @@ func (c *UDPConn) String() string {
 			rtoResend:%d,
 			lossResend:%d,
 			ack:%d,
-			overAck:%d,`,
+			overAck:%d,
+			authFail:%d,
+			replay:%d,
+			reassemblyDrop:%d,
+			plpmtu:%d,
+			connID:%x,`,
 		c.GetRemoteAddr().String(),
 		atomic.LoadUint32(&c.rtoResendCount),
 		atomic.LoadUint32(&c.lossResendCount),
 		atomic.LoadUint32(&c.ackCount),
 		atomic.LoadUint32(&c.overAckCount),
+		atomic.LoadUint32(&c.authFailCount),
+		atomic.LoadUint32(&c.replayCount),
+		atomic.LoadUint32(&c.reassemblyDropCount),
+		c.pmtud.size(),
+		c.GetConnID(),
 	)
 }
 
 func (c *UDPConn) GetRemoteAddr() net.Addr {
-	return c.addr
+	return c.getAddr()
 }
 
 func (c *UDPConn) getRTO() (rto time.Duration) {
@@ -651,47 +1120,57 @@ func (c *UDPConn) addMsg(k uint32, v *msg.UDPMessage) {
 	c.UDPPendingMap.AddMsg(k, v)
 }
 
-func (c *UDPConn) delMsg(seq uint32, ignore bool) error {
-	ok, um, msgs := c.DelMsgAndGetLossMsgs(seq)
+func (c *UDPConn) delMsg(seq uint32, ranges []sackRange) error {
+	ok, um, acked, msgs := c.DelMsgAndGetLossMsgs(seq, ranges...)
 	if ok {
-		c.AddAckCount()
-		if !ignore && !um.IsLoss() {
+		if !um.IsLoss() {
 			c.updateRTT(um.GetRTT())
 		}
-		c.updateDeliveryRate(um)
-		if QUICK_LOST_ENABLE {
-			if len(msgs) > 1 {
-				c.GetContextLogger().Debugf("resend loss msgs %v", msgs)
-				for _, msg := range msgs {
-					err := c.resendMsg(msg)
-					if err != nil {
-						c.SetStatusToError(err)
-						c.Close()
-						return err
-					}
-					c.AddLossResendCount()
-				}
-			}
-		}
-		c.UpdateLastAck(seq)
+		acked = append([]*msg.UDPMessage{um}, acked...)
+	} else {
+		c.GetContextLogger().Debugf("over ack %s", c)
+		c.AddOverAckCount()
+	}
+	if len(acked) < 1 {
+		return nil
+	}
+	c.pmtud.acked()
+	for _, um := range acked {
+		c.AddAckCount()
+		c.ca.onAck(um)
+		c.UpdateLastAck(um.GetSeq())
 		c.ca.cwndMtx.Lock()
 		c.ca.usedCwnd--
 		c.ca.cwndMtx.Unlock()
 		c.ca.bifMtx.Lock()
 		c.ca.bif -= um.PkgBytesLen()
 		c.ca.bifMtx.Unlock()
-		return c.writePendingMsgs()
-	} else if !ignore {
-		c.GetContextLogger().Debugf("over ack %s", c)
-		c.AddOverAckCount()
 	}
-	return nil
+	if QUICK_LOST_ENABLE {
+		if len(msgs) > 1 {
+			c.GetContextLogger().Debugf("resend loss msgs %v", msgs)
+			for _, msg := range msgs {
+				err := c.resendMsg(msg)
+				if err != nil {
+					c.SetStatusToError(err)
+					c.Close()
+					return err
+				}
+				c.AddLossResendCount()
+			}
+		}
+	}
+	return c.writePendingMsgs()
 }
 
 func (c *UDPConn) AddLossResendCount() {
 	atomic.AddUint32(&c.lossResendCount, 1)
 }
 
+func (c *UDPConn) getResendCount() uint32 {
+	return atomic.LoadUint32(&c.lossResendCount) + atomic.LoadUint32(&c.rtoResendCount)
+}
+
 func (c *UDPConn) AddRTOResendCount() {
 	atomic.AddUint32(&c.rtoResendCount, 1)
 }
@@ -704,6 +1183,18 @@ func (c *UDPConn) AddOverAckCount() {
 	atomic.AddUint32(&c.overAckCount, 1)
 }
 
+func (c *UDPConn) AddAuthFailCount() {
+	atomic.AddUint32(&c.authFailCount, 1)
+}
+
+func (c *UDPConn) AddReplayCount() {
+	atomic.AddUint32(&c.replayCount, 1)
+}
+
+func (c *UDPConn) AddReassemblyDropCount() {
+	atomic.AddUint32(&c.reassemblyDropCount, 1)
+}
+
 func (c *UDPConn) IsTCP() bool {
 	return false
 }
@@ -789,139 +1280,30 @@ func (c *UDPConn) updateRTT(t time.Duration) {
 	}
 }
 
-const rttUnit = time.Microsecond
-
-func (c *UDPConn) updateDeliveryRate(m *msg.UDPMessage) {
-	c.ca.Lock()
-	defer c.ca.Unlock()
-
-	isRoundStart := c.ca.updateRoundTripCounter(m.GetSeq())
-
-	c.delivered++
-	c.deliveredTime = time.Now()
-	c.sentTime = m.GetTransmittedTime()
-
-	if m.GetSentTime().IsZero() || m.GetDeliveredTime().IsZero() {
-		return
-	}
-
-	c.tryToCancelAppLimited(m.GetSeq())
-	if c.isAppLimited() {
-		c.GetContextLogger().Debugf("app limited used:%d max:%d", c.getUsedCwnd(), c.getCwnd())
-		return
-	}
-
-	sd := c.sentTime.Sub(m.GetSentTime()) / rttUnit
-	ad := c.deliveredTime.Sub(m.GetDeliveredTime()) / rttUnit
-	interval := ad
-	if sd > ad {
-		interval = sd
-	}
-	d := c.delivered - m.GetDelivered()
-	drate := rate(d * BW_UNIT / uint64(interval))
-	c.GetContextLogger().Debugf("drate(%d) d %d interval %d sd %d ad %d", drate, d, interval, sd, ad)
-	if drate <= 0 {
-		return
-	}
-	mr := c.rttSamples.getMin()
-	if mr <= 0 {
-		return
-	}
-	rtt := uint64(time.Duration(mr) / rttUnit)
-	if uint64(interval) < rtt {
-		return
-	}
-
-	hm := c.bwFilter.GetBest()
-	if drate >= hm {
-		c.bwFilter.Update(drate, c.ca.getRoundTripCount())
-		hm = c.bwFilter.GetBest()
-	}
-	if hm <= 0 {
-		return
-	}
-	max := uint64(hm)
-	if c.ca.mode == probeBW {
-		c.ca.updateGainCyclePhase(max, rtt)
-	}
-	if isRoundStart {
-		c.ca.checkFullBwReached()
-	}
-	c.ca.checkDrain(max, rtt)
-	c.setPacingRate(max, c.pacingGain)
-	c.setCwnd(d, max, rtt, c.cwndGain)
-	c.GetContextLogger().Debugf("mode %d, max bw %d rtt %d", c.mode, max, rtt)
-}
-
-func (c *UDPConn) setPacingRate(bw uint64, gain int) {
-	bw *= MAX_UDP_PACKAGE_SIZE
-	bw *= uint64(gain)
-	bw >>= BBR_SCALE
-	bw *= 1000000
-	rate := bw >> BW_SCALE
-	c.GetContextLogger().Debugf("setPacingRate: rate %d", rate)
-	c.ca.setPacingRate(rate)
-}
-
-func (c *UDPConn) setCwnd(acked, bw, rtt uint64, gain int) {
-	target := c.targetCwnd(bw, rtt, gain)
-
-	cwnd := c.ca.getCwnd()
-	if c.fullBwReached() {
-		n := cwnd + uint32(acked)
-		if n < target {
-			cwnd = n
-		} else {
-			cwnd = target
-		}
-	} else if cwnd < target {
-		cwnd = cwnd + uint32(acked)
-	}
-	if 10 > cwnd {
-		cwnd = 10
-	}
-
-	c.GetContextLogger().Debugf("setCwnd %d", cwnd)
-	c.ca.setCwnd(cwnd)
-}
-
+// ca schedules the pending msgs of a UDPConn, the CongestionController
+// decides the window and the pacing rate
 type ca struct {
-	delivered     uint64
-	deliveredTime time.Time
-	sentTime      time.Time
-	rttSamples    *rttSampler
-	bwFilter      *maxBandwidthFilter
-	cwnd          uint32
-	usedCwnd      uint32
-	cwndMtx       sync.Mutex
-	mode
-	pacingGain      int
-	pacingRate      uint64
+	cc    CongestionController
+	ccMtx sync.Mutex
+
+	rttSamples      *rttSampler
+	usedCwnd        uint32
+	cwndMtx         sync.Mutex
 	nextPacingTime  time.Time
 	nextPacingMutex sync.RWMutex
-	lastCycleStart  time.Time
-	cycleOffset     int
-	cwndGain        int
-	fullBwCnt       uint
-	fullBw          rate
 	pendingCnt      int32
 
 	bif        int
 	bifMtx     sync.RWMutex
 	bifPdId    int
 	bifPdChans map[int]*pdChan
+	// round robin order of the channels and the one whose turn it is
+	pdOrder []int
+	pdNext  int
 
 	resendChan *reChan
 
-	appLimited   bool
-	endOfLimited uint32
-
-	lastSentSeq    uint32
-	roundTripCount roundTripCount
-	currentTripEnd uint32
-	roundTripMutex sync.RWMutex
-
-	sync.RWMutex
+	closed bool
 }
 
 type pdChan struct {
@@ -931,6 +1313,12 @@ type pdChan struct {
 	cond  *sync.Cond
 	maxPd int
 	end   bool
+	// the conn is closed, msgs added are dropped
+	closed bool
+
+	priority int
+	// msgs sent in the current turn
+	served int
 }
 
 func newPdChan(max int) *pdChan {
@@ -955,39 +1343,42 @@ func newReChan() *reChan {
 
 func newCA() *ca {
 	c := &ca{
+		cc:         NewBBR(),
 		rttSamples: newRttSampler(16),
-		bwFilter:   newMaxBandwidthFilter(bandwidthWindowSize, 0, 0),
-		cwnd:       10,
-		pacingGain: highGain,
-		pacingRate: highGain * 10 * BW_UNIT / 1000,
-		cwndGain:   highGain,
 		bifPdChans: make(map[int]*pdChan),
 		resendChan: newReChan(),
 	}
 
 	c.bifPdChans[c.bifPdId] = newPdChan(100)
+	c.pdOrder = append(c.pdOrder, c.bifPdId)
 	return c
 }
 
-func (ca *ca) getDelivered() (d uint64) {
-	ca.RLock()
-	d = ca.delivered
-	ca.RUnlock()
-	return
+func (ca *ca) setCongestionController(cc CongestionController) {
+	ca.ccMtx.Lock()
+	ca.cc = cc
+	ca.ccMtx.Unlock()
 }
 
-func (ca *ca) getDeliveredTime() (d time.Time) {
-	ca.RLock()
-	d = ca.deliveredTime
-	ca.RUnlock()
-	return
+func (ca *ca) onSend(m *msg.UDPMessage) {
+	appLimited := atomic.LoadInt32(&ca.pendingCnt) <= 0 && !ca.isCwndFull()
+	ca.ccMtx.Lock()
+	ca.cc.OnSend(m, appLimited)
+	ca.ccMtx.Unlock()
 }
 
-func (ca *ca) getSentTime() (d time.Time) {
-	ca.RLock()
-	d = ca.sentTime
-	ca.RUnlock()
-	return
+func (ca *ca) onAck(m *msg.UDPMessage) {
+	minRTT := time.Duration(ca.rttSamples.getMin())
+	inFlight := ca.getUsedCwnd()
+	ca.ccMtx.Lock()
+	ca.cc.OnAck(m, minRTT, inFlight)
+	ca.ccMtx.Unlock()
+}
+
+func (ca *ca) onLoss(m *msg.UDPMessage) {
+	ca.ccMtx.Lock()
+	ca.cc.OnLoss(m)
+	ca.ccMtx.Unlock()
 }
 
 func (ca *ca) newPendingChannel() (channel int) {
@@ -996,7 +1387,27 @@ func (ca *ca) newPendingChannel() (channel int) {
 
 	ca.bifPdId++
 	channel = ca.bifPdId
-	ca.bifPdChans[channel] = newPdChan(3)
+	ch := newPdChan(3)
+	ch.closed = ca.closed
+	ca.bifPdChans[channel] = ch
+	ca.pdOrder = append(ca.pdOrder, channel)
+	return
+}
+
+func (ca *ca) setChannelPriority(channel, priority int) (err error) {
+	if priority < 0 || priority >= len(priorityWeights) {
+		return fmt.Errorf("invalid priority %d", priority)
+	}
+	ca.bifMtx.RLock()
+	ch, ok := ca.bifPdChans[channel]
+	ca.bifMtx.RUnlock()
+	if !ok {
+		return
+	}
+
+	ch.mtx.Lock()
+	ch.priority = priority
+	ch.mtx.Unlock()
 	return
 }
 
@@ -1021,6 +1432,40 @@ func (c *UDPConn) NewPendingChannel() (channel int) {
 	return c.ca.newPendingChannel()
 }
 
+func (c *UDPConn) SetChannelPriority(channel, priority int) error {
+	return c.ca.setChannelPriority(channel, priority)
+}
+
+func (c *UDPConn) SetRateLimiters(limiters ...*RateLimiter) {
+	c.FieldsMutex.Lock()
+	c.rateLimiters = limiters
+	c.FieldsMutex.Unlock()
+	c.wakeWriter()
+}
+
+func (c *UDPConn) getRateLimiters() (limiters []*RateLimiter) {
+	c.FieldsMutex.RLock()
+	limiters = c.rateLimiters
+	c.FieldsMutex.RUnlock()
+	return
+}
+
+// rateLimitDelay returns how long the limiters hold the next msg back
+func (c *UDPConn) rateLimitDelay() (d time.Duration) {
+	for _, l := range c.getRateLimiters() {
+		if ld := l.Delay(); ld > d {
+			d = ld
+		}
+	}
+	return
+}
+
+func (c *UDPConn) takeRateLimits(n int) {
+	for _, l := range c.getRateLimiters() {
+		l.Take(n)
+	}
+}
+
 func (ca *ca) addToPendingChannel(channel int, m *msg.UDPMessage) {
 	ca.bifMtx.RLock()
 	ch, ok := ca.bifPdChans[channel]
@@ -1030,9 +1475,13 @@ func (ca *ca) addToPendingChannel(channel int, m *msg.UDPMessage) {
 	}
 
 	ch.mtx.Lock()
-	for ch.pd.Len() >= ch.maxPd {
+	for !ch.closed && ch.pd.Len() >= ch.maxPd {
 		ch.cond.Wait()
 	}
+	if ch.closed {
+		ch.mtx.Unlock()
+		return
+	}
 	ch.seq++
 	m.SetChannelSeq(channel, ch.seq)
 	atomic.AddInt32(&ca.pendingCnt, 1)
@@ -1040,6 +1489,24 @@ func (ca *ca) addToPendingChannel(channel int, m *msg.UDPMessage) {
 	ch.mtx.Unlock()
 }
 
+// close wakes the writers waiting for room in the channels, the msgs of a
+// closed conn are not sent anymore
+func (ca *ca) close() {
+	ca.bifMtx.Lock()
+	ca.closed = true
+	chans := make([]*pdChan, 0, len(ca.bifPdChans))
+	for _, ch := range ca.bifPdChans {
+		chans = append(chans, ch)
+	}
+	ca.bifMtx.Unlock()
+	for _, ch := range chans {
+		ch.mtx.Lock()
+		ch.closed = true
+		ch.mtx.Unlock()
+		ch.cond.Broadcast()
+	}
+}
+
 func (ca *ca) addToResendChannel(m *msg.UDPMessage) {
 	ca.resendChan.mtx.Lock()
 	ca.resendChan.pd.ReplaceOrInsert(m)
@@ -1064,37 +1531,37 @@ func (ca *ca) popMessage() (m *msg.UDPMessage) {
 	}
 	ca.resendChan.mtx.Unlock()
 
+	cwnd := ca.getCwnd()
 	ca.cwndMtx.Lock()
 	defer ca.cwndMtx.Unlock()
-	if ca.cwnd < ca.usedCwnd+1 {
-		logrus.Debugf("popMessage cwnd %d used %d", ca.cwnd, ca.usedCwnd)
+	if cwnd < ca.usedCwnd+1 {
+		logrus.Debugf("popMessage cwnd %d used %d", cwnd, ca.usedCwnd)
 		return
 	}
 
 	ca.bifMtx.Lock()
 	defer ca.bifMtx.Unlock()
 	defer ca.gcChannel()
-OUT:
-	for _, v := range ca.bifPdChans {
+	// weighted round robin, a channel keeps the turn for the weight of its
+	// priority class, so bulk channels can't hold back interactive ones
+	n := len(ca.pdOrder)
+	for i := 0; i < n; i++ {
+		index := ca.pdNext % n
+		v := ca.bifPdChans[ca.pdOrder[index]]
 		v.mtx.Lock()
-		pd := v.pd
-		if pd.Len() < 1 {
+		m = v.pop()
+		if m == nil {
+			v.served = 0
 			v.mtx.Unlock()
+			ca.pdNext = index + 1
 			continue
 		}
-		for {
-			element := pd.Min()
-			if element == nil {
-				v.mtx.Unlock()
-				continue OUT
-			}
-			m = element.(*msg.UDPMessage)
-			pd.DeleteMin()
-			if m.IsAcked() {
-				m = nil
-				continue
-			}
-			break
+		v.served++
+		if v.served >= priorityWeights[v.priority] {
+			v.served = 0
+			ca.pdNext = index + 1
+		} else {
+			ca.pdNext = index
 		}
 
 		ca.usedCwnd++
@@ -1109,6 +1576,21 @@ OUT:
 	return
 }
 
+// call it with mtx held
+func (pd *pdChan) pop() (m *msg.UDPMessage) {
+	for {
+		element := pd.pd.Min()
+		if element == nil {
+			return nil
+		}
+		m = element.(*msg.UDPMessage)
+		pd.pd.DeleteMin()
+		if !m.IsAcked() {
+			return
+		}
+	}
+}
+
 func (ca *ca) gcChannel() {
 	var ids []int
 	for id, v := range ca.bifPdChans {
@@ -1119,9 +1601,19 @@ func (ca *ca) gcChannel() {
 		}
 		v.mtx.Unlock()
 	}
+	if len(ids) < 1 {
+		return
+	}
 	for _, id := range ids {
 		delete(ca.bifPdChans, id)
 	}
+	order := ca.pdOrder[:0]
+	for _, id := range ca.pdOrder {
+		if _, ok := ca.bifPdChans[id]; ok {
+			order = append(order, id)
+		}
+	}
+	ca.pdOrder = order
 }
 
 func (ca *ca) getBytesInFlight() (r int) {
@@ -1132,9 +1624,12 @@ func (ca *ca) getBytesInFlight() (r int) {
 }
 
 func (ca *ca) getCwnd() (cwnd uint32) {
-	ca.cwndMtx.Lock()
-	cwnd = ca.cwnd
-	ca.cwndMtx.Unlock()
+	ca.ccMtx.Lock()
+	cwnd = ca.cc.Cwnd()
+	ca.ccMtx.Unlock()
+	if cwnd < MIN_CWND {
+		cwnd = MIN_CWND
+	}
 	return
 }
 
@@ -1146,37 +1641,37 @@ func (ca *ca) getUsedCwnd() (cwnd uint32) {
 }
 
 func (ca *ca) isCwndFull() (r bool) {
+	cwnd := ca.getCwnd()
 	ca.cwndMtx.Lock()
-	r = ca.usedCwnd >= ca.cwnd
+	r = ca.usedCwnd >= cwnd
 	ca.cwndMtx.Unlock()
 	return
 }
 
-func (ca *ca) setCwnd(cwnd uint32) {
-	if cwnd < 4 {
-		cwnd = 4
-	} else if cwnd > MAX_CWND {
-		cwnd = MAX_CWND
+func (ca *ca) getPacingRate() (rate uint64) {
+	ca.ccMtx.Lock()
+	rate = ca.cc.PacingRate()
+	ca.ccMtx.Unlock()
+	if rate < 1 {
+		rate = 1
 	}
-
-	ca.cwndMtx.Lock()
-	ca.cwnd = cwnd
-	ca.cwndMtx.Unlock()
-}
-
-func (ca *ca) getPacingRate() uint64 {
-	return atomic.LoadUint64(&ca.pacingRate)
-}
-
-func (ca *ca) setPacingRate(rate uint64) {
-	atomic.StoreUint64(&ca.pacingRate, rate)
+	return
 }
 
+// calcPacingTime returns the time until the next packet may be sent. The
+// pacing times add up, so packets due while the timer was late go out at
+// once.
 func (ca *ca) calcPacingTime(len int) (d time.Duration) {
 	d = time.Duration(uint64(len) * 1000000000 / ca.getPacingRate())
-	r := time.Now().Add(d)
+	now := time.Now()
+	r := ca.nextPacingTime
+	if r.Before(now.Add(-MAX_PACING_CREDIT)) {
+		r = now.Add(-MAX_PACING_CREDIT)
+	}
+	r = r.Add(d)
 	logrus.Debugf("calcPacingTime %s", d)
 	ca.nextPacingTime = r
+	d = r.Sub(now)
 	return
 }
 
@@ -1185,114 +1680,3 @@ func (ca *ca) isPacingTime() (r bool) {
 	logrus.Debugf("nextPacingTime %s %t", ca.nextPacingTime, r)
 	return
 }
-
-func (ca *ca) checkAppLimited(seq uint32) {
-	pd := atomic.LoadInt32(&ca.pendingCnt)
-	if pd > 0 {
-		return
-	}
-	if ca.isCwndFull() {
-		return
-	}
-	ca.setAppLimited(seq)
-}
-
-func (ca *ca) tryToCancelAppLimited(seq uint32) {
-	if ca.appLimited && seq > ca.endOfLimited {
-		ca.appLimited = false
-	}
-}
-
-func (ca *ca) setAppLimited(seq uint32) {
-	ca.Lock()
-	ca.appLimited = true
-	ca.endOfLimited = seq
-	ca.Unlock()
-}
-
-func (ca *ca) isAppLimited() (r bool) {
-	r = ca.appLimited
-	return
-}
-
-func (ca *ca) fullBwReached() bool {
-	return ca.fullBwCnt >= fullBwCnt
-}
-
-func (ca *ca) checkFullBwReached() {
-	if ca.fullBwReached() || ca.isAppLimited() {
-		return
-	}
-
-	bwt := ca.fullBw * fullBwThresh >> BBR_SCALE
-	max := ca.bwFilter.GetBest()
-	if max >= bwt {
-		ca.fullBw = max
-		ca.fullBwCnt = 0
-		return
-	}
-	ca.fullBwCnt++
-}
-
-func (ca *ca) checkDrain(bw, rtt uint64) {
-	if ca.mode == startup && ca.fullBwReached() {
-		ca.mode = drain
-		ca.pacingGain = drainGain
-		ca.cwndGain = highGain
-	}
-	if ca.mode == drain {
-		pcwnd := ca.targetCwnd(bw, rtt, BBR_UNIT)
-		if ca.getUsedCwnd() <= pcwnd {
-			ca.mode = probeBW
-			ca.cwndGain = cwndGain
-			ca.pacingGain = BBR_UNIT
-		}
-	}
-}
-
-func (ca *ca) updateRoundTripCounter(seq uint32) bool {
-	ca.roundTripMutex.Lock()
-	defer ca.roundTripMutex.Unlock()
-	if seq > ca.currentTripEnd {
-		ca.roundTripCount++
-		ca.currentTripEnd = ca.lastSentSeq
-		return true
-	}
-	return false
-}
-
-func (ca *ca) updateLastSentSeq(seq uint32) {
-	ca.roundTripMutex.Lock()
-	ca.lastSentSeq = seq
-	ca.roundTripMutex.Unlock()
-}
-
-func (ca *ca) getRoundTripCount() (c roundTripCount) {
-	ca.roundTripMutex.RLock()
-	c = ca.roundTripCount
-	ca.roundTripMutex.RUnlock()
-	return
-}
-
-func (ca *ca) targetCwnd(bw, rtt uint64, gain int) uint32 {
-	cwnd := uint32((((bw * rtt * uint64(ca.cwndGain)) >> BBR_SCALE) + BW_UNIT - 1) / BW_UNIT)
-	cwnd = (cwnd + 1) & ^uint32(1)
-	return cwnd
-}
-
-func (ca *ca) updateGainCyclePhase(bw, rtt uint64) {
-	b := time.Now().Sub(ca.lastCycleStart) > time.Duration(ca.rttSamples.getMin())
-	if ca.pacingGain > BBR_UNIT && ca.getUsedCwnd() < ca.targetCwnd(bw, rtt, ca.pacingGain) {
-		b = false
-	}
-
-	if ca.pacingGain < BBR_UNIT && ca.getUsedCwnd() <= ca.targetCwnd(bw, rtt, BBR_UNIT) {
-		b = true
-	}
-
-	if b {
-		ca.cycleOffset = (ca.cycleOffset + 1) % gainCycleLength
-		ca.lastCycleStart = time.Now()
-		ca.pacingGain = pacingGain[ca.cycleOffset]
-	}
-}
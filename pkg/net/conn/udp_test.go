@@ -1,6 +1,15 @@
 package conn
 
-import "testing"
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skywire/pkg/net/msg"
+	"github.com/skycoin/skywire/pkg/net/wheel"
+)
 
 func TestRtt_Less(t *testing.T) {
 	rs := newRttSampler(4)
@@ -16,3 +25,273 @@ func TestRtt_Less(t *testing.T) {
 	t.Log(rs.push(9))
 	t.Log(rs.push(10))
 }
+
+func TestUDPConn_Migrate(t *testing.T) {
+	ca, cb := newCryptoPair(t)
+	ca.EnableAEAD()
+	oldAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+	newAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2000}
+	a := NewUDPConn(nil, oldAddr)
+	a.SetCrypto(ca)
+	a.SetConnID(NewConnID())
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	b := NewUDPConn(ln, oldAddr)
+	defer b.Close()
+	b.SetCrypto(cb)
+	b.SetConnID(a.GetConnID())
+	var migrated *net.UDPAddr
+	b.OnMigrate = func(from, to *net.UDPAddr) {
+		migrated = to
+	}
+
+	seal := func(seq uint32, id uint32) []byte {
+		m := msg.NewUDP(msg.TYPE_NORMAL, seq, []byte("hello skywire"))
+		p := m.PkgBytes()
+		a.setConnIDHeader(p[msg.PKG_HEADER_SIZE:])
+		p, err := a.encrypt(a.GetCrypto(), p, uint64(seq))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// forged ids don't authenticate
+		if id != a.GetConnID() {
+			p[msg.PKG_HEADER_SIZE+msg.UDP_CONN_ID_BEGIN] ^= 0xff
+		}
+		return p[msg.PKG_HEADER_SIZE:]
+	}
+
+	if err := b.ProcessFrom(msg.TYPE_AEAD, seal(1, 0), newAddr); err != nil {
+		t.Fatal(err)
+	}
+	if migrated != nil || b.GetRemoteAddr().String() != oldAddr.String() {
+		t.Fatalf("migrated to %s with a forged id", b.GetRemoteAddr())
+	}
+	if err := b.ProcessFrom(msg.TYPE_AEAD, seal(2, a.GetConnID()), newAddr); err != nil {
+		t.Fatal(err)
+	}
+	if migrated != newAddr || b.GetRemoteAddr().String() != newAddr.String() {
+		t.Fatalf("remote addr %s", b.GetRemoteAddr())
+	}
+
+	// another peer that picked the same id seals with other keys
+	if !b.Authenticates(seal(3, a.GetConnID())) {
+		t.Fatal("msg of the peer not authenticated")
+	}
+	other, _ := newCryptoPair(t)
+	other.EnableAEAD()
+	a.SetCrypto(other)
+	if b.Authenticates(seal(3, a.GetConnID())) {
+		t.Fatal("msg of another peer authenticated")
+	}
+}
+
+func TestUDPConn_ForgedAck(t *testing.T) {
+	ca, cb := newCryptoPair(t)
+	ca.EnableAEAD()
+	cb.EnableAEAD()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+	a := NewUDPConn(nil, addr)
+	a.SetCrypto(ca)
+	b := NewUDPConn(nil, addr)
+	b.SetCrypto(cb)
+	for seq := uint32(1); seq <= 2; seq++ {
+		b.AddMsg(seq, msg.NewUDP(msg.TYPE_NORMAL, seq, nil))
+	}
+
+	ack := func() []byte {
+		p := make([]byte, msg.PKG_HEADER_SIZE+msg.ACK_HEADER_SIZE)
+		m := p[msg.PKG_HEADER_SIZE:]
+		m[msg.ACK_TYPE_BEGIN] = msg.TYPE_ACK
+		binary.BigEndian.PutUint32(m[msg.ACK_SEQ_BEGIN:], 2)
+		binary.BigEndian.PutUint32(m[msg.ACK_NEXT_SEQ_BEGIN:], 2)
+		return p
+	}
+	fin := []byte{msg.TYPE_FIN}
+	if err := b.RecvAck(ack()[msg.PKG_HEADER_SIZE:]); err != nil {
+		t.Fatal(err)
+	}
+	sack := sackMsg(2, 2, nil)
+	if err := b.RecvSAck(sack[msg.PKG_HEADER_SIZE:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RecvFin(fin); err != nil {
+		t.Fatalf("unsealed fin err %v", err)
+	}
+	// the ack info of a sealed msg can't be changed
+	m := msg.NewUDP(msg.TYPE_NORMAL, 1, []byte("hello skywire"))
+	p, err := a.encrypt(a.GetCrypto(), m.PkgBytes(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(p[msg.PKG_HEADER_SIZE+msg.UDP_ACK_SEQ_BEGIN:], 2)
+	binary.BigEndian.PutUint32(p[msg.PKG_HEADER_SIZE+msg.UDP_ACK_NEXT_SEQ_BEGIN:], 2)
+	if err := b.ProcessFrom(msg.TYPE_AEAD, p[msg.PKG_HEADER_SIZE:], nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.UDPPendingMap.Len(); n != 2 {
+		t.Fatalf("forged acks left %d msgs", n)
+	}
+
+	sealed, err := a.sealControl(ack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RecvAck(sealed[msg.PKG_HEADER_SIZE:]); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.UDPPendingMap.Len(); n != 0 {
+		t.Fatalf("sealed ack left %d msgs", n)
+	}
+	sealed, err = a.sealControl(append(make([]byte, msg.PKG_HEADER_SIZE), fin...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RecvFin(sealed[msg.PKG_HEADER_SIZE:]); err != ErrFin {
+		t.Fatalf("sealed fin err %v", err)
+	}
+}
+
+func TestUDPConn_SeqExhausted(t *testing.T) {
+	c := NewUDPConn(nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000})
+	c.seq = 1<<32 - 2
+	if seq, err := c.GetNextSeq(); err != nil || seq != 1<<32-1 {
+		t.Fatalf("seq %d err %v", seq, err)
+	}
+	if _, err := c.GetNextSeq(); err != ErrSeqExhausted {
+		t.Fatalf("wrapped seq err %v", err)
+	}
+}
+
+func TestUDPConn_Stats(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+	c := NewUDPConn(nil, addr)
+	c.SetCongestionController(NewFixed(20, 1000))
+	c.AddSentBytes(10)
+	s := c.Stats()
+	if s.Type != "udp" || s.RemoteAddr != addr.String() || s.SentBytes != 10 {
+		t.Fatalf("stats %+v", s)
+	}
+	if s.Cwnd != 20 || s.PacingRate != 1000 || s.PLPMTU != BASE_PLPMTU || s.PayloadSize != MAX_UDP_PACKAGE_SIZE {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestUDPConn_Drain(t *testing.T) {
+	c := NewUDPConn(nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000})
+	if err := c.Drain(time.Second); err != nil {
+		t.Fatalf("drain idle conn err %v", err)
+	}
+	c.AddMsg(1, msg.NewUDP(msg.TYPE_NORMAL, 1, nil))
+	if err := c.Drain(50 * time.Millisecond); err != ErrDrainTimeout {
+		t.Fatalf("drain pending conn err %v", err)
+	}
+}
+
+func TestCA_PopMessagePriority(t *testing.T) {
+	ca := newCA()
+	ca.setCongestionController(NewFixed(MAX_CWND, 1000))
+	bulk := ca.newPendingChannel()
+	if err := ca.setChannelPriority(bulk, PRIORITY_BULK); err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.setChannelPriority(bulk, len(priorityWeights)); err == nil {
+		t.Fatal("invalid priority set")
+	}
+	interactive := ca.newPendingChannel()
+	for i := 0; i < 3; i++ {
+		ca.addToPendingChannel(bulk, msg.NewUDPWithoutSeq(msg.TYPE_NORMAL, []byte{byte(bulk)}))
+		ca.addToPendingChannel(interactive, msg.NewUDPWithoutSeq(msg.TYPE_NORMAL, []byte{byte(interactive)}))
+	}
+	var order []byte
+	for m := ca.popMessage(); m != nil; m = ca.popMessage() {
+		order = append(order, m.Body[0])
+	}
+	// the bulk channel gets one msg per turn, the interactive one up to its weight
+	expected := []byte{byte(bulk), byte(interactive), byte(interactive), byte(interactive), byte(bulk), byte(bulk)}
+	if string(order) != string(expected) {
+		t.Fatalf("order %v, expected %v", order, expected)
+	}
+}
+
+func TestCA_ClosedDoesNotBlock(t *testing.T) {
+	ca := newCA()
+	channel := ca.newPendingChannel()
+	for i := 0; i < 3; i++ {
+		ca.addToPendingChannel(channel, msg.NewUDPWithoutSeq(msg.TYPE_NORMAL, nil))
+	}
+	done := make(chan struct{})
+	go func() {
+		// the channel is full, it waits for the conn to send
+		ca.addToPendingChannel(channel, msg.NewUDPWithoutSeq(msg.TYPE_NORMAL, nil))
+		ca.addToPendingChannel(ca.newPendingChannel(), msg.NewUDPWithoutSeq(msg.TYPE_NORMAL, nil))
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	ca.close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write to a closed conn blocked")
+	}
+}
+
+// conns on one wheel send their delayed acks over real sockets, the wheel
+// keeps firing on time as the acks are written by the WriteLoops
+func BenchmarkUDPConn_DelayedAcks(b *testing.B) {
+	const conns = 64
+	w := wheel.New(wheel.TICK)
+	defer w.Stop()
+	peer := listenUDP(b, "127.0.0.1:0")
+	defer peer.Close()
+	cs := make([]*UDPConn, conns)
+	for i := range cs {
+		c := NewUDPConn(listenUDP(b, "127.0.0.1:0"), peer.LocalAddr().(*net.UDPAddr))
+		c.UnsharedUdpConn = true
+		c.SetTimerWheel(w)
+		go c.WriteLoop()
+		defer c.Close()
+		cs[i] = c
+	}
+
+	// a timer rearmed every tick measures how late the wheel fires
+	var late, fired, stop int64
+	var armed time.Time
+	var t *wheel.Timer
+	t = w.NewTimer(func() {
+		atomic.AddInt64(&late, int64(time.Since(armed)-wheel.TICK))
+		atomic.AddInt64(&fired, 1)
+		if atomic.LoadInt64(&stop) == 0 {
+			armed = time.Now()
+			t.Reset(wheel.TICK)
+		}
+	})
+	armed = time.Now()
+	t.Reset(wheel.TICK)
+
+	buf := make([]byte, MTU)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, c := range cs {
+			if err := c.process(msg.TYPE_SYN, uint32(i+1), false, []byte("ping")); err != nil {
+				b.Fatal(err)
+			}
+			<-c.In
+		}
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for n := 0; n < conns; n++ {
+			if _, _, err := peer.ReadFrom(buf); err != nil {
+				b.Fatalf("%d of %d acks, err %v", n, conns, err)
+			}
+		}
+	}
+	b.StopTimer()
+	atomic.StoreInt64(&stop, 1)
+	t.Stop()
+	b.ReportMetric(float64(b.N*conns)/b.Elapsed().Seconds(), "acks/s")
+	if n := atomic.LoadInt64(&fired); n > 0 {
+		b.ReportMetric(float64(atomic.LoadInt64(&late)/n)/float64(time.Microsecond), "late-us")
+	}
+}
@@ -0,0 +1,122 @@
+package emulator
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errClosed = errors.New("use of closed network connection")
+
+type datagram struct {
+	b    []byte
+	from *net.UDPAddr
+}
+
+// PacketConn is a socket of a Network, it implements net.PacketConn
+type PacketConn struct {
+	network *Network
+	addr    *net.UDPAddr
+	in      chan datagram
+	// the bandwidth is used until then, guarded by the network
+	busyUntil time.Time
+
+	readDeadline time.Time
+	closed       chan struct{}
+	closeOnce    sync.Once
+	mtx          sync.Mutex
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (c *PacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	c.mtx.Lock()
+	deadline := c.readDeadline
+	c.mtx.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case d := <-c.in:
+		n = copy(b, d.b)
+		addr = d.from
+	case <-c.closed:
+		err = c.opError("read", errClosed)
+	case <-timeout:
+		err = c.opError("read", timeoutError{})
+	}
+	return
+}
+
+// WriteTo never blocks, datagrams the network can't carry are dropped
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	select {
+	case <-c.closed:
+		err = c.opError("write", errClosed)
+		return
+	default:
+	}
+	if addr == nil {
+		err = c.opError("write", errors.New("missing address"))
+		return
+	}
+	c.network.send(c, addr.String(), append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *PacketConn) deliver(d datagram) {
+	select {
+	case <-c.closed:
+		atomic.AddUint64(&c.network.dropped, 1)
+		return
+	default:
+	}
+	select {
+	case c.in <- d:
+		atomic.AddUint64(&c.network.delivered, 1)
+	default:
+		// the socket buffer is full
+		atomic.AddUint64(&c.network.dropped, 1)
+	}
+}
+
+func (c *PacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.network.remove(c)
+	})
+	return nil
+}
+
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.mtx.Lock()
+	c.readDeadline = t
+	c.mtx.Unlock()
+	return nil
+}
+
+// writes don't block so there is nothing to time out
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *PacketConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Addr: c.addr, Err: err}
+}
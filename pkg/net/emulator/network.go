@@ -0,0 +1,201 @@
+// Package emulator is an in-process network of net.PacketConn sockets that
+// drops, duplicates, reorders, delays and throttles datagrams, so the udp
+// stack can be tested without real links.
+package emulator
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Profile is what datagrams suffer on their way, the zero value is a perfect
+// link
+type Profile struct {
+	// probability of a datagram being dropped
+	Loss float64
+	// probability of a datagram being delivered twice
+	Duplicate float64
+	// probability of a datagram being held back by ReorderDelay so that the
+	// next ones overtake it
+	Reorder      float64
+	ReorderDelay time.Duration
+	// one way delay, each datagram gets a random variation within Jitter
+	Latency time.Duration
+	Jitter  time.Duration
+	// bytes per second leaving a socket, 0 is unlimited
+	Bandwidth int
+	// bytes waiting for the bandwidth before new datagrams are dropped, 0 is
+	// unlimited
+	QueueSize int
+	// bigger datagrams are dropped, 0 is unlimited
+	MTU int
+}
+
+var (
+	Perfect = Profile{}
+	LAN     = Profile{Latency: time.Millisecond, Bandwidth: 100 * 1024 * 1024}
+	WAN     = Profile{Latency: 30 * time.Millisecond, Jitter: 5 * time.Millisecond, Loss: 0.01,
+		Bandwidth: 4 * 1024 * 1024, QueueSize: 256 * 1024, MTU: 1500}
+	Lossy = Profile{Latency: 10 * time.Millisecond, Jitter: 5 * time.Millisecond, Loss: 0.1,
+		Duplicate: 0.02, Reorder: 0.05, ReorderDelay: 20 * time.Millisecond}
+	Mobile = Profile{Latency: 80 * time.Millisecond, Jitter: 40 * time.Millisecond, Loss: 0.03,
+		Duplicate: 0.01, Reorder: 0.02, ReorderDelay: 50 * time.Millisecond,
+		Bandwidth: 512 * 1024, QueueSize: 64 * 1024, MTU: 1400}
+)
+
+// the sockets buffer this many datagrams nobody read yet
+const SOCKET_BUFFER = 1024
+
+// Stats are the counters of a network
+type Stats struct {
+	Sent       uint64
+	Delivered  uint64
+	Dropped    uint64
+	Duplicated uint64
+}
+
+// Network connects the sockets listening on it
+type Network struct {
+	profile  Profile
+	rand     *rand.Rand
+	conns    map[string]*PacketConn
+	nextPort int
+	mtx      sync.Mutex
+
+	sent       uint64
+	delivered  uint64
+	dropped    uint64
+	duplicated uint64
+}
+
+// NewNetwork creates a network, the same seed drops the same datagrams
+func NewNetwork(profile Profile, seed int64) *Network {
+	return &Network{
+		profile:  profile,
+		rand:     rand.New(rand.NewSource(seed)),
+		conns:    make(map[string]*PacketConn),
+		nextPort: 10000,
+	}
+}
+
+func (n *Network) SetProfile(p Profile) {
+	n.mtx.Lock()
+	n.profile = p
+	n.mtx.Unlock()
+}
+
+func (n *Network) GetProfile() (p Profile) {
+	n.mtx.Lock()
+	p = n.profile
+	n.mtx.Unlock()
+	return
+}
+
+func (n *Network) Stats() Stats {
+	return Stats{
+		Sent:       atomic.LoadUint64(&n.sent),
+		Delivered:  atomic.LoadUint64(&n.delivered),
+		Dropped:    atomic.LoadUint64(&n.dropped),
+		Duplicated: atomic.LoadUint64(&n.duplicated),
+	}
+}
+
+// ListenPacket opens a socket like net.ListenPacket, port 0 picks a free one
+func (n *Network) ListenPacket(address string) (c *PacketConn, err error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if addr.Port == 0 {
+		for {
+			addr.Port = n.nextPort
+			n.nextPort++
+			if _, ok := n.conns[addr.String()]; !ok {
+				break
+			}
+		}
+	}
+	if _, ok := n.conns[addr.String()]; ok {
+		err = fmt.Errorf("address %s in use", addr)
+		return
+	}
+	c = &PacketConn{
+		network: n,
+		addr:    addr,
+		in:      make(chan datagram, SOCKET_BUFFER),
+		closed:  make(chan struct{}),
+	}
+	n.conns[addr.String()] = c
+	return
+}
+
+func (n *Network) remove(c *PacketConn) {
+	n.mtx.Lock()
+	if n.conns[c.addr.String()] == c {
+		delete(n.conns, c.addr.String())
+	}
+	n.mtx.Unlock()
+}
+
+// send schedules the delivery of b to the socket at to
+func (n *Network) send(from *PacketConn, to string, b []byte) {
+	atomic.AddUint64(&n.sent, 1)
+	n.mtx.Lock()
+	p := n.profile
+	dst, ok := n.conns[to]
+	if !ok || (p.MTU > 0 && len(b) > p.MTU) || n.rand.Float64() < p.Loss {
+		n.mtx.Unlock()
+		atomic.AddUint64(&n.dropped, 1)
+		return
+	}
+	now := time.Now()
+	var queueing time.Duration
+	if p.Bandwidth > 0 {
+		if from.busyUntil.Before(now) {
+			from.busyUntil = now
+		}
+		queueing = from.busyUntil.Sub(now)
+		queued := int(queueing.Seconds() * float64(p.Bandwidth))
+		if p.QueueSize > 0 && queued+len(b) > p.QueueSize {
+			n.mtx.Unlock()
+			atomic.AddUint64(&n.dropped, 1)
+			return
+		}
+		from.busyUntil = from.busyUntil.Add(time.Duration(len(b)) * time.Second / time.Duration(p.Bandwidth))
+		queueing = from.busyUntil.Sub(now)
+	}
+	delays := []time.Duration{n.delay(p, queueing)}
+	if n.rand.Float64() < p.Duplicate {
+		delays = append(delays, n.delay(p, queueing))
+		atomic.AddUint64(&n.duplicated, 1)
+	}
+	n.mtx.Unlock()
+
+	d := datagram{b: b, from: from.addr}
+	for _, delay := range delays {
+		time.AfterFunc(delay, func() {
+			dst.deliver(d)
+		})
+	}
+}
+
+// call it with mtx held
+func (n *Network) delay(p Profile, queueing time.Duration) (d time.Duration) {
+	d = queueing + p.Latency
+	if p.Jitter > 0 {
+		d += time.Duration(n.rand.Int63n(int64(2*p.Jitter)+1)) - p.Jitter
+	}
+	if n.rand.Float64() < p.Reorder {
+		d += p.ReorderDelay
+	}
+	if d < 0 {
+		d = 0
+	}
+	return
+}
@@ -0,0 +1,81 @@
+package emulator
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNetwork(t *testing.T) {
+	n := NewNetwork(Profile{Loss: 0.2, Duplicate: 0.1, MTU: 100}, 1)
+	a, err := n.ListenPacket("10.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := n.ListenPacket("10.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err = n.ListenPacket(b.LocalAddr().String()); err == nil {
+		t.Fatal("listened twice on the same address")
+	}
+
+	const count = 500
+	for i := 0; i < count; i++ {
+		a.WriteTo([]byte{byte(i)}, b.LocalAddr())
+	}
+	a.WriteTo(make([]byte, 101), b.LocalAddr())
+
+	received := 0
+	b.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buf := make([]byte, 200)
+	for {
+		l, addr, err := b.ReadFrom(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); !ok || !e.Timeout() {
+				t.Fatal(err)
+			}
+			break
+		}
+		if l != 1 || addr.String() != a.LocalAddr().String() {
+			t.Fatalf("read %d bytes from %s", l, addr)
+		}
+		received++
+	}
+	s := n.Stats()
+	if s.Sent != count+1 || uint64(received) != s.Delivered || s.Delivered+s.Dropped != s.Sent+s.Duplicated {
+		t.Fatalf("received %d, %+v", received, s)
+	}
+	if s.Dropped < count/10 || s.Dropped > count/3 || s.Duplicated == 0 {
+		t.Fatalf("%+v", s)
+	}
+}
+
+func TestNetwork_Bandwidth(t *testing.T) {
+	n := NewNetwork(Profile{Bandwidth: 100 * 1000, QueueSize: 10 * 1000}, 1)
+	a, _ := n.ListenPacket("10.0.0.1:0")
+	defer a.Close()
+	b, _ := n.ListenPacket("10.0.0.2:0")
+	defer b.Close()
+
+	// the queue takes 100ms of the bandwidth, the rest is dropped
+	for i := 0; i < 20; i++ {
+		a.WriteTo(make([]byte, 1000), b.LocalAddr())
+	}
+	start := time.Now()
+	buf := make([]byte, 1000)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 10; i++ {
+		if _, _, err := b.ReadFrom(buf); err != nil {
+			t.Fatalf("read %d err %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("10KB in %s at 100KB/s", elapsed)
+	}
+	if s := n.Stats(); s.Dropped != 10 {
+		t.Fatalf("%+v", s)
+	}
+}
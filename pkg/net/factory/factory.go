@@ -1,6 +1,10 @@
 package factory
 
-import "sync"
+import (
+	"sync"
+
+	"github.com/skycoin/skywire/pkg/net/conn"
+)
 
 type Factory interface {
 	Listen(address string) error
@@ -13,6 +17,9 @@ type Factory interface {
 type FactoryCommonFields struct {
 	AcceptedCallback func(connection *Connection)
 
+	// timeouts of the conns, set it before Listen or Connect
+	Options conn.Options
+
 	connections      map[*Connection]struct{}
 	connectionsMutex sync.RWMutex
 
@@ -23,7 +30,11 @@ type FactoryCommonFields struct {
 }
 
 func NewFactoryCommonFields() FactoryCommonFields {
-	return FactoryCommonFields{connections: make(map[*Connection]struct{}), acceptedConnections: make(map[*Connection]struct{})}
+	return FactoryCommonFields{
+		Options:             conn.DefaultOptions(),
+		connections:         make(map[*Connection]struct{}),
+		acceptedConnections: make(map[*Connection]struct{}),
+	}
 }
 
 func (f *FactoryCommonFields) AddConn(conn *Connection) {
@@ -6,6 +6,7 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/skycoin/skywire/pkg/net/client"
+	"github.com/skycoin/skywire/pkg/net/conn"
 	"github.com/skycoin/skywire/pkg/net/server"
 )
 
@@ -56,6 +57,7 @@ func (factory *TCPFactory) Close() error {
 
 func (factory *TCPFactory) createConn(c *net.TCPConn) *Connection {
 	tcpConn := server.NewServerTCPConn(c)
+	tcpConn.SetOptions(factory.Options)
 	tcpConn.SetStatusToConnected()
 	conn := newConnection(tcpConn, factory)
 	conn.SetContextLogger(conn.GetContextLogger().WithField("type", "tcp"))
@@ -65,11 +67,17 @@ func (factory *TCPFactory) createConn(c *net.TCPConn) *Connection {
 }
 
 func (factory *TCPFactory) Connect(address string) (conn *Connection, err error) {
+	return factory.ConnectWithOptions(address, factory.Options)
+}
+
+// ConnectWithOptions connects with other timeouts than the factory ones
+func (factory *TCPFactory) ConnectWithOptions(address string, options conn.Options) (conn *Connection, err error) {
 	c, err := net.Dial("tcp", address)
 	if err != nil {
 		return
 	}
 	cn := client.NewClientTCPConn(c)
+	cn.SetOptions(options)
 	cn.SetStatusToConnected()
 	conn = newConnection(cn, factory)
 	conn.SetContextLogger(conn.GetContextLogger().WithField("type", "tcp"))
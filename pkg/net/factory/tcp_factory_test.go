@@ -0,0 +1,64 @@
+package factory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skycoin/skywire/pkg/net/conn"
+)
+
+// the server closes a conn without msgs for TCPReadTimeout, the pings of a
+// client every TCPPingTickPeriod keep it open
+func TestTCPFactory_Options(t *testing.T) {
+	accepted := make(chan *Connection, 1)
+	server := NewTCPFactory()
+	server.Options.TCPReadTimeout = 200 * time.Millisecond
+	server.AcceptedCallback = func(connection *Connection) {
+		accepted <- connection
+	}
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name   string
+		ping   time.Duration
+		closed bool
+	}{
+		{"ping", 50 * time.Millisecond, false},
+		{"idle", time.Hour, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := NewTCPFactory()
+			defer client.Close()
+			options := conn.DefaultOptions()
+			options.TCPPingTickPeriod = tc.ping
+			out, err := client.ConnectWithOptions(server.listener.Addr().String(), options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+			// the first msg arms the read deadline of the server
+			if err = out.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			var in *Connection
+			select {
+			case in = <-accepted:
+			case <-time.After(5 * time.Second):
+				t.Fatal("conn not accepted")
+			}
+			select {
+			case <-in.GetDisconnectedChan():
+				if !tc.closed {
+					t.Fatal("conn with pings closed")
+				}
+			case <-time.After(time.Second):
+				if tc.closed {
+					t.Fatal("idle conn not closed")
+				}
+			}
+		})
+	}
+}
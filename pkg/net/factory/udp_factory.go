@@ -7,26 +7,37 @@ import (
 	"sync"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/skycoin/skywire/pkg/net/msg"
 
 	"github.com/skycoin/skywire/pkg/net/client"
 	"github.com/skycoin/skywire/pkg/net/conn"
 	"github.com/skycoin/skywire/pkg/net/server"
+	"github.com/skycoin/skywire/pkg/net/wheel"
 )
 
 type UDPFactory struct {
-	listener *net.UDPConn
+	listener net.PacketConn
 	server   *server.ServerUDPConn
 
 	FactoryCommonFields
 
 	udpConnMapMutex sync.RWMutex
 	udpConnMap      map[string]*Connection
+	// conns by connection id, they keep it when the remote address changes.
+	// The connecting side picks the id, two peers may pick the same one
+	udpConnIDMap map[uint32][]*Connection
 
 	stopGC chan struct{}
 
+	// drives the timers of all the conns
+	wheel *wheel.Wheel
+
 	BeforeReadOnConn func(m *msg.UDPMessage)
 	BeforeSendOnConn func(m *msg.UDPMessage)
+
+	// creates the congestion controller of new conns, BBR if nil
+	NewCongestionController func() conn.CongestionController
 }
 
 func NewUDPFactory() *UDPFactory {
@@ -34,8 +45,9 @@ func NewUDPFactory() *UDPFactory {
 		stopGC:              make(chan struct{}),
 		FactoryCommonFields: NewFactoryCommonFields(),
 		udpConnMap:          make(map[string]*Connection),
+		udpConnIDMap:        make(map[uint32][]*Connection),
+		wheel:               wheel.New(wheel.TICK),
 	}
-	go udpFactory.GC()
 	return udpFactory
 }
 
@@ -48,16 +60,44 @@ func (factory *UDPFactory) Listen(address string) error {
 	if err != nil {
 		return err
 	}
+	allowFragmentation(udp)
+	return factory.ListenPacket(udp)
+}
+
+// ListenPacket serves on a socket that is already open, like one of an
+// emulated network in tests
+func (factory *UDPFactory) ListenPacket(c net.PacketConn) error {
+	s := server.NewServerUDPConn(c)
 	factory.fieldsMutex.Lock()
-	factory.listener = udp
-	factory.server = server.NewServerUDPConn(udp)
+	factory.listener = c
+	factory.server = s
 	factory.fieldsMutex.Unlock()
+	go factory.GC()
 	go func() {
-		factory.server.ReadLoop(factory.createConn)
+		s.ReadLoop(factory.createConn)
 	}()
 	return nil
 }
 
+// LocalAddr returns the address of the socket listened on, nil before
+// Listen
+func (factory *UDPFactory) LocalAddr() (addr net.Addr) {
+	factory.fieldsMutex.RLock()
+	if factory.listener != nil {
+		addr = factory.listener.LocalAddr()
+	}
+	factory.fieldsMutex.RUnlock()
+	return
+}
+
+// only path mtu probes go out with the DF bit, msgs bigger than the path
+// get fragmented instead of lost
+func allowFragmentation(udp *net.UDPConn) {
+	if err := conn.AllowFragmentation(udp); err != nil {
+		logrus.Errorf("AllowFragmentation err %v", err)
+	}
+}
+
 func (factory *UDPFactory) Close() error {
 	factory.fieldsMutex.RLock()
 	defer factory.fieldsMutex.RUnlock()
@@ -73,22 +113,48 @@ func (factory *UDPFactory) Close() error {
 	factory.FactoryCommonFields.Close()
 	factory.server.Close()
 	factory.server = nil
+	factory.wheel.Stop()
 	return nil
 }
 
-func (factory *UDPFactory) createConn(c *net.UDPConn, addr *net.UDPAddr) *conn.UDPConn {
+func (factory *UDPFactory) createConn(c net.PacketConn, addr *net.UDPAddr, id uint32, m []byte) *conn.UDPConn {
 	factory.udpConnMapMutex.Lock()
-	if cc, ok := factory.udpConnMap[addr.String()]; ok {
+	if id != 0 {
+		// the conn migrates if the msg came from a new address
+		if cc, ok := factory.connByID(id, addr, m); ok {
+			factory.udpConnMapMutex.Unlock()
+			return cc.Connection.(*conn.UDPConn)
+		}
+	}
+	if cc, ok := factory.openConn(addr.String()); ok {
+		udpConn := cc.Connection.(*conn.UDPConn)
+		if id != 0 && udpConn.GetConnID() == 0 {
+			// the first msgs of the peer carried no id
+			udpConn.SetConnID(id)
+			factory.udpConnIDMap[id] = append(factory.udpConnIDMap[id], cc)
+		}
 		factory.udpConnMapMutex.Unlock()
-		return cc.Connection.(*conn.UDPConn)
+		return udpConn
 	}
 
 	udpConn := conn.NewUDPConn(c, addr)
+	udpConn.SetTimerWheel(factory.wheel)
+	udpConn.SetOptions(factory.Options)
+	if factory.NewCongestionController != nil {
+		udpConn.SetCongestionController(factory.NewCongestionController())
+	}
+	udpConn.SetConnID(id)
 	udpConn.BeforeRead = factory.BeforeReadOnConn
 	udpConn.BeforeSend = factory.BeforeSendOnConn
 	udpConn.SetStatusToConnected()
 	connection := newConnection(udpConn, factory)
+	udpConn.OnMigrate = func(from, to *net.UDPAddr) {
+		factory.migrate(connection, from, to)
+	}
 	factory.udpConnMap[addr.String()] = connection
+	if id != 0 {
+		factory.udpConnIDMap[id] = append(factory.udpConnIDMap[id], connection)
+	}
 	factory.udpConnMapMutex.Unlock()
 
 	connection.SetContextLogger(connection.GetContextLogger().WithField("type", "udp").
@@ -100,9 +166,9 @@ func (factory *UDPFactory) createConn(c *net.UDPConn, addr *net.UDPAddr) *conn.U
 	return udpConn
 }
 
-func (factory *UDPFactory) createConnAfterListen(addr *net.UDPAddr, skipBeforeCallbacks bool) (*Connection, bool) {
+func (factory *UDPFactory) createConnAfterListen(addr *net.UDPAddr, skipBeforeCallbacks bool, controller conn.CongestionController) (*Connection, bool) {
 	factory.udpConnMapMutex.Lock()
-	if cc, ok := factory.udpConnMap[addr.String()]; ok {
+	if cc, ok := factory.openConn(addr.String()); ok {
 		factory.udpConnMapMutex.Unlock()
 		return cc, false
 	}
@@ -112,31 +178,63 @@ func (factory *UDPFactory) createConnAfterListen(addr *net.UDPAddr, skipBeforeCa
 	factory.fieldsMutex.Unlock()
 
 	udpConn := conn.NewUDPConn(ln, addr)
+	udpConn.SetTimerWheel(factory.wheel)
+	udpConn.SetOptions(factory.Options)
+	if controller == nil && factory.NewCongestionController != nil {
+		controller = factory.NewCongestionController()
+	}
+	if controller != nil {
+		udpConn.SetCongestionController(controller)
+	}
 	if !skipBeforeCallbacks {
 		udpConn.BeforeRead = factory.BeforeReadOnConn
 		udpConn.BeforeSend = factory.BeforeSendOnConn
 	}
+	id := conn.NewConnID()
+	for len(factory.udpConnIDMap[id]) > 0 {
+		id = conn.NewConnID()
+	}
+	udpConn.SetConnID(id)
 	udpConn.SendPing = true
 	udpConn.SetStatusToConnected()
 	connection := newConnection(udpConn, factory)
+	udpConn.OnMigrate = func(from, to *net.UDPAddr) {
+		factory.migrate(connection, from, to)
+	}
 	factory.udpConnMap[addr.String()] = connection
+	factory.udpConnIDMap[id] = []*Connection{connection}
 	factory.udpConnMapMutex.Unlock()
 	factory.AddAcceptedConn(connection)
 	return connection, true
 }
 
+// migrate keys the conn by its new address
+func (factory *UDPFactory) migrate(connection *Connection, from, to *net.UDPAddr) {
+	factory.udpConnMapMutex.Lock()
+	if cc, ok := factory.udpConnMap[from.String()]; ok && cc == connection {
+		delete(factory.udpConnMap, from.String())
+	}
+	old, ok := factory.udpConnMap[to.String()]
+	factory.udpConnMap[to.String()] = connection
+	factory.udpConnMapMutex.Unlock()
+	if ok && old != connection {
+		// created by msgs without id that came before the migration
+		old.Close()
+	}
+}
+
 func (factory *UDPFactory) GC() {
-	ticker := time.NewTicker(time.Second * conn.UDP_GC_PERIOD)
+	period := factory.Options.WithDefaults().UDPGCPeriod
+	ticker := time.NewTicker(period)
 	for {
 		select {
 		case <-factory.stopGC:
 			return
 		case <-ticker.C:
-			nowUnix := time.Now().Unix()
 			var closed []string
 			factory.udpConnMapMutex.RLock()
 			for k, udp := range factory.udpConnMap {
-				if nowUnix-udp.GetLastTime() >= conn.UDP_GC_PERIOD {
+				if time.Since(time.Unix(udp.GetLastTime(), 0)) >= period {
 					udp.SetStatusToError(errors.New("udp gc timeout"))
 					udp.Close()
 					closed = append(closed, k)
@@ -148,7 +246,12 @@ func (factory *UDPFactory) GC() {
 			}
 			factory.udpConnMapMutex.Lock()
 			for _, u := range closed {
+				cc, ok := factory.udpConnMap[u]
+				if !ok {
+					continue
+				}
 				delete(factory.udpConnMap, u)
+				factory.deleteConnID(cc)
 			}
 			factory.udpConnMapMutex.Unlock()
 		}
@@ -164,7 +267,10 @@ func (factory *UDPFactory) Connect(address string) (conn *Connection, err error)
 	if err != nil {
 		return
 	}
+	allowFragmentation(udp)
 	cn := client.NewClientUDPConn(udp, addr)
+	cn.SetTimerWheel(factory.wheel)
+	cn.SetOptions(factory.Options)
 	cn.SetStatusToConnected()
 	conn = newConnection(cn, factory)
 	conn.SetContextLogger(conn.GetContextLogger().
@@ -175,12 +281,13 @@ func (factory *UDPFactory) Connect(address string) (conn *Connection, err error)
 	return
 }
 
-func (factory *UDPFactory) ConnectAfterListen(address string, skipBeforeCallbacks bool) (conn *Connection, err error) {
+// ConnectAfterListen creates a conn sharing the listening socket, a nil controller keeps the factory default
+func (factory *UDPFactory) ConnectAfterListen(address string, skipBeforeCallbacks bool, controller conn.CongestionController) (conn *Connection, err error) {
 	ra, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
 		return
 	}
-	conn, create := factory.createConnAfterListen(ra, skipBeforeCallbacks)
+	conn, create := factory.createConnAfterListen(ra, skipBeforeCallbacks, controller)
 	if !create {
 		return nil, nil
 	}
@@ -201,9 +308,67 @@ func (factory *UDPFactory) AddAcceptedConn(conn *Connection) {
 	}()
 }
 
-func (factory *UDPFactory) RemoveAcceptedConn(conn *Connection) {
+func (factory *UDPFactory) RemoveAcceptedConn(connection *Connection) {
 	factory.udpConnMapMutex.Lock()
-	delete(factory.udpConnMap, conn.GetRemoteAddr().String())
+	addr := connection.GetRemoteAddr().String()
+	// the address may belong to another conn after a migration
+	if cc, ok := factory.udpConnMap[addr]; ok && cc == connection {
+		delete(factory.udpConnMap, addr)
+	}
+	factory.deleteConnID(connection)
 	factory.udpConnMapMutex.Unlock()
-	factory.FactoryCommonFields.RemoveAcceptedConn(conn)
+	factory.FactoryCommonFields.RemoveAcceptedConn(connection)
+}
+
+// the conn of addr, a closed one whose writer did not exit yet gives the
+// address up to a new conn. Call it with udpConnMapMutex held.
+func (factory *UDPFactory) openConn(addr string) (cc *Connection, ok bool) {
+	cc, ok = factory.udpConnMap[addr]
+	if ok && cc.IsClosed() {
+		delete(factory.udpConnMap, addr)
+		factory.deleteConnID(cc)
+		return nil, false
+	}
+	return
+}
+
+// connByID returns the conn of id that the msg m from addr belongs to, the
+// one at addr or else the one m authenticates with. Another peer's msg with
+// the same id gets the conn of its own address. Call it with
+// udpConnMapMutex held.
+func (factory *UDPFactory) connByID(id uint32, addr *net.UDPAddr, m []byte) (cc *Connection, ok bool) {
+	conns := factory.udpConnIDMap[id]
+	for _, cc = range conns {
+		if cc.GetRemoteAddr().String() == addr.String() {
+			return cc, true
+		}
+	}
+	for _, cc = range conns {
+		if cc.Connection.(*conn.UDPConn).Authenticates(m) {
+			return cc, true
+		}
+	}
+	return nil, false
+}
+
+// call it with udpConnMapMutex held
+func (factory *UDPFactory) deleteConnID(connection *Connection) {
+	udpConn, ok := connection.Connection.(*conn.UDPConn)
+	if !ok {
+		return
+	}
+	id := udpConn.GetConnID()
+	conns := factory.udpConnIDMap[id]
+	for i, cc := range conns {
+		if cc != connection {
+			continue
+		}
+		conns = append(conns[:i:i], conns[i+1:]...)
+		if len(conns) == 0 {
+			delete(factory.udpConnIDMap, id)
+		} else {
+			factory.udpConnIDMap[id] = conns
+		}
+		return
+	}
 }
@@ -0,0 +1,386 @@
+package factory
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+	"github.com/skycoin/skywire/pkg/net/conn"
+	"github.com/skycoin/skywire/pkg/net/emulator"
+)
+
+func newCryptoPair(t *testing.T) (a, b *conn.Crypto) {
+	apk, ask := cipher.GenerateKeyPair()
+	bpk, bsk := cipher.GenerateKeyPair()
+	iv := cipher.RandByte(aes.BlockSize)
+	a = conn.NewCrypto(apk, ask)
+	b = conn.NewCrypto(bpk, bsk)
+	if err := a.SetTargetKey(bpk); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetTargetKey(apk); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Init(iv); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Init(iv); err != nil {
+		t.Fatal(err)
+	}
+	a.EnableAEAD()
+	b.EnableAEAD()
+	return
+}
+
+// newEmulatedPair connects two udp factories over an emulated network, the
+// returned conns are the sending and the accepting side
+func newEmulatedPair(t *testing.T, n *emulator.Network) (out, in *Connection, close func()) {
+	ca, cb := newCryptoPair(t)
+	pa, err := n.ListenPacket("10.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb, err := n.ListenPacket("10.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan *Connection, 1)
+	fa := NewUDPFactory()
+	fa.AcceptedCallback = func(connection *Connection) {
+		connection.SetCrypto(cb)
+		accepted <- connection
+	}
+	if err = fa.ListenPacket(pa); err != nil {
+		t.Fatal(err)
+	}
+	fb := NewUDPFactory()
+	fb.AcceptedCallback = func(connection *Connection) {}
+	if err = fb.ListenPacket(pb); err != nil {
+		t.Fatal(err)
+	}
+	out, err = fb.ConnectAfterListen(pa.LocalAddr().String(), true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.SetCrypto(ca)
+	// the first msg creates the conn of the accepting side
+	if err = out.Write(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case in = <-accepted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("conn not accepted")
+	}
+	select {
+	case <-in.GetChanIn():
+	case <-time.After(10 * time.Second):
+		t.Fatal("first msg not received")
+	}
+	return out, in, func() {
+		fb.Close()
+		fa.Close()
+	}
+}
+
+func TestUDPFactory_ConnIDCollision(t *testing.T) {
+	n := emulator.NewNetwork(emulator.Perfect, 1)
+	pa, err := n.ListenPacket("10.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *Connection, 2)
+	cryptos := make(map[string]*conn.Crypto)
+	fa := NewUDPFactory()
+	fa.AcceptedCallback = func(connection *Connection) {
+		connection.SetCrypto(cryptos[connection.GetRemoteAddr().String()])
+		accepted <- connection
+	}
+	if err = fa.ListenPacket(pa); err != nil {
+		t.Fatal(err)
+	}
+	defer fa.Close()
+
+	var id uint32
+	for i, address := range []string{"10.0.0.2:0", "10.0.0.3:0"} {
+		p, err := n.ListenPacket(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := NewUDPFactory()
+		f.AcceptedCallback = func(connection *Connection) {}
+		if err = f.ListenPacket(p); err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		out, err := f.ConnectAfterListen(pa.LocalAddr().String(), true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		udpConn := out.Connection.(*conn.UDPConn)
+		// both peers picked the same id
+		if id == 0 {
+			id = udpConn.GetConnID()
+		} else {
+			udpConn.SetConnID(id)
+		}
+		ca, cb := newCryptoPair(t)
+		cryptos[p.LocalAddr().String()] = cb
+		out.SetCrypto(ca)
+		if err = out.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		var in *Connection
+		select {
+		case in = <-accepted:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("peer %d not accepted", i)
+		}
+		if in.GetRemoteAddr().String() != p.LocalAddr().String() {
+			t.Fatalf("peer %d accepted as %s", i, in.GetRemoteAddr())
+		}
+		select {
+		case b := <-in.GetChanIn():
+			if len(b) != 1 || b[0] != byte(i) {
+				t.Fatalf("peer %d msg %x", i, b)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("msg of peer %d not received", i)
+		}
+	}
+}
+
+func TestUDPFactory_Emulated(t *testing.T) {
+	if testing.Short() {
+		t.Skip("emulated transfers take a few seconds")
+	}
+	cases := []struct {
+		name    string
+		profile emulator.Profile
+		msgs    int
+		// bytes per second the transfer has to reach
+		minRate float64
+	}{
+		{"perfect", emulator.Perfect, 2000, 512 * 1024},
+		{"lan", emulator.LAN, 2000, 512 * 1024},
+		{"wan", emulator.WAN, 1000, 256 * 1024},
+		{"lossy", emulator.Lossy, 500, 128 * 1024},
+		{"mobile", emulator.Mobile, 300, 32 * 1024},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n := emulator.NewNetwork(emulator.Perfect, 1)
+			out, in, close := newEmulatedPair(t, n)
+			defer close()
+			n.SetProfile(c.profile)
+
+			size := out.GetPayloadSize()
+			start := time.Now()
+			go func() {
+				for i := 0; i < c.msgs; i++ {
+					b := make([]byte, size)
+					binary.BigEndian.PutUint32(b, uint32(i))
+					if err := out.Write(b); err != nil {
+						return
+					}
+				}
+			}()
+
+			timeout := time.After(30 * time.Second)
+			for i := 0; i < c.msgs; i++ {
+				select {
+				case b, ok := <-in.GetChanIn():
+					if !ok {
+						t.Fatalf("conn closed after %d msgs", i)
+					}
+					if len(b) != size {
+						t.Fatalf("msg %d len %d", i, len(b))
+					}
+					// in order and exactly once
+					if seq := binary.BigEndian.Uint32(b); seq != uint32(i) {
+						t.Fatalf("msg %d received as %d", seq, i)
+					}
+				case <-timeout:
+					t.Fatalf("received %d of %d msgs, %+v", i, c.msgs, n.Stats())
+				}
+			}
+			elapsed := time.Since(start)
+			rate := float64(c.msgs*size) / elapsed.Seconds()
+			t.Logf("%d msgs in %s, %.0f B/s, %+v, %+v", c.msgs, elapsed, rate, n.Stats(), out.Stats())
+			if rate < c.minRate {
+				t.Fatalf("rate %.0f B/s below %.0f B/s", rate, c.minRate)
+			}
+			select {
+			case b := <-in.GetChanIn():
+				t.Fatalf("duplicate msg %d", binary.BigEndian.Uint32(b))
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestUDPFactory_EmulatedFragments(t *testing.T) {
+	n := emulator.NewNetwork(emulator.Perfect, 1)
+	out, in, close := newEmulatedPair(t, n)
+	defer close()
+	// the header of its msgs tells out that in reassembles
+	if err := in.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-out.GetChanIn():
+	case <-time.After(10 * time.Second):
+		t.Fatal("msg not received")
+	}
+	n.SetProfile(emulator.Lossy)
+
+	sizes := []int{out.GetPayloadSize() + 1, 64 * 1024, 1}
+	go func() {
+		for _, size := range sizes {
+			b := make([]byte, size)
+			for i := range b {
+				b[i] = byte(i % 251)
+			}
+			if err := out.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+	for _, size := range sizes {
+		select {
+		case b := <-in.GetChanIn():
+			if len(b) != size {
+				t.Fatalf("msg of %d bytes received as %d bytes", size, len(b))
+			}
+			for i := range b {
+				if b[i] != byte(i%251) {
+					t.Fatalf("msg of %d bytes differs at %d", size, i)
+				}
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatalf("msg of %d bytes not received, %+v", size, n.Stats())
+		}
+	}
+}
+
+func TestUDPFactory_EmulatedRateLimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("emulated transfers take a few seconds")
+	}
+	n := emulator.NewNetwork(emulator.Perfect, 1)
+	out, in, close := newEmulatedPair(t, n)
+	defer close()
+	const rate = 256 * 1024
+	limiter := conn.NewRateLimiter(rate)
+	out.SetRateLimiters(limiter)
+
+	size := out.GetPayloadSize()
+	msgs := 200
+	start := time.Now()
+	go func() {
+		for i := 0; i < msgs; i++ {
+			if err := out.Write(make([]byte, size)); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < msgs; i++ {
+		if i == msgs/2 {
+			// raised at runtime
+			limiter.SetRate(4 * rate)
+		}
+		select {
+		case <-in.GetChanIn():
+		case <-time.After(30 * time.Second):
+			t.Fatalf("received %d of %d msgs", i, msgs)
+		}
+	}
+	elapsed := time.Since(start)
+	// the first half at rate and the second one at 4 * rate, less the
+	// burst of the bucket
+	half := float64(msgs / 2 * size)
+	min := time.Duration((half/rate+half/(4*rate))*float64(time.Second)) - 2*conn.RATE_LIMIT_BURST
+	t.Logf("%d msgs in %s, %.0f B/s", msgs, elapsed, float64(msgs*size)/elapsed.Seconds())
+	if elapsed < min {
+		t.Fatalf("%d msgs in %s, faster than the limit allows, %s", msgs, elapsed, min)
+	}
+	if elapsed > 2*min+time.Second {
+		t.Fatalf("%d msgs in %s, the limit allows %s", msgs, elapsed, min)
+	}
+}
+
+// the factory closes the accepted conns without msgs for UDPGCPeriod
+func TestUDPFactory_GCPeriod(t *testing.T) {
+	n := emulator.NewNetwork(emulator.Perfect, 1)
+	for i, tc := range []struct {
+		name   string
+		period time.Duration
+		closed bool
+	}{
+		{"gc", 100 * time.Millisecond, true},
+		{"defaults", 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pa, err := n.ListenPacket(fmt.Sprintf("10.0.%d.1:0", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pb, err := n.ListenPacket(fmt.Sprintf("10.0.%d.2:0", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ca, cb := newCryptoPair(t)
+			accepted := make(chan *Connection, 1)
+			fa := NewUDPFactory()
+			fa.Options.UDPGCPeriod = tc.period
+			fa.AcceptedCallback = func(connection *Connection) {
+				connection.SetCrypto(cb)
+				accepted <- connection
+			}
+			if err = fa.ListenPacket(pa); err != nil {
+				t.Fatal(err)
+			}
+			defer fa.Close()
+			fb := NewUDPFactory()
+			fb.AcceptedCallback = func(connection *Connection) {}
+			if err = fb.ListenPacket(pb); err != nil {
+				t.Fatal(err)
+			}
+			defer fb.Close()
+			out, err := fb.ConnectAfterListen(pa.LocalAddr().String(), true, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out.SetCrypto(ca)
+			if err = out.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			var in *Connection
+			select {
+			case in = <-accepted:
+			case <-time.After(10 * time.Second):
+				t.Fatal("conn not accepted")
+			}
+			// a slow run may see the gc close before the msg
+			if m, ok := <-in.GetChanIn(); ok && string(m) != "hello" {
+				t.Fatalf("read %q", m)
+			}
+
+			// the last read time is counted in seconds
+			select {
+			case <-in.GetDisconnectedChan():
+				if !tc.closed {
+					t.Fatal("conn closed by the default period")
+				}
+			case <-time.After(1500 * time.Millisecond):
+				if tc.closed {
+					t.Fatal("idle conn not closed")
+				}
+			}
+		})
+	}
+}
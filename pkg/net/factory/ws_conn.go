@@ -0,0 +1,62 @@
+package factory
+
+import (
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsConn is the byte stream of the binary msgs of a websocket conn, the tcp
+// conns run on it unchanged
+type wsConn struct {
+	*websocket.Conn
+	// the msg being read
+	reader io.Reader
+}
+
+func newWSConn(c *websocket.Conn) *wsConn {
+	return &wsConn{Conn: c}
+}
+
+func (c *wsConn) Read(b []byte) (n int, err error) {
+	for {
+		if c.reader == nil {
+			var t int
+			t, c.reader, err = c.NextReader()
+			if err != nil {
+				return
+			}
+			if t != websocket.BinaryMessage {
+				c.reader = nil
+				continue
+			}
+		}
+		n, err = c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			err = nil
+			if n == 0 {
+				continue
+			}
+		}
+		return
+	}
+}
+
+// every write is sent as one msg, the callers serialize them
+func (c *wsConn) Write(b []byte) (n int, err error) {
+	err = c.WriteMessage(websocket.BinaryMessage, b)
+	if err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) (err error) {
+	err = c.SetReadDeadline(t)
+	if err != nil {
+		return
+	}
+	return c.SetWriteDeadline(t)
+}
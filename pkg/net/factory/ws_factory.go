@@ -0,0 +1,124 @@
+package factory
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+
+	"github.com/skycoin/skywire/pkg/net/client"
+	"github.com/skycoin/skywire/pkg/net/conn"
+	"github.com/skycoin/skywire/pkg/net/server"
+)
+
+const WS_HANDSHAKE_TIMEOUT = 30 * time.Second
+
+// IsWebSocketAddress reports whether address is a ws:// or wss:// url to be
+// connected by a WebSocketFactory
+func IsWebSocketAddress(address string) bool {
+	return strings.HasPrefix(address, "ws://") || strings.HasPrefix(address, "wss://")
+}
+
+// WebSocketFactory carries the msgs of tcp conns over websocket, so nodes
+// behind http proxies or firewalls letting only http(s) out reach the server.
+// Clients go through the proxy of HTTP_PROXY or HTTPS_PROXY with CONNECT.
+type WebSocketFactory struct {
+	listener net.Listener
+	server   *http.Server
+
+	// tls of the wss conns, the server serves wss instead of ws if set
+	TLSConfig *tls.Config
+
+	FactoryCommonFields
+}
+
+func NewWebSocketFactory() *WebSocketFactory {
+	return &WebSocketFactory{FactoryCommonFields: NewFactoryCommonFields()}
+}
+
+// Listen accepts websocket conns on every path of address
+func (factory *WebSocketFactory) Listen(address string) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	if factory.TLSConfig != nil {
+		ln = tls.NewListener(ln, factory.TLSConfig)
+	}
+	upgrader := &websocket.Upgrader{
+		HandshakeTimeout: WS_HANDSHAKE_TIMEOUT,
+		// the clients are nodes and apps, not browsers
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				logrus.Debugf("websocket upgrade err %v", err)
+				return
+			}
+			factory.createConn(newWSConn(c))
+		}),
+	}
+	factory.fieldsMutex.Lock()
+	factory.listener = ln
+	factory.server = srv
+	factory.fieldsMutex.Unlock()
+	go func() {
+		err := srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("websocket serve err %v", err)
+		}
+	}()
+	return nil
+}
+
+func (factory *WebSocketFactory) Close() error {
+	factory.FactoryCommonFields.Close()
+	factory.fieldsMutex.RLock()
+	defer factory.fieldsMutex.RUnlock()
+	if factory.server == nil {
+		return nil
+	}
+	return factory.server.Close()
+}
+
+func (factory *WebSocketFactory) createConn(c net.Conn) *Connection {
+	tcpConn := server.NewServerTCPConn(c)
+	tcpConn.SetOptions(factory.Options)
+	tcpConn.SetStatusToConnected()
+	conn := newConnection(tcpConn, factory)
+	conn.SetContextLogger(conn.GetContextLogger().WithField("type", "ws"))
+	factory.AddAcceptedConn(conn)
+	go factory.AcceptedCallback(conn)
+	return conn
+}
+
+// Connect dials the ws:// or wss:// url address
+func (factory *WebSocketFactory) Connect(address string) (conn *Connection, err error) {
+	return factory.ConnectWithOptions(address, factory.Options)
+}
+
+// ConnectWithOptions connects with other timeouts than the factory ones
+func (factory *WebSocketFactory) ConnectWithOptions(address string, options conn.Options) (conn *Connection, err error) {
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: WS_HANDSHAKE_TIMEOUT,
+		TLSClientConfig:  factory.TLSConfig,
+	}
+	c, _, err := dialer.Dial(address, nil)
+	if err != nil {
+		return
+	}
+	cn := client.NewClientTCPConn(newWSConn(c))
+	cn.SetOptions(options)
+	cn.SetStatusToConnected()
+	conn = newConnection(cn, factory)
+	conn.SetContextLogger(conn.GetContextLogger().WithField("type", "ws"))
+	factory.AddConn(conn)
+	return
+}
@@ -0,0 +1,74 @@
+package factory
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWebSocketFactory(t *testing.T) {
+	accepted := make(chan *Connection, 1)
+	server := NewWebSocketFactory()
+	server.AcceptedCallback = func(connection *Connection) {
+		accepted <- connection
+	}
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client := NewWebSocketFactory()
+	defer client.Close()
+	out, err := client.Connect("ws://" + server.listener.Addr().String() + "/skywire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !out.IsTCP() {
+		t.Fatal("websocket conn does not behave like a tcp conn")
+	}
+
+	// spans several websocket frames
+	big := bytes.Repeat([]byte{0xab}, 8*1024)
+	if err = out.Write(big); err != nil {
+		t.Fatal(err)
+	}
+	var in *Connection
+	select {
+	case in = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("conn not accepted")
+	}
+	select {
+	case m := <-in.GetChanIn():
+		if !bytes.Equal(m, big) {
+			t.Fatalf("received %d bytes, sent %d", len(m), len(big))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("msg not received")
+	}
+
+	if err = in.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-out.GetChanIn():
+		if string(m) != "pong" {
+			t.Fatalf("received %q", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reply not received")
+	}
+}
+
+func TestIsWebSocketAddress(t *testing.T) {
+	for address, ws := range map[string]bool{
+		"wss://discovery.skywire.org/ws": true,
+		"ws://127.0.0.1:5999":            true,
+		"127.0.0.1:5999":                 false,
+		"http://discovery.skywire.org":   false,
+	} {
+		if IsWebSocketAddress(address) != ws {
+			t.Fatalf("IsWebSocketAddress(%q) != %v", address, ws)
+		}
+	}
+}
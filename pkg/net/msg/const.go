@@ -16,6 +16,18 @@ const (
 	UDP_TYPE_SIZE = 1
 	MSG_SEQ_SIZE  = 4
 	MSG_LEN_SIZE  = 4
+	FEC_SIZE      = 1
+	FLAGS_SIZE    = 1
+	CONN_ID_SIZE  = 4
+
+	SACK_RANGE_COUNT_SIZE = 1
+	SACK_RANGE_SIZE       = 2 * MSG_SEQ_SIZE
+	MAX_SACK_RANGES       = 64
+
+	FRAG_ID_SIZE    = 4
+	FRAG_INDEX_SIZE = 2
+	FRAG_COUNT_SIZE = 2
+	MAX_FRAG_COUNT  = 1<<(8*FRAG_COUNT_SIZE) - 1
 
 	MAX_MESSAGE_SIZE = 10240
 )
@@ -37,10 +49,28 @@ const (
 	TYPE_NORMAL = 0x01
 	TYPE_FEC    = 0x02
 	TYPE_SYN    = 0x03
+	TYPE_AEAD   = 0x04
 	TYPE_ACK    = 0x80
 	TYPE_PING   = 0x81
 	TYPE_PONG   = 0x82
 	TYPE_FIN    = 0x83
+	TYPE_SACK   = 0x84
+	// padded path mtu probe and its ack
+	TYPE_PROBE     = 0x85
+	TYPE_PROBE_ACK = 0x86
+)
+
+const (
+	// the sender understands TYPE_SACK
+	UDP_FLAG_SACK = 1 << iota
+	// the sender answers TYPE_PROBE
+	UDP_FLAG_PMTUD
+	// the header carries the connection id
+	UDP_FLAG_CONN_ID
+	// the sender reassembles fragmented msgs
+	UDP_FLAG_REASSEMBLY
+	// the body starts with a fragment header
+	UDP_FLAG_FRAGMENT
 )
 
 const (
@@ -67,6 +97,50 @@ const (
 	ACK_HEADER_SIZE
 )
 
+// sack msg index, followed by count ranges of received seqs [begin, end]
+// above the next seq
+const (
+	SACK_HEADER_BEGIN = 0
+	SACK_TYPE_BEGIN
+	SACK_TYPE_END = SACK_TYPE_BEGIN + MSG_TYPE_SIZE
+	SACK_SEQ_BEGIN
+	SACK_SEQ_END = SACK_SEQ_BEGIN + MSG_SEQ_SIZE
+	SACK_NEXT_SEQ_BEGIN
+	SACK_NEXT_SEQ_END = SACK_NEXT_SEQ_BEGIN + MSG_SEQ_SIZE
+	SACK_RANGE_COUNT_BEGIN
+	SACK_RANGE_COUNT_END = SACK_RANGE_COUNT_BEGIN + SACK_RANGE_COUNT_SIZE
+	SACK_HEADER_END
+
+	SACK_HEADER_SIZE
+)
+
+// fragment header index, a msg too big for one packet is split into count
+// fragments with the same id
+const (
+	FRAG_HEADER_BEGIN = 0
+	FRAG_ID_BEGIN
+	FRAG_ID_END = FRAG_ID_BEGIN + FRAG_ID_SIZE
+	FRAG_INDEX_BEGIN
+	FRAG_INDEX_END = FRAG_INDEX_BEGIN + FRAG_INDEX_SIZE
+	FRAG_COUNT_BEGIN
+	FRAG_COUNT_END = FRAG_COUNT_BEGIN + FRAG_COUNT_SIZE
+	FRAG_HEADER_END
+
+	FRAG_HEADER_SIZE
+)
+
+// probe msg index, the probe is padded to the probed datagram size
+const (
+	PROBE_HEADER_BEGIN = 0
+	PROBE_TYPE_BEGIN
+	PROBE_TYPE_END = PROBE_TYPE_BEGIN + MSG_TYPE_SIZE
+	PROBE_SIZE_BEGIN
+	PROBE_SIZE_END = PROBE_SIZE_BEGIN + MSG_LEN_SIZE
+	PROBE_HEADER_END
+
+	PROBE_HEADER_SIZE
+)
+
 const (
 	UDP_HEADER_BEGIN = 0
 	UDP_TYPE_BEGIN
@@ -81,7 +155,20 @@ const (
 	UDP_ACK_NEXT_SEQ_END = UDP_ACK_NEXT_SEQ_BEGIN + MSG_SEQ_SIZE
 	UDP_ACK_ACKED_SEQ_BEGIN
 	UDP_ACK_ACKED_SEQ_END = UDP_ACK_ACKED_SEQ_BEGIN + MSG_SEQ_SIZE
-	UDP_PADDING           = UDP_ACK_ACKED_SEQ_END + 11
+	// fec group of the msg, the seq of a fec msg is the first seq of its group
+	UDP_FEC_DATA_SHARDS_BEGIN
+	UDP_FEC_DATA_SHARDS_END = UDP_FEC_DATA_SHARDS_BEGIN + FEC_SIZE
+	UDP_FEC_PARITY_SHARDS_BEGIN
+	UDP_FEC_PARITY_SHARDS_END = UDP_FEC_PARITY_SHARDS_BEGIN + FEC_SIZE
+	UDP_FEC_INDEX_BEGIN
+	UDP_FEC_INDEX_END = UDP_FEC_INDEX_BEGIN + FEC_SIZE
+	// features supported by the sender
+	UDP_FLAGS_BEGIN
+	UDP_FLAGS_END = UDP_FLAGS_BEGIN + FLAGS_SIZE
+	// picked by the side that opens the conn, it survives nat rebinding
+	UDP_CONN_ID_BEGIN
+	UDP_CONN_ID_END = UDP_CONN_ID_BEGIN + CONN_ID_SIZE
+	UDP_PADDING     = UDP_CONN_ID_END + 3
 	UDP_HEADER_END
 
 	UDP_HEADER_SIZE
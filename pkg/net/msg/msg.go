@@ -9,6 +9,7 @@ import (
 
 	"github.com/google/btree"
 	"github.com/skycoin/skywire/pkg/net/util"
+	"github.com/skycoin/skywire/pkg/net/wheel"
 
 	"github.com/skycoin/skycoin/src/cipher"
 )
@@ -159,7 +160,7 @@ type UDPMessage struct {
 
 	miss        uint32
 	resendCnt   uint32
-	resendTimer *time.Timer
+	resendTimer *wheel.Timer
 
 	delivered     uint64
 	deliveredTime time.Time
@@ -167,13 +168,13 @@ type UDPMessage struct {
 
 	channel    int64
 	channelSeq uint32
+
+	// the body starts with a fragment header
+	fragment bool
 }
 
 func NewUDP(t uint8, seq uint32, bytes []byte) *UDPMessage {
-	if len(bytes) > util.FixedMtuPool.Size {
-		panic("invalid UDPMessage body size")
-	}
-	b := util.FixedMtuPool.Get()
+	b := util.FixedMtuPool.GetSize(len(bytes), 0)
 	l := copy(b, bytes)
 	return &UDPMessage{
 		Message: New(t, seq, b[:l]),
@@ -181,10 +182,7 @@ func NewUDP(t uint8, seq uint32, bytes []byte) *UDPMessage {
 }
 
 func NewUDPWithoutSeq(t uint8, bytes []byte) *UDPMessage {
-	if len(bytes) > util.FixedMtuPool.Size {
-		panic("invalid UDPMessage body size")
-	}
-	b := util.FixedMtuPool.Get()
+	b := util.FixedMtuPool.GetSize(len(bytes), 0)
 	l := copy(b, bytes)
 	return &UDPMessage{
 		Message: NewWithoutSeq(t, b[:l]),
@@ -199,18 +197,23 @@ func (msg *UDPMessage) UpdateState(delivered uint64, deliveredTime, sentTime tim
 	msg.Unlock()
 }
 
-func (msg *UDPMessage) SetRTO(rto time.Duration, fn func(m *UDPMessage) error) {
+// SetRTO arms the resend timer of the msg on w, fn runs on the goroutine of
+// the wheel and must not block
+func (msg *UDPMessage) SetRTO(w *wheel.Wheel, rto time.Duration, fn func(m *UDPMessage) error) {
 	msg.Lock()
-	msg.resendTimer = time.AfterFunc(rto*time.Duration((msg.resendCnt)*3/2+1), func() {
-		msg.Lock()
-		if msg.status&MSG_STATUS_ACKED > 0 {
+	if msg.resendTimer == nil {
+		msg.resendTimer = w.NewTimer(func() {
+			msg.Lock()
+			if msg.status&MSG_STATUS_ACKED > 0 {
+				msg.Unlock()
+				return
+			}
+			msg.resendCnt++
 			msg.Unlock()
-			return
-		}
-		msg.resendCnt++
-		msg.Unlock()
-		fn(msg)
-	})
+			fn(msg)
+		})
+	}
+	msg.resendTimer.Reset(rto * time.Duration((msg.resendCnt)*3/2+1))
 	msg.Unlock()
 }
 
@@ -293,6 +296,14 @@ func (msg *UDPMessage) GetChannel() int {
 	return int(atomic.LoadInt64(&msg.channel))
 }
 
+func (msg *UDPMessage) SetFragment() {
+	msg.fragment = true
+}
+
+func (msg *UDPMessage) IsFragment() bool {
+	return msg.fragment
+}
+
 func (msg *UDPMessage) Loss() {
 	msg.Lock()
 	msg.status |= MSG_STATUS_LOSS
@@ -315,8 +326,8 @@ func (msg *UDPMessage) PkgBytes() (result []byte) {
 		return
 	}
 
-	result = util.FixedMtuPool.Get()
-	result = result[:PKG_HEADER_SIZE+UDP_HEADER_SIZE+msg.Len]
+	// the gcm tag is appended in place
+	result = util.FixedMtuPool.GetSize(PKG_HEADER_SIZE+UDP_HEADER_SIZE+int(msg.Len), 16)
 	m := result[PKG_HEADER_SIZE:]
 	m[0] = byte(msg.Type)
 	binary.BigEndian.PutUint32(m[UDP_SEQ_BEGIN:], msg.GetSeq())
@@ -13,7 +13,7 @@ type ServerTCPConn struct {
 	conn.TCPConn
 }
 
-func NewServerTCPConn(c *net.TCPConn) *ServerTCPConn {
+func NewServerTCPConn(c net.Conn) *ServerTCPConn {
 	return &ServerTCPConn{
 		TCPConn: conn.TCPConn{
 			TcpConn:          c,
@@ -54,18 +54,14 @@ func (c *ServerTCPConn) ReadLoop() (err error) {
 			if err != nil {
 				return err
 			}
-		case msg.TYPE_SYN, msg.TYPE_NORMAL:
-			err = c.ReadBytes(reader, header, msg.MSG_HEADER_SIZE)
+		case msg.TYPE_SYN, msg.TYPE_NORMAL, msg.TYPE_AEAD:
+			body, err := c.ReadMsg(reader, header)
 			if err != nil {
 				return err
 			}
-
-			m := msg.NewByHeader(header)
-			err = c.ReadBytes(reader, m.Body, int(m.Len))
-			if err != nil {
-				return err
+			if body != nil {
+				c.In <- body
 			}
-			c.In <- m.Body
 		default:
 			c.GetContextLogger().Debugf("not implemented msg type %d", t)
 			return fmt.Errorf("not implemented msg type %d", msg_t)
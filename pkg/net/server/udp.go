@@ -15,7 +15,7 @@ type ServerUDPConn struct {
 	conn.UDPConn
 }
 
-func NewServerUDPConn(c *net.UDPConn) *ServerUDPConn {
+func NewServerUDPConn(c net.PacketConn) *ServerUDPConn {
 	return &ServerUDPConn{
 		UDPConn: conn.UDPConn{
 			UdpConn:          c,
@@ -25,7 +25,9 @@ func NewServerUDPConn(c *net.UDPConn) *ServerUDPConn {
 	}
 }
 
-func (c *ServerUDPConn) ReadLoop(fn func(c *net.UDPConn, addr *net.UDPAddr) *conn.UDPConn) (err error) {
+// ReadLoop dispatches datagrams to the conn fn returns, id is the connection
+// id of data msgs or 0 if the datagram carries none, m is the msg
+func (c *ServerUDPConn) ReadLoop(fn func(c net.PacketConn, addr *net.UDPAddr, id uint32, m []byte) *conn.UDPConn) (err error) {
 	defer func() {
 		if !conn.DEV {
 			if e := recover(); e != nil {
@@ -40,9 +42,11 @@ func (c *ServerUDPConn) ReadLoop(fn func(c *net.UDPConn, addr *net.UDPAddr) *con
 	}()
 	var lst = time.Time{}
 	var rt = time.Time{}
-	var at = time.Time{}
-	var nt = time.Time{}
-	maxBuf := make([]byte, conn.MTU)
+	bc := conn.NewBatchConn(c.UdpConn)
+	ds := make([]conn.Datagram, conn.UDP_BATCH_SIZE)
+	for i := range ds {
+		ds[i].Buf = make([]byte, conn.MAX_PLPMTU)
+	}
 	for {
 		if conn.DEV {
 			if !lst.IsZero() {
@@ -50,15 +54,15 @@ func (c *ServerUDPConn) ReadLoop(fn func(c *net.UDPConn, addr *net.UDPAddr) *con
 			}
 			rt = time.Now()
 		}
-		n, addr, err := c.UdpConn.ReadFromUDP(maxBuf)
+		n, err := bc.ReadBatch(ds)
 		if conn.DEV {
-			c.GetContextLogger().Debugf("process read udp d %s", time.Now().Sub(rt))
+			c.GetContextLogger().Debugf("process read udp d %s, %d datagrams", time.Now().Sub(rt), n)
 			lst = time.Now()
 		}
 		if err != nil {
 			if e, ok := err.(net.Error); ok {
 				if e.Timeout() {
-					cc := fn(c.UdpConn, addr)
+					cc := fn(c.UdpConn, nil, 0, nil)
 					cc.GetContextLogger().Debug("close in")
 					close(cc.In)
 					continue
@@ -66,65 +70,94 @@ func (c *ServerUDPConn) ReadLoop(fn func(c *net.UDPConn, addr *net.UDPAddr) *con
 			}
 			return err
 		}
-		c.AddReceivedBytes(n)
-		pkg := maxBuf[:n]
-		cc := fn(c.UdpConn, addr)
-		if cc.IsClosed() {
-			c.GetContextLogger().Infof("udp server conn closed")
-			continue
-		}
-		m := pkg[msg.PKG_HEADER_SIZE:]
-		checksum := binary.BigEndian.Uint32(pkg[msg.PKG_CRC32_BEGIN:])
-		if checksum != crc32.ChecksumIEEE(m) {
-			c.GetContextLogger().Infof("checksum !=")
-			continue
+		for _, d := range ds[:n] {
+			addr, _ := d.Addr.(*net.UDPAddr)
+			c.dispatch(d.Buf[:d.N], addr, fn)
 		}
+	}
+}
 
-		t := m[msg.MSG_TYPE_BEGIN]
-		switch t {
-		case msg.TYPE_ACK:
-			if conn.DEV {
-				at = time.Now()
-			}
-			wrapForClient(cc, func() error {
-				return cc.RecvAck(m)
-			})
-			if conn.DEV {
-				c.GetContextLogger().Debugf("process ack d %s", time.Now().Sub(at))
-			}
-		case msg.TYPE_PONG:
-		case msg.TYPE_PING:
-			wrapForClient(cc, func() error {
-				m[msg.PING_MSG_TYPE_BEGIN] = msg.TYPE_PONG
-				checksum := crc32.ChecksumIEEE(m)
-				binary.BigEndian.PutUint32(pkg[msg.PKG_CRC32_BEGIN:], checksum)
-				cc.GetContextLogger().Debugf("pong")
-				return cc.WriteExt(pkg)
-			})
-		case msg.TYPE_NORMAL, msg.TYPE_FEC, msg.TYPE_SYN:
-			if conn.DEV {
-				nt = time.Now()
-			}
-			wrapForClient(cc, func() error {
-				return cc.Process(t, m)
-			})
-			if conn.DEV {
-				c.GetContextLogger().Debugf("process normal d %s", time.Now().Sub(nt))
-			}
-		case msg.TYPE_FIN:
-			wrapForClient(cc, func() error {
-				cc.GetContextLogger().Debug("process fin")
-				return conn.ErrFin
-			})
-		default:
-			cc.GetContextLogger().Debugf("not implemented msg type %d", t)
-			cc.SetStatusToError(fmt.Errorf("not implemented msg type %d", t))
-			cc.Close()
-			continue
-		}
+// dispatch hands a datagram to its conn
+func (c *ServerUDPConn) dispatch(pkg []byte, addr *net.UDPAddr, fn func(c net.PacketConn, addr *net.UDPAddr, id uint32, m []byte) *conn.UDPConn) {
+	var at = time.Time{}
+	var nt = time.Time{}
+	c.AddReceivedBytes(len(pkg))
+	if len(pkg) < msg.PKG_HEADER_SIZE+msg.MSG_TYPE_END {
+		return
+	}
+	m := pkg[msg.PKG_HEADER_SIZE:]
+	checksum := binary.BigEndian.Uint32(pkg[msg.PKG_CRC32_BEGIN:])
+	if checksum != crc32.ChecksumIEEE(m) {
+		c.GetContextLogger().Infof("checksum !=")
+		return
+	}
 
-		cc.UpdateLastTime()
+	t := m[msg.MSG_TYPE_BEGIN]
+	var id uint32
+	switch t {
+	case msg.TYPE_NORMAL, msg.TYPE_FEC, msg.TYPE_SYN, msg.TYPE_AEAD:
+		id = conn.HeaderConnID(m)
 	}
+	cc := fn(c.UdpConn, addr, id, m)
+	if cc.IsClosed() {
+		c.GetContextLogger().Infof("udp server conn closed")
+		return
+	}
+	switch t {
+	case msg.TYPE_ACK:
+		if conn.DEV {
+			at = time.Now()
+		}
+		wrapForClient(cc, func() error {
+			return cc.RecvAck(m)
+		})
+		if conn.DEV {
+			c.GetContextLogger().Debugf("process ack d %s", time.Now().Sub(at))
+		}
+	case msg.TYPE_SACK:
+		wrapForClient(cc, func() error {
+			return cc.RecvSAck(m)
+		})
+	case msg.TYPE_PROBE:
+		wrapForClient(cc, func() error {
+			return cc.RecvProbe(m)
+		})
+	case msg.TYPE_PROBE_ACK:
+		wrapForClient(cc, func() error {
+			return cc.RecvProbeAck(m)
+		})
+	case msg.TYPE_PONG:
+	case msg.TYPE_PING:
+		wrapForClient(cc, func() error {
+			m[msg.PING_MSG_TYPE_BEGIN] = msg.TYPE_PONG
+			checksum := crc32.ChecksumIEEE(m)
+			binary.BigEndian.PutUint32(pkg[msg.PKG_CRC32_BEGIN:], checksum)
+			cc.GetContextLogger().Debugf("pong")
+			return cc.WriteExt(pkg)
+		})
+	case msg.TYPE_NORMAL, msg.TYPE_FEC, msg.TYPE_SYN, msg.TYPE_AEAD:
+		if conn.DEV {
+			nt = time.Now()
+		}
+		wrapForClient(cc, func() error {
+			return cc.ProcessFrom(t, m, addr)
+		})
+		if conn.DEV {
+			c.GetContextLogger().Debugf("process normal d %s", time.Now().Sub(nt))
+		}
+	case msg.TYPE_FIN:
+		wrapForClient(cc, func() error {
+			cc.GetContextLogger().Debug("process fin")
+			return cc.RecvFin(m)
+		})
+	default:
+		cc.GetContextLogger().Debugf("not implemented msg type %d", t)
+		cc.SetStatusToError(fmt.Errorf("not implemented msg type %d", t))
+		cc.Close()
+		return
+	}
+
+	cc.UpdateLastTime()
 }
 
 func wrapForClient(cc *conn.UDPConn, fn func() error) {
@@ -0,0 +1,141 @@
+package factory
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// localIPs returns the unicast addresses of the interfaces that are up, ipv6
+// ones first. Loopback and link local addresses are left out, they can't
+// reach another node.
+func localIPs() (ips []net.IP) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	var v4 []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || !ipnet.IP.IsGlobalUnicast() {
+				continue
+			}
+			if ip4 := ipnet.IP.To4(); ip4 != nil {
+				v4 = append(v4, ip4)
+				continue
+			}
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	ips = append(ips, v4...)
+	return
+}
+
+// localAddresses returns the ips a node is reachable by, of both families
+func localAddresses() (addrs []string) {
+	for _, ip := range localIPs() {
+		if len(addrs) >= MAX_CANDIDATES {
+			break
+		}
+		addrs = append(addrs, ip.String())
+	}
+	return
+}
+
+// localCandidates returns the addresses of the local ips at port, the udp
+// socket of a transport listens on all of them
+func localCandidates(port int) (candidates []string) {
+	p := strconv.Itoa(port)
+	for _, ip := range localAddresses() {
+		candidates = append(candidates, net.JoinHostPort(ip, p))
+	}
+	return
+}
+
+// udpPort returns the port of a udp address, 0 if it has none
+func udpPort(addr net.Addr) int {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		return a.Port
+	}
+	return 0
+}
+
+// udpIP returns the ip of a udp address, nil if it has none
+func udpIP(addr net.Addr) net.IP {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		return a.IP
+	}
+	return nil
+}
+
+// orderCandidates returns the addresses to reach a node at. The one the
+// discovery saw comes first as it made it through the nat already, then
+// the ones offered by the node, ipv6 before ipv4. Invalid and duplicate
+// addresses are dropped.
+func orderCandidates(observed string, offered []string) (candidates []string) {
+	seen := make(map[string]bool)
+	add := func(addr string) {
+		if len(candidates) >= MAX_CANDIDATES || !checkAddress(addr) {
+			return
+		}
+		addr = normalizeAddress(addr)
+		if seen[addr] {
+			return
+		}
+		seen[addr] = true
+		candidates = append(candidates, addr)
+	}
+	add(observed)
+	for _, ipv6 := range []bool{true, false} {
+		for _, addr := range offered {
+			if isIPv6Address(addr) == ipv6 {
+				add(addr)
+			}
+		}
+	}
+	return
+}
+
+// normalizeAddress writes host:port as net.UDPAddr does, ipv4 mapped ipv6
+// addresses as ipv4, so one address has a single form
+func normalizeAddress(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	ip, zone := splitZone(host)
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+		if zone != "" {
+			ip += "%" + zone
+		}
+		return net.JoinHostPort(ip, port)
+	}
+	return addr
+}
+
+func isIPv6Address(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	host, _ = splitZone(host)
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// splitZone splits the zone of a link local ipv6 address like fe80::1%eth0
+func splitZone(host string) (ip, zone string) {
+	if i := strings.LastIndex(host, "%"); i > 0 {
+		return host[:i], host[i+1:]
+	}
+	return host, ""
+}
@@ -0,0 +1,58 @@
+package factory
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestOrderCandidates(t *testing.T) {
+	got := orderCandidates("1.2.3.4:5000", []string{
+		"10.0.0.2:5000",
+		"[2001:db8::1]:5000",
+		"[::ffff:1.2.3.4]:5000",
+		"bad",
+		"[2001:DB8::1]:5000",
+		"[fe80::1%eth0]:5000",
+	})
+	want := []string{
+		"1.2.3.4:5000",
+		"[2001:db8::1]:5000",
+		"[fe80::1%eth0]:5000",
+		"10.0.0.2:5000",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("candidates %v, want %v", got, want)
+	}
+
+	var offered []string
+	for i := 0; i < 2*MAX_CANDIDATES; i++ {
+		offered = append(offered, fmt.Sprintf("10.0.0.%d:5000", i+1))
+	}
+	if n := len(orderCandidates("", offered)); n != MAX_CANDIDATES {
+		t.Fatalf("%d candidates, want %d", n, MAX_CANDIDATES)
+	}
+}
+
+func TestCheckAddress_IPv6(t *testing.T) {
+	for addr, valid := range map[string]bool{
+		"1.2.3.4:80":         true,
+		"[2001:db8::1]:80":   true,
+		"[fe80::1%eth0]:80":  true,
+		"2001:db8::1:80":     false,
+		"[not-an-ip]:80":     false,
+		"[2001:db8::1]:6553": true,
+	} {
+		if checkAddress(addr) != valid {
+			t.Errorf("checkAddress(%q) != %v", addr, valid)
+		}
+	}
+}
+
+func TestMergeAddresses(t *testing.T) {
+	got := mergeAddresses("2001:db8::1", []string{"10.0.0.2", "2001:DB8::1", "bad"})
+	want := []string{"2001:db8::1", "10.0.0.2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("addresses %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,116 @@
+package factory
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// COMPRESSION_FLATE is the only algorithm so far, faster ones can be offered
+// next to it at reg
+const COMPRESSION_FLATE = "flate"
+
+// the algorithms this node supports, the preferred one first
+var compressions = []string{COMPRESSION_FLATE}
+
+// negotiateCompression picks the first offered algorithm this node supports,
+// empty if there is none
+func negotiateCompression(offered []string) string {
+	for _, o := range offered {
+		for _, c := range compressions {
+			if o == c {
+				return c
+			}
+		}
+	}
+	return ""
+}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// deflate returns header followed by b compressed, ok is false if that is
+// not smaller than sending b as it is
+func deflate(header, b []byte) (m []byte, ok bool) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(header)+len(b)))
+	buf.Write(header)
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(buf)
+	_, err := w.Write(b)
+	if err == nil {
+		err = w.Close()
+	}
+	flateWriters.Put(w)
+	if err != nil || buf.Len() >= len(header)+len(b) {
+		return
+	}
+	return buf.Bytes(), true
+}
+
+// inflate returns header followed by b decompressed, msgs decompressing to
+// more than limit bytes are refused
+func inflate(header, b []byte, limit int) (m []byte, err error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	buf := bytes.NewBuffer(make([]byte, 0, len(header)+2*len(b)))
+	buf.Write(header)
+	n, err := io.Copy(buf, io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return
+	}
+	if n > int64(limit) {
+		err = fmt.Errorf("compressed msg bigger than %d bytes", limit)
+		return
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Connection) setCompression(algorithm string) {
+	c.fieldsMutex.Lock()
+	c.compression = algorithm
+	c.fieldsMutex.Unlock()
+}
+
+// the algorithm negotiated at reg, empty if the ops are not compressed
+func (c *Connection) getCompression() (algorithm string) {
+	c.fieldsMutex.RLock()
+	algorithm = c.compression
+	c.fieldsMutex.RUnlock()
+	return
+}
+
+// encodeOP builds the msg of op, the body is compressed if the conn
+// negotiated it and that makes the msg smaller
+func (c *Connection) encodeOP(op byte, body []byte) (data []byte) {
+	if len(body) >= COMPRESSION_MIN_SIZE && c.getCompression() != "" {
+		m, ok := deflate([]byte{op | COMPRESSED_PREFIX}, body)
+		if ok {
+			c.AddCompressedBytes(MSG_HEADER_END+len(body), len(m))
+			return m
+		}
+		c.AddCompressedBytes(MSG_HEADER_END+len(body), MSG_HEADER_END+len(body))
+	}
+	data = make([]byte, MSG_HEADER_END+len(body))
+	data[MSG_OP_BEGIN] = op
+	copy(data[MSG_HEADER_END:], body)
+	return
+}
+
+// decodeOP decompresses m if it was sent compressed
+func (c *Connection) decodeOP(m []byte) ([]byte, error) {
+	if m[MSG_OP_BEGIN]&COMPRESSED_PREFIX == 0 || c.getCompression() == "" {
+		return m, nil
+	}
+	d, err := inflate([]byte{m[MSG_OP_BEGIN] &^ COMPRESSED_PREFIX}, m[MSG_HEADER_END:], MAX_DECOMPRESSED_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	c.AddCompressedBytes(len(d), len(m))
+	return d, nil
+}
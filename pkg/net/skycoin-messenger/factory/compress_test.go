@@ -0,0 +1,80 @@
+package factory
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+	cn "github.com/skycoin/skywire/pkg/net/conn"
+)
+
+func TestDeflate(t *testing.T) {
+	header := []byte{OP_SEND | COMPRESSED_PREFIX}
+	body := bytes.Repeat([]byte("skywire "), 1024)
+	m, ok := deflate(header, body)
+	if !ok {
+		t.Fatal("repeated body not compressed")
+	}
+	if !bytes.Equal(m[:len(header)], header) {
+		t.Fatalf("header %x, expected %x", m[:len(header)], header)
+	}
+	d, err := inflate([]byte{OP_SEND}, m[len(header):], len(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d[0] != OP_SEND || !bytes.Equal(d[1:], body) {
+		t.Fatalf("inflated %d bytes differ", len(d))
+	}
+	if _, err = inflate(nil, m[len(header):], len(body)-1); err == nil {
+		t.Fatal("limit not enforced")
+	}
+	if _, ok = deflate(header, []byte{1, 2, 3}); ok {
+		t.Fatal("msg compressed into more bytes")
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	if c := negotiateCompression([]string{"zstd", COMPRESSION_FLATE}); c != COMPRESSION_FLATE {
+		t.Fatalf("negotiated %q", c)
+	}
+	if c := negotiateCompression([]string{"zstd"}); c != "" {
+		t.Fatalf("negotiated %q", c)
+	}
+	if c := negotiateCompression(nil); c != "" {
+		t.Fatalf("negotiated %q", c)
+	}
+}
+
+// a body that doesn't inflate resets its app conn, the others go on
+func TestTransportInflateError(t *testing.T) {
+	tr := newTransport(NewMessengerFactory(), cipher.PubKey{}, cipher.PubKey{}, cipher.PubKey{}, cipher.PubKey{}, true)
+	conn := newOptionsTestConnection(tr.factory, nil)
+	tr.conn = conn
+	bad, badPeer := net.Pipe()
+	good, goodPeer := net.Pipe()
+	tr.conns[1] = bad
+	tr.conns[2] = good
+	go tr.nodeReadLoop(conn, tr.getAppConn)
+	defer conn.Close()
+
+	in := conn.Connection.Connection.(*cn.UDPConn).In
+	in <- append(opPkg(1, OP_TRANSPORT|OP_COMPRESSED), 0xff, 0xff, 0xff)
+	in <- append(opPkg(2, OP_TRANSPORT), "hello"...)
+
+	goodPeer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	n, err := goodPeer.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("read %q err %v", buf[:n], err)
+	}
+	badPeer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = badPeer.Read(buf); err != io.EOF {
+		t.Fatalf("app conn of the bad body not closed, err %v", err)
+	}
+	if tr.getAppConn(1) != nil || tr.getAppConn(2) == nil {
+		t.Fatal("wrong app conn reset")
+	}
+}
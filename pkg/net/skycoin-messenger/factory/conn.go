@@ -17,8 +17,6 @@ import (
 	"github.com/skycoin/skywire/pkg/net/factory"
 )
 
-const keyWaitTimeout time.Duration = 60 * time.Second
-
 type Connection struct {
 	*factory.Connection
 	factory *MessengerFactory
@@ -37,8 +35,13 @@ type Connection struct {
 	fieldsMutex sync.RWMutex
 
 	in chan []byte
+	// the bodies of OP_NET_CONN, nil until NetConn is called
+	netIn     chan []byte
+	netClosed bool
 
 	proxyConnections map[uint32]*Connection
+	// the answers to queries of the node itself by seq
+	queryCallbacks map[uint32]func(info *AttrNodesInfo)
 
 	appTransports      map[cipher.PubKey]*Transport
 	appTransportsMutex sync.RWMutex
@@ -69,6 +72,13 @@ type Connection struct {
 	onConnected    func(connection *Connection)
 	onDisconnected func(connection *Connection)
 	reconnect      func()
+
+	// congestion controller of the transports built through this conn
+	newCongestionController func() conn.CongestionController
+	// timeouts of this conn and its transports, the factory ones if nil
+	options *Options
+	// compression of the ops negotiated at reg
+	compression string
 }
 
 // Used by factory to spawn connections for server side
@@ -231,14 +241,27 @@ func (c *Connection) Reg() error {
 }
 
 func (c *Connection) RegWithKey(key cipher.PubKey, context map[string]string) error {
-	c.StoreContext(publicKey, key)
-	return c.writeOPSyn(OP_REG_KEY, &regWithKey{PublicKey: key, Context: context, Version: RegWithKeyAndEncryptionVersion})
+	return c.regWithKey(key, context, latestRegVersion)
 }
 
 func (c *Connection) RegWithKeys(key, target cipher.PubKey, context map[string]string) error {
-	c.StoreContext(publicKey, key)
 	c.SetTargetKey(target)
-	return c.writeOPSyn(OP_REG_KEY, &regWithKey{PublicKey: key, Context: context, Version: RegWithKeyAndEncryptionVersion})
+	return c.regWithKey(key, context, latestRegVersion)
+}
+
+// offer versions up to max to the server
+func (c *Connection) regWithKey(key cipher.PubKey, context map[string]string, max RegVersion) error {
+	c.StoreContext(publicKey, key)
+	reg := &regWithKey{PublicKey: key, Context: context, Version: RegWithKeyAndEncryptionVersion, MaxVersion: max, Reassembly: true}
+	if c.IsTCP() && c.getOptions().Compression {
+		reg.Compression = compressions
+	}
+	if max >= RegWithEphemeralKeyVersion {
+		var esk cipher.SecKey
+		reg.Ephemeral, esk = cipher.GenerateKeyPair()
+		c.StoreContext(ephemeralKey, esk)
+	}
+	return c.writeOPSyn(OP_REG_KEY, reg)
 }
 
 // register services to discovery
@@ -249,6 +272,7 @@ func (c *Connection) UpdateServices(ns *NodeServices) (err error) {
 			return
 		}
 		ns.Version = []string{c.factory.GetAppVersion(), VERSION, conn.VERSION}
+		ns.Addresses = localAddresses()
 	}
 	c.setServices(ns)
 	if ns == nil {
@@ -278,6 +302,8 @@ func checkAddress(addr string) (valid bool) {
 	if err != nil {
 		return
 	}
+	// ipv6 link local addresses carry a zone
+	host, _ = splitZone(host)
 	if len(host) != 0 && net.ParseIP(host) == nil {
 		return
 	}
@@ -314,6 +340,14 @@ func checkNodeServices(ns *NodeServices) (valid bool) {
 			return
 		}
 	}
+	if len(ns.Addresses) > MAX_CANDIDATES {
+		return false
+	}
+	for _, a := range ns.Addresses {
+		if net.ParseIP(a) == nil {
+			return false
+		}
+	}
 	for _, s := range ns.Services {
 		valid = checkAttrs(s.Attributes)
 		if !valid {
@@ -397,6 +431,17 @@ func (c *Connection) BuildAppConnection(node, app, discovery cipher.PubKey) erro
 	return c.writeOP(OP_BUILD_APP_CONN, &appConn{Node: node, App: app, Discovery: discovery})
 }
 
+// BuildRouteConnection asks the node to build a transport to app through
+// hops other nodes, the response is the one of BuildAppConnection
+func (c *Connection) BuildRouteConnection(node, app, discovery cipher.PubKey, hops int) error {
+	return c.writeOP(OP_BUILD_ROUTE, &buildRoute{Node: node, App: app, Discovery: discovery, HopCount: hops})
+}
+
+// CloseRoute asks the node to tear the route to app down
+func (c *Connection) CloseRoute(app cipher.PubKey) error {
+	return c.writeOP(OP_CLOSE_ROUTE, &closeRoute{App: app})
+}
+
 func (c *Connection) Send(to cipher.PubKey, msg []byte) error {
 	return c.Write(GenSendMsg(c.GetKey(), to, msg))
 }
@@ -405,6 +450,63 @@ func (c *Connection) SendCustom(msg []byte) error {
 	return c.writeOPBytes(OP_CUSTOM, msg)
 }
 
+// NetConn returns a net.Conn over the conn, its bytes go in OP_NET_CONN
+// msgs next to the other ops. Closing it closes the conn.
+func (c *Connection) NetConn() net.Conn {
+	c.fieldsMutex.Lock()
+	if c.netIn == nil {
+		c.netIn = make(chan []byte, 8)
+		if c.netClosed {
+			close(c.netIn)
+		}
+	}
+	c.fieldsMutex.Unlock()
+	return conn.NewNetConn(&netConnMsgs{c})
+}
+
+// hand the body of an OP_NET_CONN msg to the net.Conn, called by the loop
+// reading the conn. Nothing waits for them before NetConn is called.
+func (c *Connection) deliverNetConn(body []byte) {
+	c.fieldsMutex.RLock()
+	in := c.netIn
+	c.fieldsMutex.RUnlock()
+	if in == nil {
+		c.GetContextLogger().Debugf("net conn msg dropped, no net conn")
+		return
+	}
+	select {
+	case in <- body:
+	case <-c.GetDisconnectedChan():
+	}
+}
+
+// the loop reading the conn stopped, the net.Conn reads EOF
+func (c *Connection) closeNetConn() {
+	c.fieldsMutex.Lock()
+	if !c.netClosed {
+		c.netClosed = true
+		if c.netIn != nil {
+			close(c.netIn)
+		}
+	}
+	c.fieldsMutex.Unlock()
+}
+
+// netConnMsgs frames the msgs of the net.Conn of a conn in OP_NET_CONN
+type netConnMsgs struct {
+	*Connection
+}
+
+func (m *netConnMsgs) Write(bytes []byte) error {
+	return m.writeOPBytes(OP_NET_CONN, bytes)
+}
+
+func (m *netConnMsgs) GetChanIn() <-chan []byte {
+	m.fieldsMutex.RLock()
+	defer m.fieldsMutex.RUnlock()
+	return m.netIn
+}
+
 func (c *Connection) preprocessor() (err error) {
 	defer func() {
 		if !conn.DEV {
@@ -415,6 +517,7 @@ func (c *Connection) preprocessor() (err error) {
 		if err != nil {
 			c.GetContextLogger().Debugf("preprocessor err %v", err)
 		}
+		c.closeNetConn()
 		c.Close()
 	}()
 OUTER:
@@ -430,7 +533,15 @@ OUTER:
 			if len(m) < MSG_HEADER_END {
 				return
 			}
+			m, err = c.decodeOP(m)
+			if err != nil {
+				return
+			}
 			opn := m[MSG_OP_BEGIN]
+			if opn == OP_NET_CONN {
+				c.deliverNetConn(m[MSG_HEADER_END:])
+				continue
+			}
 			if opn&RESP_PREFIX > 0 {
 				i := int(opn &^ RESP_PREFIX)
 				r := getResp(i)
@@ -518,7 +629,15 @@ func (c *Connection) Close() {
 	c.Connection.Close()
 }
 
+func (c *Connection) getOptions() Options {
+	if c.options != nil {
+		return *c.options
+	}
+	return c.factory.GetOptions()
+}
+
 func (c *Connection) WaitForKey() (err error) {
+	keyWaitTimeout := c.getOptions().KeyWaitTimeout
 	c.GetContextLogger().WithField("timeout", keyWaitTimeout).Debug("WaitForKey")
 	ok := make(chan struct{})
 	go func() {
@@ -541,10 +660,7 @@ func (c *Connection) WaitForKey() (err error) {
 }
 
 func (c *Connection) writeOPBytes(op byte, body []byte) error {
-	data := make([]byte, MSG_HEADER_END+len(body))
-	data[MSG_OP_BEGIN] = op
-	copy(data[MSG_HEADER_END:], body)
-	return c.Write(data)
+	return c.Write(c.encodeOP(op, body))
 }
 
 func (c *Connection) writeOP(op byte, object interface{}) error {
@@ -570,10 +686,7 @@ func (c *Connection) writeOPSyn(op byte, object interface{}) error {
 		c.GetContextLogger().Debugf("writeOP %#v", object)
 	}
 
-	data := make([]byte, MSG_HEADER_END+len(body))
-	data[MSG_OP_BEGIN] = op
-	copy(data[MSG_HEADER_END:], body)
-	return c.WriteSyn(data)
+	return c.WriteSyn(c.encodeOP(op, body))
 }
 
 // Set transport if key is not exists. Delete the transport of the key if tr is nil
@@ -694,7 +807,7 @@ func (c *Connection) GetAppFeedback() (v *AppFeedback) {
 	return
 }
 
-func (c *Connection) SetCrypto(pk cipher.PubKey, sk cipher.SecKey, target cipher.PubKey, iv []byte) (err error) {
+func (c *Connection) SetCrypto(pk cipher.PubKey, sk cipher.SecKey, target cipher.PubKey, iv []byte, version RegVersion) (err error) {
 	c.fieldsMutex.Lock()
 	defer c.fieldsMutex.Unlock()
 	if c.Connection.GetCrypto() != nil {
@@ -705,11 +818,81 @@ func (c *Connection) SetCrypto(pk cipher.PubKey, sk cipher.SecKey, target cipher
 	if err != nil {
 		return
 	}
+	err = c.initCrypto(crypto, iv, version)
+	return
+}
+
+// SetEphemeralCrypto replaces the crypto of the connection with a forward secret one,
+// the session secret mixes in both ephemeral keys
+func (c *Connection) SetEphemeralCrypto(pk cipher.PubKey, sk cipher.SecKey, target cipher.PubKey, iv []byte,
+	ephemeral cipher.SecKey, remoteEphemeral cipher.PubKey) (err error) {
+	c.fieldsMutex.Lock()
+	defer c.fieldsMutex.Unlock()
+	crypto := conn.NewCrypto(pk, sk)
+	err = crypto.SetTargetKey(target)
+	if err != nil {
+		return
+	}
+	err = crypto.SetEphemeralKeys(ephemeral, remoteEphemeral)
+	if err != nil {
+		return
+	}
+	err = c.initCrypto(crypto, iv, RegWithEphemeralKeyVersion)
+	return
+}
+
+// use the ephemeral key stored by regWithKey, it is dropped afterwards
+func (c *Connection) setEphemeralCryptoFromContext(pk cipher.PubKey, sk cipher.SecKey, target cipher.PubKey, iv []byte,
+	remoteEphemeral cipher.PubKey) (err error) {
+	k, ok := c.context.Load(ephemeralKey)
+	if !ok {
+		err = errors.New("ephemeral key not found")
+		return
+	}
+	c.context.Delete(ephemeralKey)
+	esk, ok := k.(cipher.SecKey)
+	if !ok {
+		err = errors.New("ephemeral key invalid")
+		return
+	}
+	err = c.SetEphemeralCrypto(pk, sk, target, iv, esk, remoteEphemeral)
+	return
+}
+
+// the peer told at reg or at the build of a transport that it reassembles
+// fragments, udp conns send msgs bigger than a packet as fragments from now
+// msgs written wait until the conn has crypto
+func (c *Connection) holdUntilCrypto() {
+	if u, is := c.Connection.Connection.(interface {
+		HoldUntilCrypto()
+	}); is {
+		u.HoldUntilCrypto()
+	}
+}
+
+func (c *Connection) setPeerReassembly(ok bool) {
+	if !ok {
+		return
+	}
+	if u, is := c.Connection.Connection.(interface {
+		SetPeerReassembly()
+	}); is {
+		u.SetPeerReassembly()
+	}
+}
+
+func (c *Connection) initCrypto(crypto *conn.Crypto, iv []byte, version RegVersion) (err error) {
 	if len(iv) == aes.BlockSize {
 		err = crypto.Init(iv)
 		if err != nil {
 			return
 		}
+		if version >= RegWithKeyAndAEADVersion {
+			crypto.EnableAEAD()
+		}
+		if version >= RegWithEphemeralKeyVersion {
+			crypto.EnableRekey()
+		}
 	}
 	c.Connection.SetCrypto(crypto)
 	return
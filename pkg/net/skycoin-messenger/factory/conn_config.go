@@ -11,6 +11,7 @@ import (
 
 	"github.com/skycoin/skycoin/src/cipher"
 	"github.com/skycoin/skycoin/src/cipher/go-bip39"
+	"github.com/skycoin/skywire/pkg/net/conn"
 )
 
 type ConnConfig struct {
@@ -25,12 +26,21 @@ type ConnConfig struct {
 	// context
 	Context map[string]string
 
+	// the highest RegVersion to offer, zero offers the latest one
 	UseCrypto RegVersion
 
 	TargetKey cipher.PubKey
 
 	SkipBeforeCallbacks bool
 
+	// creates the congestion controller of the udp conn, transports built
+	// through this conn use it too. BBR if nil
+	CongestionController func() conn.CongestionController
+
+	// timeouts of the conn and the transports built through it, the ones
+	// of the factory if nil
+	Options *Options
+
 	// callbacks
 
 	FindServiceNodesByKeysCallback func(resp *QueryResp)
@@ -45,6 +55,20 @@ type ConnConfig struct {
 	OnDisconnected func(connection *Connection)
 }
 
+func (c *ConnConfig) maxRegVersion() RegVersion {
+	if c.UseCrypto == regWithKeyVersion {
+		return latestRegVersion
+	}
+	return c.UseCrypto
+}
+
+func (c *ConnConfig) newCongestionController() conn.CongestionController {
+	if c.CongestionController == nil {
+		return nil
+	}
+	return c.CongestionController()
+}
+
 type SeedConfig struct {
 	Seed      string
 	SecKey    string
@@ -1,6 +1,10 @@
 package factory
 
-import "github.com/skycoin/skycoin/src/cipher"
+import (
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
 
 const VERSION = "0.1.0"
 
@@ -58,9 +62,49 @@ const (
 	// POW (unused)
 	OP_POW
 
+	// node A asks the discovery to relay the transport being built
+	OP_RELAY_NODE_CONN
+
+	// apps ask their node to build a transport through other nodes
+	OP_BUILD_ROUTE
+	// apps ask their node to tear a route down
+	OP_CLOSE_ROUTE
+
+	// the bytes of the net.Conn of a conn
+	OP_NET_CONN
+
 	OP_SIZE
 )
 
 const RESP_PREFIX = 0x80
 
+// set on the op of msgs whose body is compressed with the algorithm
+// negotiated at reg
+const COMPRESSED_PREFIX = 0x40
+
+const (
+	// smaller bodies are not worth compressing
+	COMPRESSION_MIN_SIZE = 512
+	// compressed msgs decompressing to more are refused
+	MAX_DECOMPRESSED_SIZE = 16 * 1024 * 1024
+)
+
+const (
+	// addresses of both families a node offers to be reached at
+	MAX_CANDIDATES = 8
+	// node B tries the next address of node A once the msg building the
+	// transport is not acked within this
+	CANDIDATE_TIMEOUT = 3 * time.Second
+)
+
+const (
+	// the attribute of the service nodes forwarding routes offer
+	ROUTE_ATTRIBUTE = "route"
+	// nodes a route goes through when the app does not say
+	ROUTE_HOPS     = 2
+	MAX_ROUTE_HOPS = 4
+	// forwarding nodes asked from the discovery to pick the route out of
+	ROUTE_QUERY_LIMIT = 64
+)
+
 var EMPTY_PUBLIC_KEY = cipher.PubKey{}
@@ -0,0 +1,330 @@
+package factory
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cn "github.com/skycoin/skywire/pkg/net/conn"
+)
+
+const (
+	// a flow no datagram went through for this long is dropped
+	DATAGRAM_FLOW_TIMEOUT = 2 * time.Minute
+	// the biggest udp datagram
+	MAX_DATAGRAM_SIZE = 64 * 1024
+	// the flows of a transport by default, each one is a socket on node B
+	DATAGRAM_MAX_FLOWS = 256
+)
+
+// TransportMode is what the app of a service takes through transports
+type TransportMode uint8
+
+const (
+	TRANSPORT_STREAM TransportMode = 1 << iota
+	TRANSPORT_DATAGRAM
+)
+
+// services that did not say take streams only
+func (m TransportMode) streams() bool {
+	return m == 0 || m&TRANSPORT_STREAM > 0
+}
+
+func (m TransportMode) datagrams() bool {
+	return m&TRANSPORT_DATAGRAM > 0
+}
+
+// datagramFlows carries the udp datagrams of a transport. On node A the apps
+// send them to the port of the transport, each address they come from is a
+// flow. Node B sends the ones of a flow to the app from a socket of its own,
+// the answers go back to the address of the flow. Flows idle for
+// DATAGRAM_FLOW_TIMEOUT are dropped by each node on its own, a datagram of
+// a flow node B dropped opens it again. Datagrams of new flows are dropped
+// while maxFlows are open.
+type datagramFlows struct {
+	t       *Transport
+	conn    *Connection
+	channel int
+
+	// node A
+	ln  *net.UDPConn
+	ids map[string]uint32
+	seq uint32
+	// node B
+	appAddress string
+
+	flows    map[uint32]*datagramFlow
+	maxFlows int
+	mtx      sync.Mutex
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type datagramFlow struct {
+	id uint32
+	// the app on node A
+	addr *net.UDPAddr
+	// to the app on node B
+	conn *net.UDPConn
+	// unix nano of the last datagram
+	last int64
+}
+
+// ln is the socket of the apps on node A, nil on node B
+func newDatagramFlows(t *Transport, conn *Connection, ln *net.UDPConn, appAddress string, maxFlows int) *datagramFlows {
+	d := &datagramFlows{
+		t:          t,
+		conn:       conn,
+		channel:    conn.NewPendingChannel(),
+		ln:         ln,
+		ids:        make(map[string]uint32),
+		appAddress: appAddress,
+		flows:      make(map[uint32]*datagramFlow),
+		maxFlows:   maxFlows,
+		closed:     make(chan struct{}),
+	}
+	if ln != nil {
+		go d.readApps()
+	}
+	go d.expire()
+	return d
+}
+
+// Read from the apps on node A, write to node B
+func (d *datagramFlows) readApps() {
+	buf := make([]byte, PKG_HEADER_END+MAX_DATAGRAM_SIZE)
+	for {
+		n, addr, err := d.ln.ReadFromUDP(buf[PKG_HEADER_END:])
+		if err != nil {
+			log.Debugf("datagram read err %v", err)
+			return
+		}
+		f := d.flowOf(addr)
+		if f == nil {
+			continue
+		}
+		f.touch()
+		d.send(f.id, buf[:PKG_HEADER_END+n])
+	}
+}
+
+// the flow of the app at addr, a new one the first time. It is nil if
+// maxFlows are open.
+func (d *datagramFlows) flowOf(addr *net.UDPAddr) (f *datagramFlow) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if id, ok := d.ids[addr.String()]; ok {
+		return d.flows[id]
+	}
+	if len(d.flows) >= d.maxFlows {
+		return
+	}
+	d.seq++
+	f = &datagramFlow{id: d.seq, addr: addr}
+	d.ids[addr.String()] = f.id
+	d.flows[f.id] = f
+	return
+}
+
+// Read from the app on node B, write to node A
+func (d *datagramFlows) readApp(f *datagramFlow) {
+	defer d.remove(f)
+	buf := make([]byte, PKG_HEADER_END+MAX_DATAGRAM_SIZE)
+	for {
+		n, err := f.conn.Read(buf[PKG_HEADER_END:])
+		if err != nil {
+			log.Debugf("datagram flow %d read err %v", f.id, err)
+			return
+		}
+		f.touch()
+		d.send(f.id, buf[:PKG_HEADER_END+n])
+	}
+}
+
+// send pkg of flow id to the other node. Datagrams may get lost, so they are
+// dropped rather than waiting for the rate limits.
+func (d *datagramFlows) send(id uint32, pkg []byte) {
+	pkg[PKG_HEADER_OP_BEGIN] = OP_DATAGRAM
+	binary.BigEndian.PutUint32(pkg[PKG_HEADER_ID_BEGIN:PKG_HEADER_ID_END], id)
+	limiters := d.t.appRateLimiters()
+	for _, l := range limiters {
+		if l.Delay() > 0 {
+			return
+		}
+	}
+	for _, l := range limiters {
+		l.Take(len(pkg))
+	}
+	d.mtx.Lock()
+	conn, channel := d.conn, d.channel
+	d.mtx.Unlock()
+	if conn.IsClosed() {
+		// the transport resumes
+		return
+	}
+	if cn.DEBUG_DATA_HEX {
+		conn.GetContextLogger().Debugf("datagram in %x", pkg)
+	}
+	d.t.uploadBW.add(len(pkg))
+	err := conn.WriteToChannel(channel, pkg)
+	if err != nil {
+		conn.GetContextLogger().Debugf("datagram flow %d write err %v", id, err)
+	}
+}
+
+// the transport resumed over conn
+func (d *datagramFlows) setConn(conn *Connection) {
+	d.mtx.Lock()
+	d.conn.DeletePendingChannel(d.channel)
+	d.conn = conn
+	d.channel = conn.NewPendingChannel()
+	d.mtx.Unlock()
+}
+
+// a datagram of flow id from the other node
+func (d *datagramFlows) receive(id uint32, body []byte) {
+	var err error
+	if d.ln != nil {
+		d.mtx.Lock()
+		f := d.flows[id]
+		d.mtx.Unlock()
+		if f == nil {
+			return
+		}
+		f.touch()
+		_, err = d.ln.WriteToUDP(body, f.addr)
+	} else {
+		var f *datagramFlow
+		f, err = d.dial(id)
+		if err != nil {
+			log.Debugf("datagram flow %d dial err %v", id, err)
+			return
+		}
+		f.touch()
+		_, err = f.conn.Write(body)
+	}
+	if err != nil {
+		log.Debugf("datagram flow %d write err %v", id, err)
+	}
+}
+
+// the socket to the app of flow id on node B, dialed the first time unless
+// maxFlows are open
+func (d *datagramFlows) dial(id uint32) (f *datagramFlow, err error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	f = d.flows[id]
+	if f != nil {
+		return
+	}
+	select {
+	case <-d.closed:
+		err = net.ErrClosed
+		return
+	default:
+	}
+	if len(d.flows) >= d.maxFlows {
+		err = fmt.Errorf("%d datagram flows open", len(d.flows))
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", d.appAddress)
+	if err != nil {
+		return
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return
+	}
+	f = &datagramFlow{id: id, conn: conn}
+	d.flows[id] = f
+	go d.readApp(f)
+	return
+}
+
+func (d *datagramFlows) remove(f *datagramFlow) {
+	d.mtx.Lock()
+	d._remove(f)
+	d.mtx.Unlock()
+}
+
+// call it with mtx held
+func (d *datagramFlows) _remove(f *datagramFlow) {
+	if d.flows[f.id] != f {
+		return
+	}
+	delete(d.flows, f.id)
+	if f.addr != nil {
+		delete(d.ids, f.addr.String())
+	}
+	if f.conn != nil {
+		f.conn.Close()
+	}
+}
+
+func (d *datagramFlows) expire() {
+	ticker := time.NewTicker(DATAGRAM_FLOW_TIMEOUT / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			d.dropIdle(now.Add(-DATAGRAM_FLOW_TIMEOUT))
+		case <-d.closed:
+			return
+		}
+	}
+}
+
+// drop the flows idle since before
+func (d *datagramFlows) dropIdle(before time.Time) {
+	d.mtx.Lock()
+	for _, f := range d.flows {
+		if atomic.LoadInt64(&f.last) < before.UnixNano() {
+			log.Debugf("datagram flow %d idle", f.id)
+			d._remove(f)
+		}
+	}
+	d.mtx.Unlock()
+}
+
+func (d *datagramFlows) close() {
+	d.closeOnce.Do(func() {
+		close(d.closed)
+		if d.ln != nil {
+			d.ln.Close()
+		}
+		d.mtx.Lock()
+		for _, f := range d.flows {
+			d._remove(f)
+		}
+		d.conn.DeletePendingChannel(d.channel)
+		d.mtx.Unlock()
+	})
+}
+
+func (f *datagramFlow) touch() {
+	atomic.StoreInt64(&f.last, time.Now().UnixNano())
+}
+
+// listen on port for the streams and datagrams of the apps modes asks for
+func listenApp(port int, modes TransportMode) (ln net.Listener, udp *net.UDPConn, err error) {
+	if modes.streams() {
+		ln, err = net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
+		if err != nil {
+			return
+		}
+	}
+	if modes.datagrams() {
+		udp, err = net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil && ln != nil {
+			ln.Close()
+			ln = nil
+		}
+	}
+	return
+}
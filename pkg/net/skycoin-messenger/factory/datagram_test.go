@@ -0,0 +1,137 @@
+package factory
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestDatagramFlows(ln *net.UDPConn, appAddress string) *datagramFlows {
+	return &datagramFlows{
+		ln:         ln,
+		ids:        make(map[string]uint32),
+		appAddress: appAddress,
+		flows:      make(map[uint32]*datagramFlow),
+		maxFlows:   DATAGRAM_MAX_FLOWS,
+		closed:     make(chan struct{}),
+	}
+}
+
+func TestTransportMode(t *testing.T) {
+	var m TransportMode
+	if !m.streams() || m.datagrams() {
+		t.Fatal("services that did not say take streams only")
+	}
+	m = TRANSPORT_DATAGRAM
+	if m.streams() || !m.datagrams() {
+		t.Fatal("datagrams only")
+	}
+	m |= TRANSPORT_STREAM
+	if !m.streams() || !m.datagrams() {
+		t.Fatal("both")
+	}
+}
+
+func TestDatagramFlows_NodeA(t *testing.T) {
+	d := newTestDatagramFlows(nil, "")
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+	b := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1001}
+	fa := d.flowOf(a)
+	if d.flowOf(a) != fa {
+		t.Fatal("an address got two flows")
+	}
+	fb := d.flowOf(b)
+	if fb.id == fa.id {
+		t.Fatalf("both addresses got flow %d", fa.id)
+	}
+
+	fa.last = time.Now().Add(-2 * DATAGRAM_FLOW_TIMEOUT).UnixNano()
+	fb.touch()
+	d.dropIdle(time.Now().Add(-DATAGRAM_FLOW_TIMEOUT))
+	if len(d.flows) != 1 || d.flows[fb.id] != fb {
+		t.Fatalf("flows left %v", d.flows)
+	}
+	if f := d.flowOf(a); f.id == fa.id || f.id == fb.id {
+		t.Fatalf("dropped address got flow %d again", f.id)
+	}
+}
+
+func TestDatagramFlows_NodeB(t *testing.T) {
+	app, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	d := newTestDatagramFlows(nil, app.LocalAddr().String())
+
+	buf := make([]byte, 64)
+	var addrs [2]*net.UDPAddr
+	for i, id := range []uint32{1, 2} {
+		d.receive(id, []byte("datagram"))
+		app.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := app.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "datagram" {
+			t.Fatalf("app read %q", buf[:n])
+		}
+		addrs[i] = addr
+	}
+	if addrs[0].String() == addrs[1].String() {
+		t.Fatalf("flows sent from the same socket %s", addrs[0])
+	}
+
+	d.dropIdle(time.Now().Add(time.Second))
+	if len(d.flows) != 0 {
+		t.Fatalf("flows left %v", d.flows)
+	}
+}
+
+func TestListenApp(t *testing.T) {
+	ln, udp, err := listenApp(0, TRANSPORT_DATAGRAM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	if ln != nil || udp == nil {
+		t.Fatalf("listened for datagrams on %v %v", ln, udp)
+	}
+}
+
+func TestDatagramFlows_MaxFlows(t *testing.T) {
+	a := newTestDatagramFlows(nil, "")
+	a.maxFlows = 2
+	for port := 1000; port < 1002; port++ {
+		if a.flowOf(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}) == nil {
+			t.Fatalf("no flow for port %d", port)
+		}
+	}
+	if a.flowOf(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1002}) != nil {
+		t.Fatal("flow over maxFlows")
+	}
+	if a.flowOf(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}) == nil {
+		t.Fatal("open flow refused")
+	}
+
+	app, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	b := newTestDatagramFlows(nil, app.LocalAddr().String())
+	b.maxFlows = 2
+	for id := uint32(1); id <= 10; id++ {
+		b.receive(id, []byte("datagram"))
+	}
+	if len(b.flows) != 2 {
+		t.Fatalf("%d flows dialed", len(b.flows))
+	}
+	// a flow dropped makes room for a new one
+	b.remove(b.flows[1])
+	b.receive(11, []byte("datagram"))
+	if b.flows[11] == nil {
+		t.Fatal("no flow after one was dropped")
+	}
+	b.dropIdle(time.Now().Add(time.Second))
+}
@@ -0,0 +1,351 @@
+package factory
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+const (
+	// nodes restored from the store file are dropped if they did not
+	// register again within this
+	DISCOVERY_RESTORE_TIMEOUT = 2 * time.Minute
+	// changes are written to the store file at most this often
+	DISCOVERY_SAVE_DELAY = time.Second
+)
+
+// DiscoveryStore keeps the services the nodes registered to a discovery,
+// indexed by node key, app key and attribute. With a path the nodes are
+// saved to a json file, so a restarted discovery answers queries while the
+// nodes connect again.
+type DiscoveryStore struct {
+	nodes map[cipher.PubKey]*NodeServices
+	// app key => node keys
+	apps map[cipher.PubKey]map[cipher.PubKey]struct{}
+	// attribute => services of it, hidden ones left out
+	attrs map[string]map[nodeApp]struct{}
+	// nodes restored from the file that did not register yet
+	restored map[cipher.PubKey]struct{}
+
+	path         string
+	saveTimer    *time.Timer
+	restoreTimer *time.Timer
+	mtx          sync.RWMutex
+	saveMutex    sync.Mutex
+}
+
+type nodeApp struct {
+	node, app cipher.PubKey
+}
+
+// NewDiscoveryStore returns a store restored from the file of path, an
+// empty path keeps it in memory only
+func NewDiscoveryStore(path string) (s *DiscoveryStore, err error) {
+	s = &DiscoveryStore{
+		nodes:    make(map[cipher.PubKey]*NodeServices),
+		apps:     make(map[cipher.PubKey]map[cipher.PubKey]struct{}),
+		attrs:    make(map[string]map[nodeApp]struct{}),
+		restored: make(map[cipher.PubKey]struct{}),
+		path:     path,
+	}
+	if len(path) < 1 {
+		return
+	}
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// UseDiscoveryStore serves the services registered to a non proxy factory
+// and the queries for them from s
+func (f *MessengerFactory) UseDiscoveryStore(s *DiscoveryStore) {
+	f.RegisterService = s.Register
+	f.UnRegisterService = s.Unregister
+	f.FindServiceAddresses = s.FindServiceAddresses
+	f.FindByAttributes = s.FindByAttributes
+	f.FindByAttributesAndPaging = s.FindByAttributesAndPaging
+}
+
+// Register replaces the services of the node of key
+func (s *DiscoveryStore) Register(key cipher.PubKey, ns *NodeServices) (err error) {
+	s.mtx.Lock()
+	s.remove(key)
+	s.add(key, ns)
+	delete(s.restored, key)
+	s.scheduleSave()
+	s.mtx.Unlock()
+	return
+}
+
+func (s *DiscoveryStore) Unregister(key cipher.PubKey) (err error) {
+	s.mtx.Lock()
+	s.remove(key)
+	delete(s.restored, key)
+	s.scheduleSave()
+	s.mtx.Unlock()
+	return
+}
+
+// FindServiceAddresses returns the nodes of each app key but exclude
+func (s *DiscoveryStore) FindServiceAddresses(keys []cipher.PubKey, exclude cipher.PubKey) (result []*ServiceInfo) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	for _, k := range keys {
+		info := &ServiceInfo{PubKey: k}
+		for _, node := range sortedKeys(s.apps[k]) {
+			if node == exclude {
+				continue
+			}
+			info.Nodes = append(info.Nodes, &NodeInfo{
+				PubKey:  node,
+				Address: s.nodes[node].ServiceAddress,
+			})
+		}
+		result = append(result, info)
+	}
+	return
+}
+
+// FindByAttributes returns all the nodes of services having every one of
+// attrs
+func (s *DiscoveryStore) FindByAttributes(attrs ...string) (result *AttrNodesInfo) {
+	return s.FindByAttributesAndPaging(1, 0, attrs...)
+}
+
+// FindByAttributesAndPaging returns the nodes of page, from 1, of services
+// having every one of attrs. Count is the number of all the nodes found, a
+// limit of 0 returns all of them.
+func (s *DiscoveryStore) FindByAttributesAndPaging(page, limit int, attrs ...string) (result *AttrNodesInfo) {
+	result = &AttrNodesInfo{}
+	if len(attrs) < 1 {
+		return
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	apps := make(map[cipher.PubKey][]cipher.PubKey)
+	for na := range s.attrs[attrs[0]] {
+		found := true
+		for _, a := range attrs[1:] {
+			if _, ok := s.attrs[a][na]; !ok {
+				found = false
+				break
+			}
+		}
+		if found {
+			apps[na.node] = append(apps[na.node], na.app)
+		}
+	}
+	nodes := make([]cipher.PubKey, 0, len(apps))
+	for node := range apps {
+		nodes = append(nodes, node)
+	}
+	sortKeys(nodes)
+	result.Count = int64(len(nodes))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit > 0 {
+		start := (page - 1) * limit
+		if start >= len(nodes) {
+			return
+		}
+		nodes = nodes[start:]
+		if len(nodes) > limit {
+			nodes = nodes[:limit]
+		}
+	}
+	for _, node := range nodes {
+		ns := s.nodes[node]
+		keys := apps[node]
+		sortKeys(keys)
+		info := &AttrNodeInfo{
+			Node:     node,
+			Apps:     keys,
+			Location: ns.Location,
+			Version:  ns.Version,
+		}
+		for _, k := range keys {
+			for _, service := range ns.Services {
+				if service.Key == k {
+					info.AppInfos = append(info.AppInfos, &AttrAppInfo{Key: k, Version: service.Version})
+					break
+				}
+			}
+		}
+		result.Nodes = append(result.Nodes, info)
+	}
+	return
+}
+
+// Close writes the changes not saved yet
+func (s *DiscoveryStore) Close() (err error) {
+	s.mtx.Lock()
+	if s.restoreTimer != nil {
+		s.restoreTimer.Stop()
+	}
+	pending := s.saveTimer != nil && s.saveTimer.Stop()
+	s.saveTimer = nil
+	s.mtx.Unlock()
+	if pending {
+		err = s.save()
+	}
+	return
+}
+
+// call it with mtx held
+func (s *DiscoveryStore) add(key cipher.PubKey, ns *NodeServices) {
+	s.nodes[key] = ns
+	for _, service := range ns.Services {
+		nodes, ok := s.apps[service.Key]
+		if !ok {
+			nodes = make(map[cipher.PubKey]struct{})
+			s.apps[service.Key] = nodes
+		}
+		nodes[key] = struct{}{}
+		if service.HideFromDiscovery {
+			continue
+		}
+		for _, a := range service.Attributes {
+			services, ok := s.attrs[a]
+			if !ok {
+				services = make(map[nodeApp]struct{})
+				s.attrs[a] = services
+			}
+			services[nodeApp{node: key, app: service.Key}] = struct{}{}
+		}
+	}
+}
+
+// call it with mtx held
+func (s *DiscoveryStore) remove(key cipher.PubKey) {
+	ns, ok := s.nodes[key]
+	if !ok {
+		return
+	}
+	delete(s.nodes, key)
+	for _, service := range ns.Services {
+		if nodes, ok := s.apps[service.Key]; ok {
+			delete(nodes, key)
+			if len(nodes) < 1 {
+				delete(s.apps, service.Key)
+			}
+		}
+		for _, a := range service.Attributes {
+			if services, ok := s.attrs[a]; ok {
+				delete(services, nodeApp{node: key, app: service.Key})
+				if len(services) < 1 {
+					delete(s.attrs, a)
+				}
+			}
+		}
+	}
+}
+
+func (s *DiscoveryStore) load() (err error) {
+	d, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	nodes := make(map[string]*NodeServices)
+	err = json.Unmarshal(d, &nodes)
+	if err != nil {
+		return
+	}
+	for k, ns := range nodes {
+		key, e := cipher.PubKeyFromHex(k)
+		if e != nil || !checkNodeServices(ns) {
+			log.Errorf("discovery store: invalid node %s", k)
+			continue
+		}
+		s.add(key, ns)
+		s.restored[key] = struct{}{}
+	}
+	if len(s.restored) > 0 {
+		s.restoreTimer = time.AfterFunc(DISCOVERY_RESTORE_TIMEOUT, s.dropRestored)
+	}
+	return
+}
+
+// the nodes that did not come back are gone
+func (s *DiscoveryStore) dropRestored() {
+	s.mtx.Lock()
+	for key := range s.restored {
+		s.remove(key)
+	}
+	s.restored = make(map[cipher.PubKey]struct{})
+	s.scheduleSave()
+	s.mtx.Unlock()
+}
+
+// call it with mtx held
+func (s *DiscoveryStore) scheduleSave() {
+	if len(s.path) < 1 || s.saveTimer != nil {
+		return
+	}
+	s.saveTimer = time.AfterFunc(DISCOVERY_SAVE_DELAY, func() {
+		s.mtx.Lock()
+		s.saveTimer = nil
+		s.mtx.Unlock()
+		err := s.save()
+		if err != nil {
+			log.Errorf("discovery store: save err %v", err)
+		}
+	})
+}
+
+// write the nodes to a temp file renamed to path, a crash leaves the last
+// file whole
+func (s *DiscoveryStore) save() (err error) {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+	s.mtx.RLock()
+	nodes := make(map[string]*NodeServices, len(s.nodes))
+	for k, ns := range s.nodes {
+		nodes[k.Hex()] = ns
+	}
+	d, err := json.Marshal(nodes)
+	s.mtx.RUnlock()
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(s.path), 0700)
+	if err != nil {
+		return
+	}
+	tmp := s.path + ".tmp"
+	err = ioutil.WriteFile(tmp, d, 0600)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp, s.path)
+	return
+}
+
+func sortedKeys(set map[cipher.PubKey]struct{}) (keys []cipher.PubKey) {
+	keys = make([]cipher.PubKey, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sortKeys(keys)
+	return
+}
+
+func sortKeys(keys []cipher.PubKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+}
@@ -1,6 +1,7 @@
 package factory
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,8 +17,10 @@ import (
 )
 
 type MessengerFactory struct {
-	factory             factory.Factory
-	udp                 *factory.UDPFactory
+	factory factory.Factory
+	udp     *factory.UDPFactory
+	// conns to ws:// and wss:// addresses and the ones accepted over websocket
+	ws                  *factory.WebSocketFactory
 	udpMutex            sync.Mutex
 	regConnections      map[cipher.PubKey]*Connection
 	regConnectionsMutex sync.RWMutex
@@ -46,14 +49,46 @@ type MessengerFactory struct {
 
 	BeforeReadOnConn func(m *msg.UDPMessage)
 	BeforeSendOnConn func(m *msg.UDPMessage)
+
+	// creates the congestion controller of udp conns, BBR if nil
+	NewCongestionController func() conn.CongestionController
+
+	options Options
+
+	// shape the transports created by the factory
+	rateLimits *RateLimits
+
+	// the routes the node forwards by the app key of the transport to the
+	// next node
+	routeHops      map[cipher.PubKey]*routeHop
+	routeHopsMutex sync.RWMutex
+
+	// the transports node B may resume by the key of node A and the session
+	sessions      map[string]*Transport
+	sessionsMutex sync.RWMutex
 }
 
 func NewMessengerFactory() *MessengerFactory {
-	return &MessengerFactory{regConnections: make(map[cipher.PubKey]*Connection), serviceDiscovery: newServiceDiscovery()}
+	return &MessengerFactory{
+		regConnections:   make(map[cipher.PubKey]*Connection),
+		serviceDiscovery: newServiceDiscovery(),
+		options:          DefaultOptions(),
+		rateLimits:       newRateLimits(),
+		routeHops:        make(map[cipher.PubKey]*routeHop),
+		sessions:         make(map[string]*Transport),
+	}
+}
+
+// GetRateLimits returns the bandwidth limits of the transports, they may be
+// changed at any time
+func (f *MessengerFactory) GetRateLimits() *RateLimits {
+	return f.rateLimits
 }
 
 func (f *MessengerFactory) Listen(address string) (err error) {
+	options := f.GetOptions()
 	tcp := factory.NewTCPFactory()
+	tcp.Options = options.Options
 	tcp.AcceptedCallback = f.acceptedCallback
 	f.fieldsMutex.Lock()
 	f.factory = tcp
@@ -64,8 +99,10 @@ func (f *MessengerFactory) Listen(address string) (err error) {
 	}
 	if !f.Proxy {
 		udp := factory.NewUDPFactory()
+		udp.Options = options.Options
 		udp.BeforeReadOnConn = f.BeforeReadOnConn
 		udp.BeforeSendOnConn = f.BeforeSendOnConn
+		udp.NewCongestionController = f.NewCongestionController
 		udp.AcceptedCallback = f.acceptedUDPCallback
 		f.fieldsMutex.Lock()
 		f.udp = udp
@@ -75,6 +112,23 @@ func (f *MessengerFactory) Listen(address string) (err error) {
 	return
 }
 
+// ListenWebSocket accepts conns over websocket on address next to the tcp
+// ones, they are served over tls if tlsConfig is not nil
+func (f *MessengerFactory) ListenWebSocket(address string, tlsConfig *tls.Config) (err error) {
+	ws := factory.NewWebSocketFactory()
+	ws.Options = f.GetOptions().Options
+	ws.TLSConfig = tlsConfig
+	ws.AcceptedCallback = f.acceptedCallback
+	f.fieldsMutex.Lock()
+	if f.ws != nil {
+		f.fieldsMutex.Unlock()
+		return errors.New("websocket factory exists")
+	}
+	f.ws = ws
+	f.fieldsMutex.Unlock()
+	return ws.Listen(address)
+}
+
 func (f *MessengerFactory) acceptedUDPCallback(connection *factory.Connection) {
 	var err error
 	c, ok := connection.RealObject.(*Connection)
@@ -109,6 +163,7 @@ func (f *MessengerFactory) callbackLoop(conn *Connection) (err error) {
 	go conn.WaitForKey()
 	var m []byte
 	var ok bool
+	defer conn.closeNetConn()
 	defer func() {
 		if err != nil && err != ErrDetach {
 			conn.GetContextLogger().Debugf("err in %x", m)
@@ -123,6 +178,10 @@ func (f *MessengerFactory) callbackLoop(conn *Connection) (err error) {
 			if len(m) < MSG_HEADER_END {
 				return
 			}
+			m, err = conn.decodeOP(m)
+			if err != nil {
+				return
+			}
 			opn := m[MSG_OP_BEGIN]
 			op := getOP(int(opn))
 			if op == nil {
@@ -316,11 +375,29 @@ func (f *MessengerFactory) ConnectWithConfig(address string, config *ConnConfig)
 		}
 	}()
 	f.fieldsMutex.Lock()
-	if f.factory == nil {
-		tcpFactory := factory.NewTCPFactory()
-		f.factory = tcpFactory
+	var c *factory.Connection
+	if factory.IsWebSocketAddress(address) {
+		if f.ws == nil {
+			f.ws = factory.NewWebSocketFactory()
+			f.ws.Options = f.options.Options
+		}
+		if config != nil && config.Options != nil {
+			c, err = f.ws.ConnectWithOptions(address, config.Options.WithDefaults().Options)
+		} else {
+			c, err = f.ws.Connect(address)
+		}
+	} else {
+		if f.factory == nil {
+			tcpFactory := factory.NewTCPFactory()
+			tcpFactory.Options = f.options.Options
+			f.factory = tcpFactory
+		}
+		if tcp, ok := f.factory.(*factory.TCPFactory); ok && config != nil && config.Options != nil {
+			c, err = tcp.ConnectWithOptions(address, config.Options.WithDefaults().Options)
+		} else {
+			c, err = f.factory.Connect(address)
+		}
 	}
-	c, err := f.factory.Connect(address)
 	f.fieldsMutex.Unlock()
 	if err != nil {
 		if config != nil && config.Reconnect {
@@ -339,6 +416,11 @@ func (f *MessengerFactory) ConnectWithConfig(address string, config *ConnConfig)
 		conn.findServiceNodesByKeysCallback = config.FindServiceNodesByKeysCallback
 		conn.findServiceNodesByAttributesCallback = config.FindServiceNodesByAttributesCallback
 		conn.appConnectionInitCallback = config.AppConnectionInitCallback
+		conn.newCongestionController = config.CongestionController
+		if config.Options != nil {
+			options := config.Options.WithDefaults()
+			conn.options = &options
+		}
 		if config.Reconnect {
 			conn.reconnect = func() {
 				time.Sleep(config.ReconnectWait)
@@ -356,10 +438,9 @@ func (f *MessengerFactory) ConnectWithConfig(address string, config *ConnConfig)
 		if err == nil {
 			conn.SetSecKey(secKey)
 			if config.TargetKey != EMPTY_PUBLIC_KEY {
-				err = conn.RegWithKeys(key, config.TargetKey, config.Context)
-			} else {
-				err = conn.RegWithKey(key, config.Context)
+				conn.SetTargetKey(config.TargetKey)
 			}
+			err = conn.regWithKey(key, config.Context, config.maxRegVersion())
 		} else {
 			conn.GetContextLogger().Error(err)
 			err = conn.Reg()
@@ -379,8 +460,10 @@ func (f *MessengerFactory) listenForUDP() (err error) {
 	f.fieldsMutex.Lock()
 	if f.udp == nil {
 		ff := factory.NewUDPFactory()
+		ff.Options = f.options.Options
 		ff.BeforeReadOnConn = f.BeforeReadOnConn
 		ff.BeforeSendOnConn = f.BeforeSendOnConn
+		ff.NewCongestionController = f.NewCongestionController
 		ff.AcceptedCallback = f.acceptedUDPCallback
 		err = ff.Listen(":0")
 		if err != nil {
@@ -393,6 +476,22 @@ func (f *MessengerFactory) listenForUDP() (err error) {
 	return
 }
 
+// the addresses of the local ips at the port of the udp socket, the other
+// node of a transport tries them
+func (f *MessengerFactory) udpCandidates() []string {
+	f.fieldsMutex.RLock()
+	udp := f.udp
+	f.fieldsMutex.RUnlock()
+	if udp == nil {
+		return nil
+	}
+	port := udpPort(udp.LocalAddr())
+	if port == 0 {
+		return nil
+	}
+	return localCandidates(port)
+}
+
 func (f *MessengerFactory) connectUDPWithConfig(address string, config *ConnConfig) (connection *Connection, err error) {
 	f.fieldsMutex.Lock()
 	if f.udp == nil {
@@ -405,7 +504,7 @@ func (f *MessengerFactory) connectUDPWithConfig(address string, config *ConnConf
 		err = errors.New("config is nil")
 		return
 	}
-	c, err := f.udp.ConnectAfterListen(address, config.SkipBeforeCallbacks)
+	c, err := f.udp.ConnectAfterListen(address, config.SkipBeforeCallbacks, config.newCongestionController())
 	if err != nil {
 		return
 	}
@@ -419,17 +518,16 @@ func (f *MessengerFactory) connectUDPWithConfig(address string, config *ConnConf
 		WithField("mf", fmt.Sprintf("%p", f)).
 		WithField("dir", "out"))
 	if config != nil {
-		if config.UseCrypto == RegWithKeyAndEncryptionVersion {
+		if config.UseCrypto >= RegWithKeyAndEncryptionVersion {
 			var key cipher.PubKey
 			var secKey cipher.SecKey
 			key, secKey, err = f.loadSeedConfig(config)
 			if err == nil {
 				connection.SetSecKey(secKey)
 				if config.TargetKey != EMPTY_PUBLIC_KEY {
-					err = connection.RegWithKeys(key, config.TargetKey, config.Context)
-				} else {
-					err = connection.RegWithKey(key, config.Context)
+					connection.SetTargetKey(config.TargetKey)
 				}
+				err = connection.regWithKey(key, config.Context, config.maxRegVersion())
 				err = connection.WaitForKey()
 			}
 		}
@@ -449,7 +547,7 @@ func (f *MessengerFactory) acceptUDPWithConfig(address string, config *ConnConfi
 		err = errors.New("config is nil")
 		return
 	}
-	c, err := f.udp.ConnectAfterListen(address, config.SkipBeforeCallbacks)
+	c, err := f.udp.ConnectAfterListen(address, config.SkipBeforeCallbacks, config.newCongestionController())
 	if err != nil {
 		return nil, err
 	}
@@ -477,12 +575,33 @@ func (f *MessengerFactory) Close() (err error) {
 	if f.udp != nil {
 		err = f.udp.Close()
 	}
+	if err != nil {
+		return
+	}
+	if f.ws != nil {
+		err = f.ws.Close()
+	}
 	return
 }
 
 // Execute fn for each connection that connected to server
 func (f *MessengerFactory) ForEachConn(fn func(connection *Connection)) {
-	f.factory.ForEachConn(func(conn *factory.Connection) {
+	f.fieldsMutex.RLock()
+	factories := make([]factory.Factory, 0, 2)
+	if f.factory != nil {
+		factories = append(factories, f.factory)
+	}
+	if f.ws != nil {
+		factories = append(factories, f.ws)
+	}
+	f.fieldsMutex.RUnlock()
+	for _, ff := range factories {
+		f.forEachConn(ff, fn)
+	}
+}
+
+func (f *MessengerFactory) forEachConn(ff factory.Factory, fn func(connection *Connection)) {
+	ff.ForEachConn(func(conn *factory.Connection) {
 		real := conn.RealObject
 		if real == nil {
 			return
@@ -505,9 +624,8 @@ func (f *MessengerFactory) discoveryRegister(conn *Connection, ns *NodeServices)
 	}
 	if f.Proxy {
 		f.serviceDiscovery.register(conn, ns)
-		nodeServices := f.pack()
 		f.ForEachConn(func(connection *Connection) {
-			err := connection.UpdateServices(nodeServices)
+			err := connection.UpdateServices(f.nodeServices(connection))
 			if err != nil {
 				connection.GetContextLogger().Errorf("discoveryRegister err %v", err)
 			}
@@ -522,7 +640,7 @@ func (f *MessengerFactory) ResyncToDiscovery(connection *Connection) (err error)
 	if !f.Proxy {
 		return
 	}
-	nodeServices := f.pack()
+	nodeServices := f.nodeServices(connection)
 	if nodeServices == nil {
 		return
 	}
@@ -536,9 +654,8 @@ func (f *MessengerFactory) ResyncToDiscovery(connection *Connection) (err error)
 func (f *MessengerFactory) discoveryUnregister(conn *Connection) {
 	if f.Proxy {
 		f.serviceDiscovery.unregister(conn)
-		nodeServices := f.pack()
 		f.ForEachConn(func(connection *Connection) {
-			connection.UpdateServices(nodeServices)
+			connection.UpdateServices(f.nodeServices(connection))
 		})
 	} else {
 		f.serviceDiscovery.discoveryUnregister(conn)
@@ -576,6 +693,20 @@ func (f *MessengerFactory) SetLoggerLevel(level Level) {
 	log.SetLevel(log.Level(level))
 }
 
+// SetOptions replaces the timeouts, call it before Listen or Connect
+func (f *MessengerFactory) SetOptions(o Options) {
+	f.fieldsMutex.Lock()
+	f.options = o.WithDefaults()
+	f.fieldsMutex.Unlock()
+}
+
+func (f *MessengerFactory) GetOptions() (o Options) {
+	f.fieldsMutex.RLock()
+	o = f.options
+	f.fieldsMutex.RUnlock()
+	return
+}
+
 func (f *MessengerFactory) SetAppVersion(v string) {
 	f.fieldsMutex.Lock()
 	f.appVersion = v
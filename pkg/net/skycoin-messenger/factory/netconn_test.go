@@ -0,0 +1,86 @@
+package factory
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// the net.Conns of a client conn and of the conn the server accepted carry
+// their bytes next to the ops of the conns
+func TestConnection_NetConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+
+	server := NewMessengerFactory()
+	server.SetDefaultSeedConfig(NewSeedConfig())
+	custom := make(chan []byte, 1)
+	server.CustomMsgHandler = func(c *Connection, m []byte) {
+		custom <- m
+	}
+	if err = server.Listen(address); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client := NewMessengerFactory()
+	defer client.Close()
+	sc := NewSeedConfig()
+	if err = client.ConnectWithConfig(address, &ConnConfig{SeedConfig: sc}); err != nil {
+		t.Fatal(err)
+	}
+	var out *Connection
+	client.ForEachConn(func(c *Connection) {
+		out = c
+	})
+	// the server registers the conn once the client signed
+	var in *Connection
+	for i := 0; in == nil && i < 100; i++ {
+		time.Sleep(50 * time.Millisecond)
+		in, _ = server.GetConnection(sc.publicKey)
+	}
+	if out == nil || in == nil {
+		t.Fatal("conns not found")
+	}
+
+	a, b := out.NetConn(), in.NetConn()
+	exchange := func(from, to net.Conn, data string) {
+		if _, err := from.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		to.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(to, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != data {
+			t.Fatalf("read %q, want %q", buf, data)
+		}
+	}
+	exchange(a, b, "hello")
+	exchange(b, a, "world")
+
+	// the ops of the conn go on
+	if err = out.SendCustom([]byte("custom")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-custom:
+		if string(m) != "custom" {
+			t.Fatalf("custom msg %q", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("custom msg not handled")
+	}
+	exchange(a, b, "again")
+
+	a.Close()
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = b.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after close, err %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package factory
 
 import (
 	"errors"
+	"reflect"
 	"sync"
 )
 
@@ -45,6 +46,7 @@ func putOP(n int, op interface{}) {
 	if pool == nil {
 		return
 	}
+	reset(op)
 	pool.Put(op)
 }
 
@@ -67,5 +69,13 @@ func putResp(n int, r resp) {
 	if pool == nil {
 		return
 	}
+	reset(r)
 	pool.Put(r)
 }
+
+// zero v before it goes back to its pool, the fields left out of the next
+// msg must not keep the values of the last one
+func reset(v interface{}) {
+	e := reflect.ValueOf(v).Elem()
+	e.Set(reflect.Zero(e.Type()))
+}
@@ -87,47 +87,60 @@ func (req *appConn) Execute(f *MessengerFactory, conn *Connection) (r resp, err
 			return
 		}
 		sent[discoveryKey.Hex()] = struct{}{}
-		fromNode := connection.GetKey()
-		fromApp := conn.GetKey()
-		iv := make([]byte, aes.BlockSize)
-		if _, err = io.ReadFull(rand.Reader, iv); err != nil {
-			conn.GetContextLogger().Debugf("transport err %v", err)
-			return
-		}
-		tr := NewTransport(f, conn, fromNode, req.Node, fromApp, req.App)
-		tr.SetOnAcceptedUDPCallback(func(connection *Connection) {
-			connection.CreatedByTransport = tr
-			sc := f.GetDefaultSeedConfig()
-			connection.GetContextLogger().Debugf("set crypto sc %v", sc)
-			if sc == nil {
-				connection.GetContextLogger().Debugf("tr sc is nil")
-			}
-			connection.SetKey(req.Node)
-			err := connection.SetCrypto(sc.publicKey, sc.secKey, req.Node, iv)
-			if err != nil {
-				connection.GetContextLogger().Debugf("set crypto err %v", err)
-			}
-		})
+		tr := NewTransport(f, conn, connection.GetKey(), req.Node, conn.GetKey(), req.App)
 		conn.GetContextLogger().Debugf("app conn create transport to %s", connection.GetRemoteAddr().String())
-		c, err := tr.ListenAndConnect(connection.GetRemoteAddr().String(), discoveryKey)
+		err := f.connectTransport(tr, connection, nil)
 		if err != nil {
 			conn.GetContextLogger().Debugf("transport err %v", err)
 			return
 		}
-		nodeConn := &forwardNodeConn{
-			Node:     req.Node,
-			App:      req.App,
-			FromApp:  fromApp,
-			FromNode: fromNode,
-			Num:      iv,
-		}
-		c.writeOP(OP_FORWARD_NODE_CONN, nodeConn)
-		tr.SetupTimeout()
 		conn.setTransport(discoveryKey, tr)
 	})
 	return
 }
 
+// ask node tr.ToNode through the discovery of connection to build tr, the
+// onion of a route goes to it
+func (f *MessengerFactory) connectTransport(tr *Transport, connection *Connection, onion []byte) (err error) {
+	iv := make([]byte, aes.BlockSize)
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		return
+	}
+	tr.setCongestionController(connection.newCongestionController)
+	tr.setOptions(connection.getOptions())
+	ephemeral, ephemeralSecKey := cipher.GenerateKeyPair()
+	tr.setEphemeralKey(iv, ephemeralSecKey)
+	tr.SetOnAcceptedUDPCallback(func(connection *Connection) {
+		connection.CreatedByTransport = tr
+		connection.SetKey(tr.ToNode)
+		err := tr.setNodeCrypto(connection)
+		if err != nil {
+			connection.GetContextLogger().Debugf("set crypto err %v", err)
+		}
+	})
+	c, err := tr.ListenAndConnect(connection.GetRemoteAddr().String(), connection.GetTargetKey())
+	if err != nil {
+		return
+	}
+	session, resume := tr.sessionToSend()
+	nodeConn := &forwardNodeConn{
+		Node:       tr.ToNode,
+		App:        tr.ToApp,
+		FromApp:    tr.FromApp,
+		FromNode:   tr.FromNode,
+		Num:        iv,
+		Version:    latestRegVersion,
+		Ephemeral:  ephemeral,
+		Candidates: tr.factory.udpCandidates(),
+		Route:      onion,
+		Session:    session,
+		Resume:     resume,
+	}
+	c.writeOP(OP_FORWARD_NODE_CONN, nodeConn)
+	tr.SetupTimeout()
+	return
+}
+
 type Priority int
 type MsgType int
 
@@ -151,6 +164,8 @@ type PriorityMsg struct {
 	Msg      string   `json:"msg"`
 	Type     MsgType  `json:"type"`
 	Time     int64    `json:"time"`
+	// the discovery relaying the transport
+	Relay string `json:"relay,omitempty"`
 }
 
 type AppConnResp struct {
@@ -160,6 +175,9 @@ type AppConnResp struct {
 	Port      int
 	Failed    bool
 	Msg       PriorityMsg
+	Relay     string `json:",omitempty"`
+	// what the app takes at Port, streams if 0
+	Transports TransportMode `json:",omitempty"`
 }
 
 // run on app
@@ -206,35 +224,69 @@ type buildConnResp buildConn
 // run on node A, conn is udp from node B
 func (req *buildConnResp) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
 	conn.GetContextLogger().Debugf("buildConnResp %#v", req)
-	appConn, ok := f.Parent.GetConnection(req.FromApp)
-	if !ok {
-		err = fmt.Errorf("buildConnResp app %x not found", req.FromApp)
-		return
-	}
+	conn.setPeerReassembly(req.Reassembly)
 	tr := conn.CreatedByTransport
 	if tr == nil {
 		err = fmt.Errorf("buildConnResp tr %x not found", req.App)
 		return
 	}
-	tr.setUDPConn(conn)
-	tr.connAck()
-	exists := appConn.setTransportIfNotExists(req.App, tr)
-	if exists {
-		tr.Close()
-		conn.GetContextLogger().Debugf("buildConnResp transport exists")
+	tr.setFlowControl(req.FlowControl)
+	if tr.isResuming() {
+		return req.resume(conn, tr)
+	}
+	hop := tr.getRouteHop()
+	var appConn *Connection
+	if hop == nil {
+		var ok bool
+		appConn, ok = f.Parent.GetConnection(req.FromApp)
+		if !ok {
+			err = fmt.Errorf("buildConnResp app %x not found", req.FromApp)
+			return
+		}
+	}
+	if !tr.setUDPConn(conn) {
+		conn.GetContextLogger().Debugf("buildConnResp transport built over another conn")
 		return
 	}
-	fnOK := func(port int) {
-		msg := fmt.Sprintf("Discovery(%x): Connected app %x",
-			tr.getDiscoveryKey(), req.App)
-		priorityMsg := PriorityMsg{Priority: Connected, Msg: msg}
-		appConn.PutMessage(priorityMsg)
-		appConn.writeOP(OP_BUILD_APP_CONN|RESP_PREFIX, &AppConnResp{
-			Discovery: tr.getDiscoveryKey(),
-			App:       req.App,
-			Port:      port,
-			Msg:       priorityMsg,
-		})
+	tr.connAck()
+	tr.setTransports(req.Transports)
+	tr.acceptSession(req.Session)
+	var fnOK func(port int)
+	if hop != nil {
+		fnOK = func(port int) {
+			go hop.serve(port)
+		}
+	} else {
+		app := tr.remoteApp()
+		exists := appConn.setTransportIfNotExists(app, tr)
+		if exists {
+			tr.Close()
+			conn.GetContextLogger().Debugf("buildConnResp transport exists")
+			return
+		}
+		relay := tr.relayOf(conn)
+		hops := tr.routeHops()
+		// run with the fields of tr locked
+		fnOK = func(port int) {
+			msg := fmt.Sprintf("Discovery(%x): Connected app %x",
+				tr.getDiscoveryKey(), app)
+			if hops > 0 {
+				msg += fmt.Sprintf(" through %d nodes", hops)
+			}
+			if len(relay) > 0 {
+				msg += " relayed by discovery"
+			}
+			priorityMsg := PriorityMsg{Priority: Connected, Msg: msg, Relay: relay}
+			appConn.PutMessage(priorityMsg)
+			appConn.writeOP(OP_BUILD_APP_CONN|RESP_PREFIX, &AppConnResp{
+				Discovery:  tr.getDiscoveryKey(),
+				App:        app,
+				Port:       port,
+				Msg:        priorityMsg,
+				Relay:      relay,
+				Transports: req.Transports,
+			})
+		}
 	}
 	err = tr.ListenForApp(fnOK)
 	if err != nil {
@@ -242,8 +294,10 @@ func (req *buildConnResp) Execute(f *MessengerFactory, conn *Connection) (r resp
 		return
 	}
 	err = conn.writeOP(OP_APP_CONN_ACK|RESP_PREFIX, &connAck{
-		FromApp: req.FromApp,
-		App:     req.App,
+		FromApp:     req.FromApp,
+		App:         req.App,
+		Reassembly:  true,
+		FlowControl: true,
 	})
 	if err != nil {
 		err = fmt.Errorf("buildConnResp err %v", err)
@@ -254,12 +308,52 @@ func (req *buildConnResp) Execute(f *MessengerFactory, conn *Connection) (r resp
 	return
 }
 
+// node B built a new conn of the resuming transport, run on node A
+func (req *buildConnResp) resume(conn *Connection, tr *Transport) (r resp, err error) {
+	if !tr.setUDPConn(conn) {
+		conn.GetContextLogger().Debugf("buildConnResp transport resumed over another conn")
+		return
+	}
+	tr.connAck()
+	err = conn.writeOP(OP_APP_CONN_ACK|RESP_PREFIX, &connAck{
+		FromApp:     req.FromApp,
+		App:         req.App,
+		Reassembly:  true,
+		FlowControl: true,
+	})
+	if err != nil {
+		err = fmt.Errorf("buildConnResp err %v", err)
+		return
+	}
+	go tr.nodeReadLoop(conn, tr.getAppConn)
+	err = tr.sendResume(conn)
+	if err != nil {
+		err = fmt.Errorf("buildConnResp resume err %v", err)
+		return
+	}
+	err = ErrDetach
+	return
+}
+
 type forwardNodeConn struct {
 	Node     cipher.PubKey
 	App      cipher.PubKey
 	FromApp  cipher.PubKey
 	FromNode cipher.PubKey
 	Num      []byte
+	// the highest version node A supports
+	Version RegVersion
+	// node A ephemeral key for RegWithEphemeralKeyVersion
+	Ephemeral cipher.PubKey
+	// the addresses of node A of both families, tried by node B after the
+	// one seen by the manager
+	Candidates []string `json:",omitempty"`
+	// the onion of a route node A builds through node B
+	Route []byte `json:",omitempty"`
+	// node B keeps the transport by the session to resume it, Resume asks
+	// for a new conn of the transport
+	Session []byte `json:",omitempty"`
+	Resume  bool   `json:",omitempty"`
 }
 
 // run on manager, conn is udp conn from node A
@@ -267,7 +361,7 @@ func (req *forwardNodeConn) Execute(f *MessengerFactory, conn *Connection) (r re
 	c, ok := f.GetConnection(req.Node)
 	if !ok {
 		cause := fmt.Sprintf("Node %x not exists", req.Node)
-		conn.GetContextLogger().Debugf(cause)
+		conn.GetContextLogger().Debug(cause)
 		err = conn.writeOP(OP_FORWARD_NODE_CONN_RESP|RESP_PREFIX, &forwardNodeConnResp{
 			Node:     req.Node,
 			App:      req.App,
@@ -281,7 +375,7 @@ func (req *forwardNodeConn) Execute(f *MessengerFactory, conn *Connection) (r re
 	}
 
 	conn.GetContextLogger().Debugf("conn remote addr %v", conn.GetRemoteAddr())
-	p := globalTransportPairManagerInstance.create(req.FromApp, req.FromNode, req.Node, req.App)
+	p := globalTransportPairManagerInstance.create(req.FromApp, req.FromNode, req.Node, req.App, f.GetOptions().TransportPairTimeout)
 	err = p.setFromConn(conn)
 	if err != nil {
 		err = fmt.Errorf("set from Conn err: %s", err)
@@ -290,12 +384,18 @@ func (req *forwardNodeConn) Execute(f *MessengerFactory, conn *Connection) (r re
 	conn.SetTransportPair(p)
 	err = c.writeOP(OP_BUILD_NODE_CONN|RESP_PREFIX,
 		&buildConn{
-			Address:  conn.GetRemoteAddr().String(),
-			Node:     req.Node,
-			App:      req.App,
-			FromApp:  req.FromApp,
-			FromNode: req.FromNode,
-			Num:      req.Num,
+			Address:    conn.GetRemoteAddr().String(),
+			Node:       req.Node,
+			App:        req.App,
+			FromApp:    req.FromApp,
+			FromNode:   req.FromNode,
+			Num:        req.Num,
+			Version:    req.Version,
+			Ephemeral:  req.Ephemeral,
+			Candidates: req.Candidates,
+			Route:      req.Route,
+			Session:    req.Session,
+			Resume:     req.Resume,
 		})
 	return
 }
@@ -309,6 +409,10 @@ type forwardNodeConnResp struct {
 	Msg      PriorityMsg
 	Address  string
 	Num      []byte
+	// node B ephemeral key for RegWithEphemeralKeyVersion
+	Ephemeral cipher.PubKey
+	// the addresses of node B of both families
+	Candidates []string `json:",omitempty"`
 }
 
 // run on manager, conn is tcp/udp from node B
@@ -346,6 +450,10 @@ func (req *forwardNodeConnResp) Run(conn *Connection) (err error) {
 	if factory == nil {
 		factory = conn.factory
 	}
+	if hop, ok := factory.getRouteHop(req.FromApp); ok {
+		hop.forwardResp(conn, req)
+		return
+	}
 	appConn, ok := factory.GetConnection(req.FromApp)
 	if !ok {
 		conn.GetContextLogger().Debugf("forwardNodeConnResp app %x not found", req.FromApp)
@@ -361,65 +469,92 @@ func (req *forwardNodeConnResp) Run(conn *Connection) (err error) {
 		return
 	}
 	appConn.PutMessage(req.Msg)
+	if req.Failed && tr.isResuming() {
+		// through another discovery
+		tr.resumeFail()
+		return
+	}
 	if req.Failed {
 		appConn.writeOP(OP_BUILD_APP_CONN|RESP_PREFIX, &AppConnResp{
 			Discovery: conn.GetTargetKey(),
-			App:       req.App,
+			App:       tr.remoteApp(),
 			Failed:    req.Failed,
 			Msg:       req.Msg,
 		})
 		tr.Close()
 		return
 	}
-	if len(req.Address) > 0 {
-		e := tr.clientSideConnect(req.Address, conn.factory.GetDefaultSeedConfig(), req.Num)
+	req.connect(conn, tr)
+	return
+}
+
+// connect tr to node B at the addresses the manager forwarded
+func (req *forwardNodeConnResp) connect(conn *Connection, tr *Transport) {
+	// an empty key tells the conns from node B to use the static keys
+	e := tr.setRemoteEphemeralKey(req.Ephemeral)
+	if e != nil {
+		conn.GetContextLogger().Debugf("forwardNodeConnResp setRemoteEphemeralKey %v", e)
+	}
+	if len(req.Address) > 0 || len(req.Candidates) > 0 {
+		e := tr.clientSideConnect(orderCandidates(req.Address, req.Candidates))
 		if e != nil {
 			conn.GetContextLogger().Debugf("forwardNodeConnResp clientSideConnect %v", e)
 		}
 	}
-	return
+	tr.scheduleRelay(tr.discoveryConn)
 }
 
 type buildConn struct {
-	Address  string
-	Node     cipher.PubKey
-	App      cipher.PubKey
-	FromApp  cipher.PubKey
-	FromNode cipher.PubKey
-	Num      []byte
+	Address    string
+	Node       cipher.PubKey
+	App        cipher.PubKey
+	FromApp    cipher.PubKey
+	FromNode   cipher.PubKey
+	Num        []byte
+	Version    RegVersion
+	Ephemeral  cipher.PubKey
+	Candidates []string `json:",omitempty"`
+	// the onion of a route, the node opens its layer
+	Route []byte `json:",omitempty"`
+	// what the app of node B takes, sent back by node B
+	Transports TransportMode `json:",omitempty"`
+	// the session of node A, node B sends it back if it keeps the
+	// transport by it
+	Session []byte `json:",omitempty"`
+	Resume  bool   `json:",omitempty"`
+	// node B reassembles fragmented udp msgs, set in the resp of node B
+	Reassembly bool `json:",omitempty"`
+	// node B does flow control of app conns, set in the resp of node B
+	FlowControl bool `json:",omitempty"`
 }
 
 func (req *buildConn) Run(conn *Connection) (err error) {
+	if req.Resume {
+		return req.resume(conn)
+	}
+	var routeKey []byte
+	if len(req.Route) > 0 {
+		var layer *routeLayer
+		layer, routeKey, err = openRouteLayer(conn.factory.GetDefaultSeedConfig(), req.Route)
+		if err != nil {
+			cause := fmt.Sprintf("Node %x route err %v", req.Node, err)
+			return req.refuse(conn, NotAllowed, cause)
+		}
+		if layer.Node != EMPTY_PUBLIC_KEY {
+			return req.forwardRoute(conn, layer, routeKey)
+		}
+	}
+
 	appConn, ok := conn.factory.GetConnection(req.App)
 	if !ok {
 		cause := fmt.Sprintf("Node %x app %x not exists", req.Node, req.App)
-		conn.GetContextLogger().Debugf(cause)
-		err = conn.writeOP(OP_FORWARD_NODE_CONN_RESP, &forwardNodeConnResp{
-			Node:     req.Node,
-			App:      req.App,
-			FromApp:  req.FromApp,
-			FromNode: req.FromNode,
-			Failed:   true,
-			Msg:      PriorityMsg{Priority: NotFound, Msg: cause, Type: Failed},
-			Num:      req.Num,
-		})
-		return
+		return req.refuse(conn, NotFound, cause)
 	}
 
 	s, ok := appConn.getService(req.App)
 	if !ok {
 		cause := fmt.Sprintf("Node %x app %x not exists", req.Node, req.App)
-		conn.GetContextLogger().Debugf(cause)
-		err = conn.writeOP(OP_FORWARD_NODE_CONN_RESP, &forwardNodeConnResp{
-			Node:     req.Node,
-			App:      req.App,
-			FromApp:  req.FromApp,
-			FromNode: req.FromNode,
-			Failed:   true,
-			Msg:      PriorityMsg{Priority: NotFound, Msg: cause, Type: Failed},
-			Num:      req.Num,
-		})
-		return
+		return req.refuse(conn, NotFound, cause)
 	}
 
 	if len(s.AllowNodes) > 0 {
@@ -432,21 +567,70 @@ func (req *buildConn) Run(conn *Connection) (err error) {
 		}
 		if !allow {
 			cause := fmt.Sprintf("Node %x app %x forbid %x", req.Node, req.App, req.FromNode)
-			conn.GetContextLogger().Debugf(cause)
-			err = conn.writeOP(OP_FORWARD_NODE_CONN_RESP, &forwardNodeConnResp{
-				Node:     req.Node,
-				App:      req.App,
-				FromApp:  req.FromApp,
-				FromNode: req.FromNode,
-				Failed:   true,
-				Msg:      PriorityMsg{Priority: NotAllowed, Msg: cause, Type: Failed},
-				Num:      req.Num,
-			})
-			return
+			return req.refuse(conn, NotAllowed, cause)
 		}
 	}
 
+	modes := s.Transports
+	if routeKey != nil {
+		// the layers of a route are on streams only
+		if !modes.streams() {
+			cause := fmt.Sprintf("Node %x app %x takes no streams through routes", req.Node, req.App)
+			return req.refuse(conn, NotAllowed, cause)
+		}
+		modes &^= TRANSPORT_DATAGRAM
+	}
+
 	tr := NewTransport(conn.factory, appConn, req.FromNode, req.Node, req.FromApp, req.App)
+	tr.setTransports(modes)
+	if routeKey != nil {
+		tr.setRouteKeys([][]byte{routeKey})
+	} else if len(req.Session) > 0 {
+		tr.keepSession(req.Session)
+	}
+	return req.accept(conn, tr, s.Address)
+}
+
+// node A asks for a new conn of the transport of the session, the old one
+// is dropped if node B did not notice it broke
+func (req *buildConn) resume(conn *Connection) (err error) {
+	tr, ok := conn.factory.getSession(req.FromNode, req.Session)
+	if !ok || tr.FromApp != req.FromApp || tr.ToApp != req.App {
+		cause := fmt.Sprintf("Node %x transport to resume not exists", req.Node)
+		return req.refuse(conn, NotFound, cause)
+	}
+	tr.fieldsMutex.RLock()
+	old := tr.conn
+	tr.fieldsMutex.RUnlock()
+	if old != nil {
+		tr.lost(old)
+	}
+	if !tr.isResuming() {
+		cause := fmt.Sprintf("Node %x transport to resume closed", req.Node)
+		return req.refuse(conn, NotFound, cause)
+	}
+	return req.accept(conn, tr, tr.getAppAddress())
+}
+
+// tell node A through the manager it can't have the transport
+func (req *buildConn) refuse(conn *Connection, priority Priority, cause string) error {
+	conn.GetContextLogger().Debug(cause)
+	return conn.writeOP(OP_FORWARD_NODE_CONN_RESP, &forwardNodeConnResp{
+		Node:     req.Node,
+		App:      req.App,
+		FromApp:  req.FromApp,
+		FromNode: req.FromNode,
+		Failed:   true,
+		Msg:      PriorityMsg{Priority: priority, Msg: cause, Type: Failed},
+		Num:      req.Num,
+	})
+}
+
+// answer node A through the manager and connect tr to it, its app streams
+// go to appAddress
+func (req *buildConn) accept(conn *Connection, tr *Transport, appAddress string) (err error) {
+	tr.setCongestionController(conn.newCongestionController)
+	tr.setOptions(conn.getOptions())
 	connection, err := tr.ListenAndConnect(conn.GetRemoteAddr().String(), conn.GetTargetKey())
 	if err != nil {
 		return
@@ -461,43 +645,79 @@ func (req *buildConn) Run(conn *Connection) (err error) {
 			req.App,
 		),
 	}
-	appConn.PutMessage(msg)
+	tr.putMessage(msg)
+	version := negotiateRegVersionWithKey(RegWithKeyAndEncryptionVersion, req.Version, req.Ephemeral)
+	var ephemeral cipher.PubKey
+	if version >= RegWithEphemeralKeyVersion {
+		var ephemeralSecKey cipher.SecKey
+		ephemeral, ephemeralSecKey = cipher.GenerateKeyPair()
+		tr.setEphemeralKey(req.Num, ephemeralSecKey)
+		err = tr.setRemoteEphemeralKey(req.Ephemeral)
+		if err != nil {
+			return
+		}
+	}
 	err = connection.writeOP(OP_FORWARD_NODE_CONN_RESP, &forwardNodeConnResp{
-		Node:     req.Node,
-		App:      req.App,
-		FromApp:  req.FromApp,
-		FromNode: req.FromNode,
-		Msg:      msg,
-		Num:      req.Num,
+		Node:       req.Node,
+		App:        req.App,
+		FromApp:    req.FromApp,
+		FromNode:   req.FromNode,
+		Msg:        msg,
+		Num:        req.Num,
+		Ephemeral:  ephemeral,
+		Candidates: tr.factory.udpCandidates(),
 	})
 	if err != nil {
 		return
 	}
-	err = tr.serverSiceConnect(req.Address, s.Address, conn.factory.GetDefaultSeedConfig(), req.Num)
+	err = tr.serverSiceConnect(orderCandidates(req.Address, req.Candidates), appAddress, conn.factory.GetDefaultSeedConfig(), req.Num, version)
 	tr.SetupTimeout()
 	return
 }
 
 type connAck struct {
 	FromApp, App cipher.PubKey
+	// node A reassembles fragmented udp msgs
+	Reassembly bool `json:",omitempty"`
+	// node A does flow control of app conns
+	FlowControl bool `json:",omitempty"`
 }
 
 // run on node b from node a udp
 func (req *connAck) Run(conn *Connection) (err error) {
 	conn.GetContextLogger().Debugf("recv conn ack %x", req.App)
+	conn.setPeerReassembly(req.Reassembly)
 	tr := conn.CreatedByTransport
 	if tr == nil {
 		err = fmt.Errorf("tr %x not exists", tr)
 		return
 	}
-	tr.appConnHolder.setTransportIfNotExists(req.FromApp, tr)
+	tr.setFlowControl(req.FlowControl)
+	err = tr.serveNode(conn)
+	if err != nil {
+		return
+	}
+	if tr.appConnHolder != nil {
+		tr.appConnHolder.setTransportIfNotExists(req.FromApp, tr)
+	}
+	tr.nodeAck()
 	tr.StopTimeout()
+	if tr.isResuming() {
+		err = tr.sendResume(conn)
+		if err != nil {
+			return
+		}
+	}
 	msg := PriorityMsg{
 		Priority: Connected,
 		Msg: fmt.Sprintf("Discovery(%x): Connected by app %x",
 			tr.getDiscoveryKey(), req.FromApp),
+		Relay: tr.relayOf(conn),
+	}
+	if len(msg.Relay) > 0 {
+		msg.Msg += " relayed by discovery"
 	}
-	tr.appConnHolder.PutMessage(msg)
+	tr.putMessage(msg)
 	err = ErrDetach
 	return
 }
@@ -0,0 +1,22 @@
+package factory
+
+import (
+	"sync"
+)
+
+func init() {
+	ops[OP_NET_CONN] = &sync.Pool{
+		New: func() interface{} {
+			return new(netConnData)
+		},
+	}
+}
+
+// the bytes of the net.Conn of the conn, see Connection.NetConn
+type netConnData struct {
+}
+
+func (d *netConnData) RawExecute(f *MessengerFactory, conn *Connection, m []byte) (rb []byte, err error) {
+	conn.deliverNetConn(m[MSG_HEADER_END:])
+	return
+}
@@ -49,9 +49,29 @@ func (offer *offer) Execute(f *MessengerFactory, conn *Connection) (r resp, err
 		}
 		offer.Services.ServiceAddress = net.JoinHostPort(host, port)
 	}
+	offer.Services.Addresses = mergeAddresses(host, offer.Services.Addresses)
 	if util.IPLocator.IsOK() {
 		offer.Services.Location = util.IPLocator.LookupLocation(host)
 	}
 	err = f.discoveryRegister(conn, offer.Services)
 	return
 }
+
+// the ip discovery sees the node at comes first, the ones the node reported
+// follow
+func mergeAddresses(observed string, reported []string) (addrs []string) {
+	seen := make(map[string]bool)
+	for _, a := range append([]string{observed}, reported...) {
+		ip := net.ParseIP(a)
+		if ip == nil || len(addrs) >= MAX_CANDIDATES {
+			continue
+		}
+		a = ip.String()
+		if seen[a] {
+			continue
+		}
+		seen[a] = true
+		addrs = append(addrs, a)
+	}
+	return
+}
@@ -108,7 +108,7 @@ func (query *queryByAttrs) Execute(f *MessengerFactory, conn *Connection) (r res
 		query.Limit = 5
 	}
 	if !f.Proxy {
-		r = &QueryByAttrsResp{Seq: query.Seq, Result: f.FindByAttributesAndPaging(query.Pages, query.Limit, query.Attrs...)}
+		r = &QueryByAttrsResp{Seq: query.Seq, Result: f.findByAttributesAndPaging(query.Pages, query.Limit, query.Attrs...)}
 		return
 	}
 	f.ForEachConn(func(connection *Connection) {
@@ -128,6 +128,10 @@ func (resp *QueryByAttrsResp) Run(conn *Connection) (err error) {
 	if connection, ok := conn.removeProxyConnection(resp.Seq); ok {
 		return connection.writeOP(OP_QUERY_BY_ATTRS|RESP_PREFIX, resp)
 	}
+	if fn, ok := conn.removeQueryCallback(resp.Seq); ok {
+		fn(resp.Result)
+		return
+	}
 	if conn.findServiceNodesByAttributesCallback != nil {
 		conn.findServiceNodesByAttributesCallback(resp)
 	}
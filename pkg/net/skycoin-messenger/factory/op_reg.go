@@ -74,6 +74,7 @@ func (resp *regResp) Run(conn *Connection) (err error) {
 const (
 	publicKey = iota
 	randomBytes
+	ephemeralKey
 )
 
 type RegVersion int
@@ -81,12 +82,47 @@ type RegVersion int
 const (
 	regWithKeyVersion RegVersion = iota
 	RegWithKeyAndEncryptionVersion
+	// authenticated encryption with replay protection
+	RegWithKeyAndAEADVersion
+	// ephemeral keys mixed into the session secret and periodic rekey
+	RegWithEphemeralKeyVersion
+
+	// the highest version offered by this node
+	latestRegVersion = RegWithEphemeralKeyVersion
 )
 
+// negotiateRegVersion picks the highest version both sides support
+func negotiateRegVersion(version, max RegVersion) RegVersion {
+	if max > latestRegVersion {
+		max = latestRegVersion
+	}
+	if max > version {
+		return max
+	}
+	return version
+}
+
+// the ephemeral key is needed for RegWithEphemeralKeyVersion
+func negotiateRegVersionWithKey(version, max RegVersion, ephemeral cipher.PubKey) RegVersion {
+	v := negotiateRegVersion(version, max)
+	if v >= RegWithEphemeralKeyVersion && ephemeral == EMPTY_PUBLIC_KEY {
+		v = RegWithKeyAndAEADVersion
+	}
+	return v
+}
+
 type regWithKey struct {
 	PublicKey cipher.PubKey
 	Context   map[string]string
 	Version   RegVersion
+	// the highest version the client supports, zero for old clients
+	MaxVersion RegVersion
+	// client ephemeral key for RegWithEphemeralKeyVersion
+	Ephemeral cipher.PubKey
+	// compression algorithms the client supports for the ops, none if empty
+	Compression []string
+	// the client reassembles fragmented udp msgs
+	Reassembly bool `json:",omitempty"`
 }
 
 func (reg *regWithKey) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
@@ -98,7 +134,8 @@ func (reg *regWithKey) Execute(f *MessengerFactory, conn *Connection) (r resp, e
 		conn.StoreContext(k, v)
 	}
 	conn.StoreContext(publicKey, reg.PublicKey)
-	if reg.Version == RegWithKeyAndEncryptionVersion {
+	conn.setPeerReassembly(reg.Reassembly)
+	if reg.Version >= RegWithKeyAndEncryptionVersion {
 		sc := f.GetDefaultSeedConfig()
 		if sc == nil {
 			err = errors.New("GetDefaultSeedConfig is nil")
@@ -108,26 +145,39 @@ func (reg *regWithKey) Execute(f *MessengerFactory, conn *Connection) (r resp, e
 		hash := cipher.SumSHA256(n)
 		conn.StoreContext(randomBytes, hash)
 		resp := &regWithKeyResp{
-			Num:       make([]byte, aes.BlockSize),
-			PublicKey: sc.publicKey,
-			Version:   reg.Version,
-			Hash:      hash,
+			Num:         make([]byte, aes.BlockSize),
+			PublicKey:   sc.publicKey,
+			Version:     negotiateRegVersionWithKey(reg.Version, reg.MaxVersion, reg.Ephemeral),
+			Hash:        hash,
+			Compression: negotiateCompression(reg.Compression),
+			Reassembly:  true,
 		}
 		if _, err = io.ReadFull(rand.Reader, resp.Num); err != nil {
 			return
 		}
-		err = conn.SetCrypto(sc.publicKey, sc.secKey, reg.PublicKey, resp.Num)
+		if resp.Version >= RegWithEphemeralKeyVersion {
+			var esk cipher.SecKey
+			resp.Ephemeral, esk = cipher.GenerateKeyPair()
+			err = conn.SetEphemeralCrypto(sc.publicKey, sc.secKey, reg.PublicKey, resp.Num, esk, reg.Ephemeral)
+		} else {
+			err = conn.SetCrypto(sc.publicKey, sc.secKey, reg.PublicKey, resp.Num, resp.Version)
+		}
 		if err != nil {
 			return
 		}
 
 		err = conn.writeOPSyn(OP_REG_KEY|RESP_PREFIX,
 			resp)
+		if err != nil {
+			return
+		}
+		// the resp itself goes out uncompressed
+		conn.setCompression(resp.Compression)
 		return
 	}
 	n := cipher.RandByte(64)
 	conn.StoreContext(randomBytes, n)
-	r = &regWithKeyResp{Num: n}
+	r = &regWithKeyResp{Num: n, Reassembly: true}
 	return
 }
 
@@ -136,10 +186,18 @@ type regWithKeyResp struct {
 	Hash      cipher.SHA256
 	PublicKey cipher.PubKey
 	Version   RegVersion
+	// server ephemeral key for RegWithEphemeralKeyVersion
+	Ephemeral cipher.PubKey
+	// compression of the ops picked by the server, none if empty
+	Compression string
+	// the server reassembles fragmented udp msgs
+	Reassembly bool `json:",omitempty"`
 }
 
 func (resp *regWithKeyResp) Run(conn *Connection) (err error) {
-	if resp.Version == RegWithKeyAndEncryptionVersion {
+	conn.setPeerReassembly(resp.Reassembly)
+	if resp.Version >= RegWithKeyAndEncryptionVersion {
+		conn.setCompression(negotiateCompression([]string{resp.Compression}))
 		k, ok := conn.context.Load(publicKey)
 		if !ok {
 			err = errors.New("public key not found")
@@ -155,7 +213,11 @@ func (resp *regWithKeyResp) Run(conn *Connection) (err error) {
 		if t != EMPTY_PUBLIC_KEY && t != tpk {
 			tpk = t
 		}
-		err = conn.SetCrypto(pk, conn.GetSecKey(), tpk, resp.Num)
+		if resp.Version >= RegWithEphemeralKeyVersion {
+			err = conn.setEphemeralCryptoFromContext(pk, conn.GetSecKey(), tpk, resp.Num, resp.Ephemeral)
+		} else {
+			err = conn.SetCrypto(pk, conn.GetSecKey(), tpk, resp.Num, resp.Version)
+		}
 		if err != nil {
 			return
 		}
@@ -194,7 +256,7 @@ func (reg *regCheckSig) Execute(f *MessengerFactory, conn *Connection) (r resp,
 		err = errors.New("public key invalid")
 		return
 	}
-	if reg.Version == RegWithKeyAndEncryptionVersion {
+	if reg.Version >= RegWithKeyAndEncryptionVersion {
 		if conn.GetCrypto() == nil {
 			err = errors.New("regCheckSig conn crypto is nil")
 			return
@@ -0,0 +1,105 @@
+package factory
+
+import (
+	"flag"
+	"time"
+
+	"github.com/skycoin/skywire/pkg/net/conn"
+)
+
+const (
+	KEY_WAIT_TIMEOUT         = 60 * time.Second
+	TRANSPORT_PAIR_TIMEOUT   = 120 * time.Second
+	TRANSPORT_SETUP_TIMEOUT  = 30 * time.Second
+	TRANSPORT_RELAY_TIMEOUT  = 10 * time.Second
+	TRANSPORT_RESUME_TIMEOUT = 2 * time.Minute
+)
+
+// Options are the timeouts and compression settings of a MessengerFactory
+// and its conns, zero timeouts keep the defaults
+type Options struct {
+	conn.Options
+
+	// reg waits this long for the key of the server
+	KeyWaitTimeout time.Duration
+	// the manager forgets a transport pair not built within this time
+	TransportPairTimeout time.Duration
+	// a transport not built within this time fails
+	TransportSetupTimeout time.Duration
+	// node A asks the discovery to relay a transport the nodes could not
+	// build directly within this time
+	TransportRelayTimeout time.Duration
+	// a transport whose conn between the nodes broke keeps its app conns
+	// this long while node A builds a new one
+	TransportResumeTimeout time.Duration
+	// the discovery relays the transports the nodes ask it to
+	RelayTransports bool
+	// forward the routes of other nodes, the node is offered to them by
+	// its discoveries
+	RouteForwarding bool
+
+	// offer the server to compress the ops of tcp conns
+	Compression bool
+	// compress the app streams of the transports built through the conns,
+	// both nodes have to support it
+	CompressTransports bool
+
+	// a transport carries at most this many datagram flows, datagrams of
+	// new ones are dropped
+	DatagramFlows int
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Options:                conn.DefaultOptions(),
+		KeyWaitTimeout:         KEY_WAIT_TIMEOUT,
+		TransportPairTimeout:   TRANSPORT_PAIR_TIMEOUT,
+		TransportSetupTimeout:  TRANSPORT_SETUP_TIMEOUT,
+		TransportRelayTimeout:  TRANSPORT_RELAY_TIMEOUT,
+		TransportResumeTimeout: TRANSPORT_RESUME_TIMEOUT,
+		RelayTransports:        true,
+		DatagramFlows:          DATAGRAM_MAX_FLOWS,
+	}
+}
+
+// WithDefaults returns o with the zero fields set to the defaults
+func (o Options) WithDefaults() Options {
+	o.Options = o.Options.WithDefaults()
+	if o.KeyWaitTimeout <= 0 {
+		o.KeyWaitTimeout = KEY_WAIT_TIMEOUT
+	}
+	if o.TransportPairTimeout <= 0 {
+		o.TransportPairTimeout = TRANSPORT_PAIR_TIMEOUT
+	}
+	if o.TransportSetupTimeout <= 0 {
+		o.TransportSetupTimeout = TRANSPORT_SETUP_TIMEOUT
+	}
+	if o.TransportRelayTimeout <= 0 {
+		o.TransportRelayTimeout = TRANSPORT_RELAY_TIMEOUT
+	}
+	if o.TransportResumeTimeout <= 0 {
+		o.TransportResumeTimeout = TRANSPORT_RESUME_TIMEOUT
+	}
+	if o.DatagramFlows <= 0 {
+		o.DatagramFlows = DATAGRAM_MAX_FLOWS
+	}
+	return o
+}
+
+// RegisterFlags lets the command line of nodes and apps set the options
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&o.TCPReadTimeout, "tcp-read-timeout", o.TCPReadTimeout, "close tcp conns without msgs for this long")
+	fs.DurationVar(&o.TCPPingTickPeriod, "tcp-ping-period", o.TCPPingTickPeriod, "ping period of tcp conns")
+	fs.DurationVar(&o.UDPPingTickPeriod, "udp-ping-period", o.UDPPingTickPeriod, "ping period of idle udp conns")
+	fs.DurationVar(&o.UDPGCPeriod, "udp-gc-period", o.UDPGCPeriod, "close udp conns without msgs for this long")
+	fs.DurationVar(&o.KeyWaitTimeout, "key-wait-timeout", o.KeyWaitTimeout, "timeout of the reg to the server")
+	fs.DurationVar(&o.TransportPairTimeout, "transport-pair-timeout", o.TransportPairTimeout, "time the manager keeps a transport pair being built")
+	fs.DurationVar(&o.TransportSetupTimeout, "transport-setup-timeout", o.TransportSetupTimeout, "timeout of building a transport")
+	fs.DurationVar(&o.TransportRelayTimeout, "transport-relay-timeout", o.TransportRelayTimeout, "ask the discovery to relay a transport not built directly within this time")
+	fs.DurationVar(&o.TransportResumeTimeout, "transport-resume-timeout", o.TransportResumeTimeout, "time a broken transport keeps its app conns while it gets built again")
+	fs.BoolVar(&o.RelayTransports, "relay-transports", o.RelayTransports, "relay the transports nodes can't build directly, for discoveries")
+	fs.BoolVar(&o.RouteForwarding, "route-forwarding", o.RouteForwarding, "forward the routes of other nodes")
+	fs.BoolVar(&o.Compression, "compression", o.Compression, "compress the msgs to the server if it supports it")
+	fs.BoolVar(&o.CompressTransports, "compress-transports", o.CompressTransports, "compress the app streams of transports")
+	fs.IntVar(&o.DatagramFlows, "datagram-flows", o.DatagramFlows, "most datagram flows of a transport")
+}
@@ -0,0 +1,147 @@
+package factory
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+	cn "github.com/skycoin/skywire/pkg/net/conn"
+	"github.com/skycoin/skywire/pkg/net/factory"
+)
+
+// a conn over a udp conn without a socket, writes wait in its channels
+func newOptionsTestConnection(f *MessengerFactory, addr *net.UDPAddr) *Connection {
+	return newConnection(&factory.Connection{Connection: cn.NewUDPConn(nil, addr)}, f)
+}
+
+func TestOptions_WithDefaults(t *testing.T) {
+	d := DefaultOptions()
+	custom := Options{
+		Options: cn.Options{
+			TCPReadTimeout:    time.Second,
+			TCPPingTickPeriod: 2 * time.Second,
+			UDPPingTickPeriod: 3 * time.Second,
+			UDPGCPeriod:       4 * time.Second,
+		},
+		KeyWaitTimeout:         5 * time.Second,
+		TransportPairTimeout:   6 * time.Second,
+		TransportSetupTimeout:  7 * time.Second,
+		TransportRelayTimeout:  8 * time.Second,
+		TransportResumeTimeout: 9 * time.Second,
+		RouteForwarding:        true,
+		Compression:            true,
+		CompressTransports:     true,
+		DatagramFlows:          10,
+	}
+	// the switches are left as they are, only the timeouts get defaults
+	zero := d
+	zero.RelayTransports = false
+	negative := zero
+	negative.KeyWaitTimeout = -time.Second
+	negative.TransportResumeTimeout = -time.Second
+	negative.UDPGCPeriod = -time.Second
+	negative.DatagramFlows = -1
+	partial := zero
+	partial.TransportSetupTimeout = time.Second
+	partial.TCPReadTimeout = time.Second
+	for _, tc := range []struct {
+		name     string
+		in, want Options
+	}{
+		{"zero", Options{}, zero},
+		{"defaults", d, d},
+		{"custom", custom, custom},
+		{"negative", negative, zero},
+		{"partial", Options{TransportSetupTimeout: time.Second, Options: cn.Options{TCPReadTimeout: time.Second}}, partial},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.in.WithDefaults(); got != tc.want {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOptions_KeyWaitTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	for _, tc := range []struct {
+		name string
+		conn func() *Connection
+	}{
+		{"factory", func() *Connection {
+			f := NewMessengerFactory()
+			f.SetOptions(Options{KeyWaitTimeout: timeout})
+			return newOptionsTestConnection(f, nil)
+		}},
+		{"conn", func() *Connection {
+			c := newOptionsTestConnection(NewMessengerFactory(), nil)
+			c.options = &Options{KeyWaitTimeout: timeout}
+			return c
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			start := time.Now()
+			if err := tc.conn().WaitForKey(); err == nil {
+				t.Fatal("key set")
+			}
+			if d := time.Since(start); d >= KEY_WAIT_TIMEOUT/2 {
+				t.Fatalf("waited %v", d)
+			}
+		})
+	}
+}
+
+func TestOptions_TransportPairTimeout(t *testing.T) {
+	f := NewMessengerFactory()
+	f.SetOptions(Options{TransportPairTimeout: 50 * time.Millisecond})
+	fromApp, _ := cipher.GenerateKeyPair()
+	fromNode, _ := cipher.GenerateKeyPair()
+	toApp, _ := cipher.GenerateKeyPair()
+	node, _ := cipher.GenerateKeyPair()
+	f.regConnections[node] = newOptionsTestConnection(f, nil)
+	from := newOptionsTestConnection(f, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000})
+	req := &forwardNodeConn{Node: node, App: toApp, FromApp: fromApp, FromNode: fromNode}
+	if _, err := req.Execute(f, from); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := globalTransportPairManagerInstance.get(req.FromApp, req.FromNode, req.Node, req.App); !ok {
+		t.Fatal("transport pair not created")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, ok := globalTransportPairManagerInstance.get(req.FromApp, req.FromNode, req.Node, req.App); ok {
+		t.Fatal("transport pair kept past TransportPairTimeout")
+	}
+}
+
+func TestOptions_RelayTransports(t *testing.T) {
+	f := NewMessengerFactory()
+	o := DefaultOptions()
+	o.RelayTransports = false
+	f.SetOptions(o)
+	conn := newOptionsTestConnection(f, nil)
+	conn.SetTransportPair(&transportPair{})
+	r, err := (&relayNodeConn{}).Execute(f, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, ok := r.(*relayNodeConnResp); !ok || !resp.Failed {
+		t.Fatalf("relayed with RelayTransports off, resp %#v", r)
+	}
+}
+
+func TestOptions_CompressTransports(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		f := NewMessengerFactory()
+		tr := newTransport(f, cipher.PubKey{}, cipher.PubKey{}, cipher.PubKey{}, cipher.PubKey{}, true)
+		o := DefaultOptions()
+		o.CompressTransports = compress
+		tr.setOptions(o)
+		if tr.isCompress() != compress {
+			t.Fatalf("CompressTransports %v, transport compresses %v", compress, tr.isCompress())
+		}
+		if tr.factory.GetOptions() != o.WithDefaults() {
+			t.Fatal("options not passed to the conns of the transport")
+		}
+	}
+}
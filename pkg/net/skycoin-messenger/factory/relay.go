@@ -0,0 +1,239 @@
+package factory
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cn "github.com/skycoin/skywire/pkg/net/conn"
+)
+
+func init() {
+	ops[OP_RELAY_NODE_CONN] = &sync.Pool{
+		New: func() interface{} {
+			return new(relayNodeConn)
+		},
+	}
+	resps[OP_RELAY_NODE_CONN] = &sync.Pool{
+		New: func() interface{} {
+			return new(relayNodeConnResp)
+		},
+	}
+}
+
+type relayNodeConn struct {
+}
+
+// run on discovery, conn is udp from node A. Both nodes get the port of
+// the relay to send to.
+func (req *relayNodeConn) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
+	p := conn.GetTransportPair()
+	if p == nil || !f.GetOptions().RelayTransports {
+		conn.GetContextLogger().Debugf("relay refused")
+		r = &relayNodeConnResp{Failed: true}
+		return
+	}
+	fromConn, toConn, fromPort, toPort, e := p.setupRelay(f.GetRateLimits().global)
+	if e != nil {
+		conn.GetContextLogger().Debugf("relay err %v", e)
+		r = &relayNodeConnResp{Failed: true}
+		return
+	}
+	conn.GetContextLogger().Debugf("relay transport on ports %d %d", fromPort, toPort)
+	err = toConn.writeOP(OP_RELAY_NODE_CONN|RESP_PREFIX, &relayNodeConnResp{Port: toPort})
+	if err != nil {
+		return
+	}
+	err = fromConn.writeOP(OP_RELAY_NODE_CONN|RESP_PREFIX, &relayNodeConnResp{Port: fromPort})
+	return
+}
+
+type relayNodeConnResp struct {
+	Port   int  `json:",omitempty"`
+	Failed bool `json:",omitempty"`
+}
+
+// run on node A and B, conn is udp from discovery
+func (req *relayNodeConnResp) Run(conn *Connection) (err error) {
+	tr := conn.CreatedByTransport
+	if tr == nil || req.Failed {
+		conn.GetContextLogger().Debugf("relay failed")
+		return
+	}
+	host, _, err := net.SplitHostPort(conn.GetRemoteAddr().String())
+	if err != nil {
+		return
+	}
+	e := tr.relayConnect(net.JoinHostPort(host, strconv.Itoa(req.Port)))
+	if e != nil {
+		conn.GetContextLogger().Debugf("relay connect err %v", e)
+	}
+	return
+}
+
+// ask the discovery to relay the transport if the nodes did not reach each
+// other within TransportRelayTimeout, run on node A
+func (t *Transport) scheduleRelay(discovery *Connection) {
+	time.AfterFunc(t.creator.GetOptions().TransportRelayTimeout, func() {
+		t.fieldsMutex.RLock()
+		built := t.conn != nil || t.factory == nil
+		t.fieldsMutex.RUnlock()
+		if built {
+			return
+		}
+		t.putMessage(PriorityMsg{
+			Priority: Building,
+			Msg: fmt.Sprintf("Discovery(%x): No direct connection to node %x app %x, relaying",
+				t.getDiscoveryKey(), t.ToNode, t.ToApp),
+		})
+		err := discovery.writeOP(OP_RELAY_NODE_CONN, &relayNodeConn{})
+		if err != nil {
+			discovery.GetContextLogger().Debugf("relay err %v", err)
+		}
+	})
+}
+
+// node A punches the relay like an address of node B, node B connects to
+// node A through it
+func (t *Transport) relayConnect(address string) (err error) {
+	t.fieldsMutex.Lock()
+	if t.relayAddr == address {
+		t.fieldsMutex.Unlock()
+		return
+	}
+	t.relayAddr = address
+	if t.clientSide {
+		defer t.fieldsMutex.Unlock()
+		if t.factory == nil {
+			err = errors.New("transport has been closed")
+			return
+		}
+		err = t.punch(address)
+		return
+	}
+	t.fieldsMutex.Unlock()
+	_, err = t.connectNode(address)
+	return
+}
+
+// the key of the discovery relaying conn, empty if it goes directly
+func (t *Transport) relayOf(conn *Connection) (relay string) {
+	t.fieldsMutex.RLock()
+	if len(t.relayAddr) > 0 && conn.GetRemoteAddr().String() == t.relayAddr {
+		relay = t.getDiscoveryKey().Hex()
+	}
+	t.fieldsMutex.RUnlock()
+	return
+}
+
+// relay forwards the datagrams of a transport between its nodes when they
+// can't reach each other. Each node sends to a socket of its own, the
+// datagrams of one go out of the socket of the other. They are encrypted
+// between the nodes, the relay only passes them on.
+type relay struct {
+	from, to *relayEnd
+	limiter  *cn.RateLimiter
+
+	closeOnce sync.Once
+}
+
+// the socket of a node, it learns the address of the node by the first
+// datagram from the ip discovery saw the node at
+type relayEnd struct {
+	conn *net.UDPConn
+	ip   net.IP
+	addr *net.UDPAddr
+	mtx  sync.RWMutex
+}
+
+func newRelay(fromIP, toIP net.IP, limiter *cn.RateLimiter) (r *relay, err error) {
+	from, err := newRelayEnd(fromIP)
+	if err != nil {
+		return
+	}
+	to, err := newRelayEnd(toIP)
+	if err != nil {
+		from.conn.Close()
+		return
+	}
+	r = &relay{from: from, to: to, limiter: limiter}
+	go r.forward(from, to)
+	go r.forward(to, from)
+	return
+}
+
+func newRelayEnd(ip net.IP) (e *relayEnd, err error) {
+	if ip == nil {
+		err = errors.New("relay: node ip unknown")
+		return
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return
+	}
+	e = &relayEnd{conn: conn, ip: ip}
+	return
+}
+
+// ports the nodes send to, node A the first one
+func (r *relay) ports() (from, to int) {
+	return udpPort(r.from.conn.LocalAddr()), udpPort(r.to.conn.LocalAddr())
+}
+
+func (r *relay) forward(src, dst *relayEnd) {
+	defer r.close()
+	buf := make([]byte, cn.MAX_PLPMTU)
+	for {
+		n, addr, err := src.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !src.learn(addr) {
+			continue
+		}
+		to := dst.getAddr()
+		if to == nil {
+			// the other node did not send yet, the sender resends
+			continue
+		}
+		if r.limiter != nil {
+			if r.limiter.Delay() > 0 {
+				continue
+			}
+			r.limiter.Take(n)
+		}
+		_, err = dst.conn.WriteToUDP(buf[:n], to)
+		if err != nil {
+			log.Debugf("relay write to %s err %v", to, err)
+		}
+	}
+}
+
+func (r *relay) close() {
+	r.closeOnce.Do(func() {
+		r.from.conn.Close()
+		r.to.conn.Close()
+	})
+}
+
+// the node may change its port, a nat rebinding, but not its ip
+func (e *relayEnd) learn(addr *net.UDPAddr) bool {
+	if !addr.IP.Equal(e.ip) {
+		return false
+	}
+	e.mtx.Lock()
+	e.addr = addr
+	e.mtx.Unlock()
+	return true
+}
+
+func (e *relayEnd) getAddr() (addr *net.UDPAddr) {
+	e.mtx.RLock()
+	addr = e.addr
+	e.mtx.RUnlock()
+	return
+}
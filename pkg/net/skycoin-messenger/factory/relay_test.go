@@ -0,0 +1,83 @@
+package factory
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelay_Forward(t *testing.T) {
+	loopback := net.IPv4(127, 0, 0, 1)
+	r, err := newRelay(loopback, loopback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+	fromPort, toPort := r.ports()
+
+	a, err := net.ListenUDP("udp", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := net.ListenUDP("udp", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	toFrom := &net.UDPAddr{IP: loopback, Port: fromPort}
+	toTo := &net.UDPAddr{IP: loopback, Port: toPort}
+
+	// node A punches first, its datagram has nowhere to go yet
+	if _, err = a.WriteToUDP([]byte("punch"), toFrom); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err = b.WriteToUDP([]byte("from b"), toTo); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	a.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := a.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "from b" || addr.Port != fromPort {
+		t.Fatalf("node A read %q from %s", buf[:n], addr)
+	}
+
+	if _, err = a.WriteToUDP([]byte("from a"), toFrom); err != nil {
+		t.Fatal(err)
+	}
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err = b.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "from a" || addr.Port != toPort {
+		t.Fatalf("node B read %q from %s", buf[:n], addr)
+	}
+}
+
+func TestRelay_UnknownIP(t *testing.T) {
+	loopback := net.IPv4(127, 0, 0, 1)
+	r, err := newRelay(net.IPv4(192, 0, 2, 1), loopback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+	fromPort, _ := r.ports()
+
+	a, err := net.ListenUDP("udp", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if _, err = a.WriteToUDP([]byte("spoof"), &net.UDPAddr{IP: loopback, Port: fromPort}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if addr := r.from.getAddr(); addr != nil {
+		t.Fatalf("relay learned %s", addr)
+	}
+}
@@ -0,0 +1,446 @@
+package factory
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+const (
+	// bytes of the session node A names a transport by to resume it
+	TRANSPORT_SESSION_SIZE = 16
+	// an entry of OP_RESUME, the id of an app conn, the bytes the node
+	// received of it and the OP_WINDOW it sent for them
+	RESUME_ENTRY_SIZE = 4 + 8 + 8
+	// entries of an OP_RESUME pkg
+	RESUME_ENTRIES = 50
+)
+
+// A transport resumes if the conn between the nodes breaks. Both nodes keep
+// the app conns for TransportResumeTimeout, node A asks node B to build a
+// new conn through the discovery of the transport, or another one, naming
+// the transport by its session. Over the new conn each node tells what it
+// received of the app conns with OP_RESUME, the other one sends again what
+// is missing. The sender keeps the data of an app conn until the OP_WINDOW
+// of the receiver show it has been consumed.
+
+// the state of an app conn told to the other node
+type streamState struct {
+	received uint64
+	grants   uint64
+}
+
+// the session node A asks node B to keep the transport by, the routes have
+// none. resume is true if the transport resumes.
+func (t *Transport) sessionToSend() (session []byte, resume bool) {
+	t.fieldsMutex.Lock()
+	defer t.fieldsMutex.Unlock()
+	resume = t.resumed != nil
+	if t.session == nil && t.hop == nil && len(t.routeKeys) == 0 {
+		session = make([]byte, TRANSPORT_SESSION_SIZE)
+		if _, err := io.ReadFull(rand.Reader, session); err != nil {
+			return nil, false
+		}
+		t.session = session
+	}
+	session = t.session
+	return
+}
+
+// node B echoed the session, so it keeps the transport for a resume. Run on
+// node A.
+func (t *Transport) acceptSession(session []byte) {
+	t.fieldsMutex.Lock()
+	t.resumable = len(session) > 0 && bytes.Equal(session, t.session)
+	t.fieldsMutex.Unlock()
+}
+
+// keep the transport for a resume by the session of node A, run on node B
+func (t *Transport) keepSession(session []byte) {
+	t.fieldsMutex.Lock()
+	t.session = session
+	t.resumable = true
+	t.fieldsMutex.Unlock()
+	t.creator.setSession(t.FromNode, session, t)
+}
+
+func (t *Transport) getSession() (session []byte) {
+	t.fieldsMutex.RLock()
+	session = t.session
+	t.fieldsMutex.RUnlock()
+	return
+}
+
+func (t *Transport) isResumable() (resumable bool) {
+	t.fieldsMutex.RLock()
+	resumable = t.resumable
+	t.fieldsMutex.RUnlock()
+	return
+}
+
+func (t *Transport) isResuming() (resuming bool) {
+	t.fieldsMutex.RLock()
+	resuming = t.resumed != nil
+	t.fieldsMutex.RUnlock()
+	return
+}
+
+// waitResumed returns once the transport is not resuming anymore
+func (t *Transport) waitResumed() {
+	t.fieldsMutex.RLock()
+	resumed := t.resumed
+	t.fieldsMutex.RUnlock()
+	if resumed == nil {
+		return
+	}
+	select {
+	case <-resumed:
+	case <-t.done:
+	}
+}
+
+// the conn between the nodes broke. A transport that may resume keeps its
+// app conns and node A builds a new conn, the others close.
+func (t *Transport) lost(conn *Connection) {
+	t.fieldsMutex.Lock()
+	if t.factory == nil || t.conn != conn {
+		t.fieldsMutex.Unlock()
+		return
+	}
+	if !t.resumable {
+		t.fieldsMutex.Unlock()
+		t.Close()
+		return
+	}
+	start := t._detach()
+	clientSide := t.clientSide
+	t.fieldsMutex.Unlock()
+	conn.Close()
+	t.putMessage(PriorityMsg{
+		Priority: Building,
+		Msg:      fmt.Sprintf("Discovery(%x): Transport lost, resuming", t.getDiscoveryKey()),
+	})
+	if clientSide && start {
+		go t.resume()
+	}
+}
+
+// forget the conn between the nodes, the transport is built again from
+// scratch. It returns true if the transport was not resuming already, the
+// grace period starts then. Call it with fieldsMutex held.
+func (t *Transport) _detach() (start bool) {
+	t.conn = nil
+	t.connAcked = false
+	t.nodeAcked = make(chan struct{})
+	t.nodeConns = nil
+	t.remoteEphemeral = EMPTY_PUBLIC_KEY
+	t.remoteKnown = false
+	t.relayAddr = ""
+	if t.resumed != nil {
+		return
+	}
+	t.resumed = make(chan struct{})
+	t.resumeFailed = make(chan struct{}, 1)
+	t.resumeTimer = time.AfterFunc(t.creator.GetOptions().TransportResumeTimeout, t.resumeTimeout)
+	return true
+}
+
+func (t *Transport) resumeTimeout() {
+	if !t.isResuming() {
+		return
+	}
+	t.putMessage(PriorityMsg{
+		Type:     Failed,
+		Msg:      "Transport not resumed",
+		Priority: Timeout,
+	})
+	t.Close()
+}
+
+// node B could not take the resume, node A tries again
+func (t *Transport) resumeFail() {
+	t.fieldsMutex.RLock()
+	failed := t.resumeFailed
+	t.fieldsMutex.RUnlock()
+	if failed == nil {
+		return
+	}
+	select {
+	case failed <- struct{}{}:
+	default:
+	}
+}
+
+// ask node B for a new conn through the discovery of the transport, the
+// others in turn if it is gone or fails, until the transport resumed or
+// closed. Run on node A.
+func (t *Transport) resume() {
+	t.fieldsMutex.RLock()
+	resumed, failed := t.resumed, t.resumeFailed
+	t.fieldsMutex.RUnlock()
+	if resumed == nil {
+		return
+	}
+	wait := func(d time.Duration) bool {
+		select {
+		case <-resumed:
+			return false
+		case <-t.done:
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+	key := t.getDiscoveryKey()
+	for attempt := 0; ; attempt++ {
+		discovery := t.creator.resumeDiscovery(key, attempt)
+		if discovery == nil {
+			if !wait(CANDIDATE_TIMEOUT) {
+				return
+			}
+			continue
+		}
+		t.appConnHolder.setTransport(discovery.GetTargetKey(), t)
+		err := t.creator.connectTransport(t, discovery, nil)
+		if err != nil {
+			log.Debugf("transport resume through %x err %v", discovery.GetTargetKey(), err)
+			if !wait(CANDIDATE_TIMEOUT) {
+				return
+			}
+			continue
+		}
+		select {
+		case <-resumed:
+			return
+		case <-t.done:
+			return
+		case <-failed:
+			if !wait(CANDIDATE_TIMEOUT) {
+				return
+			}
+		case <-time.After(t.creator.GetOptions().TransportSetupTimeout):
+		}
+	}
+}
+
+// the conn to the discovery of key for an attempt to resume, the other
+// discoveries in turn
+func (f *MessengerFactory) resumeDiscovery(key cipher.PubKey, attempt int) *Connection {
+	var conns []*Connection
+	f.ForEachConn(func(connection *Connection) {
+		if connection.IsClosed() {
+			return
+		}
+		if connection.GetTargetKey() == key {
+			conns = append([]*Connection{connection}, conns...)
+			return
+		}
+		conns = append(conns, connection)
+	})
+	if len(conns) < 1 {
+		return nil
+	}
+	return conns[attempt%len(conns)]
+}
+
+// the transport goes over conn again, the other node is told what the node
+// received of the app conns. The OP_WINDOW counted in it are sent before it,
+// the ones after it follow it.
+func (t *Transport) sendResume(conn *Connection) (err error) {
+	t.grantMutex.Lock()
+	defer t.grantMutex.Unlock()
+	states := make(map[uint32]streamState)
+	t.connsMutex.RLock()
+	for id, c := range t.conns {
+		if c == nil {
+			continue
+		}
+		var s streamState
+		if w := t.windows[id]; w != nil {
+			s.received, s.grants = w.state()
+		}
+		states[id] = s
+	}
+	t.connsMutex.RUnlock()
+	for _, pkg := range resumePkgs(states) {
+		err = conn.Write(pkg)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// the OP_RESUME pkgs of states, the id of each is the number of the pkgs
+// after it
+func resumePkgs(states map[uint32]streamState) (pkgs [][]byte) {
+	ids := make([]uint32, 0, len(states))
+	for id := range states {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	n := (len(ids) + RESUME_ENTRIES - 1) / RESUME_ENTRIES
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		pkg := opPkg(uint32(n-1-i), OP_RESUME)
+		entries := ids[i*RESUME_ENTRIES:]
+		if len(entries) > RESUME_ENTRIES {
+			entries = entries[:RESUME_ENTRIES]
+		}
+		for _, id := range entries {
+			var e [RESUME_ENTRY_SIZE]byte
+			binary.BigEndian.PutUint32(e[:4], id)
+			binary.BigEndian.PutUint64(e[4:12], states[id].received)
+			binary.BigEndian.PutUint64(e[12:], states[id].grants)
+			pkg = append(pkg, e[:]...)
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return
+}
+
+// add the entries of the body of an OP_RESUME pkg to states
+func parseResume(body []byte, states map[uint32]streamState) {
+	for ; len(body) >= RESUME_ENTRY_SIZE; body = body[RESUME_ENTRY_SIZE:] {
+		states[binary.BigEndian.Uint32(body[:4])] = streamState{
+			received: binary.BigEndian.Uint64(body[4:12]),
+			grants:   binary.BigEndian.Uint64(body[12:RESUME_ENTRY_SIZE]),
+		}
+	}
+}
+
+// the other node told what it received of the app conns, the node sends
+// again what is missing over conn. The app conns the other node does not
+// have have been closed by it, but the ones node A opened while the
+// transport was broken.
+func (t *Transport) resumeStreams(conn *Connection, peer map[uint32]streamState) {
+	clientSide := t.IsClientSide()
+	local := make(map[uint32]net.Conn)
+	t.connsMutex.RLock()
+	for id, c := range t.conns {
+		local[id] = c
+	}
+	t.connsMutex.RUnlock()
+	for id := range peer {
+		if c, ok := local[id]; c == nil && (ok || clientSide) {
+			// closed while the transport was broken
+			conn.Write(opPkg(id, OP_CLOSE))
+		}
+	}
+	for id, appConn := range local {
+		if appConn == nil {
+			continue
+		}
+		// the reader of an app conn just accepted finds it in the window
+		w := t.getWindow(id, true)
+		state, ok := peer[id]
+		if !ok && !(clientSide && !w.peerFlowControl()) {
+			t.closeAppConn(id, appConn)
+			continue
+		}
+		w.replay(conn, id, state, !ok)
+	}
+
+	t.fieldsMutex.Lock()
+	if t.conn != conn || t.resumed == nil {
+		t.fieldsMutex.Unlock()
+		return
+	}
+	if t.datagrams != nil {
+		t.datagrams.setConn(conn)
+	}
+	close(t.resumed)
+	t.resumed = nil
+	t.resumeFailed = nil
+	t.resumeTimer.Stop()
+	t.resumeTimer = nil
+	t.fieldsMutex.Unlock()
+	t.putMessage(PriorityMsg{
+		Priority: Connected,
+		Msg:      fmt.Sprintf("Discovery(%x): Transport resumed", t.getDiscoveryKey()),
+	})
+}
+
+// replay sends over conn what the peer did not receive of app conn id, from
+// the pkg opening it if open is true, and takes the window the peer granted
+func (w *streamWindow) replay(conn *Connection, id uint32, state streamState, open bool) {
+	w.resync(state.grants)
+	w.ack(state.received)
+	w.sendMtx.Lock()
+	defer w.sendMtx.Unlock()
+	if w.out != nil {
+		w.out.DeletePendingChannel(w.channel)
+	}
+	w.out = conn
+	w.channel = conn.NewPendingChannel()
+	if err := conn.SetChannelPriority(w.channel, w.priority); err != nil {
+		conn.GetContextLogger().Debugf("replay app conn %d priority err %v", id, err)
+	}
+	if open {
+		w._write(opPkg(id, OP_TRANSPORT))
+	}
+	size := conn.GetPayloadSize() - 100 - PKG_HEADER_END
+	for _, b := range w.unacked {
+		for len(b) > 0 {
+			n := len(b)
+			if n > size {
+				n = size
+			}
+			w._write(append(opPkg(id, OP_TRANSPORT), b[:n]...))
+			b = b[n:]
+		}
+	}
+	if w.closeOp != 0 {
+		w._write(opPkg(id, w.closeOp))
+	}
+}
+
+// the peer sent grants OP_WINDOW in all, the ones lost with the old conn
+// count too
+func (w *streamWindow) resync(grants uint64) {
+	if grants < 1 {
+		return
+	}
+	w.mtx.Lock()
+	w.windows = grants
+	w.limit = FLOW_WINDOW + (grants-1)*FLOW_WINDOW_STEP
+	w.mtx.Unlock()
+	w.cond.Broadcast()
+}
+
+func sessionKey(node cipher.PubKey, session []byte) string {
+	return node.Hex() + hex.EncodeToString(session)
+}
+
+func (f *MessengerFactory) setSession(node cipher.PubKey, session []byte, t *Transport) {
+	f.sessionsMutex.Lock()
+	f.sessions[sessionKey(node, session)] = t
+	f.sessionsMutex.Unlock()
+}
+
+// the transport node A of key node resumes by session
+func (f *MessengerFactory) getSession(node cipher.PubKey, session []byte) (t *Transport, ok bool) {
+	f.sessionsMutex.RLock()
+	t, ok = f.sessions[sessionKey(node, session)]
+	f.sessionsMutex.RUnlock()
+	return
+}
+
+func (f *MessengerFactory) deleteSession(node cipher.PubKey, session []byte, t *Transport) {
+	f.sessionsMutex.Lock()
+	if f.sessions[sessionKey(node, session)] == t {
+		delete(f.sessions, sessionKey(node, session))
+	}
+	f.sessionsMutex.Unlock()
+}
@@ -0,0 +1,80 @@
+package factory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestResumePkgs(t *testing.T) {
+	if pkgs := resumePkgs(nil); len(pkgs) != 1 {
+		t.Fatalf("%d pkgs without app conns", len(pkgs))
+	}
+	states := make(map[uint32]streamState)
+	for id := uint32(1); id <= 2*RESUME_ENTRIES+1; id++ {
+		states[id] = streamState{received: uint64(id) * 1000, grants: uint64(id)}
+	}
+	pkgs := resumePkgs(states)
+	if len(pkgs) != 3 {
+		t.Fatalf("%d pkgs", len(pkgs))
+	}
+	parsed := make(map[uint32]streamState)
+	for i, pkg := range pkgs {
+		if pkg[PKG_HEADER_OP_BEGIN] != OP_RESUME {
+			t.Fatalf("pkg %d op %d", i, pkg[PKG_HEADER_OP_BEGIN])
+		}
+		if more := binary.BigEndian.Uint32(pkg[PKG_HEADER_ID_BEGIN:PKG_HEADER_ID_END]); more != uint32(len(pkgs)-1-i) {
+			t.Fatalf("pkg %d says %d more follow", i, more)
+		}
+		parseResume(pkg[PKG_HEADER_END:], parsed)
+	}
+	if len(parsed) != len(states) {
+		t.Fatalf("parsed %d of %d app conns", len(parsed), len(states))
+	}
+	for id, s := range states {
+		if parsed[id] != s {
+			t.Fatalf("app conn %d parsed %v, want %v", id, parsed[id], s)
+		}
+	}
+}
+
+func TestStreamWindowAck(t *testing.T) {
+	w := newStreamWindow()
+	w.setOut(nil, true)
+	w.send(opPkg(1, OP_TRANSPORT), nil)
+	for _, b := range []string{"abc", "defg", "hi"} {
+		w.send(append(opPkg(1, OP_TRANSPORT), b...), []byte(b))
+	}
+	w.ack(2)
+	if got := bytes.Join(w.unacked, nil); string(got) != "cdefghi" {
+		t.Fatalf("kept %q", got)
+	}
+	w.ack(7)
+	if got := bytes.Join(w.unacked, nil); string(got) != "hi" {
+		t.Fatalf("kept %q", got)
+	}
+	w.ack(9)
+	if len(w.unacked) != 0 || w.acked != 9 {
+		t.Fatalf("kept %q acked %d", w.unacked, w.acked)
+	}
+
+	w.sendOp(1, OP_CLOSE_WRITE)
+	if w.closeOp != OP_CLOSE_WRITE {
+		t.Fatal("half close not kept for a replay")
+	}
+}
+
+func TestStreamWindowResync(t *testing.T) {
+	w := newStreamWindow()
+	w.grant()
+	w.grant()
+	// the third window got lost with the conn
+	w.resync(3)
+	if w.limit != FLOW_WINDOW+2*FLOW_WINDOW_STEP {
+		t.Fatalf("limit %d", w.limit)
+	}
+	w.resync(0)
+	if w.limit != FLOW_WINDOW+2*FLOW_WINDOW_STEP {
+		t.Fatalf("limit %d without windows", w.limit)
+	}
+}
@@ -0,0 +1,424 @@
+package factory
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func init() {
+	ops[OP_BUILD_ROUTE] = &sync.Pool{
+		New: func() interface{} {
+			return new(buildRoute)
+		},
+	}
+	ops[OP_CLOSE_ROUTE] = &sync.Pool{
+		New: func() interface{} {
+			return new(closeRoute)
+		},
+	}
+}
+
+// A route is a transport going through other nodes before the one of the
+// app. Node A builds a transport to the first node with an onion holding a
+// layer for each node, the node opens its layer and builds the transport to
+// the next node it names the same way. It answers the node before it once
+// that is built, so node A is connected once the whole route is. Each node
+// only knows the nodes before and after it, the app streams carry a layer
+// of encryption for every node.
+type buildRoute struct {
+	Node      cipher.PubKey
+	App       cipher.PubKey
+	Discovery cipher.PubKey
+	// the nodes to go through in turn, picked out of the forwarding nodes
+	// of the discovery if empty
+	Hops []cipher.PubKey `json:",omitempty"`
+	// the number of nodes to pick, ROUTE_HOPS if 0
+	HopCount int `json:",omitempty"`
+}
+
+// run on node A
+func (req *buildRoute) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
+	if !f.Proxy {
+		return
+	}
+	var discovery *Connection
+	f.ForEachConn(func(connection *Connection) {
+		if discovery != nil {
+			return
+		}
+		if req.Discovery != EMPTY_PUBLIC_KEY && connection.GetTargetKey() != req.Discovery {
+			return
+		}
+		discovery = connection
+	})
+	if discovery == nil {
+		req.fail(conn, req.Discovery, NotFound, fmt.Sprintf("Discovery %x not connected", req.Discovery))
+		return
+	}
+	b := *req
+	if len(b.Hops) > 0 {
+		b.build(f, conn, discovery, b.Hops)
+		return
+	}
+	n := b.HopCount
+	if n <= 0 {
+		n = ROUTE_HOPS
+	}
+	if n > MAX_ROUTE_HOPS {
+		b.fail(conn, discovery.GetTargetKey(), NotAllowed, fmt.Sprintf("Route of %d nodes, %d at most", n, MAX_ROUTE_HOPS))
+		return
+	}
+	discovery.queryRouteNodes(f.GetOptions().TransportSetupTimeout, func(info *AttrNodesInfo) {
+		hops, err := selectRoute(info, n, discovery.GetKey(), b.Node)
+		if err != nil {
+			b.fail(conn, discovery.GetTargetKey(), NotFound, fmt.Sprintf("Discovery(%x): %v", discovery.GetTargetKey(), err))
+			return
+		}
+		b.build(f, conn, discovery, hops)
+	})
+	return
+}
+
+func (req *buildRoute) build(f *MessengerFactory, conn, discovery *Connection, hops []cipher.PubKey) {
+	discoveryKey := discovery.GetTargetKey()
+	nodes := append(append([]cipher.PubKey(nil), hops...), req.Node)
+	err := checkRoute(nodes, discovery.GetKey())
+	if err != nil {
+		req.fail(conn, discoveryKey, NotAllowed, err.Error())
+		return
+	}
+	onion, keys, err := newRouteOnion(nodes, req.App)
+	if err != nil {
+		req.fail(conn, discoveryKey, NotAllowed, fmt.Sprintf("Route err %v", err))
+		return
+	}
+	tr := NewTransport(f, conn, discovery.GetKey(), hops[0], conn.GetKey(), hops[0])
+	tr.setRoute(keys, req.App)
+	conn.PutMessage(PriorityMsg{
+		Priority: Building,
+		Msg: fmt.Sprintf("Discovery(%x): Building route to node %x app %x through %d nodes",
+			discoveryKey, req.Node, req.App, len(hops)),
+	})
+	err = f.connectTransport(tr, discovery, onion)
+	if err != nil {
+		tr.Close()
+		req.fail(conn, discoveryKey, NotFound, fmt.Sprintf("Route err %v", err))
+		return
+	}
+	conn.setTransport(discoveryKey, tr)
+}
+
+// tell the app the route failed like a transport
+func (req *buildRoute) fail(conn *Connection, discovery cipher.PubKey, priority Priority, cause string) {
+	conn.GetContextLogger().Debug(cause)
+	msg := PriorityMsg{Priority: priority, Msg: cause, Type: Failed}
+	conn.PutMessage(msg)
+	conn.writeOP(OP_BUILD_APP_CONN|RESP_PREFIX, &AppConnResp{
+		Discovery: discovery,
+		App:       req.App,
+		Failed:    true,
+		Msg:       msg,
+	})
+}
+
+// a route goes through each node once, neither node A nor the last node
+// forward it
+func checkRoute(nodes []cipher.PubKey, self cipher.PubKey) (err error) {
+	if len(nodes) > MAX_ROUTE_HOPS+1 {
+		return fmt.Errorf("Route of %d nodes, %d at most", len(nodes)-1, MAX_ROUTE_HOPS)
+	}
+	seen := map[cipher.PubKey]bool{self: true}
+	for _, node := range nodes {
+		if node == EMPTY_PUBLIC_KEY || seen[node] {
+			return fmt.Errorf("Route through node %x twice", node)
+		}
+		seen[node] = true
+	}
+	return
+}
+
+// pick n of the forwarding nodes found at random, leaving exclude out
+func selectRoute(info *AttrNodesInfo, n int, exclude ...cipher.PubKey) (hops []cipher.PubKey, err error) {
+	skip := make(map[cipher.PubKey]bool)
+	for _, k := range exclude {
+		skip[k] = true
+	}
+	var nodes []cipher.PubKey
+	if info != nil {
+		for _, node := range info.Nodes {
+			if skip[node.Node] {
+				continue
+			}
+			skip[node.Node] = true
+			nodes = append(nodes, node.Node)
+		}
+	}
+	if len(nodes) < n {
+		err = fmt.Errorf("%d forwarding nodes found, %d needed", len(nodes), n)
+		return
+	}
+	for i := 0; i < n; i++ {
+		j, e := rand.Int(rand.Reader, big.NewInt(int64(len(nodes)-i)))
+		if e != nil {
+			return nil, e
+		}
+		k := i + int(j.Int64())
+		nodes[i], nodes[k] = nodes[k], nodes[i]
+	}
+	hops = nodes[:n]
+	return
+}
+
+type closeRoute struct {
+	App cipher.PubKey
+}
+
+// run on node A, the nodes of the route close their transports once the
+// one before or after them does
+func (req *closeRoute) Execute(f *MessengerFactory, conn *Connection) (r resp, err error) {
+	tr, ok := conn.getTransport(req.App)
+	if !ok || tr.routeHops() < 1 {
+		conn.GetContextLogger().Debugf("closeRoute route to %x not found", req.App)
+		return
+	}
+	tr.Close()
+	return
+}
+
+// routeHop is a node forwarding a route. The transport from the node before
+// it, in, is served once the one to the next node, out, is built, its app
+// streams go to out.
+type routeHop struct {
+	factory   *MessengerFactory
+	discovery *Connection
+	req       buildConn
+	secret    []byte
+	// the app key of out, a new one for each route
+	app     cipher.PubKey
+	in, out *Transport
+	closed  bool
+	mtx     sync.Mutex
+}
+
+// run on a node forwarding a route, the transport to the next node is
+// built before the one before it is answered
+func (req *buildConn) forwardRoute(conn *Connection, layer *routeLayer, secret []byte) (err error) {
+	f := conn.factory
+	if !f.GetOptions().RouteForwarding || req.App != req.Node {
+		cause := fmt.Sprintf("Node %x does not forward routes", req.Node)
+		return req.refuse(conn, NotAllowed, cause)
+	}
+	app, _ := cipher.GenerateKeyPair()
+	h := &routeHop{
+		factory:   f,
+		discovery: conn,
+		req:       *req,
+		secret:    secret,
+		app:       app,
+	}
+	h.out = newRouteTransport(f, h, req.Node, layer.Node, app, layer.App, true)
+	f.setRouteHop(app, h)
+	conn.GetContextLogger().Debugf("forward route from node %x to node %x", req.FromNode, layer.Node)
+	e := f.connectTransport(h.out, conn, layer.Onion)
+	if e != nil {
+		conn.GetContextLogger().Debugf("forward route err %v", e)
+		h.fail(NotFound)
+	}
+	return
+}
+
+// the next node answered through the manager
+func (h *routeHop) forwardResp(conn *Connection, req *forwardNodeConnResp) {
+	if h.out.isConnAck() {
+		return
+	}
+	if req.Failed {
+		h.fail(req.Msg.Priority)
+		return
+	}
+	req.connect(conn, h.out)
+}
+
+// out is built, serve in over it
+func (h *routeHop) serve(port int) {
+	h.mtx.Lock()
+	if h.closed {
+		h.mtx.Unlock()
+		return
+	}
+	in := newRouteTransport(h.factory, h, h.req.FromNode, h.req.Node, h.req.FromApp, h.req.App, false)
+	in.setRouteKeys([][]byte{h.secret})
+	h.in = in
+	h.mtx.Unlock()
+	err := h.req.accept(h.discovery, in, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		log.Debugf("forward route accept err %v", err)
+		h.mtx.Lock()
+		h.in = nil
+		h.mtx.Unlock()
+		in.Close()
+		h.fail(NotFound)
+	}
+}
+
+func (h *routeHop) close() {
+	h.fail(TransportClosed)
+}
+
+// the route is gone, the node before is told if it still waits for the
+// answer. The cause is not passed on, the nodes before must not learn the
+// nodes after.
+func (h *routeHop) fail(priority Priority) {
+	h.mtx.Lock()
+	if h.closed {
+		h.mtx.Unlock()
+		return
+	}
+	h.closed = true
+	in, out := h.in, h.out
+	h.mtx.Unlock()
+	h.factory.deleteRouteHop(h.app)
+	if in == nil {
+		h.req.refuse(h.discovery, priority, fmt.Sprintf("Node %x: route failed", h.req.Node))
+	} else {
+		in.Close()
+	}
+	out.Close()
+}
+
+// a transport of a route the node forwards, it has no app
+func newRouteTransport(creator *MessengerFactory, h *routeHop, fromNode, toNode, fromApp, toApp cipher.PubKey, clientSide bool) *Transport {
+	t := newTransport(creator, fromNode, toNode, fromApp, toApp, clientSide)
+	t.hop = h
+	return t
+}
+
+func (t *Transport) getRouteHop() (h *routeHop) {
+	t.fieldsMutex.RLock()
+	h = t.hop
+	t.fieldsMutex.RUnlock()
+	return
+}
+
+// node A goes through the nodes of keys to app
+func (t *Transport) setRoute(keys [][]byte, app cipher.PubKey) {
+	t.fieldsMutex.Lock()
+	t.routeKeys = keys
+	t.routeApp = app
+	t.fieldsMutex.Unlock()
+}
+
+func (t *Transport) setRouteKeys(keys [][]byte) {
+	t.fieldsMutex.Lock()
+	t.routeKeys = keys
+	t.fieldsMutex.Unlock()
+}
+
+// the number of nodes node A goes through, 0 if it connects directly
+func (t *Transport) routeHops() (n int) {
+	t.fieldsMutex.RLock()
+	if t.clientSide && len(t.routeKeys) > 0 {
+		n = len(t.routeKeys) - 1
+	}
+	t.fieldsMutex.RUnlock()
+	return
+}
+
+// the app node A reaches, at the end of its route if it has one
+func (t *Transport) remoteApp() (app cipher.PubKey) {
+	t.fieldsMutex.RLock()
+	app = t._remoteApp()
+	t.fieldsMutex.RUnlock()
+	return
+}
+
+// call it with fieldsMutex held
+func (t *Transport) _remoteApp() cipher.PubKey {
+	if t.routeApp != EMPTY_PUBLIC_KEY {
+		return t.routeApp
+	}
+	return t.ToApp
+}
+
+func (f *MessengerFactory) setRouteHop(app cipher.PubKey, h *routeHop) {
+	f.routeHopsMutex.Lock()
+	f.routeHops[app] = h
+	f.routeHopsMutex.Unlock()
+}
+
+// the route the node forwards over the transport of app
+func (f *MessengerFactory) getRouteHop(app cipher.PubKey) (h *routeHop, ok bool) {
+	f.routeHopsMutex.RLock()
+	h, ok = f.routeHops[app]
+	f.routeHopsMutex.RUnlock()
+	return
+}
+
+func (f *MessengerFactory) deleteRouteHop(app cipher.PubKey) {
+	f.routeHopsMutex.Lock()
+	delete(f.routeHops, app)
+	f.routeHopsMutex.Unlock()
+}
+
+// the services offered to the discovery of connection, with the one of the
+// node itself if it forwards routes
+func (f *MessengerFactory) nodeServices(connection *Connection) (ns *NodeServices) {
+	ns = f.pack()
+	if !f.GetOptions().RouteForwarding {
+		return
+	}
+	if ns == nil {
+		ns = &NodeServices{}
+	}
+	ns.Services = append(ns.Services, &Service{
+		Key:        connection.GetKey(),
+		Attributes: []string{ROUTE_ATTRIBUTE},
+	})
+	return
+}
+
+// ask the discovery for the nodes forwarding routes, fn gets nil if it did
+// not answer within timeout
+func (c *Connection) queryRouteNodes(timeout time.Duration, fn func(info *AttrNodesInfo)) {
+	q := newQueryByAttrsAndPage(1, ROUTE_QUERY_LIMIT, []string{ROUTE_ATTRIBUTE})
+	c.setQueryCallback(q.Seq, fn)
+	time.AfterFunc(timeout, func() {
+		if fn, ok := c.removeQueryCallback(q.Seq); ok {
+			fn(nil)
+		}
+	})
+	err := c.writeOP(OP_QUERY_BY_ATTRS, q)
+	if err != nil {
+		c.GetContextLogger().Debugf("query route nodes err %v", err)
+		if fn, ok := c.removeQueryCallback(q.Seq); ok {
+			fn(nil)
+		}
+	}
+}
+
+func (c *Connection) setQueryCallback(seq uint32, fn func(info *AttrNodesInfo)) {
+	c.fieldsMutex.Lock()
+	if c.queryCallbacks == nil {
+		c.queryCallbacks = make(map[uint32]func(info *AttrNodesInfo))
+	}
+	c.queryCallbacks[seq] = fn
+	c.fieldsMutex.Unlock()
+}
+
+func (c *Connection) removeQueryCallback(seq uint32) (fn func(info *AttrNodesInfo), ok bool) {
+	c.fieldsMutex.Lock()
+	fn, ok = c.queryCallbacks[seq]
+	if ok {
+		delete(c.queryCallbacks, seq)
+	}
+	c.fieldsMutex.Unlock()
+	return
+}
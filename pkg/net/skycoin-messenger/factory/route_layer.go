@@ -0,0 +1,318 @@
+package factory
+
+import (
+	"crypto/aes"
+	cipher2 "crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+const (
+	// the app streams of a route start with it, the layers derive from it
+	ROUTE_NONCE_SIZE = aes.BlockSize
+
+	ROUTE_LAYER_KEY_BEGIN = 0
+	ROUTE_LAYER_KEY_END   = ROUTE_LAYER_KEY_BEGIN + MSG_PUBLIC_KEY_SIZE
+
+	ROUTE_LAYER_NODE_BEGIN = 0
+	ROUTE_LAYER_NODE_END   = ROUTE_LAYER_NODE_BEGIN + MSG_PUBLIC_KEY_SIZE
+	ROUTE_LAYER_APP_BEGIN  = ROUTE_LAYER_NODE_END
+	ROUTE_LAYER_APP_END    = ROUTE_LAYER_APP_BEGIN + MSG_PUBLIC_KEY_SIZE
+	ROUTE_LAYER_ONION_BEGIN
+)
+
+// routeLayer is what a node of a route learns of it: the node after it and
+// the app there, both empty on the last node, and the onion of the next node
+type routeLayer struct {
+	Node  cipher.PubKey
+	App   cipher.PubKey
+	Onion []byte
+}
+
+// newRouteOnion seals a layer for each of nodes, the route ends at app on
+// the last one. The onion goes to the first node, keys are the secrets node
+// A shares with each of them.
+func newRouteOnion(nodes []cipher.PubKey, app cipher.PubKey) (onion []byte, keys [][]byte, err error) {
+	keys = make([][]byte, len(nodes))
+	for i := len(nodes) - 1; i >= 0; i-- {
+		layer := &routeLayer{Onion: onion}
+		if i+1 < len(nodes) {
+			layer.Node = nodes[i+1]
+			layer.App = nodes[i+1]
+			if i+2 == len(nodes) {
+				layer.App = app
+			}
+		}
+		onion, keys[i], err = sealRouteLayer(nodes[i], layer)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// the layer of node is sealed to a new ephemeral key, the key goes in front
+// of it
+func sealRouteLayer(node cipher.PubKey, layer *routeLayer) (onion, secret []byte, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("sealRouteLayer recovered err %v", e)
+		}
+	}()
+	pub, sec := cipher.GenerateKeyPair()
+	secret = routeSecret(cipher.ECDH(node, sec), pub)
+	aead, err := newRouteAEAD(secret)
+	if err != nil {
+		return
+	}
+	plain := make([]byte, ROUTE_LAYER_ONION_BEGIN+len(layer.Onion))
+	copy(plain[ROUTE_LAYER_NODE_BEGIN:ROUTE_LAYER_NODE_END], layer.Node[:])
+	copy(plain[ROUTE_LAYER_APP_BEGIN:ROUTE_LAYER_APP_END], layer.App[:])
+	copy(plain[ROUTE_LAYER_ONION_BEGIN:], layer.Onion)
+	onion = make([]byte, ROUTE_LAYER_KEY_END, ROUTE_LAYER_KEY_END+len(plain)+aead.Overhead())
+	copy(onion, pub[:])
+	onion = aead.Seal(onion, make([]byte, aead.NonceSize()), plain, pub[:])
+	return
+}
+
+// openRouteLayer opens the layer of the node of sc
+func openRouteLayer(sc *SeedConfig, onion []byte) (layer *routeLayer, secret []byte, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("openRouteLayer recovered err %v", e)
+		}
+	}()
+	if len(onion) < ROUTE_LAYER_KEY_END {
+		err = errors.New("route onion too short")
+		return
+	}
+	var pub cipher.PubKey
+	copy(pub[:], onion[ROUTE_LAYER_KEY_BEGIN:ROUTE_LAYER_KEY_END])
+	secret = routeSecret(cipher.ECDH(pub, sc.secKey), pub)
+	aead, err := newRouteAEAD(secret)
+	if err != nil {
+		return
+	}
+	plain, err := aead.Open(nil, make([]byte, aead.NonceSize()), onion[ROUTE_LAYER_KEY_END:], pub[:])
+	if err != nil {
+		return
+	}
+	if len(plain) < ROUTE_LAYER_ONION_BEGIN {
+		err = errors.New("route layer too short")
+		return
+	}
+	layer = &routeLayer{Onion: plain[ROUTE_LAYER_ONION_BEGIN:]}
+	copy(layer.Node[:], plain[ROUTE_LAYER_NODE_BEGIN:ROUTE_LAYER_NODE_END])
+	copy(layer.App[:], plain[ROUTE_LAYER_APP_BEGIN:ROUTE_LAYER_APP_END])
+	return
+}
+
+func routeSecret(ecdh []byte, ephemeral cipher.PubKey) []byte {
+	h := sha256.New()
+	h.Write(ecdh)
+	h.Write(ephemeral[:])
+	return h.Sum(nil)
+}
+
+// each use of the secret of a layer gets its own key
+func routeKey(secret []byte, use string) []byte {
+	h := sha256.New()
+	h.Write(secret)
+	h.Write([]byte(use))
+	return h.Sum(nil)
+}
+
+// the key of a layer seals it once, the nonce is left zero
+func newRouteAEAD(secret []byte) (aead cipher2.AEAD, err error) {
+	block, err := aes.NewCipher(routeKey(secret, "onion"))
+	if err != nil {
+		return
+	}
+	return cipher2.NewGCM(block)
+}
+
+// the key streams of a layer for the data going to the last node and back
+func routeStreams(secret, nonce []byte) (forward, backward cipher2.Stream, err error) {
+	fb, err := aes.NewCipher(routeKey(secret, "forward"))
+	if err != nil {
+		return
+	}
+	bb, err := aes.NewCipher(routeKey(secret, "backward"))
+	if err != nil {
+		return
+	}
+	forward = cipher2.NewCTR(fb, nonce)
+	backward = cipher2.NewCTR(bb, nonce)
+	return
+}
+
+// the nonce a node passes to the next one
+func nextRouteNonce(secret, nonce []byte) []byte {
+	h := sha256.New()
+	h.Write(routeKey(secret, "nonce"))
+	h.Write(nonce)
+	return h.Sum(nil)[:ROUTE_NONCE_SIZE]
+}
+
+// routeConn adds or removes the layers of a route on an app stream. The
+// stream starts with a nonce the layers derive from, each node passes the
+// next one a nonce of its own so the stream differs on every hop. As the
+// layers are key streams xored in, they come off in any order.
+type routeConn struct {
+	net.Conn
+	secret []byte
+	// a forwarding node passes a nonce on, the last node does not
+	hop   bool
+	nonce []byte
+	// started once the nonce is known, only touched by the writer
+	started bool
+	// what is read from and written to Conn goes through these
+	readStreams, writeStreams []cipher2.Stream
+	// the nonce node A sends first
+	pending []byte
+
+	ready     chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// wrapRouteConn wraps an app conn of a transport of a route. On node A,
+// source, it adds the layers of every node to what the app writes and takes
+// them off what it reads. On the other nodes the conn is the one to the next
+// transport or the app, only the layer of the node is handled.
+func wrapRouteConn(conn net.Conn, secrets [][]byte, source, hop bool) (net.Conn, error) {
+	if len(secrets) == 0 {
+		return conn, nil
+	}
+	if source {
+		return newRouteSourceConn(conn, secrets)
+	}
+	return newRouteNodeConn(conn, secrets[0], hop), nil
+}
+
+func newRouteSourceConn(conn net.Conn, secrets [][]byte) (c *routeConn, err error) {
+	nonce := make([]byte, ROUTE_NONCE_SIZE)
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return
+	}
+	c = &routeConn{
+		Conn:    conn,
+		started: true,
+		pending: nonce,
+		ready:   make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	close(c.ready)
+	for _, secret := range secrets {
+		var forward, backward cipher2.Stream
+		forward, backward, err = routeStreams(secret, nonce)
+		if err != nil {
+			return nil, err
+		}
+		c.readStreams = append(c.readStreams, forward)
+		c.writeStreams = append(c.writeStreams, backward)
+		nonce = nextRouteNonce(secret, nonce)
+	}
+	return
+}
+
+func newRouteNodeConn(conn net.Conn, secret []byte, hop bool) *routeConn {
+	return &routeConn{
+		Conn:   conn,
+		secret: secret,
+		hop:    hop,
+		nonce:  make([]byte, 0, ROUTE_NONCE_SIZE),
+		ready:  make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *routeConn) Read(b []byte) (n int, err error) {
+	if len(c.pending) > 0 {
+		n = copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return
+	}
+	// what comes back can't be layered before the nonce is known
+	select {
+	case <-c.ready:
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+	n, err = c.Conn.Read(b)
+	for _, s := range c.readStreams {
+		s.XORKeyStream(b[:n], b[:n])
+	}
+	return
+}
+
+func (c *routeConn) Write(b []byte) (n int, err error) {
+	n = len(b)
+	if !c.started {
+		i := copy(c.nonce[len(c.nonce):cap(c.nonce)], b)
+		c.nonce = c.nonce[:len(c.nonce)+i]
+		b = b[i:]
+		if len(c.nonce) < ROUTE_NONCE_SIZE {
+			return
+		}
+		err = c.start()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(b) == 0 {
+		return
+	}
+	d := make([]byte, len(b))
+	copy(d, b)
+	for _, s := range c.writeStreams {
+		s.XORKeyStream(d, d)
+	}
+	err = writeAll(c.Conn, d)
+	if err != nil {
+		n = 0
+	}
+	return
+}
+
+// the nonce of the node came in, the next node gets its own
+func (c *routeConn) start() (err error) {
+	forward, backward, err := routeStreams(c.secret, c.nonce)
+	if err != nil {
+		return
+	}
+	if c.hop {
+		err = writeAll(c.Conn, nextRouteNonce(c.secret, c.nonce))
+		if err != nil {
+			return
+		}
+	}
+	c.writeStreams = []cipher2.Stream{forward}
+	c.readStreams = []cipher2.Stream{backward}
+	c.started = true
+	close(c.ready)
+	return
+}
+
+func (c *routeConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+func (c *routeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
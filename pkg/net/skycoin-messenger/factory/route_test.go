@@ -0,0 +1,115 @@
+package factory
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func newTestSeedConfig() *SeedConfig {
+	pub, sec := cipher.GenerateKeyPair()
+	return &SeedConfig{publicKey: pub, secKey: sec}
+}
+
+func TestRouteOnion(t *testing.T) {
+	scs := []*SeedConfig{newTestSeedConfig(), newTestSeedConfig(), newTestSeedConfig()}
+	nodes := []cipher.PubKey{scs[0].publicKey, scs[1].publicKey, scs[2].publicKey}
+	app := cipher.PubKey([33]byte{0xf1})
+	onion, keys, err := newRouteOnion(nodes, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, sc := range scs {
+		if _, _, err = openRouteLayer(newTestSeedConfig(), onion); err == nil {
+			t.Fatalf("layer %d opened by another node", i)
+		}
+		layer, secret, err := openRouteLayer(sc, onion)
+		if err != nil {
+			t.Fatalf("layer %d: %v", i, err)
+		}
+		if !bytes.Equal(secret, keys[i]) {
+			t.Fatalf("secret of layer %d differs", i)
+		}
+		var next, nextApp cipher.PubKey
+		if i+1 < len(nodes) {
+			next, nextApp = nodes[i+1], nodes[i+1]
+		}
+		if i+2 == len(nodes) {
+			nextApp = app
+		}
+		if layer.Node != next || layer.App != nextApp {
+			t.Fatalf("layer %d names node %x app %x", i, layer.Node, layer.App)
+		}
+		onion = layer.Onion
+	}
+	if len(onion) != 0 {
+		t.Fatalf("%d bytes left of the onion", len(onion))
+	}
+}
+
+func TestRouteConn(t *testing.T) {
+	secrets := [][]byte{routeKey([]byte("a"), "test"), routeKey([]byte("b"), "test")}
+	// app of node A - node A | hop - hop | destination - app of the destination
+	srcApp, src := net.Pipe()
+	hopIn, hopOut := net.Pipe()
+	dst, dstApp := net.Pipe()
+	defer srcApp.Close()
+	defer dstApp.Close()
+
+	source, err := wrapRouteConn(src, secrets, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hop, _ := wrapRouteConn(hopOut, secrets[:1], false, true)
+	last, _ := wrapRouteConn(dstApp, secrets[1:], false, false)
+	// the transports copy what the conns of a node read to the next one
+	go io.Copy(hop, source)
+	go io.Copy(source, hop)
+	go io.Copy(last, hopIn)
+	go io.Copy(hopIn, last)
+
+	msg := []byte("through the route")
+	go srcApp.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err = io.ReadFull(dst, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatalf("destination read %q", buf)
+	}
+
+	msg = []byte("and back")
+	go dst.Write(msg)
+	buf = make([]byte, len(msg))
+	if _, err = io.ReadFull(srcApp, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatalf("node A read %q", buf)
+	}
+}
+
+func TestSelectRoute(t *testing.T) {
+	self := cipher.PubKey([33]byte{0x01})
+	dst := cipher.PubKey([33]byte{0x02})
+	info := &AttrNodesInfo{}
+	for _, k := range []byte{0x01, 0x02, 0x03, 0x04, 0x04, 0x05} {
+		info.Nodes = append(info.Nodes, &AttrNodeInfo{Node: cipher.PubKey([33]byte{k})})
+	}
+	if _, err := selectRoute(info, 4, self, dst); err == nil {
+		t.Fatal("4 of 3 nodes selected")
+	}
+	hops, err := selectRoute(info, 3, self, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checkRoute(append(hops, dst), self); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkRoute([]cipher.PubKey{hops[0], dst, hops[0]}, self); err == nil {
+		t.Fatal("route through a node twice")
+	}
+}
@@ -13,6 +13,8 @@ type Service struct {
 	HideFromDiscovery bool     `json:",omitempty"`
 	AllowNodes        []string `json:",omitempty"`
 	Version           string   `json:",omitempty"`
+	// streams, datagrams or both, streams if 0
+	Transports TransportMode `json:",omitempty"`
 }
 
 type NodeServices struct {
@@ -24,6 +26,8 @@ type NodeServices struct {
 	Location string `json:",omitempty"`
 	// Node version info
 	Version []string `json:",omitempty"`
+	// Node ips of both families, the one seen by discovery first
+	Addresses []string `json:",omitempty"`
 }
 
 type serviceDiscovery struct {
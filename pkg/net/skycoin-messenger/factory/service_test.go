@@ -1,10 +1,13 @@
 package factory
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/skycoin/skycoin/src/cipher"
-	"sync"
 )
 
 func newTestConnection() *Connection {
@@ -14,88 +17,149 @@ func newTestConnection() *Connection {
 }
 
 func TestRegisterAndFind(t *testing.T) {
+	store, err := NewDiscoveryStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := newServiceDiscovery()
+	service.RegisterService = store.Register
+	service.UnRegisterService = store.Unregister
+	service.FindServiceAddresses = store.FindServiceAddresses
+	service.FindByAttributes = store.FindByAttributes
+	service.FindByAttributesAndPaging = store.FindByAttributesAndPaging
+
 	conn1 := newTestConnection()
 	connkey1 := cipher.PubKey([33]byte{0x01})
 	key1 := cipher.PubKey([33]byte{0xf1})
 	subs1 := []*Service{{Key: key1, Attributes: []string{"vpn"}},
 		{Key: cipher.PubKey([33]byte{0xf2}), Attributes: []string{"vpn"}}}
 	conn1.SetKey(connkey1)
-	service := newServiceDiscovery()
-	service.register(conn1, &NodeServices{Services: subs1})
+	service.discoveryRegister(conn1, &NodeServices{Services: subs1, ServiceAddress: "1.2.3.4:5"})
 
-	var result []cipher.PubKey
-	result = service.find(key1)
-	if len(result) != 1 || result[0] != connkey1 {
-		t.Fatalf("len(result) != 1 || result[0] != connkey1 %v", result)
+	result := service.findServiceAddresses([]cipher.PubKey{key1}, EMPTY_PUBLIC_KEY)
+	if len(result) != 1 || len(result[0].Nodes) != 1 || result[0].Nodes[0].PubKey != connkey1 {
+		t.Fatalf("nodes of key1 %v", result)
+	}
+	if result[0].Nodes[0].Address != "1.2.3.4:5" {
+		t.Fatalf("address of key1 %s", result[0].Nodes[0].Address)
 	}
 	resultOfAttrs := service.findByAttributes("vpn")
-	if len(resultOfAttrs) != 1 || result[0] != connkey1 {
-		t.Fatalf("len(result) != 1 || result[0] != connkey1 %v", result)
+	if resultOfAttrs.Count != 1 || len(resultOfAttrs.Nodes[0].Apps) != 2 {
+		t.Fatalf("nodes of vpn %#v", resultOfAttrs)
 	}
 
 	conn2 := newTestConnection()
 	connkey2 := cipher.PubKey([33]byte{0x02})
 	key2 := cipher.PubKey([33]byte{0xa1})
 	subs2 := []*Service{{Key: key2, Attributes: []string{"ss"}},
-		{Key: key1, Attributes: []string{"ss"}}}
+		{Key: key1, Attributes: []string{"ss", "vpn"}}}
 	conn2.SetKey(connkey2)
+	service.discoveryRegister(conn2, &NodeServices{Services: subs2})
 
-	service.register(conn2, &NodeServices{Services: subs2})
-
-	result = service.find(key1)
-	if len(result) != 2 {
-		t.Fatalf("len(result) != 2 %v", result)
+	result = service.findServiceAddresses([]cipher.PubKey{key1}, EMPTY_PUBLIC_KEY)
+	if len(result[0].Nodes) != 2 {
+		t.Fatalf("nodes of key1 %v", result[0].Nodes)
 	}
-	resultOfAttrs = service.findByAttributes("a")
-	if len(resultOfAttrs) != 0 {
-		t.Fatalf("len(result) != 0 %v", result)
+	result = service.findServiceAddresses([]cipher.PubKey{key1}, connkey1)
+	if len(result[0].Nodes) != 1 || result[0].Nodes[0].PubKey != connkey2 {
+		t.Fatalf("nodes of key1 but node 1 %v", result[0].Nodes)
 	}
-	resultOfAttrs = service.findByAttributes("vpn")
-	if len(resultOfAttrs) != 2 {
-		t.Fatalf("len(result) != 2 %v", result)
+	if n := service.findByAttributes("a").Count; n != 0 {
+		t.Fatalf("%d nodes of a", n)
+	}
+	if n := service.findByAttributes("vpn").Count; n != 2 {
+		t.Fatalf("%d nodes of vpn", n)
 	}
-	resultOfAttrs = service.findByAttributes("ss")
-	if len(resultOfAttrs) != 2 {
-		t.Fatalf("len(result) != 2 %v", result)
+	if n := service.findByAttributes("ss").Count; n != 1 {
+		t.Fatalf("%d nodes of ss", n)
+	}
+	if n := service.findByAttributes("vpn", "ss").Count; n != 1 {
+		t.Fatalf("%d nodes of vpn and ss", n)
 	}
 
 	conn3 := newTestConnection()
 	connkey3 := cipher.PubKey([33]byte{0x03})
 	subs3 := []*Service{
-		{Key: cipher.PubKey([33]byte{0xff}), Attributes: []string{"vpn"}}}
+		{Key: cipher.PubKey([33]byte{0xff}), Attributes: []string{"vpn"}},
+		{Key: cipher.PubKey([33]byte{0xfe}), Attributes: []string{"vpn"}, HideFromDiscovery: true}}
 	conn3.SetKey(connkey3)
-
-	service.register(conn3, &NodeServices{Services: subs3})
+	service.discoveryRegister(conn3, &NodeServices{Services: subs3})
 
 	resultOfAttrs = service.findByAttributes("vpn")
-	if len(resultOfAttrs) != 3 {
-		t.Fatalf("len(result) != 3 %v", result)
+	if resultOfAttrs.Count != 3 {
+		t.Fatalf("nodes of vpn %#v", resultOfAttrs)
 	}
-
-	resultOfAttrs = service.findByAttributes("vpn", "a")
-	if len(resultOfAttrs) != 0 {
-		t.Fatalf("len(result) != 0 %v", result)
+	if apps := resultOfAttrs.Nodes[2].Apps; len(apps) != 1 {
+		t.Fatalf("hidden app found %v", apps)
+	}
+	resultOfAttrs = service.findByAttributesAndPaging(2, 2, "vpn")
+	if resultOfAttrs.Count != 3 || len(resultOfAttrs.Nodes) != 1 || resultOfAttrs.Nodes[0].Node != connkey3 {
+		t.Fatalf("page 2 of vpn %#v", resultOfAttrs)
 	}
 
-	if len(service.subscription2Subscriber) != 4 {
-		t.Fatal(service.subscription2Subscriber)
+	service.discoveryUnregister(conn3)
+	if n := service.findByAttributes("vpn").Count; n != 2 {
+		t.Fatalf("%d nodes of vpn", n)
 	}
-	service.unregister(conn3)
-	if len(service.subscription2Subscriber) != 3 {
-		t.Fatal(service.subscription2Subscriber)
+	service.discoveryUnregister(conn2)
+	service.discoveryUnregister(conn1)
+	if len(store.nodes) != 0 || len(store.apps) != 0 || len(store.attrs) != 0 {
+		t.Fatalf("store not empty %v %v %v", store.nodes, store.apps, store.attrs)
+	}
+}
+
+func TestRegisterAndPack(t *testing.T) {
+	service := newServiceDiscovery()
+	conn1 := newTestConnection()
+	conn1.SetKey(cipher.PubKey([33]byte{0x01}))
+	service.register(conn1, &NodeServices{Services: []*Service{{Key: cipher.PubKey([33]byte{0xf1})}}})
+	conn2 := newTestConnection()
+	conn2.SetKey(cipher.PubKey([33]byte{0x02}))
+	service.register(conn2, &NodeServices{Services: []*Service{{Key: cipher.PubKey([33]byte{0xf2})}}})
+
+	if ns := service.pack(); ns == nil || len(ns.Services) != 2 {
+		t.Fatalf("packed %#v", ns)
 	}
 	service.unregister(conn2)
-	if len(service.subscription2Subscriber) != 2 {
+	if len(service.subscription2Subscriber) != 1 {
 		t.Fatal(service.subscription2Subscriber)
 	}
 	service.unregister(conn1)
-	if len(service.subscription2Subscriber) != 0 {
-		t.Fatal(service.subscription2Subscriber)
+	if ns := service.pack(); ns != nil {
+		t.Fatalf("packed %#v", ns)
+	}
+}
+
+func TestDiscoveryStore_Persist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.json")
+
+	store, err := NewDiscoveryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := cipher.PubKey([33]byte{0x01})
+	app := cipher.PubKey([33]byte{0xf1})
+	store.Register(node, &NodeServices{Services: []*Service{{Key: app, Attributes: []string{"vpn"}}}})
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewDiscoveryStore(path)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if len(service.attribute2Keys) != 0 {
-		t.Fatal(service.attribute2Keys)
+	defer store.Close()
+	if r := store.FindByAttributes("vpn"); r.Count != 1 || r.Nodes[0].Node != node {
+		t.Fatalf("restored nodes of vpn %#v", r)
 	}
-	if len(service.key2Attributes) != 0 {
-		t.Fatal(service.key2Attributes)
+	// the node did not come back
+	store.dropRestored()
+	if r := store.FindByAttributes("vpn"); r.Count != 0 {
+		t.Fatalf("nodes of vpn %#v", r)
 	}
 }
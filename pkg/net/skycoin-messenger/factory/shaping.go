@@ -0,0 +1,159 @@
+package factory
+
+import (
+	"sync"
+
+	"github.com/skycoin/skycoin/src/cipher"
+	cn "github.com/skycoin/skywire/pkg/net/conn"
+)
+
+// RateLimits caps the bytes/sec the transports of a node send, over all of
+// them, per remote node key and per app key. A limit of 0 is no limit. The
+// conns between nodes are shaped by the global and node limits in their
+// pacing, the app streams by the app limits as they are read. A limiter of a
+// key is kept while it has a limit or transports use it.
+type RateLimits struct {
+	global *cn.RateLimiter
+	nodes  map[cipher.PubKey]*sharedLimiter
+	apps   map[cipher.PubKey]*sharedLimiter
+	mtx    sync.Mutex
+}
+
+// a limiter of a key and the transports using it
+type sharedLimiter struct {
+	*cn.RateLimiter
+	refs int
+}
+
+// RateLimitsConfig are the limits set, by hex key
+type RateLimitsConfig struct {
+	Global uint64            `json:"global"`
+	Nodes  map[string]uint64 `json:"nodes"`
+	Apps   map[string]uint64 `json:"apps"`
+}
+
+func newRateLimits() *RateLimits {
+	return &RateLimits{
+		global: cn.NewRateLimiter(0),
+		nodes:  make(map[cipher.PubKey]*sharedLimiter),
+		apps:   make(map[cipher.PubKey]*sharedLimiter),
+	}
+}
+
+func (r *RateLimits) SetGlobal(rate uint64) {
+	r.global.SetRate(rate)
+}
+
+// SetNode limits the transports to or from the node of key, the transports
+// running take the new rate at once
+func (r *RateLimits) SetNode(key cipher.PubKey, rate uint64) {
+	r.mtx.Lock()
+	r._set(r.nodes, key, rate)
+	r.mtx.Unlock()
+}
+
+// SetApp limits the streams of the transports of the app of key, the
+// transports running take the new rate at once
+func (r *RateLimits) SetApp(key cipher.PubKey, rate uint64) {
+	r.mtx.Lock()
+	r._set(r.apps, key, rate)
+	r.mtx.Unlock()
+}
+
+// SetConfig replaces all the limits by the ones of c
+func (r *RateLimits) SetConfig(c RateLimitsConfig) (err error) {
+	nodes := make(map[cipher.PubKey]uint64)
+	for k, v := range c.Nodes {
+		key, e := cipher.PubKeyFromHex(k)
+		if e != nil {
+			return e
+		}
+		nodes[key] = v
+	}
+	apps := make(map[cipher.PubKey]uint64)
+	for k, v := range c.Apps {
+		key, e := cipher.PubKeyFromHex(k)
+		if e != nil {
+			return e
+		}
+		apps[key] = v
+	}
+	r.SetGlobal(c.Global)
+	r.mtx.Lock()
+	for k := range r.nodes {
+		r._set(r.nodes, k, nodes[k])
+	}
+	for k := range r.apps {
+		r._set(r.apps, k, apps[k])
+	}
+	for k, v := range nodes {
+		r._set(r.nodes, k, v)
+	}
+	for k, v := range apps {
+		r._set(r.apps, k, v)
+	}
+	r.mtx.Unlock()
+	return
+}
+
+// GetConfig returns the limits set
+func (r *RateLimits) GetConfig() (c RateLimitsConfig) {
+	c.Global = r.global.GetRate()
+	c.Nodes = make(map[string]uint64)
+	c.Apps = make(map[string]uint64)
+	r.mtx.Lock()
+	for k, l := range r.nodes {
+		if rate := l.GetRate(); rate > 0 {
+			c.Nodes[k.Hex()] = rate
+		}
+	}
+	for k, l := range r.apps {
+		if rate := l.GetRate(); rate > 0 {
+			c.Apps[k.Hex()] = rate
+		}
+	}
+	r.mtx.Unlock()
+	return
+}
+
+// the limiter of key in m, created unlimited
+func (r *RateLimits) _get(m map[cipher.PubKey]*sharedLimiter, key cipher.PubKey) (l *sharedLimiter) {
+	l, ok := m[key]
+	if !ok {
+		l = &sharedLimiter{RateLimiter: cn.NewRateLimiter(0)}
+		m[key] = l
+	}
+	return
+}
+
+func (r *RateLimits) _set(m map[cipher.PubKey]*sharedLimiter, key cipher.PubKey, rate uint64) {
+	l := r._get(m, key)
+	l.SetRate(rate)
+	r._drop(m, key, l)
+}
+
+// drop l once it has no limit and no transport uses it
+func (r *RateLimits) _drop(m map[cipher.PubKey]*sharedLimiter, key cipher.PubKey, l *sharedLimiter) {
+	if l.refs <= 0 && l.GetRate() == 0 {
+		delete(m, key)
+	}
+}
+
+// the limiter of key in m for a transport, release it once the transport
+// closed
+func (r *RateLimits) acquire(m map[cipher.PubKey]*sharedLimiter, key cipher.PubKey) *cn.RateLimiter {
+	r.mtx.Lock()
+	l := r._get(m, key)
+	l.refs++
+	r.mtx.Unlock()
+	return l.RateLimiter
+}
+
+func (r *RateLimits) release(m map[cipher.PubKey]*sharedLimiter, key cipher.PubKey) {
+	r.mtx.Lock()
+	if l, ok := m[key]; ok {
+		l.refs--
+		r._drop(m, key, l)
+	}
+	r.mtx.Unlock()
+}
@@ -0,0 +1,46 @@
+package factory
+
+import (
+	"testing"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// the limiters of keys without a limit go with the last transport using them
+func TestRateLimitsRelease(t *testing.T) {
+	f := NewMessengerFactory()
+	rl := f.GetRateLimits()
+	limited, _ := cipher.GenerateKeyPair()
+	rl.SetNode(limited, 100)
+	node, _ := cipher.GenerateKeyPair()
+	fromApp, _ := cipher.GenerateKeyPair()
+	toApp, _ := cipher.GenerateKeyPair()
+
+	tr := newTransport(f, cipher.PubKey{}, node, fromApp, toApp, true)
+	tr.shape(newOptionsTestConnection(f, nil))
+	tr.shape(newOptionsTestConnection(f, nil))
+	apps := tr.appRateLimiters()
+	if len(rl.nodes) != 2 || len(rl.apps) != 2 {
+		t.Fatalf("%d node and %d app limiters", len(rl.nodes), len(rl.apps))
+	}
+	// the transport running takes a new limit at once
+	rl.SetApp(fromApp, 50)
+	if apps[0].GetRate() != 50 {
+		t.Fatalf("app limiter rate %d", apps[0].GetRate())
+	}
+
+	tr.Close()
+	if _, ok := rl.nodes[node]; ok || len(rl.nodes) != 1 {
+		t.Fatalf("%d node limiters kept", len(rl.nodes))
+	}
+	if _, ok := rl.apps[fromApp]; !ok || len(rl.apps) != 1 {
+		t.Fatalf("%d app limiters kept", len(rl.apps))
+	}
+	rl.SetApp(fromApp, 0)
+	if len(rl.apps) != 0 {
+		t.Fatal("app limiter kept without a limit")
+	}
+	if c := rl.GetConfig(); len(c.Nodes) != 1 || c.Nodes[limited.Hex()] != 100 {
+		t.Fatalf("config %+v", c)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -34,6 +33,7 @@ type Transport struct {
 	servingPort      int
 
 	conns      map[uint32]net.Conn
+	windows    map[uint32]*streamWindow
 	connsMutex sync.RWMutex
 
 	timeoutTimer  *time.Timer
@@ -46,6 +46,62 @@ type Transport struct {
 
 	discoveryConn *Connection
 
+	// session keys of the conn between nodes
+	iv              []byte
+	ephemeral       cipher.SecKey
+	remoteEphemeral cipher.PubKey
+	// node B told node A its ephemeral key or that it has none, the conns
+	// from it get their crypto then and send nothing before
+	remoteKnown bool
+	// conns to the addresses of the other node being tried, on node A the
+	// ones from node B waiting for its ephemeral key
+	nodeConns []*Connection
+	// closed once node A acked the conn from node B
+	nodeAcked chan struct{}
+
+	// node B connects to node A with these, the app streams of node A go to
+	// appAddress
+	appAddress string
+	seedConfig *SeedConfig
+	version    RegVersion
+	// the address of the relay of the discovery, once asked for
+	relayAddr string
+
+	// the secrets of the layers of a route, on node A one for each node of
+	// it, on the others the one of the node
+	routeKeys [][]byte
+	// the app at the end of the route of node A
+	routeApp cipher.PubKey
+	// the node forwards the route the transport is part of
+	hop *routeHop
+
+	// deflate the app streams sent to the other node
+	compress bool
+	// the other node does flow control, told at the build of the transport
+	flowControl bool
+
+	// what the app of node B takes, and its datagrams once it takes them
+	transports TransportMode
+	datagrams  *datagramFlows
+
+	// the session node B keeps the transport by, it resumes over a new
+	// conn between the nodes if both nodes know it
+	session   []byte
+	resumable bool
+	// closed once the transport resumed, nil unless it is resuming
+	resumed      chan struct{}
+	resumeFailed chan struct{}
+	resumeTimer  *time.Timer
+	// the limiters of the other node and of the apps, held until the
+	// transport closed
+	nodeLimiter *cn.RateLimiter
+	appLimiters []*cn.RateLimiter
+
+	// the OP_WINDOW sent are counted with it read locked
+	grantMutex sync.RWMutex
+	// closed once the transport closed
+	done chan struct{}
+
 	fieldsMutex sync.RWMutex
 }
 
@@ -57,7 +113,9 @@ type transportPair struct {
 	timeoutTimer                           *time.Timer
 	closed                                 bool
 	lastCheckedTime                        time.Time
-	fieldsMutex                            sync.RWMutex
+	// forwards the transport when the nodes can't reach each other
+	relay       *relay
+	fieldsMutex sync.RWMutex
 }
 
 func (p *transportPair) ok() {
@@ -78,7 +136,11 @@ func (p *transportPair) close() {
 		return
 	}
 	p.closed = true
+	r := p.relay
 	p.fieldsMutex.Unlock()
+	if r != nil {
+		r.close()
+	}
 	keys := p.fromApp.Hex() + p.fromNode.Hex() + p.toNode.Hex() + p.toApp.Hex()
 	globalTransportPairManagerInstance.del(keys)
 }
@@ -123,6 +185,30 @@ func (p *transportPair) setToConn(toConn *Connection) (err error) {
 	return
 }
 
+// relay the transport between the conns of the pair, asking again returns
+// the same relay
+func (p *transportPair) setupRelay(limiter *cn.RateLimiter) (fromConn, toConn *Connection, fromPort, toPort int, err error) {
+	p.fieldsMutex.Lock()
+	defer p.fieldsMutex.Unlock()
+	if p.closed {
+		err = errors.New("transport pair closed")
+		return
+	}
+	if p.relay == nil {
+		if p.fromConn == nil || p.toConn == nil {
+			err = errors.New("transport pair not built")
+			return
+		}
+		p.relay, err = newRelay(udpIP(p.fromConn.GetRemoteAddr()), udpIP(p.toConn.GetRemoteAddr()), limiter)
+		if err != nil {
+			return
+		}
+	}
+	fromConn, toConn = p.fromConn, p.toConn
+	fromPort, toPort = p.relay.ports()
+	return
+}
+
 var globalTransportPairManagerInstance = newTransportPairManager()
 
 type transportPairManager struct {
@@ -138,7 +224,7 @@ func newTransportPairManager() *transportPairManager {
 
 var guid uint64 = 0
 
-func (m *transportPairManager) create(fromApp, fromNode, toNode, toApp cipher.PubKey) (p *transportPair) {
+func (m *transportPairManager) create(fromApp, fromNode, toNode, toApp cipher.PubKey, timeout time.Duration) (p *transportPair) {
 	keys := fromApp.Hex() + fromNode.Hex() + toNode.Hex() + toApp.Hex()
 	m.pairsMutex.Lock()
 	p, ok := m.pairs[keys]
@@ -152,7 +238,7 @@ func (m *transportPairManager) create(fromApp, fromNode, toNode, toApp cipher.Pu
 		toNode:   toNode,
 		toApp:    toApp,
 	}
-	p.timeoutTimer = time.AfterFunc(120*time.Second, func() {
+	p.timeoutTimer = time.AfterFunc(timeout, func() {
 		p.close()
 	})
 	m.pairs[keys] = p
@@ -184,22 +270,64 @@ func NewTransport(creator *MessengerFactory, appConn *Connection, fromNode, toNo
 	} else if appConn.GetKey() != toApp {
 		panic("invalid appConn value")
 	}
+	t := newTransport(creator, fromNode, toNode, fromApp, toApp, cs)
+	t.appConnHolder = appConn
+	return t
+}
+
+func newTransport(creator *MessengerFactory, fromNode, toNode, fromApp, toApp cipher.PubKey, clientSide bool) *Transport {
 	t := &Transport{
-		creator:       creator,
-		appConnHolder: appConn,
-		FromNode:      fromNode,
-		ToNode:        toNode,
-		FromApp:       fromApp,
-		ToApp:         toApp,
-		clientSide:    cs,
-		factory:       NewMessengerFactory(),
-		conns:         make(map[uint32]net.Conn),
+		creator:    creator,
+		FromNode:   fromNode,
+		ToNode:     toNode,
+		FromApp:    fromApp,
+		ToApp:      toApp,
+		clientSide: clientSide,
+		factory:    NewMessengerFactory(),
+		conns:      make(map[uint32]net.Conn),
+		windows:    make(map[uint32]*streamWindow),
+		nodeAcked:  make(chan struct{}),
+		done:       make(chan struct{}),
 	}
 	t.factory.Parent = creator
 	t.factory.SetDefaultSeedConfig(creator.GetDefaultSeedConfig())
+	t.factory.SetOptions(creator.GetOptions())
 	return t
 }
 
+// all udp conns of the transport use the congestion controller created by fn
+func (t *Transport) setCongestionController(fn func() cn.CongestionController) {
+	t.factory.NewCongestionController = fn
+}
+
+// the udp conns of the transport and its setup use the timeouts of o
+func (t *Transport) setOptions(o Options) {
+	t.factory.SetOptions(o)
+	t.fieldsMutex.Lock()
+	t.compress = o.CompressTransports
+	t.fieldsMutex.Unlock()
+}
+
+func (t *Transport) isCompress() (compress bool) {
+	t.fieldsMutex.RLock()
+	compress = t.compress
+	t.fieldsMutex.RUnlock()
+	return
+}
+
+func (t *Transport) setFlowControl(ok bool) {
+	t.fieldsMutex.Lock()
+	t.flowControl = ok
+	t.fieldsMutex.Unlock()
+}
+
+func (t *Transport) isFlowControl() (ok bool) {
+	t.fieldsMutex.RLock()
+	ok = t.flowControl
+	t.fieldsMutex.RUnlock()
+	return
+}
+
 func (t *Transport) SetOnAcceptedUDPCallback(fn func(connection *Connection)) {
 	t.factory.OnAcceptedUDPCallback = fn
 }
@@ -209,14 +337,19 @@ func (t *Transport) String() string {
 		t.FromApp.Hex(), t.FromNode.Hex(), t.ToNode.Hex(), t.ToApp.Hex())
 }
 
-// Listen and connect to node manager
+// Listen and connect to node manager, a resuming transport keeps its conn
+// to the same one
 func (t *Transport) ListenAndConnect(address string, key cipher.PubKey) (conn *Connection, err error) {
 	err = t.factory.listenForUDP()
 	if err != nil {
 		return
 	}
+	if c := t.discoveryConn; c != nil && !c.IsClosed() && c.GetRemoteAddr().String() == address {
+		conn = c
+		return
+	}
 	conn, err = t.factory.connectUDPWithConfig(address, &ConnConfig{
-		UseCrypto:           RegWithKeyAndEncryptionVersion,
+		UseCrypto:           latestRegVersion,
 		TargetKey:           key,
 		SkipBeforeCallbacks: true,
 	})
@@ -225,8 +358,89 @@ func (t *Transport) ListenAndConnect(address string, key cipher.PubKey) (conn *C
 	return
 }
 
-// Connect to node B
-func (t *Transport) clientSideConnect(address string, sc *SeedConfig, iv []byte) (err error) {
+func (t *Transport) setEphemeralKey(iv []byte, key cipher.SecKey) {
+	t.fieldsMutex.Lock()
+	t.iv = iv
+	t.ephemeral = key
+	t.fieldsMutex.Unlock()
+}
+
+// set the ephemeral key of the other node, empty if it has none. The conns
+// from node B accepted already get their crypto now, a conn never changes
+// its keys with msgs sealed under the old ones pending.
+func (t *Transport) setRemoteEphemeralKey(key cipher.PubKey) (err error) {
+	t.fieldsMutex.Lock()
+	defer t.fieldsMutex.Unlock()
+	if t.remoteKnown {
+		return
+	}
+	t.remoteKnown = true
+	t.remoteEphemeral = key
+	for _, conn := range t.nodeConns {
+		if conn.GetCrypto() != nil {
+			continue
+		}
+		err = t._initNodeCrypto(conn)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// set crypto of the conn from node B on node A
+func (t *Transport) setNodeCrypto(conn *Connection) (err error) {
+	t.fieldsMutex.Lock()
+	defer t.fieldsMutex.Unlock()
+	err = t._setNodeCrypto(conn)
+	return
+}
+
+// the conn waits for the key of node B unless it is known
+func (t *Transport) _setNodeCrypto(conn *Connection) (err error) {
+	for _, c := range t.nodeConns {
+		if c == conn {
+			return
+		}
+	}
+	t.nodeConns = append(t.nodeConns, conn)
+	if !t.remoteKnown {
+		conn.holdUntilCrypto()
+		return
+	}
+	err = t._initNodeCrypto(conn)
+	return
+}
+
+func (t *Transport) _initNodeCrypto(conn *Connection) (err error) {
+	if t.remoteEphemeral != EMPTY_PUBLIC_KEY {
+		err = t.setEphemeralCrypto(conn)
+		return
+	}
+	sc := t.creator.GetDefaultSeedConfig()
+	if sc == nil {
+		err = errors.New("default seed config is nil")
+		return
+	}
+	// switches to AEAD once node B speaks it
+	err = conn.SetCrypto(sc.publicKey, sc.secKey, t.ToNode, t.iv, RegWithKeyAndEncryptionVersion)
+	return
+}
+
+// call it with fieldsMutex held
+func (t *Transport) setEphemeralCrypto(conn *Connection) (err error) {
+	sc := t.creator.GetDefaultSeedConfig()
+	if sc == nil {
+		err = errors.New("default seed config is nil")
+		return
+	}
+	err = conn.SetEphemeralCrypto(sc.publicKey, sc.secKey, t.ToNode, t.iv, t.ephemeral, t.remoteEphemeral)
+	return
+}
+
+// Connect to node B, the nat is punched towards every address of it as node
+// B tries them in turn
+func (t *Transport) clientSideConnect(candidates []string) (err error) {
 	t.fieldsMutex.Lock()
 	defer t.fieldsMutex.Unlock()
 	if t.connAcked {
@@ -238,6 +452,24 @@ func (t *Transport) clientSideConnect(address string, sc *SeedConfig, iv []byte)
 		return
 	}
 
+	var punched bool
+	for _, address := range candidates {
+		e := t.punch(address)
+		if e != nil {
+			err = e
+			continue
+		}
+		punched = true
+	}
+	if punched {
+		err = nil
+	}
+	return
+}
+
+// open the nat of node A to an address of node B, call it with fieldsMutex
+// held
+func (t *Transport) punch(address string) (err error) {
 	conn, err := t.factory.acceptUDPWithConfig(address, &ConnConfig{})
 	if err != nil {
 		return
@@ -246,7 +478,7 @@ func (t *Transport) clientSideConnect(address string, sc *SeedConfig, iv []byte)
 		err = errors.New("clientSideConnect acceptUDPWithConfig return nil conn")
 		return
 	}
-	err = conn.SetCrypto(sc.publicKey, sc.secKey, t.ToNode, iv)
+	err = t._setNodeCrypto(conn)
 	if err != nil {
 		return
 	}
@@ -260,6 +492,17 @@ func (t *Transport) connAck() {
 	t.fieldsMutex.Unlock()
 }
 
+// node A acked the conn from node B
+func (t *Transport) nodeAck() {
+	t.fieldsMutex.Lock()
+	select {
+	case <-t.nodeAcked:
+	default:
+		close(t.nodeAcked)
+	}
+	t.fieldsMutex.Unlock()
+}
+
 func (t *Transport) isConnAck() (is bool) {
 	t.fieldsMutex.RLock()
 	is = t.connAcked
@@ -267,48 +510,177 @@ func (t *Transport) isConnAck() (is bool) {
 	return
 }
 
-// Connect to node A and server app
-func (t *Transport) serverSiceConnect(address, appAddress string, sc *SeedConfig, iv []byte) (err error) {
-	conn, err := t.factory.connectUDPWithConfig(address, &ConnConfig{})
+// Connect to node A and server app. The addresses of node A are tried in
+// turn, the next one once node A did not ack within CANDIDATE_TIMEOUT, the
+// last one is kept. The app streams are served over the conn node A acks.
+func (t *Transport) serverSiceConnect(candidates []string, appAddress string, sc *SeedConfig, iv []byte, version RegVersion) (err error) {
+	if len(candidates) == 0 {
+		err = errors.New("no address of node A")
+		return
+	}
+	t.fieldsMutex.Lock()
+	t.appAddress = appAddress
+	t.seedConfig = sc
+	t.iv = iv
+	t.version = version
+	t.fieldsMutex.Unlock()
+	go func() {
+		for i, address := range candidates {
+			conn, err := t.connectNode(address)
+			if err != nil {
+				log.Debugf("transport connect %s err %v", address, err)
+				continue
+			}
+			if i == len(candidates)-1 {
+				return
+			}
+			select {
+			case <-t.nodeAcked:
+				return
+			case <-time.After(CANDIDATE_TIMEOUT):
+				log.Debugf("transport connect %s not acked", address)
+				t.closeNodeConn(conn)
+			}
+		}
+	}()
+	return
+}
+
+// connect to an address of node A and ask it to build the transport
+func (t *Transport) connectNode(address string) (conn *Connection, err error) {
+	t.fieldsMutex.RLock()
+	factory := t.factory
+	sc, iv, version := t.seedConfig, t.iv, t.version
+	ephemeral, remoteEphemeral := t.ephemeral, t.remoteEphemeral
+	transports, session := t.transports, t.session
+	t.fieldsMutex.RUnlock()
+	if factory == nil {
+		err = errors.New("transport has been closed")
+		return
+	}
+	conn, err = factory.connectUDPWithConfig(address, &ConnConfig{})
 	if err != nil {
 		return
 	}
 	conn.CreatedByTransport = t
 	conn.SetKey(t.FromNode)
-	err = conn.SetCrypto(sc.publicKey, sc.secKey, t.FromNode, iv)
+	t.shape(conn)
+	if remoteEphemeral != EMPTY_PUBLIC_KEY {
+		err = conn.SetEphemeralCrypto(sc.publicKey, sc.secKey, t.FromNode, iv, ephemeral, remoteEphemeral)
+	} else {
+		err = conn.SetCrypto(sc.publicKey, sc.secKey, t.FromNode, iv, version)
+	}
+	if err == nil {
+		t.fieldsMutex.Lock()
+		t.nodeConns = append(t.nodeConns, conn)
+		t.fieldsMutex.Unlock()
+		err = conn.writeOP(OP_BUILD_APP_CONN_OK,
+			&buildConnResp{
+				FromNode:    t.FromNode,
+				Node:        t.ToNode,
+				FromApp:     t.FromApp,
+				App:         t.ToApp,
+				Transports:  transports,
+				Session:     session,
+				Reassembly:  true,
+				FlowControl: true,
+			})
+	}
 	if err != nil {
+		t.closeNodeConn(conn)
+		conn = nil
+	}
+	return
+}
+
+func (t *Transport) closeNodeConn(conn *Connection) {
+	t.fieldsMutex.Lock()
+	for i, c := range t.nodeConns {
+		if c == conn {
+			t.nodeConns = append(t.nodeConns[:i], t.nodeConns[i+1:]...)
+			break
+		}
+	}
+	t.fieldsMutex.Unlock()
+	conn.Close()
+}
+
+// serve the app streams of node A over the conn it acked, the conns to its
+// other addresses are closed
+func (t *Transport) serveNode(conn *Connection) (err error) {
+	t.fieldsMutex.Lock()
+	if t.factory == nil {
+		t.fieldsMutex.Unlock()
+		err = errors.New("transport has been closed")
 		return
 	}
-	err = conn.writeOP(OP_BUILD_APP_CONN_OK,
-		&buildConnResp{
-			FromNode: t.FromNode,
-			Node:     t.ToNode,
-			FromApp:  t.FromApp,
-			App:      t.ToApp,
-		})
-	if err != nil {
+	if t.conn != nil {
+		t.fieldsMutex.Unlock()
+		if t.conn != conn {
+			err = errors.New("transport served over another conn")
+		}
 		return
 	}
-	t.fieldsMutex.Lock()
 	t.conn = conn
+	appAddress := t.appAddress
+	routeKeys, hop := t.routeKeys, t.hop != nil
+	streams := t.transports.streams()
+	others := t.otherNodeConns(conn)
 	t.fieldsMutex.Unlock()
+	for _, c := range others {
+		c.Close()
+	}
 
 	go t.nodeReadLoop(conn, func(id uint32) net.Conn {
 		t.connsMutex.Lock()
 		defer t.connsMutex.Unlock()
 		appConn, ok := t.conns[id]
 		if !ok {
+			if !streams {
+				log.Debugf("app conn %d refused, the app takes datagrams only", id)
+				return nil
+			}
+			var err error
 			appConn, err = net.Dial("tcp", appAddress)
 			if err != nil {
 				log.Debugf("app conn dial err %v", err)
 				return nil
 			}
+			appConn, _ = wrapRouteConn(appConn, routeKeys, false, hop)
 			t.conns[id] = appConn
-			go t.appReadLoop(id, appConn, conn, false)
+			go t.appReadLoop(id, appConn, false)
 		}
 		return appConn
 	})
+	return
+}
+
+// call it with fieldsMutex held, nodeConns is left with conn only
+func (t *Transport) otherNodeConns(conn *Connection) (others []*Connection) {
+	for _, c := range t.nodeConns {
+		if c != conn {
+			others = append(others, c)
+		}
+	}
+	t.nodeConns = []*Connection{conn}
+	return
+}
+
+// the conn between the nodes, nil while the transport resumes
+func (t *Transport) getNodeConn() (conn *Connection) {
+	t.fieldsMutex.RLock()
+	if t.resumed == nil {
+		conn = t.conn
+	}
+	t.fieldsMutex.RUnlock()
+	return
+}
 
+// is conn the one the transport goes over, or resumes over
+func (t *Transport) isNodeConn(conn *Connection) (is bool) {
+	t.fieldsMutex.RLock()
+	is = t.conn == conn
+	t.fieldsMutex.RUnlock()
 	return
 }
 
@@ -319,17 +691,21 @@ func (t *Transport) getDiscoveryDisconntedChan() <-chan struct{} {
 	return t.discoveryConn.GetDisconnectedChan()
 }
 
-// Read from node, write to app
+// Read from node, write to app. A transport that may resume outlives the
+// conn and its discovery conn.
 func (t *Transport) nodeReadLoop(conn *Connection, getAppConn func(id uint32) net.Conn) {
-	defer func() {
-		t.Close()
-	}()
-	var err error
+	defer t.lost(conn)
+	discoveryClosed := t.getDiscoveryDisconntedChan()
+	var resume map[uint32]streamState
 	for {
 		select {
 		case m, ok := <-conn.GetChanIn():
 			if !ok {
-				conn.GetContextLogger().Debugf("node conn read err %v", err)
+				conn.GetContextLogger().Debugf("node conn closed")
+				return
+			}
+			if !t.isNodeConn(conn) {
+				conn.GetContextLogger().Debugf("transport goes over another conn")
 				return
 			}
 			if cn.DEBUG_DATA_HEX {
@@ -337,64 +713,213 @@ func (t *Transport) nodeReadLoop(conn *Connection, getAppConn func(id uint32) ne
 			}
 			t.downloadBW.add(len(m))
 			id := binary.BigEndian.Uint32(m[PKG_HEADER_ID_BEGIN:PKG_HEADER_ID_END])
+			op := m[PKG_HEADER_OP_BEGIN]
+			if op&OP_COMPRESSED > 0 {
+				op &^= OP_COMPRESSED
+				header := append([]byte(nil), m[:PKG_HEADER_END]...)
+				header[PKG_HEADER_OP_BEGIN] = op
+				d, err := inflate(header, m[PKG_HEADER_END:], cn.MAX_PLPMTU)
+				// a bad body costs its app conn only, the transport goes on
+				if err != nil {
+					conn.GetContextLogger().Debugf("inflate app conn %d pkg err %v", id, err)
+					t.resetAppConn(conn, id)
+					continue
+				}
+				conn.AddCompressedBytes(len(d), len(m))
+				m = d
+			}
+			if op == OP_WINDOW {
+				if w := t.getWindow(id, false); w != nil {
+					w.grant()
+				}
+				continue
+			}
+			if op == OP_DATAGRAM {
+				if d := t.getDatagrams(conn); d != nil {
+					d.receive(id, m[PKG_HEADER_END:])
+				}
+				continue
+			}
+			if op == OP_RESUME {
+				if resume == nil {
+					resume = make(map[uint32]streamState)
+				}
+				parseResume(m[PKG_HEADER_END:], resume)
+				// the id counts the pkgs to come
+				if id == 0 {
+					t.resumeStreams(conn, resume)
+					resume = nil
+				}
+				continue
+			}
 			appConn := getAppConn(id)
 			if appConn == nil {
 				continue
 			}
-			op := m[PKG_HEADER_OP_BEGIN]
 			if op == OP_CLOSE {
-				t.connsMutex.Lock()
-				t.conns[id] = nil
-				t.connsMutex.Unlock()
-				appConn.Close()
+				t.closeAppConn(id, appConn)
+				continue
+			}
+			if op == OP_CLOSE_WRITE {
+				t.getWindow(id, true).finish(appConn, false)
 				continue
 			}
 			if len(m) <= PKG_HEADER_END {
 				continue
 			}
-			body := m[PKG_HEADER_END:]
-			err = writeAll(appConn, body)
-			if err != nil {
-				conn.GetContextLogger().Debugf("app conn write err %v", err)
-				t.connsMutex.Lock()
-				t.conns[id] = nil
-				t.connsMutex.Unlock()
-				appConn.Close()
+			w := t.getWindow(id, true)
+			open, start, full := w.push(m[PKG_HEADER_END:])
+			if full {
+				conn.GetContextLogger().Debugf("app conn %d queued over %d bytes", id, FLOW_MAX_QUEUED)
+				t.resetAppConn(conn, id)
 				continue
 			}
-		case <-t.getDiscoveryDisconntedChan():
+			if open {
+				t.grant(w, id, 1)
+			}
+			if start {
+				go t.appWriteLoop(id, appConn, conn, w)
+			}
+		case <-discoveryClosed:
 			conn.GetContextLogger().Debugf("transport discovery conn closed")
+			if t.isResumable() {
+				// resumed through another one
+				discoveryClosed = nil
+				continue
+			}
+			return
+		}
+	}
+}
+
+// the other node closed app conn id
+func (t *Transport) closeAppConn(id uint32, appConn net.Conn) {
+	t.connsMutex.Lock()
+	t.conns[id] = nil
+	t.connsMutex.Unlock()
+	// the writer closes it once the queued data is written
+	if w := t.getWindow(id, false); w != nil {
+		w.finish(appConn, true)
+	} else {
+		appConn.Close()
+	}
+}
+
+// Write to app what the node conn delivered for it
+func (t *Transport) appWriteLoop(id uint32, appConn net.Conn, conn *Connection, w *streamWindow) {
+	for {
+		body, ok := w.pop()
+		if !ok {
+			closeApp(appConn, w.writerDone())
+			return
+		}
+		err := writeAll(appConn, body)
+		if err != nil {
+			conn.GetContextLogger().Debugf("app conn write err %v", err)
+			t.connsMutex.Lock()
+			t.conns[id] = nil
+			t.connsMutex.Unlock()
+			w.close()
+			appConn.Close()
 			return
 		}
+		if n := w.consume(len(body)); n > 0 {
+			t.grant(w, id, n)
+		}
+	}
+}
+
+// grant the sender of app conn id n more windows, they are counted for a
+// resume even if the conn between the nodes is broken
+func (t *Transport) grant(w *streamWindow, id uint32, n int) {
+	t.grantMutex.RLock()
+	defer t.grantMutex.RUnlock()
+	w.addGrants(n)
+	for i := 0; i < n; i++ {
+		t.writeWindow(id)
+	}
+}
+
+// grant the sender of app conn id more window
+func (t *Transport) writeWindow(id uint32) {
+	t.fieldsMutex.RLock()
+	conn := t.conn
+	t.fieldsMutex.RUnlock()
+	if conn == nil || conn.IsClosed() {
+		return
+	}
+	conn.Write(opPkg(id, OP_WINDOW))
+}
+
+// reset app conn id, its queued data is dropped and the other node told
+// to close it
+func (t *Transport) resetAppConn(conn *Connection, id uint32) {
+	t.connsMutex.Lock()
+	appConn := t.conns[id]
+	if appConn != nil {
+		t.conns[id] = nil
+	}
+	w := t.windows[id]
+	t.connsMutex.Unlock()
+	if w != nil {
+		w.close()
+	}
+	if appConn != nil {
+		appConn.Close()
+	}
+	conn.Write(opPkg(id, OP_CLOSE))
+}
+
+// window of app conn id, created if create is true
+func (t *Transport) getWindow(id uint32, create bool) (w *streamWindow) {
+	flowControl := t.isFlowControl()
+	t.connsMutex.Lock()
+	w = t.windows[id]
+	if w == nil && create {
+		w = newStreamWindow()
+		if flowControl {
+			w.startWindow()
+		}
+		t.windows[id] = w
 	}
+	t.connsMutex.Unlock()
+	return
 }
 
-// Read from app, write to node
-func (t *Transport) appReadLoop(id uint32, appConn net.Conn, conn *Connection, create bool) {
-	buf := make([]byte, cn.MAX_UDP_PACKAGE_SIZE-100)
+// Read from app, write to node. While the transport resumes the data waits
+// in the window for the new conn.
+func (t *Transport) appReadLoop(id uint32, appConn net.Conn, create bool) {
+	buf := make([]byte, cn.MAX_PLPMTU)
 	binary.BigEndian.PutUint32(buf[PKG_HEADER_ID_BEGIN:PKG_HEADER_ID_END], id)
-	channel := conn.NewPendingChannel()
-	defer conn.DeletePendingChannel(channel)
+	w := t.getWindow(id, true)
+	w.setOut(t.getNodeConn(), t.isResumable())
+	defer func() {
+		t.connsMutex.Lock()
+		delete(t.windows, id)
+		t.connsMutex.Unlock()
+		w.closeOut()
+		// the writer stops after the queued data
+		w.finish(appConn, true)
+	}()
 	defer func() {
 		if e := recover(); e != nil {
-			conn.GetContextLogger().Debugf("close app conn %d, err %v", id, e)
+			log.Debugf("close app conn %d, err %v", id, e)
 		}
+		// the last data goes over the conn the transport resumes over
+		t.waitResumed()
 		t.connsMutex.Lock()
 		defer t.connsMutex.Unlock()
 		// exited by err
 		if t.conns[id] != nil {
-			buf[PKG_HEADER_OP_BEGIN] = OP_CLOSE
 			//log.Infof("close %v, %d", create, id)
-			if !conn.IsClosed() {
-				func() {
-					defer func() {
-						if e := recover(); e != nil {
-							conn.GetContextLogger().Debugf("close app conn %d, err %v", id, e)
-						}
-					}()
-					conn.WriteToChannel(channel, buf[:PKG_HEADER_END])
+			func() {
+				defer func() {
+					if e := recover(); e != nil {
+						log.Debugf("close app conn %d, err %v", id, e)
+					}
 				}()
-			}
+				w.sendOp(id, OP_CLOSE)
+			}()
 			if create {
 				delete(t.conns, id)
 			} else {
@@ -407,27 +932,134 @@ func (t *Transport) appReadLoop(id uint32, appConn net.Conn, conn *Connection, c
 		}
 	}()
 	if create {
-		conn.WriteToChannel(channel, buf[:PKG_HEADER_END])
+		w.send(buf[:PKG_HEADER_END], nil)
 	}
+	var full int
+	var bulk bool
+	compress := t.isCompress()
+	limiters := t.appRateLimiters()
 	for {
-		n, err := appConn.Read(buf[PKG_HEADER_END:])
+		// follow the payload size found by path mtu discovery
+		b := buf[PKG_HEADER_END : w.payloadSize()-100]
+		n, err := appConn.Read(b)
 		if err != nil {
 			log.Debugf("app conn read err %v, %d", err, n)
+			if err == io.EOF && w.peerFlowControl() {
+				// half close, the app may still read until the peer
+				// ends the other direction
+				w.sendOp(id, OP_CLOSE_WRITE)
+				w.waitDone()
+			}
+			return
+		}
+		// an app conn filling every read is a bulk transfer, it is
+		// interactive again once it pauses
+		if n == len(b) {
+			full++
+		} else {
+			full = 0
+		}
+		if bulk != (full >= BULK_FULL_READS) {
+			bulk = !bulk
+			priority := cn.PRIORITY_INTERACTIVE
+			if bulk {
+				priority = cn.PRIORITY_BULK
+			}
+			if err := w.setPriority(priority); err != nil {
+				log.Debugf("app conn %d priority err %v", id, err)
+			}
+		}
+		if !w.acquire(n) {
 			return
 		}
+		body := buf[PKG_HEADER_END : PKG_HEADER_END+n]
 		pkg := buf[:PKG_HEADER_END+n]
 		if cn.DEBUG_DATA_HEX {
-			conn.GetContextLogger().Debugf("app conn in %x", pkg)
+			log.Debugf("app conn in %x", pkg)
+		}
+		if compress {
+			if c, ok := deflate(buf[:PKG_HEADER_END], body); ok {
+				c[PKG_HEADER_OP_BEGIN] |= OP_COMPRESSED
+				pkg = c
+			}
+			w.addCompressedBytes(PKG_HEADER_END+n, len(pkg))
+		}
+		for _, l := range limiters {
+			if !l.Wait(len(pkg), t.done) {
+				return
+			}
 		}
 		t.uploadBW.add(len(pkg))
-		conn.WriteToChannel(channel, pkg)
+		w.send(pkg, body)
 	}
 }
 
-func (t *Transport) setUDPConn(conn *Connection) {
+// the conn of the address of node B that made it, the others are closed.
+// It returns false if the transport goes over another conn already.
+func (t *Transport) setUDPConn(conn *Connection) bool {
 	t.fieldsMutex.Lock()
+	if t.conn != nil && t.conn != conn {
+		t.fieldsMutex.Unlock()
+		return false
+	}
 	t.conn = conn
+	others := t.otherNodeConns(conn)
+	t.fieldsMutex.Unlock()
+	t.shape(conn)
+	for _, c := range others {
+		c.Close()
+	}
+	return true
+}
+
+// shape the conn between the nodes by the global limit and the one of the
+// other node
+func (t *Transport) shape(conn *Connection) {
+	rl := t.creator.GetRateLimits()
+	t.fieldsMutex.Lock()
+	if t.nodeLimiter == nil {
+		t.nodeLimiter = cn.NewRateLimiter(0)
+		if t.factory != nil {
+			t.nodeLimiter = rl.acquire(rl.nodes, t._remoteNode())
+		}
+	}
+	l := t.nodeLimiter
+	t.fieldsMutex.Unlock()
+	conn.SetRateLimiters(rl.global, l)
+}
+
+func (t *Transport) _remoteNode() cipher.PubKey {
+	if t.clientSide {
+		return t.ToNode
+	}
+	return t.FromNode
+}
+
+// the limiters of the apps at both ends, app streams wait for them
+func (t *Transport) appRateLimiters() (limiters []*cn.RateLimiter) {
+	t.fieldsMutex.Lock()
+	if t.appLimiters == nil {
+		t.appLimiters = []*cn.RateLimiter{cn.NewRateLimiter(0)}
+		if t.factory != nil {
+			rl := t.creator.GetRateLimits()
+			t.appLimiters = []*cn.RateLimiter{rl.acquire(rl.apps, t.FromApp), rl.acquire(rl.apps, t.ToApp)}
+		}
+	}
+	limiters = t.appLimiters
 	t.fieldsMutex.Unlock()
+	return
+}
+
+// give back the limiters the transport held
+func (t *Transport) _releaseRateLimiters() {
+	rl := t.creator.GetRateLimits()
+	if t.nodeLimiter != nil {
+		rl.release(rl.nodes, t._remoteNode())
+	}
+	if t.appLimiters != nil {
+		rl.release(rl.apps, t.FromApp)
+		rl.release(rl.apps, t.ToApp)
+	}
 }
 
 var (
@@ -453,13 +1085,17 @@ func (t *Transport) ListenForApp(fn func(port int)) (err error) {
 	if t.appNet != nil {
 		return
 	}
+	if t.factory == nil {
+		err = errors.New("transport has been closed")
+		return
+	}
 
 	var ln net.Listener
+	var udp *net.UDPConn
 	var port int
 	for i := 0; i < 3; i++ {
 		port = getAppPort()
-		address := net.JoinHostPort("", strconv.Itoa(port))
-		ln, err = net.Listen("tcp", address)
+		ln, udp, err = listenApp(port, t.transports)
 		if err == nil {
 			goto OK
 		}
@@ -470,6 +1106,9 @@ func (t *Transport) ListenForApp(fn func(port int)) (err error) {
 OK:
 	t.appNet = ln
 	t.servingPort = port
+	if udp != nil {
+		t.datagrams = newDatagramFlows(t, t.conn, udp, "", t.factory.GetOptions().DatagramFlows)
+	}
 
 	fn(port)
 
@@ -493,33 +1132,71 @@ const (
 	OP_TRANSPORT = iota
 	OP_CLOSE
 	OP_SHUTDOWN
+	// grants the sender of an app conn more window, nodes without flow
+	// control skip it as it carries no data
+	OP_WINDOW
+	// the sender of an app conn won't write anymore but still reads, only
+	// sent to nodes that sent OP_WINDOW
+	OP_CLOSE_WRITE
+	// a udp datagram of the flow of the id, only sent to nodes whose app
+	// takes datagrams
+	OP_DATAGRAM
+	// what a node received of the app conns once the transport resumed over
+	// a new conn, the id counts the OP_RESUME pkgs that follow. Only sent to
+	// nodes that know the session of the transport.
+	OP_RESUME
 )
 
+// set on the op of OP_TRANSPORT pkgs whose body is deflated
+const OP_COMPRESSED = 0x40
+
 func (t *Transport) accept() {
 	t.fieldsMutex.RLock()
 	tConn := t.conn
+	routeKeys := t.routeKeys
+	ln := t.appNet
 	t.fieldsMutex.RUnlock()
 
-	go t.nodeReadLoop(tConn, func(id uint32) net.Conn {
-		t.connsMutex.RLock()
-		conn := t.conns[id]
-		t.connsMutex.RUnlock()
-		return conn
-	})
+	go t.nodeReadLoop(tConn, t.getAppConn)
+	if ln == nil {
+		// the app takes datagrams only
+		return
+	}
 	var idSeq uint32
 	for {
-		conn, err := t.appNet.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			return
 		}
+		conn, err = wrapRouteConn(conn, routeKeys, true, false)
+		if err != nil {
+			log.Debugf("route conn err %v", err)
+			continue
+		}
 		id := atomic.AddUint32(&idSeq, 1)
 		t.connsMutex.Lock()
 		t.conns[id] = conn
 		t.connsMutex.Unlock()
-		go t.appReadLoop(id, conn, tConn, true)
+		go t.appReadLoop(id, conn, true)
 	}
 }
 
+// the app conn of id accepted on node A
+func (t *Transport) getAppConn(id uint32) (conn net.Conn) {
+	t.connsMutex.RLock()
+	conn = t.conns[id]
+	t.connsMutex.RUnlock()
+	return
+}
+
+// where node B dials the app of the transport
+func (t *Transport) getAppAddress() (address string) {
+	t.fieldsMutex.RLock()
+	address = t.appAddress
+	t.fieldsMutex.RUnlock()
+	return
+}
+
 func (t *Transport) getDiscoveryKey() cipher.PubKey {
 	if t.discoveryConn == nil {
 		return EMPTY_PUBLIC_KEY
@@ -527,6 +1204,40 @@ func (t *Transport) getDiscoveryKey() cipher.PubKey {
 	return t.discoveryConn.GetTargetKey()
 }
 
+// what the app of node B takes
+func (t *Transport) setTransports(modes TransportMode) {
+	t.fieldsMutex.Lock()
+	t.transports = modes
+	t.fieldsMutex.Unlock()
+}
+
+func (t *Transport) getTransports() (modes TransportMode) {
+	t.fieldsMutex.RLock()
+	modes = t.transports
+	t.fieldsMutex.RUnlock()
+	return
+}
+
+// the datagrams of the transport, on node B they start with the first one
+// from node A
+func (t *Transport) getDatagrams(conn *Connection) (d *datagramFlows) {
+	t.fieldsMutex.Lock()
+	if t.datagrams == nil && !t.clientSide && t.factory != nil && t.transports.datagrams() {
+		t.datagrams = newDatagramFlows(t, conn, nil, t.appAddress, t.factory.GetOptions().DatagramFlows)
+	}
+	d = t.datagrams
+	t.fieldsMutex.Unlock()
+	return
+}
+
+// report msg to the app of the transport, the ones of the routes the node
+// forwards have none
+func (t *Transport) putMessage(msg PriorityMsg) {
+	if t.appConnHolder != nil {
+		t.appConnHolder.PutMessage(msg)
+	}
+}
+
 func (t *Transport) Close() {
 	t.fieldsMutex.Lock()
 	defer t.fieldsMutex.Unlock()
@@ -535,32 +1246,47 @@ func (t *Transport) Close() {
 		return
 	}
 
-	var key cipher.PubKey
-	if t.clientSide {
-		key = t.ToApp
-	} else {
-		key = t.FromApp
-	}
-	tr, ok := t.appConnHolder.getTransport(key)
-	if !ok || !t.clientSide || tr == t {
-		msg := PriorityMsg{
-			Priority: TransportClosed,
-			Msg:      fmt.Sprintf("Discovery(%s): Transport closed", t.getDiscoveryKey().Hex()),
-			Type:     Failed,
+	if t.appConnHolder != nil {
+		var key cipher.PubKey
+		if t.clientSide {
+			key = t._remoteApp()
+		} else {
+			key = t.FromApp
 		}
-		t.appConnHolder.PutMessage(msg)
-		t.appConnHolder.SetAppFeedback(&AppFeedback{
-			Discovery: t.getDiscoveryKey(),
-			App:       key,
-			Failed:    true,
-			Msg:       msg,
-		})
-		t.appConnHolder.deleteTransport(key)
+		tr, ok := t.appConnHolder.getTransport(key)
+		if !ok || !t.clientSide || tr == t {
+			msg := PriorityMsg{
+				Priority: TransportClosed,
+				Msg:      fmt.Sprintf("Discovery(%s): Transport closed", t.getDiscoveryKey().Hex()),
+				Type:     Failed,
+			}
+			t.appConnHolder.PutMessage(msg)
+			t.appConnHolder.SetAppFeedback(&AppFeedback{
+				Discovery: t.getDiscoveryKey(),
+				App:       key,
+				Failed:    true,
+				Msg:       msg,
+			})
+			t.appConnHolder.deleteTransport(key)
+		}
+	}
+	if t.hop != nil {
+		// the transports before and after the node go with it
+		go t.hop.close()
 	}
 
 	if t.timeoutTimer != nil {
 		t.timeoutTimer.Stop()
 	}
+	if t.resumeTimer != nil {
+		t.resumeTimer.Stop()
+		t.resumeTimer = nil
+	}
+	if t.resumable && !t.clientSide {
+		t.creator.deleteSession(t.FromNode, t.session, t)
+	}
+	close(t.done)
+	t._releaseRateLimiters()
 	t.connsMutex.RLock()
 	for _, v := range t.conns {
 		if v == nil {
@@ -568,16 +1294,30 @@ func (t *Transport) Close() {
 		}
 		v.Close()
 	}
+	for _, w := range t.windows {
+		w.close()
+	}
 	t.connsMutex.RUnlock()
 	if t.appNet != nil {
 		t.appNet.Close()
 		t.appNet = nil
 	}
-	if t.conn != nil {
-		t.conn.Close()
-		t.conn = nil
+	if t.datagrams != nil {
+		t.datagrams.close()
+		t.datagrams = nil
 	}
-	t.factory.Close()
+	// the last msgs of the app conns get delivered before the conns close
+	go func(conn *Connection, factory *MessengerFactory) {
+		if conn != nil {
+			err := conn.Drain(TRANSPORT_DRAIN_TIMEOUT)
+			if err != nil {
+				conn.GetContextLogger().Debugf("transport drain err %v", err)
+			}
+			conn.Close()
+		}
+		factory.Close()
+	}(t.conn, t.factory)
+	t.conn = nil
 	t.factory = nil
 }
 
@@ -606,13 +1346,26 @@ func (t *Transport) GetServingPort() int {
 	return port
 }
 
+// SetupTimeout closes the transport if it is not built in time, a resuming
+// one has TransportResumeTimeout instead
 func (t *Transport) SetupTimeout() {
 	t.fieldsMutex.Lock()
+	if t.resumed != nil {
+		t.fieldsMutex.Unlock()
+		return
+	}
 	if t.timeoutTimer != nil {
 		t.timeoutTimer.Stop()
 	}
-	t.timeoutTimer = time.AfterFunc(30*time.Second, func() {
-		t.appConnHolder.PutMessage(PriorityMsg{
+	timeout := t.factory.GetOptions().TransportSetupTimeout
+	if t.hop != nil && t.clientSide {
+		// the next node answers once the rest of the route is built
+		timeout *= MAX_ROUTE_HOPS
+	} else if n := len(t.routeKeys); n > 1 {
+		timeout *= time.Duration(n)
+	}
+	t.timeoutTimer = time.AfterFunc(timeout, func() {
+		t.putMessage(PriorityMsg{
 			Type:     Failed,
 			Msg:      "Timeout",
 			Priority: Timeout,
@@ -690,3 +1443,18 @@ func (t *Transport) GetUploadTotal() uint {
 func (t *Transport) GetDownloadTotal() uint {
 	return t.downloadBW.getTotal()
 }
+
+// GetConnStats returns the stats of the udp conn between the nodes, ok is
+// false until it has been built
+func (t *Transport) GetConnStats() (stats cn.Stats, ok bool) {
+	t.fieldsMutex.RLock()
+	conn := t.conn
+	if conn == nil && len(t.nodeConns) > 0 {
+		conn = t.nodeConns[0]
+	}
+	t.fieldsMutex.RUnlock()
+	if conn == nil {
+		return
+	}
+	return conn.Stats(), true
+}
@@ -0,0 +1,97 @@
+package factory
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+	cn "github.com/skycoin/skywire/pkg/net/conn"
+	"github.com/skycoin/skywire/pkg/net/factory"
+	"github.com/skycoin/skywire/pkg/net/msg"
+)
+
+// a conn from node B accepted before node A knows the ephemeral key of node
+// B holds what is written, it goes out sealed under the key node B uses
+func TestTransportNodeCryptoHeld(t *testing.T) {
+	scA, scB := NewSeedConfig(), NewSeedConfig()
+	fA := NewMessengerFactory()
+	fA.SetDefaultSeedConfig(scA)
+	tr := newTransport(fA, scA.publicKey, scB.publicKey, cipher.PubKey{}, cipher.PubKey{}, true)
+	iv := cipher.RandByte(16)
+	ephA, eskA := cipher.GenerateKeyPair()
+	ephB, eskB := cipher.GenerateKeyPair()
+	tr.setEphemeralKey(iv, eskA)
+
+	sock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeB, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nodeB.Close()
+	ua := cn.NewUDPConn(sock, nodeB.LocalAddr().(*net.UDPAddr))
+	ua.UnsharedUdpConn = true
+	defer ua.Close()
+	go ua.WriteLoop()
+	connA := newConnection(&factory.Connection{Connection: ua}, fA)
+	if err = tr.setNodeCrypto(connA); err != nil {
+		t.Fatal(err)
+	}
+	if connA.GetCrypto() != nil {
+		t.Fatal("crypto set before the key of node B is known")
+	}
+	if err = connA.Write([]byte("in flight")); err != nil {
+		t.Fatal(err)
+	}
+
+	// read the msgs node A sent until fn returns true
+	buf := make([]byte, cn.MAX_UDP_PACKAGE_SIZE)
+	read := func(wait time.Duration, fn func(m []byte) bool) {
+		for deadline := time.Now().Add(wait); ; {
+			nodeB.SetReadDeadline(deadline)
+			n, _, err := nodeB.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			m := buf[msg.PKG_HEADER_SIZE:n]
+			switch m[msg.UDP_TYPE_BEGIN] {
+			case msg.TYPE_NORMAL, msg.TYPE_AEAD:
+				if fn(m) {
+					return
+				}
+			}
+		}
+	}
+	read(200*time.Millisecond, func(m []byte) bool {
+		t.Fatal("msg sent before the key of node B is known")
+		return true
+	})
+
+	if err = tr.setRemoteEphemeralKey(ephB); err != nil {
+		t.Fatal(err)
+	}
+	ub := cn.NewUDPConn(nil, sock.LocalAddr().(*net.UDPAddr))
+	connB := newConnection(&factory.Connection{Connection: ub}, NewMessengerFactory())
+	err = connB.SetEphemeralCrypto(scB.publicKey, scB.secKey, scA.publicKey, iv, eskB, ephA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body []byte
+	read(5*time.Second, func(m []byte) bool {
+		if err := ub.ProcessFrom(m[msg.UDP_TYPE_BEGIN], m, nil); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case body = <-ub.GetChanIn():
+			return true
+		default:
+			return false
+		}
+	})
+	if string(body) != "in flight" {
+		t.Fatalf("node B read %q", body)
+	}
+}
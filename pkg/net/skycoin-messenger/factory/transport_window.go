@@ -0,0 +1,356 @@
+package factory
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	cn "github.com/skycoin/skywire/pkg/net/conn"
+)
+
+const (
+	// bytes of an app conn the receiver buffers for a slow app
+	FLOW_WINDOW = 256 * 1024
+	// each OP_WINDOW after the first grants the sender this many bytes
+	FLOW_WINDOW_STEP = 32 * 1024
+	// nodes without flow control don't stop at the window, an app conn
+	// queuing more is reset, the node read loop never waits for one
+	FLOW_MAX_QUEUED = 4 * FLOW_WINDOW
+
+	// consecutive full reads from an app conn making it bulk
+	BULK_FULL_READS = 8
+
+	// time the last msgs of a closing transport have to get acked
+	TRANSPORT_DRAIN_TIMEOUT = 5 * time.Second
+)
+
+// streamWindow is the flow control of an app conn of a transport. The
+// receiver queues what the node conn delivers and writes it to the app on
+// its own goroutine, so a slow app doesn't block the other app conns. It
+// sends OP_WINDOW when the conn opens and each time the app consumed
+// FLOW_WINDOW_STEP bytes, the sender stops once the window is used. A
+// sender that knows the peer does flow control starts with FLOW_WINDOW.
+// The peer ends its direction with OP_CLOSE_WRITE or both with OP_CLOSE.
+type streamWindow struct {
+	// send side, no limit until the transport was built with a node doing
+	// flow control or the peer sent OP_WINDOW
+	sent    uint64
+	limit   uint64
+	windows uint64
+
+	// receive side
+	queue    [][]byte
+	queued   int
+	consumed int
+	opened   bool
+	writing  bool
+	// no more data, the queue is written and the app conn closed, or only
+	// closed for writing if the peer half closed
+	fin  bool
+	full bool
+	// the receive side is over
+	done bool
+
+	closed bool
+	mtx    sync.Mutex
+	cond   *sync.Cond
+
+	// the bytes pushed and the OP_WINDOW sent for them
+	received uint64
+	grants   uint64
+
+	// the node conn the app conn goes over, its channel and priority
+	out      *Connection
+	channel  int
+	priority int
+	// the data sent from offset acked on is kept until the peer consumed
+	// it if the transport may resume, then replayed with the last of
+	// OP_CLOSE_WRITE and OP_CLOSE sent
+	retain  bool
+	unacked [][]byte
+	acked   uint64
+	closeOp byte
+	sendMtx sync.Mutex
+}
+
+func newStreamWindow() *streamWindow {
+	w := &streamWindow{}
+	w.cond = sync.NewCond(&w.mtx)
+	return w
+}
+
+// the peer does flow control, the sender may fill the first window before
+// its OP_WINDOW arrives
+func (w *streamWindow) startWindow() {
+	w.mtx.Lock()
+	if w.limit == 0 {
+		w.limit = FLOW_WINDOW
+	}
+	w.mtx.Unlock()
+}
+
+// acquire waits for the window to cover n more bytes, false if closed
+func (w *streamWindow) acquire(n int) (ok bool) {
+	w.mtx.Lock()
+	for !w.closed && w.limit > 0 && w.sent+uint64(n) > w.limit {
+		w.cond.Wait()
+	}
+	ok = !w.closed
+	w.sent += uint64(n)
+	w.mtx.Unlock()
+	return
+}
+
+func (w *streamWindow) grant() {
+	w.mtx.Lock()
+	w.windows++
+	// each window after the first is granted once the app consumed a step
+	consumed := (w.windows - 1) * FLOW_WINDOW_STEP
+	w.limit = FLOW_WINDOW + consumed
+	w.mtx.Unlock()
+	w.cond.Broadcast()
+	w.ack(consumed)
+}
+
+// push queues data for the app, open is true the first time so the window
+// gets advertised and start is true if the writer isn't running yet. It
+// never waits, full is true if the sender went past FLOW_MAX_QUEUED and
+// nothing was queued.
+func (w *streamWindow) push(b []byte) (open, start, full bool) {
+	w.mtx.Lock()
+	if w.queued+len(b) > FLOW_MAX_QUEUED {
+		w.mtx.Unlock()
+		full = true
+		return
+	}
+	w.queue = append(w.queue, b)
+	w.queued += len(b)
+	w.received += uint64(len(b))
+	open = !w.opened
+	w.opened = true
+	start = !w.writing
+	w.writing = true
+	w.mtx.Unlock()
+	w.cond.Broadcast()
+	return
+}
+
+// pop waits for queued data, false once the queue is drained after finish
+// or the window closed
+func (w *streamWindow) pop() (b []byte, ok bool) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for !w.closed && !w.fin && len(w.queue) < 1 {
+		w.cond.Wait()
+	}
+	if w.closed || len(w.queue) < 1 {
+		return
+	}
+	b = w.queue[0]
+	w.queue[0] = nil
+	w.queue = w.queue[1:]
+	w.queued -= len(b)
+	w.cond.Broadcast()
+	return b, true
+}
+
+// consume returns the number of OP_WINDOW to send after n bytes were
+// written to the app
+func (w *streamWindow) consume(n int) (grants int) {
+	w.mtx.Lock()
+	w.consumed += n
+	grants = w.consumed / FLOW_WINDOW_STEP
+	w.consumed %= FLOW_WINDOW_STEP
+	w.mtx.Unlock()
+	return
+}
+
+// the receiver sent n more OP_WINDOW
+func (w *streamWindow) addGrants(n int) {
+	w.mtx.Lock()
+	w.grants += uint64(n)
+	w.mtx.Unlock()
+}
+
+// the bytes pushed and the windows granted, told to the peer when the
+// transport resumes
+func (w *streamWindow) state() (received, grants uint64) {
+	w.mtx.Lock()
+	received, grants = w.received, w.grants
+	w.mtx.Unlock()
+	return
+}
+
+// finish lets the writer drain the queue, full is false for a half close.
+// If the writer isn't running the app conn is closed here.
+func (w *streamWindow) finish(appConn net.Conn, full bool) {
+	w.mtx.Lock()
+	w.fin = true
+	w.full = w.full || full
+	writing := w.writing
+	if !writing {
+		w.done = true
+	}
+	w.mtx.Unlock()
+	w.cond.Broadcast()
+	if !writing && appConn != nil {
+		closeApp(appConn, full)
+	}
+}
+
+// the writer drained the queue, it returns how to close the app conn
+func (w *streamWindow) writerDone() (full bool) {
+	w.mtx.Lock()
+	w.writing = false
+	w.done = true
+	full = w.full || w.closed
+	w.mtx.Unlock()
+	w.cond.Broadcast()
+	return
+}
+
+// waitDone waits for the peer to end its direction
+func (w *streamWindow) waitDone() {
+	w.mtx.Lock()
+	for !w.closed && !w.done {
+		w.cond.Wait()
+	}
+	w.mtx.Unlock()
+}
+
+// the peer does flow control, told at the build of the transport or by
+// OP_WINDOW, so it understands OP_CLOSE_WRITE too
+func (w *streamWindow) peerFlowControl() (ok bool) {
+	w.mtx.Lock()
+	ok = w.limit > 0
+	w.mtx.Unlock()
+	return
+}
+
+func closeApp(appConn net.Conn, full bool) {
+	if !full {
+		if c, ok := appConn.(interface {
+			CloseWrite() error
+		}); ok {
+			c.CloseWrite()
+			return
+		}
+	}
+	appConn.Close()
+}
+
+func (w *streamWindow) close() {
+	w.mtx.Lock()
+	w.closed = true
+	w.queue = nil
+	w.mtx.Unlock()
+	w.cond.Broadcast()
+}
+
+// the app conn goes over conn, nil while the transport resumes. The data
+// sent is kept for a replay if retain is true. A replay may have set the
+// conn already.
+func (w *streamWindow) setOut(conn *Connection, retain bool) {
+	w.sendMtx.Lock()
+	if w.out == nil && conn != nil {
+		w.out = conn
+		w.channel = conn.NewPendingChannel()
+	}
+	w.retain = retain
+	w.sendMtx.Unlock()
+}
+
+func (w *streamWindow) closeOut() {
+	w.sendMtx.Lock()
+	if w.out != nil {
+		w.out.DeletePendingChannel(w.channel)
+		w.out = nil
+	}
+	w.unacked = nil
+	w.sendMtx.Unlock()
+}
+
+func (w *streamWindow) setPriority(priority int) (err error) {
+	w.sendMtx.Lock()
+	defer w.sendMtx.Unlock()
+	if w.out != nil {
+		err = w.out.SetChannelPriority(w.channel, priority)
+		if err != nil {
+			return
+		}
+	}
+	w.priority = priority
+	return
+}
+
+// the payload of a pkg, the default one while the transport resumes
+func (w *streamWindow) payloadSize() (size int) {
+	w.sendMtx.Lock()
+	size = cn.MAX_UDP_PACKAGE_SIZE
+	if w.out != nil {
+		size = w.out.GetPayloadSize()
+	}
+	w.sendMtx.Unlock()
+	return
+}
+
+func (w *streamWindow) addCompressedBytes(uncompressed, compressed int) {
+	w.sendMtx.Lock()
+	if w.out != nil {
+		w.out.AddCompressedBytes(uncompressed, compressed)
+	}
+	w.sendMtx.Unlock()
+}
+
+// send pkg of the app conn, body is the data it carries
+func (w *streamWindow) send(pkg, body []byte) {
+	w.sendMtx.Lock()
+	if w.retain && len(body) > 0 {
+		w.unacked = append(w.unacked, append([]byte(nil), body...))
+	}
+	w._write(pkg)
+	w.sendMtx.Unlock()
+}
+
+// send op of app conn id, OP_CLOSE_WRITE is sent again on a replay
+func (w *streamWindow) sendOp(id uint32, op byte) {
+	w.sendMtx.Lock()
+	if op == OP_CLOSE_WRITE {
+		w.closeOp = op
+	}
+	w._write(opPkg(id, op))
+	w.sendMtx.Unlock()
+}
+
+// call it with sendMtx held, nothing is written over a closed conn
+func (w *streamWindow) _write(pkg []byte) {
+	if w.out == nil || w.out.IsClosed() {
+		return
+	}
+	w.out.WriteToChannel(w.channel, pkg)
+}
+
+// the peer consumed the data up to offset, it is not replayed anymore
+func (w *streamWindow) ack(offset uint64) {
+	w.sendMtx.Lock()
+	for len(w.unacked) > 0 && w.acked < offset {
+		b := w.unacked[0]
+		if n := offset - w.acked; n < uint64(len(b)) {
+			w.unacked[0] = b[n:]
+			w.acked = offset
+			break
+		}
+		w.unacked[0] = nil
+		w.unacked = w.unacked[1:]
+		w.acked += uint64(len(b))
+	}
+	w.sendMtx.Unlock()
+}
+
+func opPkg(id uint32, op byte) []byte {
+	pkg := make([]byte, PKG_HEADER_END)
+	pkg[PKG_HEADER_OP_BEGIN] = op
+	binary.BigEndian.PutUint32(pkg[PKG_HEADER_ID_BEGIN:PKG_HEADER_ID_END], id)
+	return pkg
+}
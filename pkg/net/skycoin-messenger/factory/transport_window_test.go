@@ -0,0 +1,42 @@
+package factory
+
+import (
+	"testing"
+)
+
+func TestStreamWindowStart(t *testing.T) {
+	legacy := newStreamWindow()
+	if !legacy.acquire(2*FLOW_WINDOW) || legacy.peerFlowControl() {
+		t.Fatal("window limited without flow control")
+	}
+
+	w := newStreamWindow()
+	w.startWindow()
+	if !w.peerFlowControl() || !w.acquire(FLOW_WINDOW) {
+		t.Fatal("no window at start")
+	}
+	// the OP_WINDOW sent when the peer opened the conn
+	w.grant()
+	if w.limit != FLOW_WINDOW {
+		t.Fatalf("limit %d after the first window", w.limit)
+	}
+	w.grant()
+	if w.limit != FLOW_WINDOW+FLOW_WINDOW_STEP {
+		t.Fatalf("limit %d after a step", w.limit)
+	}
+}
+
+func TestStreamWindowPushFull(t *testing.T) {
+	w := newStreamWindow()
+	open, start, full := w.push(make([]byte, FLOW_MAX_QUEUED))
+	if !open || !start || full {
+		t.Fatalf("open %v start %v full %v", open, start, full)
+	}
+	// a sender without flow control went too far, nothing waits for the app
+	if _, _, full = w.push([]byte{1}); !full {
+		t.Fatal("queued past FLOW_MAX_QUEUED")
+	}
+	if w.queued != FLOW_MAX_QUEUED {
+		t.Fatalf("queued %d", w.queued)
+	}
+}
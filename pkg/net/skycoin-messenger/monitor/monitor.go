@@ -725,6 +725,6 @@ func (m *Monitor) getServerInfo(w http.ResponseWriter, r *http.Request) (result
 		err = errors.New("Unable to get port")
 		return
 	}
-	result = []byte(fmt.Sprintf("%s:%s-%s", host, port, sc.PublicKey))
+	result = []byte(fmt.Sprintf("%s-%s", net.JoinHostPort(host, port), sc.PublicKey))
 	return
 }
@@ -28,6 +28,15 @@ func (fp *FixedSizePool) Get() []byte {
 	return v.([]byte)
 }
 
+// GetSize returns a buffer of n bytes with room for extra more, one of the
+// pool if it fits
+func (fp *FixedSizePool) GetSize(n, extra int) []byte {
+	if n+extra > fp.Size {
+		return make([]byte, n, n+extra)
+	}
+	return fp.Get()[:n]
+}
+
 func (fp *FixedSizePool) Put(c []byte) {
 	if len(c) != fp.Size {
 		if cap(c) != fp.Size {
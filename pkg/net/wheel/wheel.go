@@ -0,0 +1,246 @@
+// Package wheel is a hierarchical timer wheel. One goroutine drives all the
+// timers of a wheel, so arming, resetting and stopping them is cheap for the
+// many short lived timers of udp conns: delayed acks, rto resends and
+// pacing.
+package wheel
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// TICK is the resolution of the Default wheel, timers fire up to a tick
+	// late
+	TICK = time.Millisecond
+
+	SLOT_BITS = 8
+	SLOTS     = 1 << SLOT_BITS
+	LEVELS    = 4
+	// longer delays are cut to this many ticks
+	MAX_TICKS = 1<<(SLOT_BITS*LEVELS) - 1
+)
+
+// Default drives the timers of conns not created by a factory
+var Default = New(TICK)
+
+// Timer calls its func on the goroutine of its wheel once it expires, the
+// func must not block
+type Timer struct {
+	w       *Wheel
+	f       func()
+	expires uint64
+	// links of the slot it waits in, nil if not armed
+	prev, next *Timer
+}
+
+// Wheel is a set of timers with a resolution of tick
+type Wheel struct {
+	tick  time.Duration
+	start time.Time
+	// the last tick processed
+	now   uint64
+	slots [LEVELS][SLOTS]Timer
+	count int
+
+	// a goroutine drives the wheel while timers are armed
+	running bool
+	stop    chan struct{}
+	stopped bool
+	mtx     sync.Mutex
+}
+
+func New(tick time.Duration) *Wheel {
+	w := &Wheel{
+		tick:  tick,
+		start: time.Now(),
+		stop:  make(chan struct{}),
+	}
+	for l := range w.slots {
+		for s := range w.slots[l] {
+			head := &w.slots[l][s]
+			head.prev, head.next = head, head
+		}
+	}
+	return w
+}
+
+// NewTimer creates a timer calling f, it is not armed until Reset
+func (w *Wheel) NewTimer(f func()) *Timer {
+	return &Timer{w: w, f: f}
+}
+
+// AfterFunc calls f on the goroutine of the wheel after d
+func (w *Wheel) AfterFunc(d time.Duration, f func()) *Timer {
+	t := w.NewTimer(f)
+	t.Reset(d)
+	return t
+}
+
+// Stop stops driving the timers, the ones armed never fire
+func (w *Wheel) Stop() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.stopped {
+		return
+	}
+	w.stopped = true
+	close(w.stop)
+}
+
+// Len returns the number of armed timers
+func (w *Wheel) Len() (n int) {
+	w.mtx.Lock()
+	n = w.count
+	w.mtx.Unlock()
+	return
+}
+
+// Reset arms t to fire after d, it returns whether t had been armed. t
+// never fires early.
+func (t *Timer) Reset(d time.Duration) (active bool) {
+	w := t.w
+	if d < 0 {
+		d = 0
+	}
+	since := time.Since(w.start)
+	// the first tick at or after the deadline, counted from the clock as
+	// the wheel may be behind it
+	expires := uint64((since + d + w.tick - 1) / w.tick)
+	w.mtx.Lock()
+	active = t.next != nil
+	if active {
+		if t.expires == expires {
+			// rearmed within the same tick
+			w.mtx.Unlock()
+			return
+		}
+		w.unlink(t)
+	}
+	now := uint64(since / w.tick)
+	if w.count == 0 && now > w.now {
+		// nothing to fire in between, catch up with the clock at once
+		w.now = now
+	}
+	if expires <= w.now {
+		expires = w.now + 1
+	} else if expires-w.now > MAX_TICKS {
+		expires = w.now + MAX_TICKS
+	}
+	t.expires = expires
+	w.add(t)
+	start := !w.running && !w.stopped
+	if start {
+		w.running = true
+	}
+	w.mtx.Unlock()
+	if start {
+		go w.run()
+	}
+	return
+}
+
+// Stop disarms t, it returns whether t had been armed. The func may still
+// run if t expired just before.
+func (t *Timer) Stop() (active bool) {
+	w := t.w
+	w.mtx.Lock()
+	active = t.next != nil
+	if active {
+		w.unlink(t)
+	}
+	w.mtx.Unlock()
+	return
+}
+
+func (w *Wheel) elapsed() uint64 {
+	return uint64(time.Since(w.start) / w.tick)
+}
+
+// add links t in the slot of its expiry, call it with mtx held
+func (w *Wheel) add(t *Timer) {
+	e := t.expires
+	if e <= w.now {
+		e = w.now
+	}
+	delta := e - w.now
+	l := 0
+	for l < LEVELS-1 && delta >= 1<<(SLOT_BITS*uint(l+1)) {
+		l++
+	}
+	head := &w.slots[l][(e>>(SLOT_BITS*uint(l)))&(SLOTS-1)]
+	t.prev, t.next = head.prev, head
+	head.prev.next = t
+	head.prev = t
+	w.count++
+}
+
+// call it with mtx held
+func (w *Wheel) unlink(t *Timer) {
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev, t.next = nil, nil
+	w.count--
+}
+
+// step processes the next tick and returns the timers expiring then, call
+// it with mtx held
+func (w *Wheel) step() (expired []*Timer) {
+	w.now++
+	// timers of higher levels move down once the lower levels wrap
+	for l := 1; l < LEVELS; l++ {
+		if w.now&(1<<(SLOT_BITS*uint(l))-1) != 0 {
+			break
+		}
+		head := &w.slots[l][(w.now>>(SLOT_BITS*uint(l)))&(SLOTS-1)]
+		for head.next != head {
+			t := head.next
+			w.unlink(t)
+			w.add(t)
+		}
+	}
+	head := &w.slots[0][w.now&(SLOTS-1)]
+	for head.next != head {
+		t := head.next
+		w.unlink(t)
+		expired = append(expired, t)
+	}
+	return
+}
+
+// run drives the wheel until no timer is armed
+func (w *Wheel) run() {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.stop:
+			return
+		}
+		w.advance()
+		w.mtx.Lock()
+		if w.count == 0 {
+			w.running = false
+			w.mtx.Unlock()
+			return
+		}
+		w.mtx.Unlock()
+	}
+}
+
+// advance fires the timers up to the current tick
+func (w *Wheel) advance() {
+	for {
+		w.mtx.Lock()
+		if w.now >= w.elapsed() || w.count == 0 {
+			w.mtx.Unlock()
+			return
+		}
+		expired := w.step()
+		w.mtx.Unlock()
+		for _, t := range expired {
+			t.f()
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package wheel
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimer_Fires(t *testing.T) {
+	tick := 20 * time.Microsecond
+	w := New(tick)
+	defer w.Stop()
+	delays := []time.Duration{
+		0,
+		tick,
+		5 * time.Millisecond,
+		// the next levels of the wheel
+		time.Duration(SLOTS+10) * tick,
+		time.Duration(SLOTS*SLOTS+10) * tick,
+	}
+	var wg sync.WaitGroup
+	for _, d := range delays {
+		d := d
+		wg.Add(1)
+		start := time.Now()
+		w.AfterFunc(d, func() {
+			defer wg.Done()
+			if e := time.Since(start); e < d {
+				t.Errorf("timer of %s fired after %s", d, e)
+			}
+		})
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%d timers not fired", w.Len())
+	}
+	if n := w.Len(); n != 0 {
+		t.Fatalf("%d timers armed", n)
+	}
+}
+
+func TestTimer_ResetStop(t *testing.T) {
+	w := New(TICK)
+	defer w.Stop()
+	var fired int32
+	tm := w.NewTimer(func() {
+		atomic.AddInt32(&fired, 1)
+	})
+	if tm.Stop() {
+		t.Fatal("timer not armed is active")
+	}
+	if tm.Reset(time.Hour) {
+		t.Fatal("timer not armed is active")
+	}
+	if !tm.Reset(10 * time.Millisecond) {
+		t.Fatal("armed timer is not active")
+	}
+	if w.Len() != 1 {
+		t.Fatalf("reset timer armed %d times", w.Len())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&fired); n != 1 {
+		t.Fatalf("timer fired %d times", n)
+	}
+
+	tm.Reset(10 * time.Millisecond)
+	if !tm.Stop() {
+		t.Fatal("armed timer is not active")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if n := atomic.LoadInt32(&fired); n != 1 {
+		t.Fatalf("stopped timer fired, %d times", n)
+	}
+}
+
+func TestWheel_Stop(t *testing.T) {
+	w := New(TICK)
+	fired := make(chan struct{}, 1)
+	w.AfterFunc(10*time.Millisecond, func() {
+		fired <- struct{}{}
+	})
+	w.Stop()
+	w.Stop()
+	select {
+	case <-fired:
+		t.Fatal("timer of a stopped wheel fired")
+	case <-time.After(30 * time.Millisecond):
+	}
+}
+
+const (
+	idleConns   = 10000
+	activeConns = 1000
+)
+
+// timers stands for the timers of a conn: delayed acks, rto resends and
+// pacing
+type timers interface {
+	reset(ack, rto, pacing time.Duration)
+	stop()
+}
+
+type wheelTimers struct {
+	ack, rto, pacing *Timer
+}
+
+func (t *wheelTimers) reset(ack, rto, pacing time.Duration) {
+	t.ack.Reset(ack)
+	t.rto.Reset(rto)
+	t.pacing.Reset(pacing)
+}
+
+func (t *wheelTimers) stop() {
+	t.ack.Stop()
+	t.rto.Stop()
+	t.pacing.Stop()
+}
+
+type stdTimers struct {
+	ack, rto, pacing *time.Timer
+}
+
+func (t *stdTimers) reset(ack, rto, pacing time.Duration) {
+	t.ack.Reset(ack)
+	t.rto.Reset(rto)
+	t.pacing.Reset(pacing)
+}
+
+func (t *stdTimers) stop() {
+	t.ack.Stop()
+	t.rto.Stop()
+	t.pacing.Stop()
+}
+
+// benchmarkConns keeps the rto timers of idle conns armed while the active
+// conns re-arm their timers for every packet, like UDPConn does. Each op is
+// a packet of every active conn.
+func benchmarkConns(b *testing.B, newTimers func(f func()) timers) {
+	var fired int64
+	f := func() {
+		atomic.AddInt64(&fired, 1)
+	}
+	idle := make([]timers, idleConns)
+	for i := range idle {
+		idle[i] = newTimers(f)
+		idle[i].reset(time.Hour, time.Hour, time.Hour)
+	}
+	active := make([]timers, activeConns)
+	for i := range active {
+		active[i] = newTimers(f)
+	}
+	defer func() {
+		for _, t := range idle {
+			t.stop()
+		}
+		for _, t := range active {
+			t.stop()
+		}
+	}()
+
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(conns []timers) {
+			defer wg.Done()
+			for i := 0; i < b.N; i++ {
+				for _, t := range conns {
+					t.reset(2*time.Millisecond, 300*time.Millisecond, 100*time.Microsecond)
+				}
+			}
+		}(active[g*activeConns/4 : (g+1)*activeConns/4])
+	}
+	wg.Wait()
+	b.StopTimer()
+	b.ReportMetric(float64(b.N*activeConns)/b.Elapsed().Seconds(), "pkts/s")
+	b.ReportMetric(float64(atomic.LoadInt64(&fired))/float64(b.N), "fired/op")
+}
+
+func BenchmarkConnTimers_Wheel(b *testing.B) {
+	w := New(TICK)
+	defer w.Stop()
+	benchmarkConns(b, func(f func()) timers {
+		return &wheelTimers{ack: w.NewTimer(f), rto: w.NewTimer(f), pacing: w.NewTimer(f)}
+	})
+}
+
+func BenchmarkConnTimers_Std(b *testing.B) {
+	benchmarkConns(b, func(f func()) timers {
+		t := &stdTimers{ack: time.AfterFunc(time.Hour, f), rto: time.AfterFunc(time.Hour, f), pacing: time.AfterFunc(time.Hour, f)}
+		t.stop()
+		return t
+	})
+}
@@ -123,6 +123,8 @@ func (na *NodeApi) StartSrv() {
 	http.HandleFunc("/node/run/getAutoStartConfig", na.wrap(na.getAutoStartConfig))
 	http.HandleFunc("/node/run/setAutoStartConfig", na.wrap(na.setAutoStartConfig))
 	http.HandleFunc("/node/run/closeApp", na.wrap(na.closeApp))
+	http.HandleFunc("/node/getRateLimits", na.wrap(na.getRateLimits))
+	http.HandleFunc("/node/run/setRateLimits", na.wrap(na.setRateLimits))
 	http.HandleFunc("/node/run/term", na.handleXtermsocket)
 	na.srv.Handler = http.DefaultServeMux
 	go func() {
@@ -203,6 +205,27 @@ func (na *NodeApi) getApps(w http.ResponseWriter, r *http.Request) (result []byt
 	return
 }
 
+func (na *NodeApi) getRateLimits(w http.ResponseWriter, r *http.Request) (result []byte, err error) {
+	result, err = json.Marshal(na.node.GetRateLimits())
+	return
+}
+
+// data is the json of factory.RateLimitsConfig, it replaces all the limits
+func (na *NodeApi) setRateLimits(w http.ResponseWriter, r *http.Request) (result []byte, err error) {
+	data := r.FormValue("data")
+	c := factory.RateLimitsConfig{}
+	err = json.Unmarshal([]byte(data), &c)
+	if err != nil {
+		return
+	}
+	err = na.node.SetRateLimits(c)
+	if err != nil {
+		return
+	}
+	result = []byte("true")
+	return
+}
+
 func (na *NodeApi) wrap(fn func(w http.ResponseWriter, r *http.Request) (result []byte, err error)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		token := r.FormValue("token")
@@ -499,7 +522,8 @@ func (na *NodeApi) setNodeConfig(w http.ResponseWriter, r *http.Request) (result
 	return
 }
 
-var URLMatch = `(25[0-5]|2[0-4]\d|[0-1]\d{2}|[1-9]?\d)\.(25[0-5]|2[0-4]\d|[0-1]\d{2}|[1-9]?\d)\.(25[0-5]|2[0-4]\d|[0-1]\d{2}|[1-9]?\d)\.(25[0-5]|2[0-4]\d|[0-1]\d{2}|[1-9]?\d):\d{1,5}`
+// URLMatch matches host:port of an ipv4 or a bracketed ipv6 literal
+var URLMatch = `((25[0-5]|2[0-4]\d|[0-1]\d{2}|[1-9]?\d)\.(25[0-5]|2[0-4]\d|[0-1]\d{2}|[1-9]?\d)\.(25[0-5]|2[0-4]\d|[0-1]\d{2}|[1-9]?\d)\.(25[0-5]|2[0-4]\d|[0-1]\d{2}|[1-9]?\d)|\[[0-9a-fA-F:.]+(%[0-9a-zA-Z._-]+)?\]):\d{1,5}`
 
 func (na *NodeApi) updateNode(w http.ResponseWriter, r *http.Request) (result []byte, err error) {
 	na.restart()
@@ -859,7 +883,7 @@ func (na *NodeApi) getAutoStartConfig(w http.ResponseWriter, r *http.Request) (r
 				return
 			}
 		} else {
-			log.Errorf("read launch config err:", err)
+			log.Errorf("read launch config err: %v", err)
 			return
 		}
 	}
@@ -890,7 +914,7 @@ func (na *NodeApi) setAutoStartConfig(w http.ResponseWriter, r *http.Request) (r
 				return
 			}
 		} else {
-			log.Errorf("read launch config err:", err)
+			log.Errorf("read launch config err: %v", err)
 			return
 		}
 	}
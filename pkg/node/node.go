@@ -13,6 +13,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/skycoin/skycoin/src/cipher"
+	"github.com/skycoin/skywire/pkg/net/conn"
 	"github.com/skycoin/skywire/pkg/net/skycoin-messenger/factory"
 )
 
@@ -86,6 +87,24 @@ func New(seedPath, launchConfigPath, webPort string) *Node {
 	}
 }
 
+// SetOptions sets the timeouts of the conns to apps, discoveries and the
+// manager, call it before Start
+func (n *Node) SetOptions(o factory.Options) {
+	n.apps.SetOptions(o)
+	n.manager.SetOptions(o)
+}
+
+// GetRateLimits returns the bandwidth limits of the transports, bytes/sec
+func (n *Node) GetRateLimits() factory.RateLimitsConfig {
+	return n.apps.GetRateLimits().GetConfig()
+}
+
+// SetRateLimits replaces the bandwidth limits, the transports running take
+// them at once
+func (n *Node) SetRateLimits(c factory.RateLimitsConfig) error {
+	return n.apps.GetRateLimits().SetConfig(c)
+}
+
 func (n *Node) GetManager() *factory.MessengerFactory {
 	return n.manager
 }
@@ -121,19 +140,30 @@ func (n *Node) Start(discoveries Addresses, address string) (err error) {
 	return
 }
 
-func (n *Node) connectDiscovery(addr string) (err error) {
-	n.onDiscoveries.Store(addr, false)
-	split := strings.Split(addr, "-")
-	if len(split) != 2 {
+// parseDiscoveryAddress splits host:port-pubkey or, for discoveries reached
+// over websocket, ws://host/path-pubkey and wss://host/path-pubkey
+func parseDiscoveryAddress(addr string) (address string, key cipher.PubKey, err error) {
+	i := strings.LastIndex(addr, "-")
+	if i < 1 {
 		err = fmt.Errorf("discovery address %s is not valid", addr)
 		return
 	}
-	tk, err := cipher.PubKeyFromHex(split[1])
+	key, err = cipher.PubKeyFromHex(addr[i+1:])
 	if err != nil {
 		err = fmt.Errorf("discovery address %s is not valid", addr)
 		return
 	}
-	err = n.apps.ConnectWithConfig(split[0], &factory.ConnConfig{
+	address = addr[:i]
+	return
+}
+
+func (n *Node) connectDiscovery(addr string) (err error) {
+	n.onDiscoveries.Store(addr, false)
+	address, tk, err := parseDiscoveryAddress(addr)
+	if err != nil {
+		return
+	}
+	err = n.apps.ConnectWithConfig(address, &factory.ConnConfig{
 		TargetKey:     tk,
 		Reconnect:     true,
 		ReconnectWait: 10 * time.Second,
@@ -207,6 +237,9 @@ type NodeTransport struct {
 	DownloadBW    uint `json:"download_bandwidth"`
 	UploadTotal   uint `json:"upload_total"`
 	DownloadTotal uint `json:"download_total"`
+
+	// udp conn between the nodes, nil until it has been built
+	Conn *conn.Stats `json:"conn,omitempty"`
 }
 
 type NodeInfo struct {
@@ -230,7 +263,7 @@ func (n *Node) GetNodeInfo() (ni NodeInfo) {
 	var afs []FeedBackItem
 	n.apps.ForEachAcceptedConnection(func(key cipher.PubKey, conn *factory.Connection) {
 		conn.ForEachTransport(func(v *factory.Transport) {
-			ts = append(ts, NodeTransport{
+			nt := NodeTransport{
 				FromNode:      v.FromNode.Hex(),
 				ToNode:        v.ToNode.Hex(),
 				FromApp:       v.FromApp.Hex(),
@@ -239,7 +272,11 @@ func (n *Node) GetNodeInfo() (ni NodeInfo) {
 				DownloadBW:    v.GetDownloadBandwidth(),
 				UploadTotal:   v.GetUploadTotal(),
 				DownloadTotal: v.GetDownloadTotal(),
-			})
+			}
+			if stats, ok := v.GetConnStats(); ok {
+				nt.Conn = &stats
+			}
+			ts = append(ts, nt)
 		})
 		feedback := conn.GetAppFeedback()
 		if feedback != nil {